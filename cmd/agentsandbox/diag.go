@@ -0,0 +1,20 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+)
+
+// diagLogger returns a logger writing to the open file descriptor fd, for
+// --diag-fd. The logger takes ownership of fd.
+func diagLogger(fd int) (*log.Logger, error) {
+	f := os.NewFile(uintptr(fd), "diag")
+	if f == nil {
+		return nil, fmt.Errorf("invalid --diag-fd %d", fd)
+	}
+	if _, err := f.Stat(); err != nil {
+		return nil, fmt.Errorf("invalid --diag-fd %d: %w", fd, err)
+	}
+	return log.New(f, "", log.LstdFlags), nil
+}
@@ -0,0 +1,56 @@
+//go:build unix
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/niwoerner/go-agentsandbox/sandbox"
+)
+
+func TestDiagLogger(t *testing.T) {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	// The logger owns the fd it's given, so hand it a copy
+	fd, err := syscall.Dup(int(w.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	logger, err := diagLogger(fd)
+	if err != nil {
+		t.Fatalf("diagLogger() error: %v", err)
+	}
+
+	var stderr bytes.Buffer
+	log.SetOutput(&stderr)
+	defer log.SetOutput(os.Stderr)
+
+	// Warnings from the sandbox go to the diag fd, not the standard logger.
+	// New may fail without a backend; the warning is logged before that.
+	sandbox.New(sandbox.Config{Workdir: "/nonexistent/diag/workdir", Logger: logger, DryRun: true})
+	logger.Writer().(*os.File).Close()
+
+	diag, _ := io.ReadAll(r)
+	if !strings.Contains(string(diag), "warning: ") || !strings.Contains(string(diag), "/nonexistent/diag/workdir") {
+		t.Errorf("diag fd should get the warning, got %q", diag)
+	}
+	if stderr.Len() > 0 {
+		t.Errorf("stderr should stay clean, got %q", stderr.String())
+	}
+
+	if _, err := diagLogger(-1); err == nil {
+		t.Error("expected error for a negative fd")
+	}
+}
@@ -1,16 +1,43 @@
 package main
 
 import (
+	"bufio"
 	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"log"
+	"maps"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/niwoerner/go-agentsandbox/sandbox"
 )
 
-const exitSandboxError = 125 // Like docker
+const defaultSandboxErrorCode = 125 // Like docker
+
+// exitTimeout is the exit code for commands killed by --timeout.
+const exitTimeout = 124 // Like timeout(1)
+
+// exitSandboxError is the exit code for sandbox setup or execution errors.
+// Configurable via --sandbox-error-code.
+var exitSandboxError = defaultSandboxErrorCode
+
+// jsonResult is the --json and batch output format.
+type jsonResult struct {
+	Command  string            `json:"command,omitempty"`
+	ExitCode int               `json:"exitCode"`
+	Output   string            `json:"output"`
+	Encoding string            `json:"encoding"`
+	Error    string            `json:"error,omitempty"`
+	TimedOut bool              `json:"timedOut,omitempty"`
+	Labels   map[string]string `json:"labels,omitempty"`
+}
 
 type stringSlice []string
 
@@ -23,6 +50,87 @@ func (s *stringSlice) Set(value string) error {
 	return nil
 }
 
+// exitCodeMap collects FROM=TO exit code remappings.
+type exitCodeMap map[int]int
+
+func (m exitCodeMap) String() string {
+	var parts []string
+	for from, to := range m {
+		parts = append(parts, fmt.Sprintf("%d=%d", from, to))
+	}
+	return strings.Join(parts, ",")
+}
+
+func (m exitCodeMap) Set(value string) error {
+	from, to, ok := strings.Cut(value, "=")
+	if !ok {
+		return fmt.Errorf("expected FROM=TO, got %q", value)
+	}
+	fromCode, err := strconv.Atoi(from)
+	if err != nil {
+		return fmt.Errorf("invalid exit code %q", from)
+	}
+	toCode, err := strconv.Atoi(to)
+	if err != nil {
+		return fmt.Errorf("invalid exit code %q", to)
+	}
+	m[fromCode] = toCode
+	return nil
+}
+
+// envMap collects KEY=VALUE pairs.
+type envMap map[string]string
+
+func (m envMap) String() string {
+	var parts []string
+	for k, v := range m {
+		parts = append(parts, k+"="+v)
+	}
+	return strings.Join(parts, ",")
+}
+
+func (m envMap) Set(value string) error {
+	key, val, ok := strings.Cut(value, "=")
+	if !ok || key == "" {
+		return fmt.Errorf("expected KEY=VALUE, got %q", value)
+	}
+	m[key] = val
+	return nil
+}
+
+// scopedEnvMap collects NAME=KEY=VALUE pairs, applied only to commands
+// whose program name is NAME.
+type scopedEnvMap map[string]envMap
+
+func (m scopedEnvMap) String() string {
+	var parts []string
+	for name, env := range m {
+		parts = append(parts, name+"="+env.String())
+	}
+	return strings.Join(parts, ",")
+}
+
+func (m scopedEnvMap) Set(value string) error {
+	name, kv, ok := strings.Cut(value, "=")
+	if !ok || name == "" {
+		return fmt.Errorf("expected NAME=KEY=VALUE, got %q", value)
+	}
+	if m[name] == nil {
+		m[name] = envMap{}
+	}
+	return m[name].Set(kv)
+}
+
+// programName returns the base name of a command's program, e.g. "go" for
+// "/usr/local/bin/go build ./...".
+func programName(command string) string {
+	fields := strings.Fields(command)
+	if len(fields) == 0 {
+		return ""
+	}
+	return filepath.Base(fields[0])
+}
+
 func main() {
 	if len(os.Args) < 2 {
 		printUsage()
@@ -32,6 +140,14 @@ func main() {
 	switch os.Args[1] {
 	case "exec":
 		execCmd(os.Args[2:])
+	case "batch":
+		batchCmd(os.Args[2:])
+	case "config":
+		configCmd(os.Args[2:])
+	case "validate":
+		validateCmd(os.Args[2:])
+	case "capabilities":
+		capabilitiesCmd(os.Stdout, sandbox.DetectCapabilities())
 	case "help", "-h", "--help":
 		printUsage()
 	default:
@@ -41,26 +157,228 @@ func main() {
 	}
 }
 
+// runFlags are the sandbox flags shared by exec and batch.
+type runFlags struct {
+	configPath string
+	noConfig   bool
+	project    bool
+	workdir    string
+	allowWrite stringSlice
+	denyRead   stringSlice
+	writeAdd   stringSlice
+	denyAdd    stringSlice
+	cleanEnv   bool
+	noNetwork  bool
+	allowHost  stringSlice
+	sshAgent   bool
+	dryRun     bool
+	dryRunFmt  string
+	encoding   string
+	errorCode  int
+	remapExit  exitCodeMap
+	setEnv     envMap
+	envFor     scopedEnvMap
+	labels     envMap
+	diagFD     int
+	logger     *log.Logger
+	timeout    time.Duration
+	inputFile  string
+}
+
+func (f *runFlags) register(fs *flag.FlagSet) {
+	f.remapExit = exitCodeMap{}
+	f.setEnv = envMap{}
+	f.envFor = scopedEnvMap{}
+	f.labels = envMap{}
+
+	fs.StringVar(&f.configPath, "config", "", "Config file path, JSON or YAML (default: ~/.agent/sandbox/config.json)")
+	fs.BoolVar(&f.noConfig, "no-config", false, "Skip loading config file")
+	fs.BoolVar(&f.project, "project-config", false, "Also load "+sandbox.ProjectConfigName+" from the workdir or its parents")
+	fs.StringVar(&f.workdir, "workdir", "", "Working directory (default: cwd)")
+	fs.Var(&f.allowWrite, "allow-write", "Writable path, replaces config (repeatable)")
+	fs.Var(&f.denyRead, "deny-read", "Protected path, replaces config (repeatable)")
+	fs.Var(&f.writeAdd, "allow-write-add", "Writable path, added to config (repeatable)")
+	fs.Var(&f.denyAdd, "deny-read-add", "Protected path, added to config (repeatable)")
+	fs.BoolVar(&f.cleanEnv, "clean-env", false, "Start with minimal environment")
+	fs.BoolVar(&f.noNetwork, "no-network", false, "Run without network access")
+	fs.Var(&f.allowHost, "allow-host", "Only reach this HOST:PORT, replaces config (repeatable)")
+	fs.BoolVar(&f.sshAgent, "share-ssh-agent", false, "Share the SSH agent socket ($SSH_AUTH_SOCK)")
+	fs.Var(f.setEnv, "set-env", "Set an env var, KEY=VALUE (repeatable)")
+	fs.Var(f.envFor, "env-for", "Set an env var for one program only, NAME=KEY=VALUE (repeatable)")
+	fs.Var(f.labels, "label", "Label for logs and JSON results, KEY=VALUE (repeatable)")
+	fs.BoolVar(&f.dryRun, "dry-run", false, "Print command instead of executing")
+	fs.StringVar(&f.dryRunFmt, "dry-run-format", "", "Dry-run output: shell or json (default: shell)")
+	fs.DurationVar(&f.timeout, "timeout", 0, "Kill each command after this long, e.g. 30s")
+	fs.StringVar(&f.inputFile, "input-file", "", "Feed FILE to each command's stdin")
+	fs.IntVar(&f.errorCode, "sandbox-error-code", defaultSandboxErrorCode, "Exit code for sandbox errors (1-255)")
+	fs.Var(f.remapExit, "remap-exit-code", "Remap a command exit code, FROM=TO (repeatable)")
+	fs.IntVar(&f.diagFD, "diag-fd", 0, "Write sandbox warnings to this file descriptor instead of stderr")
+	fs.StringVar(&f.encoding, "output-encoding", "", "Output encoding: raw, utf8-lossy, base64 (default: raw, base64 with --json)")
+}
+
+// parse parses flags and applies --sandbox-error-code.
+func (f *runFlags) parse(fs *flag.FlagSet, args []string) {
+	if err := fs.Parse(args); err != nil {
+		os.Exit(exitSandboxError)
+	}
+
+	if f.errorCode < 1 || f.errorCode > 255 {
+		fmt.Fprintf(os.Stderr, "error: --sandbox-error-code must be 1-255, got %d\n", f.errorCode)
+		os.Exit(exitSandboxError)
+	}
+	exitSandboxError = f.errorCode
+
+	if f.diagFD != 0 {
+		logger, err := diagLogger(f.diagFD)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(exitSandboxError)
+		}
+		// Config file warnings use the standard logger, so route it too
+		log.SetOutput(logger.Writer())
+		f.logger = logger
+	}
+}
+
+// loadConfig returns the config from the config files the flags select.
+// A file that can't be read or parsed is an error, never skipped.
+func (f *runFlags) loadConfig() (sandbox.Config, error) {
+	switch {
+	case f.noConfig:
+		// Skip config file, use hardcoded defaults only
+		return sandbox.LoadConfigCascade(nil)
+	case f.configPath != "":
+		// Use specified config file
+		return sandbox.LoadConfigCascade([]string{f.configPath})
+	default:
+		// System, user and (opted in) project config files, in that order
+		return sandbox.LoadConfigCascade(configLayers(f.workdir, f.project))
+	}
+}
+
+// config builds the sandbox config from the config file and flags.
+func (f *runFlags) config() sandbox.Config {
+	cfg, err := f.loadConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(exitSandboxError)
+	}
+
+	if f.workdir != "" {
+		cfg.Workdir = f.workdir
+	}
+
+	// CLI flags replace config values (not append)
+	if len(f.allowWrite) > 0 {
+		cfg.AllowWrite = f.allowWrite
+	}
+
+	if len(f.denyRead) > 0 {
+		cfg.DenyRead = f.denyRead
+	}
+
+	// The -add flags extend the lists, as allowWriteAdd in a config file
+	cfg = sandbox.MergeConfig(cfg, &sandbox.FileConfig{AllowWriteAdd: f.writeAdd, DenyReadAdd: f.denyAdd})
+
+	if f.cleanEnv {
+		cfg.CleanEnv = true
+	}
+	if f.noNetwork {
+		cfg.NoNetwork = true
+	}
+	if len(f.allowHost) > 0 {
+		cfg.NetworkAllow = f.allowHost
+	}
+	if f.sshAgent {
+		cfg.ShareSSHAgent = true
+	}
+	cfg.DryRun = f.dryRun
+	cfg.DryRunFormat = f.dryRunFmt
+
+	if len(f.remapExit) > 0 {
+		cfg.ExitCodeMap = f.remapExit
+	}
+
+	if len(f.labels) > 0 {
+		cfg.Labels = f.labels
+	}
+	cfg.Logger = f.logger
+	if f.timeout > 0 {
+		cfg.Timeout = f.timeout
+	}
+	if f.inputFile != "" {
+		// Relative to the current directory, not the workdir
+		path, err := filepath.Abs(f.inputFile)
+		if err != nil {
+			path = f.inputFile
+		}
+		cfg.StdinFile = path
+	}
+
+	return cfg
+}
+
+// scope returns the env scope a command belongs to: its program name if
+// --env-for targets it, otherwise "" for the shared scope.
+func (f *runFlags) scope(command string) string {
+	if name := programName(command); f.envFor[name] != nil {
+		return name
+	}
+	return ""
+}
+
+// applyEnv layers --set-env and the scope's --env-for vars over cfg.SetEnv.
+func (f *runFlags) applyEnv(cfg *sandbox.Config, scope string) {
+	if len(f.setEnv) == 0 && len(f.envFor[scope]) == 0 {
+		return
+	}
+
+	env := maps.Clone(cfg.SetEnv)
+	if env == nil {
+		env = map[string]string{}
+	}
+	maps.Copy(env, f.setEnv)
+	maps.Copy(env, f.envFor[scope])
+	cfg.SetEnv = env
+}
+
+// jsonEncoding returns the encoding for JSON output fields and switches the
+// sandbox to raw output, since encoding is applied to the JSON field instead.
+func (f *runFlags) jsonEncoding(cfg *sandbox.Config) string {
+	encoding := f.encoding
+	if encoding == "" {
+		encoding = sandbox.EncodingBase64
+	}
+	if _, err := sandbox.EncodeOutput(nil, encoding); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(exitSandboxError)
+	}
+	cfg.OutputEncoding = sandbox.EncodingRaw
+	return encoding
+}
+
+// newSandbox creates the sandbox or exits with the sandbox error code.
+func newSandbox(cfg sandbox.Config) sandbox.Sandbox {
+	sb, err := sandbox.New(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "sandbox error: %v\n", err)
+		os.Exit(exitSandboxError)
+	}
+	return sb
+}
+
 func execCmd(args []string) {
 	fs := flag.NewFlagSet("exec", flag.ExitOnError)
 
 	var (
-		configPath string
-		noConfig   bool
-		workdir    string
-		allowWrite stringSlice
-		denyRead   stringSlice
-		cleanEnv   bool
-		dryRun     bool
+		flags      runFlags
+		jsonOutput bool
+		noShell    bool
 	)
 
-	fs.StringVar(&configPath, "config", "", "Config file path (default: ~/.agent/sandbox/config.json)")
-	fs.BoolVar(&noConfig, "no-config", false, "Skip loading config file")
-	fs.StringVar(&workdir, "workdir", "", "Working directory (default: cwd)")
-	fs.Var(&allowWrite, "allow-write", "Writable path, replaces config (repeatable)")
-	fs.Var(&denyRead, "deny-read", "Protected path, replaces config (repeatable)")
-	fs.BoolVar(&cleanEnv, "clean-env", false, "Start with minimal environment")
-	fs.BoolVar(&dryRun, "dry-run", false, "Print command instead of executing")
+	flags.register(fs)
+	fs.BoolVar(&jsonOutput, "json", false, "Print result as JSON")
+	fs.BoolVar(&noShell, "no-shell", false, "Run the arguments after -- as argv, without a shell")
 
 	// Find -- separator
 	cmdStart := -1
@@ -77,67 +395,349 @@ func execCmd(args []string) {
 		os.Exit(exitSandboxError)
 	}
 
-	if err := fs.Parse(args[:cmdStart]); err != nil {
-		os.Exit(exitSandboxError)
-	}
+	flags.parse(fs, args[:cmdStart])
 
-	command := strings.Join(args[cmdStart+1:], " ")
+	argv := args[cmdStart+1:]
+	command := strings.Join(argv, " ")
 	if command == "" {
 		fmt.Fprintln(os.Stderr, "error: no command specified")
 		os.Exit(exitSandboxError)
 	}
 
 	// Build config based on flags
-	var cfg sandbox.Config
-	if noConfig {
-		// Skip config file, use hardcoded defaults only
-		cfg = sandbox.DefaultConfigWithPath("")
-	} else if configPath != "" {
-		// Use specified config file
-		cfg = sandbox.DefaultConfigWithPath(configPath)
+	cfg := flags.config()
+	flags.applyEnv(&cfg, flags.scope(command))
+
+	encoding := flags.encoding
+	if jsonOutput {
+		encoding = flags.jsonEncoding(&cfg)
 	} else {
-		// Use default config file path
-		cfg = sandbox.DefaultConfig()
+		cfg.OutputEncoding = encoding
 	}
 
-	if workdir != "" {
-		cfg.Workdir = workdir
+	// Create sandbox
+	sb := newSandbox(cfg)
+
+	// Run command, through sh -c unless --no-shell
+	var (
+		output   []byte
+		exitCode int
+		err      error
+	)
+	if noShell {
+		output, exitCode, err = sb.RunArgs(context.Background(), argv)
+	} else {
+		output, exitCode, err = sb.Run(context.Background(), command)
 	}
 
-	// CLI flags replace config values (not append)
-	if len(allowWrite) > 0 {
-		cfg.AllowWrite = allowWrite
+	if jsonOutput {
+		result, code := newJSONResult(output, exitCode, err, encoding)
+		result.Labels = cfg.Labels
+		json.NewEncoder(os.Stdout).Encode(result)
+		os.Exit(code)
 	}
 
-	if len(denyRead) > 0 {
-		cfg.DenyRead = denyRead
+	// Print output
+	os.Stdout.Write(output)
+
+	if errors.Is(err, context.DeadlineExceeded) {
+		fmt.Fprintf(os.Stderr, "timed out after %v\n", cfg.Timeout)
+		os.Exit(exitTimeout)
 	}
 
-	if cleanEnv {
-		cfg.CleanEnv = true
+	if err != nil && exitCode == 0 {
+		// Error but no exit code means sandbox issue
+		fmt.Fprintf(os.Stderr, "execution error: %v\n", err)
+		os.Exit(exitSandboxError)
 	}
-	cfg.DryRun = dryRun
 
-	// Create sandbox
-	sb, err := sandbox.New(cfg)
+	os.Exit(exitCode)
+}
+
+func batchCmd(args []string) {
+	fs := flag.NewFlagSet("batch", flag.ExitOnError)
+
+	var flags runFlags
+	flags.register(fs)
+	flags.parse(fs, args)
+
+	// Commands come from FILE, or stdin if omitted
+	input := io.Reader(os.Stdin)
+	if fs.NArg() > 1 {
+		fmt.Fprintln(os.Stderr, "usage: agentsandbox batch [flags] [FILE]")
+		os.Exit(exitSandboxError)
+	}
+	if fs.NArg() == 1 {
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(exitSandboxError)
+		}
+		defer f.Close()
+		input = f
+	}
+
+	commands, err := readCommands(input)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "sandbox error: %v\n", err)
+		fmt.Fprintf(os.Stderr, "error: reading commands: %v\n", err)
 		os.Exit(exitSandboxError)
 	}
 
-	// Run command
-	output, exitCode, err := sb.Run(context.Background(), command)
+	cfg := flags.config()
+	encoding := flags.jsonEncoding(&cfg)
 
-	// Print output
-	os.Stdout.Write(output)
+	// One sandbox per env scope, created on first use
+	sandboxes := map[string]sandbox.Sandbox{}
+	sandboxFor := func(command string) sandbox.Sandbox {
+		scope := flags.scope(command)
+		if sb, ok := sandboxes[scope]; ok {
+			return sb
+		}
+		scoped := cfg
+		flags.applyEnv(&scoped, scope)
+		sandboxes[scope] = newSandbox(scoped)
+		return sandboxes[scope]
+	}
 
-	if err != nil && exitCode == 0 {
-		// Error but no exit code means sandbox issue
-		fmt.Fprintf(os.Stderr, "execution error: %v\n", err)
-		os.Exit(exitSandboxError)
+	if !runBatch(context.Background(), sandboxFor, commands, encoding, cfg.Labels, os.Stdout) {
+		os.Exit(1)
 	}
+}
 
-	os.Exit(exitCode)
+// readCommands reads one command per line, skipping blank lines and # comments.
+func readCommands(r io.Reader) ([]string, error) {
+	var commands []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		commands = append(commands, line)
+	}
+	return commands, scanner.Err()
+}
+
+// runBatch runs commands in order, each in the sandbox returned by sandboxFor,
+// writing one JSON result per line, tagged with labels, to w as each
+// completes. Returns false if any command failed.
+func runBatch(ctx context.Context, sandboxFor func(command string) sandbox.Sandbox, commands []string, encoding string, labels map[string]string, w io.Writer) bool {
+	enc := json.NewEncoder(w)
+	ok := true
+
+	for _, command := range commands {
+		output, exitCode, err := sandboxFor(command).Run(ctx, command)
+		result, code := newJSONResult(output, exitCode, err, encoding)
+		result.Command = command
+		result.Labels = labels
+		if code != 0 {
+			ok = false
+		}
+
+		// Each Encode is a single write of one line, so consumers see
+		// results as soon as each command completes
+		if err := enc.Encode(result); err != nil {
+			fmt.Fprintf(os.Stderr, "error: writing result: %v\n", err)
+			return false
+		}
+		if flusher, isFlusher := w.(interface{ Flush() error }); isFlusher {
+			flusher.Flush()
+		}
+	}
+
+	return ok
+}
+
+// newJSONResult builds the JSON result for a run and returns the exit code.
+func newJSONResult(output []byte, exitCode int, runErr error, encoding string) (jsonResult, int) {
+	result := jsonResult{
+		ExitCode: exitCode,
+		Encoding: encoding,
+	}
+
+	encoded, err := sandbox.EncodeOutput(output, encoding)
+	if err != nil {
+		result.Error = err.Error()
+		result.ExitCode = exitSandboxError
+		return result, result.ExitCode
+	}
+	result.Output = string(encoded)
+
+	if runErr != nil {
+		result.Error = runErr.Error()
+		if errors.Is(runErr, context.DeadlineExceeded) {
+			result.ExitCode = exitTimeout
+			result.TimedOut = true
+		} else if exitCode == 0 {
+			// Error but no exit code means sandbox issue
+			result.ExitCode = exitSandboxError
+		}
+	}
+
+	return result, result.ExitCode
+}
+
+func configCmd(args []string) {
+	if len(args) != 1 || args[0] != "show" {
+		fmt.Fprintln(os.Stderr, "usage: agentsandbox config show")
+		os.Exit(1)
+	}
+
+	layers := configLayers("", false)
+	cfg, err := sandbox.LoadConfigCascade(layers)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := showConfig(os.Stdout, cfg, configSource(layers)); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// configLayers returns the config files exec loads, lowest precedence
+// first: the system file, the user file and, if project is set, the
+// nearest project file from workdir (default: cwd) up. A sandboxed command
+// that can write the workdir could create a project file for later runs,
+// so it isn't loaded by default.
+func configLayers(workdir string, project bool) []string {
+	layers := []string{sandbox.SystemConfigPath, sandbox.DefaultConfigPath()}
+	if project {
+		if workdir == "" {
+			workdir = "."
+		}
+		layers = append(layers, sandbox.FindProjectConfig(workdir))
+	}
+	return layers
+}
+
+// configSource lists the layers that exist, for config show.
+func configSource(layers []string) string {
+	var found []string
+	for _, path := range layers {
+		if _, err := os.Stat(path); path != "" && err == nil {
+			found = append(found, path)
+		}
+	}
+	if len(found) == 0 {
+		return sandbox.SourceDefaults
+	}
+	return strings.Join(found, ", ")
+}
+
+// showConfig prints the config file source and effective values as JSON.
+func showConfig(w io.Writer, cfg sandbox.Config, source string) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(struct {
+		Source       string            `json:"source"`
+		Workdir      string            `json:"workdir"`
+		AllowWrite   []string          `json:"allowWrite"`
+		WriteExclude []string          `json:"writeExclude,omitempty"`
+		DenyRead     []string          `json:"denyRead"`
+		CleanEnv     bool              `json:"cleanEnv"`
+		Network      bool              `json:"network"`
+		NetworkAllow []string          `json:"networkAllow,omitempty"`
+		EnvAllowlist []string          `json:"envAllowlist,omitempty"`
+		EnvDenylist  []string          `json:"envDenylist,omitempty"`
+		Env          map[string]string `json:"env,omitempty"`
+		ProtectSelf  bool              `json:"protectSelf"`
+	}{
+		Source:       source,
+		Workdir:      cfg.Workdir,
+		AllowWrite:   cfg.AllowWrite,
+		WriteExclude: cfg.WriteExclude,
+		DenyRead:     cfg.DenyRead,
+		CleanEnv:     cfg.CleanEnv,
+		Network:      !cfg.NoNetwork,
+		NetworkAllow: cfg.NetworkAllow,
+		EnvAllowlist: cfg.EnvAllowlist,
+		EnvDenylist:  cfg.EnvDenylist,
+		Env:          cfg.SetEnv,
+		ProtectSelf:  cfg.ProtectSelf,
+	})
+}
+
+func validateCmd(args []string) {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	configPath := fs.String("config", "", "Config file to check, JSON or YAML (default: the files exec loads)")
+	project := fs.Bool("project-config", false, "Also load .agentsandbox.json from the current directory or its parents")
+	fs.Parse(args)
+
+	layers := configLayers("", *project)
+	if *configPath != "" {
+		// Unlike exec, a missing file given explicitly is an error
+		if _, err := os.Stat(*configPath); err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			os.Exit(1)
+		}
+		layers = []string{*configPath}
+	}
+	cfg, err := sandbox.LoadConfigCascade(layers)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+	if !printCheck(os.Stdout, configSource(layers), sandbox.CheckConfig(cfg)) {
+		os.Exit(1)
+	}
+}
+
+// printCheck prints the result of checking the config loaded from source
+// and reports whether it found no problems.
+func printCheck(w io.Writer, source string, check sandbox.ConfigCheck) bool {
+	fmt.Fprintf(w, "config:   %s\n", source)
+	if check.Backend != "" {
+		fmt.Fprintf(w, "backend:  %s\n", check.Backend)
+	}
+	for _, choice := range check.Backends {
+		switch {
+		case choice.Selected:
+			fmt.Fprintf(w, "order:    %s: selected\n", choice.Name)
+		case choice.Skipped != "":
+			fmt.Fprintf(w, "order:    %s: skipped: %s\n", choice.Name, choice.Skipped)
+		default:
+			fmt.Fprintf(w, "order:    %s: not reached\n", choice.Name)
+		}
+	}
+	for _, path := range check.Missing {
+		fmt.Fprintf(w, "note:     denyRead %q does not exist\n", path)
+	}
+	for _, problem := range check.Problems {
+		fmt.Fprintf(w, "error:    %s\n", problem)
+	}
+
+	if len(check.Problems) > 0 {
+		fmt.Fprintf(w, "%d problem(s) found\n", len(check.Problems))
+		return false
+	}
+	fmt.Fprintln(w, "config is valid")
+	return true
+}
+
+func capabilitiesCmd(w io.Writer, caps sandbox.Capabilities) {
+	landlock := "no"
+	if caps.Landlock > 0 {
+		landlock = fmt.Sprintf("yes (ABI v%d)", caps.Landlock)
+	}
+	bwrap := "not installed"
+	if caps.BwrapVersion != "" {
+		bwrap = caps.BwrapVersion
+	}
+
+	fmt.Fprintf(w, "user namespaces:  %s\n", yesNo(caps.UserNamespaces))
+	fmt.Fprintf(w, "cgroup v2:        %s\n", yesNo(caps.CgroupV2))
+	fmt.Fprintf(w, "landlock:         %s\n", landlock)
+	fmt.Fprintf(w, "seccomp:          %s\n", yesNo(caps.Seccomp))
+	fmt.Fprintf(w, "bwrap:            %s\n", bwrap)
+	fmt.Fprintf(w, "sandbox-exec:     %s\n", yesNo(caps.SandboxExec))
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
 }
 
 func printUsage() {
@@ -145,26 +745,55 @@ func printUsage() {
 
 Usage:
   agentsandbox exec [flags] -- COMMAND
+  agentsandbox batch [flags] [FILE]
+  agentsandbox config show
+  agentsandbox validate [--config PATH] [--project-config]
+  agentsandbox capabilities
   agentsandbox help
 
 Commands:
-  exec    Run a command in the sandbox
-  help    Show this help
-
-Flags for exec:
-  --config PATH        Config file path (default: ~/.agent/sandbox/config.json)
-  --no-config          Skip loading config file
-  --workdir DIR        Working directory (default: cwd)
-  --allow-write PATH   Writable path, replaces config (repeatable)
-  --deny-read PATH     Protected path, replaces config (repeatable)
-  --clean-env          Start with minimal environment
-  --dry-run            Print command instead of executing
+  exec          Run a command in the sandbox
+  batch         Run commands from FILE or stdin (one per line), printing one
+                JSON result per line as each completes
+  config show   Show which config file was loaded and the effective values
+  validate      Check the config's paths and the platform's backend without
+                running a command; exits 1 if anything is wrong
+  capabilities  Show the isolation primitives available on this host
+  help          Show this help
+
+Flags for exec and batch:
+  --config PATH             Config file path, JSON or YAML (default: ~/.agent/sandbox/config.json)
+  --no-config               Skip loading config files
+  --project-config          Also load .agentsandbox.json from the workdir or its parents
+  --workdir DIR             Working directory (default: cwd)
+  --allow-write PATH        Writable path, replaces config (repeatable)
+  --deny-read PATH          Protected path, replaces config (repeatable)
+  --allow-write-add PATH    Writable path, added to config (repeatable)
+  --deny-read-add PATH      Protected path, added to config (repeatable)
+  --clean-env               Start with minimal environment
+  --no-network              Run without network access
+  --allow-host HOST:PORT    Only reach these destinations, replaces config (repeatable, macOS only)
+  --share-ssh-agent         Share the SSH agent socket ($SSH_AUTH_SOCK), not ~/.ssh
+  --set-env KEY=VALUE       Set an env var (repeatable)
+  --env-for NAME=KEY=VALUE  Set an env var only for commands running program NAME (repeatable)
+  --label KEY=VALUE         Label warnings and JSON results, e.g. task-id=42 (repeatable)
+  --dry-run                 Print command instead of executing
+  --dry-run-format F        shell or json: backend, argv, env and paths (default: shell)
+  --timeout D               Kill each command after D, e.g. 30s (exit code 124)
+  --input-file FILE         Feed FILE to each command's stdin (default: none)
+  --json                    Print result as JSON (exec only; batch always prints JSON)
+  --no-shell                Run the arguments after -- as argv without a shell (exec only)
+  --output-encoding E       raw, utf8-lossy or base64 (default: raw, base64 with --json)
+  --diag-fd N               Write sandbox warnings to fd N, keeping stderr for the command
+  --sandbox-error-code N    Exit code for sandbox errors (default: 125)
+  --remap-exit-code F=T     Remap command exit code F to T (repeatable)
 
 Config file format (JSON):
   {
     "allowWrite": ["/tmp", "."],
     "denyRead": ["~/.ssh", "~/.aws"],
     "cleanEnv": false,
+    "network": true,
     "envDenylist": ["AWS_SECRET_ACCESS_KEY"]
   }
 
@@ -176,8 +805,15 @@ Examples:
   agentsandbox exec --config ./my-config.json -- make build
   agentsandbox exec --no-config -- ls -la
   agentsandbox exec --dry-run -- rm -rf /
+  agentsandbox exec --no-network -- ./untrusted-script.sh
+  agentsandbox exec --no-shell -- rm -- 'file with spaces $(x).txt'
 
 Exit codes:
-  0-124    Passed through from sandboxed command
-  125      Sandbox setup or execution error`)
+  0-123    Passed through from sandboxed command
+  124      Command timed out (--timeout)
+  125      Sandbox setup or execution error (see --sandbox-error-code)
+
+A command that itself exits 125 is indistinguishable from a sandbox error.
+Either move sandbox errors elsewhere (--sandbox-error-code 250) or remap the
+command's code (--remap-exit-code 125=1).`)
 }
@@ -0,0 +1,415 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/niwoerner/go-agentsandbox/sandbox"
+)
+
+// fakeSandbox returns canned results keyed by command.
+type fakeSandbox struct {
+	results map[string]fakeResult
+}
+
+type fakeResult struct {
+	output   string
+	exitCode int
+}
+
+func (f *fakeSandbox) Run(ctx context.Context, command string) ([]byte, int, error) {
+	r := f.results[command]
+	return []byte(r.output), r.exitCode, nil
+}
+
+func (f *fakeSandbox) RunWithStdin(ctx context.Context, command string, stdin io.Reader) ([]byte, int, error) {
+	return f.Run(ctx, command)
+}
+
+func (f *fakeSandbox) RunNoNetwork(ctx context.Context, command string) ([]byte, int, error) {
+	return f.Run(ctx, command)
+}
+
+func (f *fakeSandbox) RunWithEnv(ctx context.Context, command string, env map[string]string) ([]byte, int, error) {
+	return f.Run(ctx, command)
+}
+
+func (f *fakeSandbox) RunResult(ctx context.Context, command string) (*sandbox.Result, error) {
+	r := f.results[command]
+	return &sandbox.Result{Stdout: []byte(r.output), Combined: []byte(r.output), ExitCode: r.exitCode}, nil
+}
+
+func (f *fakeSandbox) RunSeparate(ctx context.Context, command string) ([]byte, []byte, int, error) {
+	r := f.results[command]
+	return []byte(r.output), nil, r.exitCode, nil
+}
+
+func (f *fakeSandbox) RunStream(ctx context.Context, command string, stdout, stderr io.Writer) (int, error) {
+	r := f.results[command]
+	io.WriteString(stdout, r.output)
+	return r.exitCode, nil
+}
+
+func (f *fakeSandbox) RunArgs(ctx context.Context, argv []string) ([]byte, int, error) {
+	return f.Run(ctx, strings.Join(argv, " "))
+}
+
+func (f *fakeSandbox) RunArgsAs(ctx context.Context, name string, argv []string) ([]byte, int, error) {
+	return f.Run(ctx, strings.Join(argv, " "))
+}
+
+func (f *fakeSandbox) Verify(ctx context.Context) (sandbox.VerifyReport, error) {
+	return sandbox.VerifyReport{}, nil
+}
+
+func TestReadCommands(t *testing.T) {
+	input := "# setup\nnpm ci\n\n  npm test  \n#npm run lint\nnpm run build\n"
+
+	commands, err := readCommands(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := []string{"npm ci", "npm test", "npm run build"}
+	if strings.Join(commands, "|") != strings.Join(expected, "|") {
+		t.Errorf("commands = %q, want %q", commands, expected)
+	}
+}
+
+func TestRunBatch_JSONLines(t *testing.T) {
+	sb := &fakeSandbox{results: map[string]fakeResult{
+		"first":  {"one\n", 0},
+		"second": {"two\n", 3},
+		"third":  {"three\n", 0},
+	}}
+
+	var buf bytes.Buffer
+	sandboxFor := func(string) sandbox.Sandbox { return sb }
+	ok := runBatch(context.Background(), sandboxFor, []string{"first", "second", "third"}, "raw", nil, &buf)
+	if ok {
+		t.Error("batch with a failing command should report failure")
+	}
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("expected 3 JSON lines, got %d:\n%s", len(lines), buf.String())
+	}
+
+	expected := []struct {
+		command  string
+		exitCode int
+		output   string
+	}{
+		{"first", 0, "one\n"},
+		{"second", 3, "two\n"},
+		{"third", 0, "three\n"},
+	}
+
+	for i, line := range lines {
+		var result jsonResult
+		if err := json.Unmarshal([]byte(line), &result); err != nil {
+			t.Fatalf("line %d is not valid JSON: %v", i, err)
+		}
+		if result.Command != expected[i].command {
+			t.Errorf("line %d command = %q, want %q", i, result.Command, expected[i].command)
+		}
+		if result.ExitCode != expected[i].exitCode {
+			t.Errorf("line %d exitCode = %d, want %d", i, result.ExitCode, expected[i].exitCode)
+		}
+		if result.Output != expected[i].output {
+			t.Errorf("line %d output = %q, want %q", i, result.Output, expected[i].output)
+		}
+	}
+}
+
+func TestNewJSONResult_Timeout(t *testing.T) {
+	err := fmt.Errorf("run: %w", context.DeadlineExceeded)
+	result, code := newJSONResult([]byte("partial"), -1, err, "raw")
+	if code != exitTimeout || result.ExitCode != exitTimeout {
+		t.Errorf("exit code = %d (result %d), want %d", code, result.ExitCode, exitTimeout)
+	}
+	if result.Output != "partial" || result.Error == "" {
+		t.Errorf("result = %+v, want the partial output and the error", result)
+	}
+	if !result.TimedOut {
+		t.Error("TimedOut should be set")
+	}
+
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(result); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), `"output":"partial"`) || !strings.Contains(buf.String(), `"timedOut":true`) {
+		t.Errorf("JSON should include the partial output and the flag, got %s", buf.String())
+	}
+
+	if result, _ := newJSONResult([]byte("done"), 1, nil, "raw"); result.TimedOut {
+		t.Error("TimedOut should only be set on timeout")
+	}
+}
+
+func TestScopedEnvMap_Set(t *testing.T) {
+	m := scopedEnvMap{}
+
+	for _, value := range []string{"go=GOOS=linux", "go=CGO_ENABLED=0", "npm=NODE_ENV=production", "go=GOFLAGS=-tags=a=b"} {
+		if err := m.Set(value); err != nil {
+			t.Fatalf("Set(%q) unexpected error: %v", value, err)
+		}
+	}
+
+	if m["go"]["GOOS"] != "linux" || m["go"]["CGO_ENABLED"] != "0" {
+		t.Errorf("go scope = %v", m["go"])
+	}
+	if m["go"]["GOFLAGS"] != "-tags=a=b" {
+		t.Errorf("value should keep later '=', got %q", m["go"]["GOFLAGS"])
+	}
+	if m["npm"]["NODE_ENV"] != "production" {
+		t.Errorf("npm scope = %v", m["npm"])
+	}
+
+	for _, value := range []string{"go", "go=", "=KEY=VALUE", "go==VALUE"} {
+		if err := m.Set(value); err == nil {
+			t.Errorf("Set(%q) should fail", value)
+		}
+	}
+}
+
+func TestRunFlags_ApplyEnv(t *testing.T) {
+	f := runFlags{
+		setEnv: envMap{"CI": "true", "GOOS": "darwin"},
+		envFor: scopedEnvMap{"go": envMap{"GOOS": "linux"}},
+	}
+
+	if scope := f.scope("/usr/local/bin/go build ./..."); scope != "go" {
+		t.Errorf("scope = %q, want %q", scope, "go")
+	}
+	if scope := f.scope("npm test"); scope != "" {
+		t.Errorf("scope = %q, want shared scope", scope)
+	}
+
+	base := sandbox.Config{SetEnv: map[string]string{"FROM_CONFIG": "1", "CI": "false"}}
+
+	goCfg := base
+	f.applyEnv(&goCfg, "go")
+	expected := map[string]string{"FROM_CONFIG": "1", "CI": "true", "GOOS": "linux"}
+	for k, v := range expected {
+		if goCfg.SetEnv[k] != v {
+			t.Errorf("go scope %s = %q, want %q", k, goCfg.SetEnv[k], v)
+		}
+	}
+
+	sharedCfg := base
+	f.applyEnv(&sharedCfg, "")
+	if sharedCfg.SetEnv["GOOS"] != "darwin" {
+		t.Errorf("shared scope GOOS = %q, want %q", sharedCfg.SetEnv["GOOS"], "darwin")
+	}
+
+	// Base config must not be modified
+	if len(base.SetEnv) != 2 || base.SetEnv["CI"] != "false" {
+		t.Errorf("base SetEnv modified: %v", base.SetEnv)
+	}
+}
+
+func TestRunBatch_ScopedSandboxes(t *testing.T) {
+	goSandbox := &fakeSandbox{results: map[string]fakeResult{"go build": {"go\n", 0}}}
+	sharedSandbox := &fakeSandbox{results: map[string]fakeResult{"make": {"make\n", 0}}}
+
+	f := runFlags{envFor: scopedEnvMap{"go": envMap{"GOOS": "linux"}}}
+	sandboxFor := func(command string) sandbox.Sandbox {
+		if f.scope(command) == "go" {
+			return goSandbox
+		}
+		return sharedSandbox
+	}
+
+	var buf bytes.Buffer
+	if !runBatch(context.Background(), sandboxFor, []string{"make", "go build"}, "raw", nil, &buf) {
+		t.Fatalf("batch should succeed, got:\n%s", buf.String())
+	}
+
+	if !strings.Contains(buf.String(), `"output":"make\n"`) || !strings.Contains(buf.String(), `"output":"go\n"`) {
+		t.Errorf("each command should run in its scope's sandbox, got:\n%s", buf.String())
+	}
+}
+
+func TestRunBatch_Labels(t *testing.T) {
+	sb := &fakeSandbox{results: map[string]fakeResult{"true": {"", 0}}}
+	sandboxFor := func(string) sandbox.Sandbox { return sb }
+
+	var buf bytes.Buffer
+	runBatch(context.Background(), sandboxFor, []string{"true"}, "raw", map[string]string{"task-id": "42"}, &buf)
+
+	var result jsonResult
+	if err := json.Unmarshal(buf.Bytes(), &result); err != nil {
+		t.Fatalf("output is not JSON: %v\n%s", err, buf.String())
+	}
+	if result.Labels["task-id"] != "42" {
+		t.Errorf("labels = %v, want task-id=42", result.Labels)
+	}
+}
+
+func TestCapabilitiesCmd(t *testing.T) {
+	var buf bytes.Buffer
+	capabilitiesCmd(&buf, sandbox.Capabilities{
+		UserNamespaces: true,
+		Landlock:       3,
+		BwrapVersion:   "0.9.0",
+	})
+
+	for _, want := range []string{
+		"user namespaces:  yes\n",
+		"cgroup v2:        no\n",
+		"landlock:         yes (ABI v3)\n",
+		"bwrap:            0.9.0\n",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("output missing %q:\n%s", want, buf.String())
+		}
+	}
+}
+
+func TestPrintCheck(t *testing.T) {
+	var buf bytes.Buffer
+	ok := printCheck(&buf, "/etc/agentsandbox/config.json", sandbox.ConfigCheck{
+		Missing: []string{"/home/user/.aws"},
+		Backend: "bwrap 0.9.0 (/usr/bin/bwrap)",
+		Backends: []sandbox.BackendChoice{
+			{Name: "sandbox-exec", Skipped: "sandbox-exec not found"},
+			{Name: "bwrap", Selected: true},
+			{Name: "job-object"},
+		},
+	})
+	if !ok {
+		t.Error("a check without problems should pass")
+	}
+	for _, want := range []string{
+		"config:   /etc/agentsandbox/config.json\n",
+		"backend:  bwrap 0.9.0 (/usr/bin/bwrap)\n",
+		"order:    sandbox-exec: skipped: sandbox-exec not found\n",
+		"order:    bwrap: selected\n",
+		"order:    job-object: not reached\n",
+		"note:     denyRead \"/home/user/.aws\" does not exist\n",
+		"config is valid\n",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("output missing %q:\n%s", want, buf.String())
+		}
+	}
+
+	buf.Reset()
+	ok = printCheck(&buf, sandbox.SourceDefaults, sandbox.ConfigCheck{
+		Problems: []string{`allowWrite: "/gone" does not exist`, "backend: bubblewrap not found"},
+	})
+	if ok {
+		t.Error("a check with problems should fail")
+	}
+	for _, want := range []string{
+		"error:    allowWrite: \"/gone\" does not exist\n",
+		"error:    backend: bubblewrap not found\n",
+		"2 problem(s) found\n",
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("output missing %q:\n%s", want, buf.String())
+		}
+	}
+}
+
+func TestShowConfig(t *testing.T) {
+	var buf bytes.Buffer
+	cfg := sandbox.Config{Workdir: "/project", AllowWrite: []string{"/project"}}
+	if err := showConfig(&buf, cfg, sandbox.SourceDefaults); err != nil {
+		t.Fatal(err)
+	}
+
+	var got struct {
+		Source     string   `json:"source"`
+		AllowWrite []string `json:"allowWrite"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("output is not JSON: %v\n%s", err, buf.String())
+	}
+	if got.Source != sandbox.SourceDefaults || len(got.AllowWrite) != 1 {
+		t.Errorf("unexpected output:\n%s", buf.String())
+	}
+}
+
+func TestConfigLayers(t *testing.T) {
+	project := t.TempDir()
+	projectFile := filepath.Join(project, sandbox.ProjectConfigName)
+	if err := os.WriteFile(projectFile, []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	workdir := filepath.Join(project, "src")
+	if err := os.Mkdir(workdir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	layers := configLayers(workdir, false)
+	if len(layers) != 2 || layers[0] != sandbox.SystemConfigPath || layers[1] != sandbox.DefaultConfigPath() {
+		t.Errorf("layers = %v, want the system and user files", layers)
+	}
+	if layers := configLayers(workdir, true); len(layers) != 3 || layers[2] != projectFile {
+		t.Errorf("layers = %v, want the project file last", layers)
+	}
+
+	if got := configSource([]string{"", filepath.Join(project, "missing.json"), projectFile}); got != projectFile {
+		t.Errorf("configSource() = %q, want only the existing file", got)
+	}
+	if got := configSource(nil); got != sandbox.SourceDefaults {
+		t.Errorf("configSource() = %q, want %q", got, sandbox.SourceDefaults)
+	}
+}
+
+func TestRunFlags_DryRunFormat(t *testing.T) {
+	f := runFlags{noConfig: true, dryRun: true, dryRunFmt: sandbox.DryRunJSON}
+	if cfg := f.config(); !cfg.DryRun || cfg.DryRunFormat != sandbox.DryRunJSON {
+		t.Errorf("DryRun = %v, DryRunFormat = %q, want a JSON dry run", cfg.DryRun, cfg.DryRunFormat)
+	}
+}
+
+func TestRunFlags_LoadConfigInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(`{"allowWrite": [`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	f := runFlags{configPath: path}
+	if _, err := f.loadConfig(); err == nil || !strings.Contains(err.Error(), path) {
+		t.Errorf("loadConfig() error = %v, want an error naming %s", err, path)
+	}
+
+	if err := os.WriteFile(path, []byte(`{"allowWrite": ["/cache"]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := f.loadConfig()
+	if err != nil || !slices.Equal(cfg.AllowWrite, []string{"/cache"}) {
+		t.Errorf("loadConfig() = %v, %v, want AllowWrite [/cache]", cfg.AllowWrite, err)
+	}
+}
+
+func TestRunFlags_ConfigAddFlags(t *testing.T) {
+	f := runFlags{noConfig: true, writeAdd: stringSlice{"/cache"}, denyAdd: stringSlice{"~/.ssh", "~/.netrc"}}
+	cfg := f.config()
+	defaults := sandbox.DefaultConfigWithPath("")
+
+	if want := append(defaults.AllowWrite, "/cache"); !slices.Equal(cfg.AllowWrite, want) {
+		t.Errorf("AllowWrite = %v, want %v", cfg.AllowWrite, want)
+	}
+	// ~/.ssh is a default already, so it isn't repeated
+	if want := append(defaults.DenyRead, "~/.netrc"); !slices.Equal(cfg.DenyRead, want) {
+		t.Errorf("DenyRead = %v, want %v", cfg.DenyRead, want)
+	}
+
+	// Replacing flags apply first
+	f.allowWrite = stringSlice{"/work"}
+	if cfg := f.config(); !slices.Equal(cfg.AllowWrite, []string{"/work", "/cache"}) {
+		t.Errorf("AllowWrite = %v, want [/work /cache]", cfg.AllowWrite)
+	}
+}
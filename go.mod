@@ -1,3 +1,5 @@
 module github.com/niwoerner/go-agentsandbox
 
 go 1.24.5
+
+require gopkg.in/yaml.v3 v3.0.1
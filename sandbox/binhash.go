@@ -0,0 +1,128 @@
+package sandbox
+
+import (
+	"cmp"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// ErrBinaryHashMismatch is returned when AllowedBinaryHashes is set and the
+// binary a command would execute isn't listed or has a different SHA-256.
+var ErrBinaryHashMismatch = errors.New("binary hash mismatch")
+
+// checkBinaryHashes rejects AllowedBinaryHashes values that aren't
+// hex-encoded SHA-256 digests, and lowercases them.
+func checkBinaryHashes(hashes map[string]string) (map[string]string, error) {
+	if len(hashes) == 0 {
+		return nil, nil
+	}
+	checked := make(map[string]string, len(hashes))
+	for key, sum := range hashes {
+		sum = strings.ToLower(strings.TrimSpace(sum))
+		if b, err := hex.DecodeString(sum); err != nil || len(b) != sha256.Size {
+			return nil, fmt.Errorf("invalid AllowedBinaryHashes entry %q: want a hex SHA-256, got %q", key, hashes[key])
+		}
+		checked[key] = sum
+	}
+	return checked, nil
+}
+
+// checkBinary returns ErrBinaryHashMismatch unless the binary name resolves
+// to matches its AllowedBinaryHashes entry. The entry is looked up by the
+// resolved path with symlinks followed, the path found on PATH, name as
+// given and its base name, in that order. Without AllowedBinaryHashes any
+// binary may run.
+func checkBinary(cfg Config, name string) error {
+	if len(cfg.AllowedBinaryHashes) == 0 {
+		return nil
+	}
+	path, err := findBinary(cfg, name)
+	if err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrBinaryHashMismatch, name, err)
+	}
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrBinaryHashMismatch, name, err)
+	}
+
+	var want string
+	for _, key := range []string{resolved, path, name, filepath.Base(path)} {
+		if sum, ok := cfg.AllowedBinaryHashes[key]; ok {
+			want = sum
+			break
+		}
+	}
+	if want == "" {
+		return fmt.Errorf("%w: %s (%s) is not in AllowedBinaryHashes", ErrBinaryHashMismatch, name, resolved)
+	}
+
+	got, err := hashFile(resolved)
+	if err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrBinaryHashMismatch, name, err)
+	}
+	if got != want {
+		return fmt.Errorf("%w: %s has SHA-256 %s, want %s", ErrBinaryHashMismatch, resolved, got, want)
+	}
+	return nil
+}
+
+// findBinary resolves name as the sandbox would: a name with a path
+// separator relative to Workdir, any other along the PATH the command
+// gets.
+func findBinary(cfg Config, name string) (string, error) {
+	if strings.ContainsRune(name, '/') || strings.ContainsRune(name, filepath.Separator) {
+		if !filepath.IsAbs(name) {
+			name = filepath.Join(cfg.Workdir, name)
+		}
+		if !isExecutable(name) {
+			return "", fmt.Errorf("not an executable file")
+		}
+		return name, nil
+	}
+
+	exts := []string{""}
+	if runtime.GOOS == "windows" && filepath.Ext(name) == "" {
+		exts = strings.Split(strings.ToLower(cmp.Or(os.Getenv("PATHEXT"), ".com;.exe;.bat;.cmd")), ";")
+	}
+	// Windows spells it Path, which setEnv doesn't match
+	path := cmp.Or(lookupEnv(buildEnv(cfg), "PATH"), os.Getenv("PATH"))
+	for _, dir := range filepath.SplitList(path) {
+		for _, ext := range exts {
+			if path := filepath.Join(dir, name+ext); isExecutable(path) {
+				return path, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("not found in PATH")
+}
+
+// isExecutable reports whether path is a regular file that can be
+// executed. Windows has no execute bit.
+func isExecutable(path string) bool {
+	info, err := os.Stat(path)
+	if err != nil || !info.Mode().IsRegular() {
+		return false
+	}
+	return runtime.GOOS == "windows" || info.Mode().Perm()&0111 != 0
+}
+
+// hashFile returns the hex SHA-256 of the file at path.
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
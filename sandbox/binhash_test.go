@@ -0,0 +1,72 @@
+package sandbox
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeTool creates an executable in dir and returns its path and SHA-256.
+func writeTool(t *testing.T, dir, name, content string) (string, string) {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, []byte(content), 0755); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte(content))
+	return path, hex.EncodeToString(sum[:])
+}
+
+func TestCheckBinary_Match(t *testing.T) {
+	bin := t.TempDir()
+	path, sum := writeTool(t, bin, "tool", "#!/bin/sh\necho ok\n")
+
+	for _, key := range []string{"tool", path} {
+		cfg := Config{Workdir: t.TempDir(), PathOverride: bin, AllowedBinaryHashes: map[string]string{key: sum}}
+		if err := checkBinary(cfg, "tool"); err != nil {
+			t.Errorf("keyed by %q: checkBinary() error: %v", key, err)
+		}
+	}
+
+	// Relative paths resolve against the workdir
+	cfg := Config{Workdir: bin, AllowedBinaryHashes: map[string]string{"tool": strings.ToUpper(sum)}}
+	cfg.AllowedBinaryHashes, _ = checkBinaryHashes(cfg.AllowedBinaryHashes)
+	if err := checkArgv(cfg, []string{"./tool", "arg"}); err != nil {
+		t.Errorf("checkArgv() error: %v", err)
+	}
+
+	// Without pins anything runs, even what doesn't exist
+	if err := checkBinary(Config{}, "no-such-tool"); err != nil {
+		t.Errorf("checkBinary() without AllowedBinaryHashes = %v, want nil", err)
+	}
+}
+
+func TestCheckBinary_Mismatch(t *testing.T) {
+	bin := t.TempDir()
+	_, sum := writeTool(t, bin, "tool", "#!/bin/sh\necho ok\n")
+	writeTool(t, bin, "other", "#!/bin/sh\necho other\n")
+	cfg := Config{Workdir: t.TempDir(), PathOverride: bin, AllowedBinaryHashes: map[string]string{"tool": sum}}
+
+	// The file changed after it was pinned
+	writeTool(t, bin, "tool", "#!/bin/sh\necho tampered\n")
+	err := checkArgv(cfg, []string{"tool"})
+	if !errors.Is(err, ErrBinaryHashMismatch) || !strings.Contains(err.Error(), "want "+sum) {
+		t.Errorf("tampered binary: error = %v, want ErrBinaryHashMismatch", err)
+	}
+
+	for _, name := range []string{"other", "missing"} {
+		if err := checkBinary(cfg, name); !errors.Is(err, ErrBinaryHashMismatch) {
+			t.Errorf("%s: error = %v, want ErrBinaryHashMismatch", name, err)
+		}
+	}
+}
+
+func TestCheckBinaryHashes(t *testing.T) {
+	if _, err := resolveConfig(Config{Workdir: t.TempDir(), AllowedBinaryHashes: map[string]string{"git": "abc123"}}); err == nil || !strings.Contains(err.Error(), "AllowedBinaryHashes") {
+		t.Errorf("error = %v, want an invalid AllowedBinaryHashes entry", err)
+	}
+}
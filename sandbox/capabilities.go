@@ -0,0 +1,122 @@
+package sandbox
+
+import (
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// Capabilities reports the isolation primitives available on the host.
+type Capabilities struct {
+	UserNamespaces bool   // Unprivileged user namespaces are enabled
+	CgroupV2       bool   // The unified cgroup v2 hierarchy is mounted
+	Landlock       int    // Landlock ABI version, 0 if unavailable
+	Seccomp        bool   // The kernel supports seccomp filters
+	BwrapVersion   string // bubblewrap version, empty if not installed
+	SandboxExec    bool   // sandbox-exec is available (macOS)
+}
+
+// DetectCapabilities probes the host for isolation primitives. Probes that
+// fail report the capability as unavailable.
+func DetectCapabilities() Capabilities {
+	caps := Capabilities{
+		UserNamespaces: parseUserNamespaces(
+			readProbe("/proc/sys/user/max_user_namespaces"),
+			readProbe("/proc/sys/kernel/unprivileged_userns_clone"),
+			readProbe("/proc/sys/kernel/apparmor_restrict_unprivileged_userns"),
+		),
+		CgroupV2: parseCgroupV2(readProbe("/proc/self/mounts")),
+		Landlock: landlockABI(),
+		Seccomp:  parseSeccomp(readProbe("/proc/self/status")),
+	}
+
+	if bin, err := exec.LookPath("bwrap"); err == nil {
+		out, _ := exec.Command(bin, "--version").Output()
+		caps.BwrapVersion = parseBwrapVersion(string(out))
+	}
+
+	if _, err := exec.LookPath("sandbox-exec"); err == nil {
+		caps.SandboxExec = true
+	}
+
+	return caps
+}
+
+// readProbe returns the contents of a /proc or /sys file, or "" if unreadable.
+func readProbe(path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+// parseUserNamespaces reports whether unprivileged user namespaces can be
+// created, given the contents of user.max_user_namespaces and the optional
+// Debian and Ubuntu AppArmor sysctls ("" if absent).
+func parseUserNamespaces(maxUserNamespaces, unprivilegedClone, apparmorRestrict string) bool {
+	n, err := strconv.Atoi(strings.TrimSpace(maxUserNamespaces))
+	if err != nil || n <= 0 {
+		return false
+	}
+	if strings.TrimSpace(unprivilegedClone) == "0" {
+		return false
+	}
+	return strings.TrimSpace(apparmorRestrict) != "1"
+}
+
+// parseCgroupV2 reports whether a cgroup2 filesystem appears in a mounts table.
+func parseCgroupV2(mounts string) bool {
+	for line := range strings.Lines(mounts) {
+		fields := strings.Fields(line)
+		if len(fields) >= 3 && fields[2] == "cgroup2" {
+			return true
+		}
+	}
+	return false
+}
+
+// parseSeccomp reports whether /proc/self/status has a Seccomp field, which
+// the kernel only prints when built with seccomp support.
+func parseSeccomp(status string) bool {
+	for line := range strings.Lines(status) {
+		if strings.HasPrefix(line, "Seccomp:") {
+			return true
+		}
+	}
+	return false
+}
+
+// parseBwrapVersion extracts the version from `bwrap --version` output,
+// e.g. "bubblewrap 0.9.0".
+func parseBwrapVersion(out string) string {
+	fields := strings.Fields(out)
+	if len(fields) < 2 || fields[0] != "bubblewrap" {
+		return ""
+	}
+	return fields[1]
+}
+
+// bwrapAtLeast reports whether a bwrap version, e.g. "0.9.0", is min or
+// newer. An unknown version is assumed to be recent.
+func bwrapAtLeast(version, min string) bool {
+	if version == "" {
+		return true
+	}
+	have, want := strings.Split(version, "."), strings.Split(min, ".")
+	for i, w := range want {
+		wantN, _ := strconv.Atoi(w)
+		haveN := 0
+		if i < len(have) {
+			var err error
+			if haveN, err = strconv.Atoi(have[i]); err != nil {
+				return true
+			}
+		}
+		if haveN != wantN {
+			return haveN > wantN
+		}
+	}
+	return true
+}
@@ -0,0 +1,92 @@
+package sandbox
+
+import "testing"
+
+func TestParseUserNamespaces(t *testing.T) {
+	tests := []struct {
+		name                 string
+		max, clone, apparmor string
+		want                 bool
+	}{
+		{"enabled", "63651\n", "", "", true},
+		{"debian sysctl on", "63651\n", "1\n", "", true},
+		{"debian sysctl off", "63651\n", "0\n", "", false},
+		{"apparmor restricted", "63651\n", "", "1\n", false},
+		{"apparmor unrestricted", "63651\n", "", "0\n", true},
+		{"max zero", "0\n", "", "", false},
+		{"no user namespaces", "", "", "", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseUserNamespaces(tt.max, tt.clone, tt.apparmor); got != tt.want {
+				t.Errorf("parseUserNamespaces(%q, %q, %q) = %v, want %v", tt.max, tt.clone, tt.apparmor, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseCgroupV2(t *testing.T) {
+	v2 := "proc /proc proc rw,nosuid 0 0\ncgroup2 /sys/fs/cgroup cgroup2 rw,nosuid,nodev,noexec 0 0\n"
+	v1 := "proc /proc proc rw 0 0\ncgroup /sys/fs/cgroup/memory cgroup rw,memory 0 0\n"
+
+	if !parseCgroupV2(v2) {
+		t.Error("cgroup2 mount should be detected")
+	}
+	if parseCgroupV2(v1) {
+		t.Error("cgroup v1 mounts should not be detected as v2")
+	}
+	if parseCgroupV2("") {
+		t.Error("empty mounts should not be detected as v2")
+	}
+}
+
+func TestParseSeccomp(t *testing.T) {
+	status := "Name:\tcat\nNoNewPrivs:\t0\nSeccomp:\t0\nSeccomp_filters:\t0\n"
+
+	if !parseSeccomp(status) {
+		t.Error("Seccomp field should be detected")
+	}
+	if parseSeccomp("Name:\tcat\nNoNewPrivs:\t0\n") {
+		t.Error("status without Seccomp field should not be detected")
+	}
+}
+
+func TestParseBwrapVersion(t *testing.T) {
+	tests := []struct {
+		out  string
+		want string
+	}{
+		{"bubblewrap 0.9.0\n", "0.9.0"},
+		{"bubblewrap 0.4.0", "0.4.0"},
+		{"", ""},
+		{"bwrap: Unknown option --version\n", ""},
+	}
+
+	for _, tt := range tests {
+		if got := parseBwrapVersion(tt.out); got != tt.want {
+			t.Errorf("parseBwrapVersion(%q) = %q, want %q", tt.out, got, tt.want)
+		}
+	}
+}
+
+func TestBwrapAtLeast(t *testing.T) {
+	tests := []struct {
+		version string
+		want    bool
+	}{
+		{"0.6.0", true},
+		{"0.9.0", true},
+		{"0.10.1", true},
+		{"1.0", true},
+		{"0.5.9", false},
+		{"0.4.0", false},
+		{"", true},
+	}
+
+	for _, tt := range tests {
+		if got := bwrapAtLeast(tt.version, "0.6.0"); got != tt.want {
+			t.Errorf("bwrapAtLeast(%q, 0.6.0) = %v, want %v", tt.version, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,39 @@
+package sandbox
+
+import (
+	"context"
+	"fmt"
+)
+
+// CompareConfigs runs command in a sandbox for each of a and b, one after
+// the other, and returns both results for diffing, e.g. to confirm a strict
+// policy blocks what a loose one allows. A command failing is part of its
+// Result; the error reports a sandbox that couldn't be created or run.
+func CompareConfigs(ctx context.Context, command string, a, b Config) (Result, Result, error) {
+	resA, err := runWithConfig(ctx, command, a)
+	if err != nil {
+		return Result{}, Result{}, fmt.Errorf("config a: %w", err)
+	}
+	resB, err := runWithConfig(ctx, command, b)
+	if err != nil {
+		return resA, Result{}, fmt.Errorf("config b: %w", err)
+	}
+	return resA, resB, nil
+}
+
+// runWithConfig runs command in a new sandbox for cfg. Errors that come
+// with a non-zero exit code are the command's and stay in the Result.
+func runWithConfig(ctx context.Context, command string, cfg Config) (Result, error) {
+	sb, err := New(cfg)
+	if err != nil {
+		return Result{}, err
+	}
+	res, err := sb.RunResult(ctx, command)
+	if res == nil {
+		return Result{}, err
+	}
+	if err != nil && (res.ExitCode == 0 || ctx.Err() != nil) {
+		return *res, err
+	}
+	return *res, nil
+}
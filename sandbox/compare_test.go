@@ -0,0 +1,17 @@
+package sandbox
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestCompareConfigs_InvalidConfig(t *testing.T) {
+	valid := Config{Workdir: t.TempDir(), DryRun: true}
+	invalid := Config{Workdir: t.TempDir(), TmpfsSize: "lots"}
+
+	_, _, err := CompareConfigs(context.Background(), "true", invalid, valid)
+	if err == nil || !strings.HasPrefix(err.Error(), "config a: ") {
+		t.Errorf("expected error for config a, got %v", err)
+	}
+}
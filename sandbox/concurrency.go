@@ -0,0 +1,45 @@
+package sandbox
+
+import (
+	"context"
+	"sync"
+)
+
+var (
+	slotsMu sync.Mutex
+	slots   chan struct{} // nil means unlimited
+)
+
+// SetMaxConcurrent limits how many sandboxed commands may run at once
+// across all sandboxes in this process. Runs beyond the limit block until
+// a slot frees up or their context is done. n <= 0 removes the limit.
+// Runs already waiting or in flight keep the limit they started with.
+func SetMaxConcurrent(n int) {
+	slotsMu.Lock()
+	defer slotsMu.Unlock()
+
+	if n <= 0 {
+		slots = nil
+		return
+	}
+	slots = make(chan struct{}, n)
+}
+
+// acquireSlot blocks until a concurrency slot is free and returns a func
+// that releases it.
+func acquireSlot(ctx context.Context) (release func(), err error) {
+	slotsMu.Lock()
+	sem := slots
+	slotsMu.Unlock()
+
+	if sem == nil {
+		return func() {}, nil
+	}
+
+	select {
+	case sem <- struct{}{}:
+		return func() { <-sem }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
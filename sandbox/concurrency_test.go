@@ -0,0 +1,72 @@
+package sandbox
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestAcquireSlot_Unlimited(t *testing.T) {
+	SetMaxConcurrent(0)
+
+	for i := 0; i < 100; i++ {
+		if _, err := acquireSlot(context.Background()); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+}
+
+func TestAcquireSlot_BlocksAtLimit(t *testing.T) {
+	SetMaxConcurrent(2)
+	defer SetMaxConcurrent(0)
+
+	release1, err := acquireSlot(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	release2, err := acquireSlot(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer release2()
+
+	acquired := make(chan func())
+	go func() {
+		release, _ := acquireSlot(context.Background())
+		acquired <- release
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatal("third acquire should block while two slots are held")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	release1()
+
+	select {
+	case release := <-acquired:
+		release()
+	case <-time.After(5 * time.Second):
+		t.Fatal("third acquire should proceed after a release")
+	}
+}
+
+func TestAcquireSlot_ContextCancelled(t *testing.T) {
+	SetMaxConcurrent(1)
+	defer SetMaxConcurrent(0)
+
+	release, err := acquireSlot(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	if _, err := acquireSlot(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("error = %v, want context.DeadlineExceeded", err)
+	}
+}
@@ -1,30 +1,149 @@
 package sandbox
 
 import (
+	"bufio"
 	"encoding/json"
+	"fmt"
+	"maps"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
 )
 
 // FileConfig represents the JSON config file structure.
 type FileConfig struct {
 	AllowWrite   []string `json:"allowWrite,omitempty"`
+	WriteExclude []string `json:"writeExclude,omitempty"`
 	DenyRead     []string `json:"denyRead,omitempty"`
+	AllowRead    []string `json:"allowRead,omitempty"`
+	ReadOnly     []string `json:"readOnly,omitempty"`
 	CleanEnv     *bool    `json:"cleanEnv,omitempty"`
+	Network      *bool    `json:"network,omitempty"`
 	EnvAllowlist []string `json:"envAllowlist,omitempty"`
 	EnvDenylist  []string `json:"envDenylist,omitempty"`
+
+	// AllowWriteAdd and DenyReadAdd are added to the lists of the layers
+	// below (after any allowWrite or denyRead of this file) instead of
+	// replacing them.
+	AllowWriteAdd []string `json:"allowWriteAdd,omitempty"`
+	DenyReadAdd   []string `json:"denyReadAdd,omitempty"`
+
+	Env map[string]string `json:"env,omitempty"`
+
+	AllowWriteFile string `json:"allowWriteFile,omitempty"`
+	DenyReadFile   string `json:"denyReadFile,omitempty"`
+	ProtectSelf    *bool  `json:"protectSelf,omitempty"`
+	TmpfsSize      string `json:"tmpfsSize,omitempty"`
+	BaseDir        string `json:"baseDir,omitempty"`
+	ShareSSHAgent  *bool  `json:"shareSSHAgent,omitempty"`
+	ShellPrelude   string `json:"shellPrelude,omitempty"`
+	EnableGPU      *bool  `json:"enableGPU,omitempty"`
+	PIDNamespace   *bool  `json:"pidNamespace,omitempty"`
+	UnshareIPC     *bool  `json:"unshareIPC,omitempty"`
+	UnshareUTS     *bool  `json:"unshareUTS,omitempty"`
+	Hostname       string `json:"hostname,omitempty"`
+	ForceCLocale   *bool  `json:"forceCLocale,omitempty"`
+	SeccompProfile string `json:"seccompProfile,omitempty"`
+
+	ProtectHomeDotfiles *bool    `json:"protectHomeDotfiles,omitempty"`
+	StrictWorkdir       *bool    `json:"strictWorkdir,omitempty"`
+	AllowHomeDenyRead   *bool    `json:"allowHomeDenyRead,omitempty"`
+	StrictRoot          *bool    `json:"strictRoot,omitempty"`
+	DropRoot            *bool    `json:"dropRoot,omitempty"`
+	Capabilities        []string `json:"capabilities,omitempty"`
+	BackendOrder        []string `json:"backendOrder,omitempty"`
+	NetworkAllow        []string `json:"networkAllow,omitempty"`
+
+	DenyReadImpliesNoWrite *bool   `json:"denyReadImpliesNoWrite,omitempty"`
+	TimeoutSeconds         float64 `json:"timeoutSeconds,omitempty"`
+
+	SecretsFile   string   `json:"secretsFile,omitempty"`
+	InjectSecrets []string `json:"injectSecrets,omitempty"`
+
+	Limits *FileLimits `json:"limits,omitempty"`
+}
+
+// FileLimits is the "limits" object of a config file, the resource limits
+// applied to each process of a command (Linux only).
+type FileLimits struct {
+	Memory string  `json:"memory,omitempty"` // Address space, e.g. "512m" (MemoryLimitBytes)
+	CPU    float64 `json:"cpu,omitempty"`    // CPU seconds (CPUTimeLimit)
+	NoFile int     `json:"nofile,omitempty"` // Open files (OpenFilesLimit)
+	FSize  string  `json:"fsize,omitempty"`  // Largest file written, e.g. "1g" (FileSizeLimitBytes)
+	NProc  int     `json:"nproc,omitempty"`  // Processes of the user (ProcessLimit)
 }
 
-// DefaultConfigPath returns the default config file location.
+// validate checks the sizes, so MergeConfig can parse them without errors.
+func (l *FileLimits) validate() error {
+	if l == nil {
+		return nil
+	}
+	if _, err := parseSize(l.Memory); err != nil {
+		return fmt.Errorf("memory: %w", err)
+	}
+	if _, err := parseSize(l.FSize); err != nil {
+		return fmt.Errorf("fsize: %w", err)
+	}
+	if l.CPU < 0 || l.NoFile < 0 || l.NProc < 0 {
+		return fmt.Errorf("cpu, nofile and nproc can't be negative")
+	}
+	return nil
+}
+
+// SystemConfigPath is the system-wide config file, the lowest layer of a
+// LoadConfigCascade.
+const SystemConfigPath = "/etc/agentsandbox/config.json"
+
+// ProjectConfigName is the name of a project-local config file, looked up
+// by FindProjectConfig.
+const ProjectConfigName = ".agentsandbox.json"
+
+// FindProjectConfig returns the ProjectConfigName file in dir or the
+// nearest of its parents, or "" if there is none.
+func FindProjectConfig(dir string) string {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return ""
+	}
+	for {
+		path := filepath.Join(dir, ProjectConfigName)
+		if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() {
+			return path
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// defaultConfigFiles are the names of the default config file in
+// ~/.agent/sandbox, in order of preference.
+var defaultConfigFiles = []string{"config.json", "config.yaml", "config.yml"}
+
+// DefaultConfigPath returns the default config file location: the first
+// of config.json, config.yaml and config.yml that exists, or config.json.
 func DefaultConfigPath() string {
 	home, err := os.UserHomeDir()
 	if err != nil {
 		return ""
 	}
-	return filepath.Join(home, ".agent", "sandbox", "config.json")
+	dir := filepath.Join(home, ".agent", "sandbox")
+	for _, name := range defaultConfigFiles {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			return filepath.Join(dir, name)
+		}
+	}
+	return filepath.Join(dir, defaultConfigFiles[0])
 }
 
-// LoadConfigFile loads and parses a config file.
+// LoadConfigFile loads and parses a config file, as YAML if its extension
+// is .yaml or .yml and as JSON otherwise.
 // Returns nil if file doesn't exist (not an error).
 func LoadConfigFile(path string) (*FileConfig, error) {
 	data, err := os.ReadFile(path)
@@ -36,13 +155,52 @@ func LoadConfigFile(path string) (*FileConfig, error) {
 	}
 
 	var cfg FileConfig
-	if err := json.Unmarshal(data, &cfg); err != nil {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		err = unmarshalYAML(data, &cfg)
+	default:
+		err = json.Unmarshal(data, &cfg)
+	}
+	if err != nil {
 		return nil, err
 	}
+	if err := cfg.Limits.validate(); err != nil {
+		return nil, fmt.Errorf("invalid limits: %w", err)
+	}
 
 	return &cfg, nil
 }
 
+// unmarshalYAML decodes YAML into v by way of JSON, so the json tags of
+// FileConfig name the keys in both formats and omitted keys leave
+// pointer fields nil.
+func unmarshalYAML(data []byte, v any) error {
+	var doc any
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return err
+	}
+	if doc == nil {
+		return nil // Empty file
+	}
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return fmt.Errorf("yaml: %w", err)
+	}
+	return json.Unmarshal(data, v)
+}
+
+// unionPaths returns base followed by the paths of add, each once, in the
+// order they first appear.
+func unionPaths(base, add []string) []string {
+	var merged []string
+	for _, p := range slices.Concat(base, add) {
+		if !slices.Contains(merged, p) {
+			merged = append(merged, p)
+		}
+	}
+	return merged
+}
+
 // MergeConfig merges file config into base config.
 // File config overrides base config; empty/omitted fields use base defaults.
 func MergeConfig(base Config, file *FileConfig) Config {
@@ -55,16 +213,44 @@ func MergeConfig(base Config, file *FileConfig) Config {
 		base.AllowWrite = file.AllowWrite
 	}
 
+	// WriteExclude: non-empty overrides defaults
+	if len(file.WriteExclude) > 0 {
+		base.WriteExclude = file.WriteExclude
+	}
+
 	// DenyRead: non-empty overrides defaults
 	if len(file.DenyRead) > 0 {
 		base.DenyRead = file.DenyRead
 	}
 
+	// AllowRead: non-empty overrides defaults
+	if len(file.AllowRead) > 0 {
+		base.AllowRead = file.AllowRead
+	}
+
+	// AllowWriteAdd, DenyReadAdd: added after the lists replaced above
+	if len(file.AllowWriteAdd) > 0 {
+		base.AllowWrite = unionPaths(base.AllowWrite, file.AllowWriteAdd)
+	}
+	if len(file.DenyReadAdd) > 0 {
+		base.DenyRead = unionPaths(base.DenyRead, file.DenyReadAdd)
+	}
+
 	// CleanEnv: explicit value overrides default
 	if file.CleanEnv != nil {
 		base.CleanEnv = *file.CleanEnv
 	}
 
+	// Network: explicit value overrides default
+	if file.Network != nil {
+		base.NoNetwork = !*file.Network
+	}
+
+	// NetworkAllow: non-empty overrides defaults
+	if len(file.NetworkAllow) > 0 {
+		base.NetworkAllow = file.NetworkAllow
+	}
+
 	// EnvAllowlist: non-empty overrides defaults
 	if len(file.EnvAllowlist) > 0 {
 		base.EnvAllowlist = file.EnvAllowlist
@@ -75,9 +261,221 @@ func MergeConfig(base Config, file *FileConfig) Config {
 		base.EnvDenylist = file.EnvDenylist
 	}
 
+	// Env: merged per key, file values override base values
+	if len(file.Env) > 0 {
+		env := maps.Clone(base.SetEnv)
+		if env == nil {
+			env = map[string]string{}
+		}
+		maps.Copy(env, file.Env)
+		base.SetEnv = env
+	}
+
+	// Path list files: non-empty overrides defaults
+	if file.AllowWriteFile != "" {
+		base.AllowWriteFile = file.AllowWriteFile
+	}
+	if file.DenyReadFile != "" {
+		base.DenyReadFile = file.DenyReadFile
+	}
+
+	// TmpfsSize: non-empty overrides defaults
+	if file.TmpfsSize != "" {
+		base.TmpfsSize = file.TmpfsSize
+	}
+
+	// BaseDir: non-empty overrides defaults
+	if file.BaseDir != "" {
+		base.BaseDir = file.BaseDir
+	}
+
+	// ProtectSelf: explicit value overrides default
+	if file.ProtectSelf != nil {
+		base.ProtectSelf = *file.ProtectSelf
+	}
+
+	// StrictWorkdir: explicit value overrides default
+	if file.StrictWorkdir != nil {
+		base.StrictWorkdir = *file.StrictWorkdir
+	}
+
+	// AllowHomeDenyRead: explicit value overrides default
+	if file.AllowHomeDenyRead != nil {
+		base.AllowHomeDenyRead = *file.AllowHomeDenyRead
+	}
+
+	// StrictRoot: explicit value overrides default
+	if file.StrictRoot != nil {
+		base.StrictRoot = *file.StrictRoot
+	}
+
+	// DropRoot: explicit value overrides default
+	if file.DropRoot != nil {
+		base.DropRoot = *file.DropRoot
+	}
+
+	// ReadOnly: non-empty overrides defaults
+	if len(file.ReadOnly) > 0 {
+		base.ReadOnly = file.ReadOnly
+	}
+
+	// Capabilities: non-empty overrides defaults
+	if len(file.Capabilities) > 0 {
+		base.Capabilities = file.Capabilities
+	}
+
+	// ProtectHomeDotfiles: explicit value overrides default
+	if file.ProtectHomeDotfiles != nil {
+		base.ProtectHomeDotfiles = *file.ProtectHomeDotfiles
+	}
+
+	// DenyReadImpliesNoWrite: explicit value overrides default
+	if file.DenyReadImpliesNoWrite != nil {
+		base.DenyReadImpliesNoWrite = *file.DenyReadImpliesNoWrite
+	}
+
+	// TimeoutSeconds: positive value overrides default
+	if file.TimeoutSeconds > 0 {
+		base.Timeout = time.Duration(file.TimeoutSeconds * float64(time.Second))
+	}
+
+	// ShellPrelude: non-empty overrides defaults
+	if file.ShellPrelude != "" {
+		base.ShellPrelude = file.ShellPrelude
+	}
+
+	// Secrets: non-empty overrides defaults
+	if file.SecretsFile != "" {
+		base.SecretsFile = file.SecretsFile
+	}
+	if len(file.InjectSecrets) > 0 {
+		base.InjectSecrets = file.InjectSecrets
+	}
+
+	// BackendOrder: non-empty overrides defaults
+	if len(file.BackendOrder) > 0 {
+		base.BackendOrder = file.BackendOrder
+	}
+
+	// EnableGPU: explicit value overrides default
+	if file.EnableGPU != nil {
+		base.EnableGPU = *file.EnableGPU
+	}
+
+	// PIDNamespace: explicit value overrides default
+	if file.PIDNamespace != nil {
+		base.PIDNamespace = *file.PIDNamespace
+	}
+
+	// UnshareIPC, UnshareUTS: explicit value overrides default
+	if file.UnshareIPC != nil {
+		base.UnshareIPC = *file.UnshareIPC
+	}
+	if file.UnshareUTS != nil {
+		base.UnshareUTS = *file.UnshareUTS
+	}
+
+	// Hostname: non-empty overrides default
+	if file.Hostname != "" {
+		base.Hostname = file.Hostname
+	}
+
+	// SeccompProfile: non-empty overrides default
+	if file.SeccompProfile != "" {
+		base.SeccompProfile = file.SeccompProfile
+	}
+
+	// ForceCLocale: explicit value overrides default
+	if file.ForceCLocale != nil {
+		base.ForceCLocale = *file.ForceCLocale
+	}
+
+	// ShareSSHAgent: explicit value overrides default
+	if file.ShareSSHAgent != nil {
+		base.ShareSSHAgent = *file.ShareSSHAgent
+	}
+
+	// Limits: each positive value overrides default
+	if l := file.Limits; l != nil {
+		if n, _ := parseSize(l.Memory); n > 0 {
+			base.MemoryLimitBytes = n
+		}
+		if l.CPU > 0 {
+			base.CPUTimeLimit = time.Duration(l.CPU * float64(time.Second))
+		}
+		if l.NoFile > 0 {
+			base.OpenFilesLimit = l.NoFile
+		}
+		if n, _ := parseSize(l.FSize); n > 0 {
+			base.FileSizeLimitBytes = n
+		}
+		if l.NProc > 0 {
+			base.ProcessLimit = l.NProc
+		}
+	}
+
 	return base
 }
 
+// LoadSecrets loads a KEY=VALUE secrets file. Blank lines and lines
+// starting with # are ignored. The file must not be accessible by group or
+// others (mode 0600 or stricter).
+func LoadSecrets(path string) (map[string]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if mode := info.Mode().Perm(); mode&0077 != 0 {
+		return nil, fmt.Errorf("%s has mode %#o, must be 0600: run 'chmod 600 %s'", path, mode, path)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	secrets := make(map[string]string)
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok || strings.TrimSpace(key) == "" {
+			// Don't echo the line, it may hold a secret
+			return nil, fmt.Errorf("%s:%d: expected KEY=VALUE", path, i+1)
+		}
+		secrets[strings.TrimSpace(key)] = value
+	}
+
+	return secrets, nil
+}
+
+// LoadPathList loads a newline-delimited path list file.
+// Blank lines and lines starting with # are ignored, like .gitignore.
+func LoadPathList(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var paths []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		paths = append(paths, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return paths, nil
+}
+
 // IsWildcard checks if a path is the wildcard "*".
 func IsWildcard(path string) bool {
 	return path == "*"
@@ -1,9 +1,13 @@
 package sandbox
 
 import (
+	"maps"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestDefaultConfigPath(t *testing.T) {
@@ -19,6 +23,36 @@ func TestDefaultConfigPath(t *testing.T) {
 	}
 }
 
+func TestDefaultConfigPath_YAML(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	dir := filepath.Join(home, ".agent", "sandbox")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := DefaultConfigPath(), filepath.Join(dir, "config.json"); got != want {
+		t.Errorf("without a config file got %q, want %q", got, want)
+	}
+
+	yamlPath := filepath.Join(dir, "config.yaml")
+	if err := os.WriteFile(yamlPath, []byte("cleanEnv: true\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := DefaultConfigPath(); got != yamlPath {
+		t.Errorf("with only config.yaml got %q, want %q", got, yamlPath)
+	}
+
+	// JSON is preferred when both exist
+	jsonPath := filepath.Join(dir, "config.json")
+	if err := os.WriteFile(jsonPath, []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := DefaultConfigPath(); got != jsonPath {
+		t.Errorf("with both files got %q, want %q", got, jsonPath)
+	}
+}
+
 func TestLoadConfigFile_NotExist(t *testing.T) {
 	cfg, err := LoadConfigFile("/nonexistent/path/config.json")
 	if err != nil {
@@ -66,6 +100,76 @@ func TestLoadConfigFile_Valid(t *testing.T) {
 	}
 }
 
+func TestLoadConfigFile_YAML(t *testing.T) {
+	tmpDir := t.TempDir()
+	content := `# Team defaults
+allowWrite:
+  - /custom/write
+denyRead: ["~/.custom"]
+cleanEnv: false
+timeoutSeconds: 1.5
+env:
+  NODE_ENV: production
+`
+	for _, name := range []string{"config.yaml", "config.yml"} {
+		configPath := filepath.Join(tmpDir, name)
+		if err := os.WriteFile(configPath, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		cfg, err := LoadConfigFile(configPath)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", name, err)
+		}
+		if len(cfg.AllowWrite) != 1 || cfg.AllowWrite[0] != "/custom/write" {
+			t.Errorf("%s: AllowWrite = %v, want [/custom/write]", name, cfg.AllowWrite)
+		}
+		if len(cfg.DenyRead) != 1 || cfg.DenyRead[0] != "~/.custom" {
+			t.Errorf("%s: DenyRead = %v, want [~/.custom]", name, cfg.DenyRead)
+		}
+		// An explicit false is kept apart from an omitted key
+		if cfg.CleanEnv == nil || *cfg.CleanEnv {
+			t.Errorf("%s: CleanEnv should be explicitly false", name)
+		}
+		if cfg.Network != nil {
+			t.Errorf("%s: omitted Network should stay nil", name)
+		}
+		if cfg.TimeoutSeconds != 1.5 || cfg.Env["NODE_ENV"] != "production" {
+			t.Errorf("%s: TimeoutSeconds = %v, Env = %v", name, cfg.TimeoutSeconds, cfg.Env)
+		}
+	}
+
+	merged := MergeConfig(Config{CleanEnv: true}, mustLoadConfig(t, filepath.Join(tmpDir, "config.yaml")))
+	if merged.CleanEnv {
+		t.Error("CleanEnv: false in YAML should override the default")
+	}
+
+	empty := filepath.Join(tmpDir, "empty.yaml")
+	if err := os.WriteFile(empty, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if cfg, err := LoadConfigFile(empty); err != nil || cfg == nil || cfg.CleanEnv != nil {
+		t.Errorf("an empty YAML file should load as an empty config, got %+v: %v", cfg, err)
+	}
+
+	invalid := filepath.Join(tmpDir, "invalid.yaml")
+	if err := os.WriteFile(invalid, []byte("allowWrite: [unclosed\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadConfigFile(invalid); err == nil {
+		t.Error("invalid YAML should fail")
+	}
+}
+
+func mustLoadConfig(t *testing.T, path string) *FileConfig {
+	t.Helper()
+	cfg, err := LoadConfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
 func TestLoadConfigFile_Invalid(t *testing.T) {
 	tmpDir := t.TempDir()
 	configPath := filepath.Join(tmpDir, "config.json")
@@ -129,9 +233,15 @@ func TestMergeConfig_OverridesValues(t *testing.T) {
 
 	cleanEnv := true
 	file := &FileConfig{
-		AllowWrite: []string{"/custom"},
-		DenyRead:   []string{"~/.custom"},
-		CleanEnv:   &cleanEnv,
+		AllowWrite:   []string{"/custom"},
+		DenyRead:     []string{"~/.custom"},
+		CleanEnv:     &cleanEnv,
+		BaseDir:      "~/project",
+		ShellPrelude: "set -eu",
+		BackendOrder: []string{"sandbox-exec", "bwrap"},
+		NetworkAllow: []string{"registry.npmjs.org:443"},
+
+		TimeoutSeconds: 1.5,
 	}
 
 	result := MergeConfig(base, file)
@@ -148,6 +258,54 @@ func TestMergeConfig_OverridesValues(t *testing.T) {
 	if !result.CleanEnv {
 		t.Error("CleanEnv should be true")
 	}
+
+	if result.BaseDir != "~/project" {
+		t.Errorf("BaseDir = %q, want ~/project", result.BaseDir)
+	}
+
+	if result.ShellPrelude != "set -eu" {
+		t.Errorf("ShellPrelude = %q, want %q", result.ShellPrelude, "set -eu")
+	}
+
+	if strings.Join(result.BackendOrder, ",") != "sandbox-exec,bwrap" {
+		t.Errorf("BackendOrder = %v, want [sandbox-exec bwrap]", result.BackendOrder)
+	}
+
+	if strings.Join(result.NetworkAllow, ",") != "registry.npmjs.org:443" {
+		t.Errorf("NetworkAllow = %v, want [registry.npmjs.org:443]", result.NetworkAllow)
+	}
+
+	if result.Timeout != 1500*time.Millisecond {
+		t.Errorf("Timeout = %v, want 1.5s", result.Timeout)
+	}
+}
+
+func TestMergeConfig_AddLists(t *testing.T) {
+	base := Config{AllowWrite: []string{".", "/tmp"}, DenyRead: []string{"~/.ssh"}}
+
+	merged := MergeConfig(base, &FileConfig{
+		AllowWriteAdd: []string{"/cache", "/tmp", "/cache"},
+		DenyReadAdd:   []string{"~/.aws"},
+	})
+	if want := []string{".", "/tmp", "/cache"}; !slices.Equal(merged.AllowWrite, want) {
+		t.Errorf("AllowWrite = %v, want %v", merged.AllowWrite, want)
+	}
+	if want := []string{"~/.ssh", "~/.aws"}; !slices.Equal(merged.DenyRead, want) {
+		t.Errorf("DenyRead = %v, want %v", merged.DenyRead, want)
+	}
+	if len(base.AllowWrite) != 2 {
+		t.Errorf("base AllowWrite modified: %v", base.AllowWrite)
+	}
+
+	// A replacing list in the same file applies first
+	merged = MergeConfig(base, &FileConfig{AllowWrite: []string{"/work"}, AllowWriteAdd: []string{"/cache"}})
+	if want := []string{"/work", "/cache"}; !slices.Equal(merged.AllowWrite, want) {
+		t.Errorf("AllowWrite = %v, want %v", merged.AllowWrite, want)
+	}
+	merged = MergeConfig(base, &FileConfig{DenyRead: []string{"~/.kube"}, DenyReadAdd: []string{"~/.aws"}})
+	if want := []string{"~/.kube", "~/.aws"}; !slices.Equal(merged.DenyRead, want) {
+		t.Errorf("DenyRead = %v, want %v", merged.DenyRead, want)
+	}
 }
 
 func TestMergeConfig_EmptyArraysUseDefaults(t *testing.T) {
@@ -173,6 +331,57 @@ func TestMergeConfig_EmptyArraysUseDefaults(t *testing.T) {
 	}
 }
 
+func TestLoadConfigFile_Env(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.json")
+	content := `{"env": {"NODE_ENV": "production", "CI": "1"}}`
+	if err := os.WriteFile(configPath, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := LoadConfigFile(configPath)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(cfg.Env) != 2 || cfg.Env["NODE_ENV"] != "production" || cfg.Env["CI"] != "1" {
+		t.Errorf("Env = %v, want map[CI:1 NODE_ENV:production]", cfg.Env)
+	}
+}
+
+func TestMergeConfig_Env(t *testing.T) {
+	baseEnv := map[string]string{"NODE_ENV": "development", "LANG": "C"}
+	base := Config{SetEnv: baseEnv}
+	file := &FileConfig{Env: map[string]string{"NODE_ENV": "production", "CI": "1"}}
+
+	result := MergeConfig(base, file)
+
+	want := map[string]string{"NODE_ENV": "production", "LANG": "C", "CI": "1"}
+	if !maps.Equal(result.SetEnv, want) {
+		t.Errorf("SetEnv = %v, want %v", result.SetEnv, want)
+	}
+
+	// Base map must not be modified
+	if baseEnv["NODE_ENV"] != "development" || len(baseEnv) != 2 {
+		t.Errorf("base SetEnv modified: %v", baseEnv)
+	}
+}
+
+func TestMergeConfig_Network(t *testing.T) {
+	network := false
+	if result := MergeConfig(Config{}, &FileConfig{Network: &network}); !result.NoNetwork {
+		t.Error(`"network": false should set NoNetwork`)
+	}
+
+	network = true
+	if result := MergeConfig(Config{NoNetwork: true}, &FileConfig{Network: &network}); result.NoNetwork {
+		t.Error(`"network": true should clear NoNetwork`)
+	}
+
+	if result := MergeConfig(Config{NoNetwork: true}, &FileConfig{}); !result.NoNetwork {
+		t.Error("omitted network should keep the default")
+	}
+}
+
 func TestIsWildcard(t *testing.T) {
 	tests := []struct {
 		path     string
@@ -280,3 +489,232 @@ func TestDefaultConfigWithPath_CustomFile(t *testing.T) {
 		t.Error("AllowWrite should have defaults")
 	}
 }
+
+func TestLoadConfigCascade(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	system := write("system.json", `{"denyRead": ["/secrets"], "cleanEnv": true, "envDenylist": ["TOKEN"]}`)
+	user := write("user.yaml", "allowWrite: [/work]\ncleanEnv: false\n")
+	project := write(".agentsandbox.json", `{"allowWrite": ["/work/project"]}`)
+
+	cfg, err := LoadConfigCascade([]string{system, user, filepath.Join(dir, "missing.json"), "", project})
+	if err != nil {
+		t.Fatalf("LoadConfigCascade() error: %v", err)
+	}
+	// Each layer's lists replace those below; omitted keys keep them
+	if len(cfg.AllowWrite) != 1 || cfg.AllowWrite[0] != "/work/project" {
+		t.Errorf("AllowWrite = %v, want the project's", cfg.AllowWrite)
+	}
+	if len(cfg.DenyRead) != 1 || cfg.DenyRead[0] != "/secrets" {
+		t.Errorf("DenyRead = %v, want the system's", cfg.DenyRead)
+	}
+	if len(cfg.EnvDenylist) != 1 || cfg.EnvDenylist[0] != "TOKEN" {
+		t.Errorf("EnvDenylist = %v, want the system's", cfg.EnvDenylist)
+	}
+	if cfg.CleanEnv {
+		t.Error("the user's cleanEnv: false should override the system's true")
+	}
+	if !slices.Equal(cfg.configPaths, []string{system, user, project}) {
+		t.Errorf("configPaths = %v, want the loaded files in order", cfg.configPaths)
+	}
+
+	// Every loaded file is protected from the sandboxed command
+	cfg.Workdir = dir
+	cfg.AllowWrite = []string{dir}
+	resolved, err := resolveConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{system, user, project} {
+		path, _ = expandPath(path)
+		if !slices.Contains(resolved.denyWrite, path) {
+			t.Errorf("%s should be read-only, denyWrite = %v", path, resolved.denyWrite)
+		}
+	}
+
+	invalid := write("invalid.json", "{")
+	if _, err := LoadConfigCascade([]string{system, invalid}); err == nil || !strings.Contains(err.Error(), invalid) {
+		t.Errorf("an invalid layer should fail naming the file, got %v", err)
+	}
+}
+
+func TestFindProjectConfig(t *testing.T) {
+	root := t.TempDir()
+	nested := filepath.Join(root, "a", "b")
+	if err := os.MkdirAll(nested, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if got := FindProjectConfig(nested); got != "" {
+		t.Errorf("without a project file got %q", got)
+	}
+
+	want := filepath.Join(root, "a", ProjectConfigName)
+	if err := os.WriteFile(want, []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := FindProjectConfig(nested); got != want {
+		t.Errorf("FindProjectConfig() = %q, want %q", got, want)
+	}
+
+	// A directory of that name isn't a config file
+	if err := os.Mkdir(filepath.Join(nested, ProjectConfigName), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if got := FindProjectConfig(nested); got != want {
+		t.Errorf("FindProjectConfig() = %q, want %q past the directory", got, want)
+	}
+}
+
+func TestLoadPathList(t *testing.T) {
+	tmpDir := t.TempDir()
+	listPath := filepath.Join(tmpDir, "paths")
+
+	content := `# Build outputs
+/project/build
+
+  /project/dist  
+#/project/ignored
+~/.cache/tool
+`
+
+	if err := os.WriteFile(listPath, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	paths, err := LoadPathList(listPath)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expected := []string{"/project/build", "/project/dist", "~/.cache/tool"}
+	if len(paths) != len(expected) {
+		t.Fatalf("paths = %v, want %v", paths, expected)
+	}
+	for i := range expected {
+		if paths[i] != expected[i] {
+			t.Errorf("paths[%d] = %q, want %q", i, paths[i], expected[i])
+		}
+	}
+}
+
+func TestLoadPathList_NotExist(t *testing.T) {
+	_, err := LoadPathList("/nonexistent/path/list")
+	if err == nil {
+		t.Error("expected error for non-existent file")
+	}
+}
+
+func TestLoadSecrets(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secrets.env")
+	content := "# API keys\nGITHUB_TOKEN=ghp_abc\n\nNPM_TOKEN = npm=xyz\n"
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	secrets, err := LoadSecrets(path)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := map[string]string{"GITHUB_TOKEN": "ghp_abc", "NPM_TOKEN": " npm=xyz"}
+	if !maps.Equal(secrets, want) {
+		t.Errorf("LoadSecrets() = %v, want %v", secrets, want)
+	}
+}
+
+func TestLoadSecrets_Mode(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secrets.env")
+	if err := os.WriteFile(path, []byte("TOKEN=x\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := LoadSecrets(path); err == nil || !strings.Contains(err.Error(), "0600") {
+		t.Errorf("expected mode error for 0644 file, got %v", err)
+	}
+}
+
+func TestLoadSecrets_Malformed(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secrets.env")
+	if err := os.WriteFile(path, []byte("TOKEN=x\nsupersecretvalue\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := LoadSecrets(path)
+	if err == nil || !strings.Contains(err.Error(), ":2:") {
+		t.Fatalf("expected error for line 2, got %v", err)
+	}
+	if strings.Contains(err.Error(), "supersecretvalue") {
+		t.Error("error should not echo the malformed line")
+	}
+}
+
+func TestLoadConfigFile_Limits(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.yaml")
+	content := `limits:
+  memory: 512m
+  cpu: 30
+  nofile: 256
+  fsize: 1g
+  nproc: 64
+`
+	if err := os.WriteFile(configPath, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := LoadConfigFile(configPath)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	cfg := MergeConfig(DefaultConfig(), file)
+
+	if cfg.MemoryLimitBytes != 512<<20 {
+		t.Errorf("MemoryLimitBytes = %d, want %d", cfg.MemoryLimitBytes, 512<<20)
+	}
+	if cfg.CPUTimeLimit != 30*time.Second {
+		t.Errorf("CPUTimeLimit = %v, want 30s", cfg.CPUTimeLimit)
+	}
+	if cfg.OpenFilesLimit != 256 {
+		t.Errorf("OpenFilesLimit = %d, want 256", cfg.OpenFilesLimit)
+	}
+	if cfg.FileSizeLimitBytes != 1<<30 {
+		t.Errorf("FileSizeLimitBytes = %d, want %d", cfg.FileSizeLimitBytes, 1<<30)
+	}
+	if cfg.ProcessLimit != 64 {
+		t.Errorf("ProcessLimit = %d, want 64", cfg.ProcessLimit)
+	}
+
+	// Limits the file omits keep the base's values
+	base := DefaultConfig()
+	base.OpenFilesLimit = 1024
+	cfg = MergeConfig(base, &FileConfig{Limits: &FileLimits{NProc: 8}})
+	if cfg.OpenFilesLimit != 1024 || cfg.ProcessLimit != 8 {
+		t.Errorf("OpenFilesLimit, ProcessLimit = %d, %d, want 1024, 8", cfg.OpenFilesLimit, cfg.ProcessLimit)
+	}
+}
+
+func TestMergeConfig_PIDNamespace(t *testing.T) {
+	off := false
+	cfg := MergeConfig(hardcodedDefaults(), &FileConfig{PIDNamespace: &off})
+	if cfg.PIDNamespace {
+		t.Error(`"pidNamespace": false should turn PIDNamespace off`)
+	}
+	if cfg = MergeConfig(hardcodedDefaults(), &FileConfig{}); !cfg.PIDNamespace {
+		t.Error("PIDNamespace should stay on when the file omits it")
+	}
+}
+
+func TestLoadConfigFile_InvalidLimits(t *testing.T) {
+	configPath := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(configPath, []byte(`{"limits": {"memory": "lots"}}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadConfigFile(configPath); err == nil || !strings.Contains(err.Error(), "memory") {
+		t.Errorf("error = %v, want invalid memory limit", err)
+	}
+}
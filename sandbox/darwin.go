@@ -6,8 +6,12 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"net"
 	"os/exec"
+	"slices"
 	"strings"
+	"syscall"
+	"time"
 )
 
 type darwinSandbox struct {
@@ -16,6 +20,67 @@ type darwinSandbox struct {
 }
 
 func newDarwin(cfg Config) (Sandbox, error) {
+	// PIDNamespace is on by default and has no equivalent here: it's ignored
+	if cfg.FrozenTime != nil {
+		return nil, fmt.Errorf("FrozenTime is only supported on Linux")
+	}
+	if cfg.TrackReads {
+		return nil, fmt.Errorf("TrackReads is only supported on Linux")
+	}
+	if cfg.SampleUsage > 0 {
+		return nil, fmt.Errorf("SampleUsage is only supported on Linux")
+	}
+	if cfg.TmpfsWorkdir {
+		return nil, fmt.Errorf("TmpfsWorkdir is only supported on Linux")
+	}
+	if cfg.TmpfsSize != "" {
+		return nil, fmt.Errorf("TmpfsSize is only supported on Linux")
+	}
+	if cfg.EnableGPU {
+		return nil, fmt.Errorf("EnableGPU is only supported on Linux")
+	}
+	if cfg.DropRoot {
+		return nil, fmt.Errorf("DropRoot is only supported on Linux")
+	}
+	if cfg.UnshareIPC {
+		return nil, fmt.Errorf("UnshareIPC is only supported on Linux")
+	}
+	if cfg.UnshareUTS || cfg.Hostname != "" {
+		return nil, fmt.Errorf("UnshareUTS and Hostname are only supported on Linux")
+	}
+	if cfg.SeccompProfile != "" {
+		return nil, fmt.Errorf("SeccompProfile is only supported on Linux")
+	}
+	if cfg.MemoryLimitBytes > 0 {
+		return nil, fmt.Errorf("MemoryLimitBytes is only supported on Linux")
+	}
+	if cfg.CPUTimeLimit > 0 {
+		return nil, fmt.Errorf("CPUTimeLimit is only supported on Linux")
+	}
+	if cfg.OpenFilesLimit > 0 {
+		return nil, fmt.Errorf("OpenFilesLimit is only supported on Linux")
+	}
+	if cfg.FileSizeLimitBytes > 0 {
+		return nil, fmt.Errorf("FileSizeLimitBytes is only supported on Linux")
+	}
+	if cfg.ProcessLimit > 0 {
+		return nil, fmt.Errorf("ProcessLimit is only supported on Linux")
+	}
+	if len(cfg.Capabilities) > 0 {
+		return nil, fmt.Errorf("Capabilities is only supported on Linux")
+	}
+	if len(cfg.CPUAffinity) > 0 {
+		return nil, fmt.Errorf("CPUAffinity is only supported on Linux")
+	}
+	if len(cfg.AllowedPorts) > 0 {
+		return nil, fmt.Errorf("AllowedPorts is only supported on Linux")
+	}
+	for _, dest := range cfg.networkAllow {
+		if dest.host != "*" && !dest.isLocalhost() {
+			degradef(&cfg, "NetworkAllow %s: sandbox-exec filters by port only, any host on port %s is reachable", net.JoinHostPort(dest.host, dest.port), dest.port)
+		}
+	}
+
 	s := &darwinSandbox{cfg: cfg}
 	s.profile = s.generateProfile()
 
@@ -31,21 +96,193 @@ func (s *darwinSandbox) Run(ctx context.Context, cmd string) ([]byte, int, error
 }
 
 func (s *darwinSandbox) RunWithStdin(ctx context.Context, cmd string, stdin io.Reader) ([]byte, int, error) {
+	if err := checkCommand(cmd); err != nil {
+		return nil, 0, err
+	}
+	if err := checkBinary(s.cfg, "sh"); err != nil {
+		return nil, 0, err
+	}
+
 	if s.cfg.DryRun {
 		return []byte(s.dryRunOutput(cmd)), 0, nil
 	}
 
-	c := exec.CommandContext(ctx, "sandbox-exec", "-p", s.profile, "sh", "-c", cmd)
+	res, err := s.run(ctx, cmd, shellArgv(s.cfg, cmd), stdin, nil)
+	return res.Combined, res.ExitCode, err
+}
+
+func (s *darwinSandbox) RunNoNetwork(ctx context.Context, cmd string) ([]byte, int, error) {
+	offline := *s
+	offline.cfg.NoNetwork = true
+	offline.profile = offline.generateProfile()
+	return offline.Run(ctx, cmd)
+}
+
+func (s *darwinSandbox) RunWithEnv(ctx context.Context, cmd string, env map[string]string) ([]byte, int, error) {
+	if err := checkEnv(env); err != nil {
+		return nil, 0, err
+	}
+	withEnv := *s
+	withEnv.cfg.runEnv = env
+	return withEnv.Run(ctx, cmd)
+}
+
+func (s *darwinSandbox) RunResult(ctx context.Context, cmd string) (*Result, error) {
+	if err := checkCommand(cmd); err != nil {
+		return nil, err
+	}
+	if err := checkBinary(s.cfg, "sh"); err != nil {
+		return nil, err
+	}
+
+	if s.cfg.DryRun {
+		res := dryRunResult(s.cfg, s.dryRunOutput(cmd))
+		return &res, nil
+	}
+
+	res, err := s.run(ctx, cmd, shellArgv(s.cfg, cmd), nil, nil)
+	return &res, err
+}
+
+func (s *darwinSandbox) RunSeparate(ctx context.Context, cmd string) ([]byte, []byte, int, error) {
+	res, err := s.RunResult(ctx, cmd)
+	if res == nil {
+		return nil, nil, 0, err
+	}
+	return res.Stdout, res.Stderr, res.ExitCode, err
+}
+
+func (s *darwinSandbox) RunStream(ctx context.Context, cmd string, stdout, stderr io.Writer) (int, error) {
+	if err := checkCommand(cmd); err != nil {
+		return 0, err
+	}
+	if err := checkBinary(s.cfg, "sh"); err != nil {
+		return 0, err
+	}
+
+	if s.cfg.DryRun {
+		_, err := io.WriteString(orDiscard(stdout), s.dryRunOutput(cmd))
+		return 0, err
+	}
+
+	res, err := s.run(ctx, cmd, shellArgv(s.cfg, cmd), nil, &outputSink{stdout: stdout, stderr: stderr})
+	return res.ExitCode, err
+}
+
+func (s *darwinSandbox) RunArgs(ctx context.Context, argv []string) ([]byte, int, error) {
+	return s.RunArgsAs(ctx, "", argv)
+}
+
+func (s *darwinSandbox) RunArgsAs(ctx context.Context, name string, argv []string) ([]byte, int, error) {
+	if err := checkArgv(s.cfg, argv); err != nil {
+		return nil, 0, err
+	}
+
+	if s.cfg.DryRun {
+		return []byte(s.dryRunArgsOutput(name, argv)), 0, nil
+	}
+
+	res, err := s.run(ctx, strings.Join(argv, " "), s.execArgv(name, argv), nil, nil)
+	return res.Combined, res.ExitCode, err
+}
+
+func (s *darwinSandbox) Verify(ctx context.Context) (VerifyReport, error) {
+	return verify(ctx, s, s.cfg)
+}
+
+// execArgv returns the argv passed to sandbox-exec. sandbox-exec can't set
+// argv[0] itself, so a non-empty name is applied with bash's exec -a.
+func (s *darwinSandbox) execArgv(name string, argv []string) []string {
+	if name == "" {
+		return argv
+	}
+	return append([]string{"/bin/bash", "-c", `exec -a "$0" "$@"`, name}, argv...)
+}
+
+// run executes argv under sandbox-exec; command describes it for tracing.
+// Output goes to sink if set, otherwise into the Result.
+func (s *darwinSandbox) run(ctx context.Context, command string, argv []string, stdin io.Reader, sink *outputSink) (Result, error) {
+	return transcribe(s.cfg, command, stdin, func(stdin io.Reader) (Result, error) {
+		return execute(ctx, s.cfg, command, func(ctx context.Context) (Result, error) {
+			return s.invoke(ctx, argv, stdin, sink)
+		})
+	})
+}
+
+// invoke runs argv under sandbox-exec with the generated profile and returns
+// its raw output.
+func (s *darwinSandbox) invoke(ctx context.Context, argv []string, stdin io.Reader, sink *outputSink) (Result, error) {
+	c := exec.Command("sandbox-exec", append([]string{"-p", s.profile}, argv...)...)
 	c.Env = buildEnv(s.cfg)
-	c.Stdin = stdin
-	output, err := c.CombinedOutput()
+	// New session without a controlling terminal so TTY reads fail fast,
+	// and its own process group so cancellation stops all children
+	c.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+
+	capture := captureFor(s.cfg, sink)
+	c.Stdout = &capture.stdout
+	c.Stderr = &capture.stderr
 
-	exitCode := 0
+	release, err := feedStdin(c, stdin, s.cfg.StdinFile)
+	if err != nil {
+		return Result{}, err
+	}
+	defer release()
+
+	start := time.Now()
+	if err := c.Start(); err != nil {
+		return Result{}, err
+	}
+
+	// sandbox-exec execs the command, so the whole group can get SIGTERM
+	done := make(chan struct{})
+	watchCancel(ctx, c.Process.Pid, s.cfg.KillGrace, termGroup, done)
+	err = c.Wait()
+	close(done)
+	commandDuration := time.Since(start)
+
+	exitCode, signal := 0, syscall.Signal(0)
 	if c.ProcessState != nil {
-		exitCode = c.ProcessState.ExitCode()
+		exitCode, signal = exitStatus(c.ProcessState)
+		exitCode = remapExitCode(exitCode, s.cfg.ExitCodeMap)
+	}
+
+	res := capture.result(exitCode)
+	res.Signaled = signal != 0
+	res.Signal = signal
+	res.CommandDuration = commandDuration
+	if s.cfg.CaptureViolations {
+		res.Violations = logViolations(s.cfg, start, time.Now())
+	}
+	if ctx.Err() != nil {
+		return res, ctx.Err()
 	}
+	return res, err
+}
+
+// logShowLayout is the local time format of log show's --start and --end.
+const logShowLayout = "2006-01-02 15:04:05"
+
+// sandboxDenyPredicate selects the kernel's sandbox denial messages.
+const sandboxDenyPredicate = `eventMessage CONTAINS "Sandbox: " AND eventMessage CONTAINS " deny("`
+
+// logViolations returns the sandbox denials logged from start to end. log
+// show takes whole seconds, so the window is widened to them. Failing to
+// query the log is logged and returns none.
+func logViolations(cfg Config, start, end time.Time) []Violation {
+	out, err := exec.Command("log", "show", "--style", "ndjson",
+		"--start", start.Format(logShowLayout),
+		"--end", end.Add(time.Second).Format(logShowLayout),
+		"--predicate", sandboxDenyPredicate).Output()
+	if err != nil {
+		warnf(&cfg, "CaptureViolations: log show: %v", err)
+		return nil
+	}
+	return parseSandboxLog(out)
+}
 
-	return output, exitCode, err
+// termGroup sends SIGTERM to the process group pgid.
+func termGroup(pgid int) {
+	syscall.Kill(-pgid, syscall.SIGTERM)
 }
 
 func (s *darwinSandbox) generateProfile() string {
@@ -53,7 +290,14 @@ func (s *darwinSandbox) generateProfile() string {
 
 	sb.WriteString("(version 1)\n")
 	sb.WriteString("(allow default)\n")
-	sb.WriteString("(allow network*)\n")
+	if s.cfg.NoNetwork {
+		sb.WriteString("(deny network*)\n")
+	} else {
+		sb.WriteString("(allow network*)\n")
+		if len(s.cfg.networkAllow) > 0 {
+			s.writeNetworkAllow(&sb)
+		}
+	}
 
 	// Handle write permissions
 	if HasWildcard(s.cfg.AllowWrite) {
@@ -62,19 +306,25 @@ func (s *darwinSandbox) generateProfile() string {
 		// Deny all file writes by default
 		sb.WriteString("(deny file-write*)\n")
 
-		// Allow writes to specific paths
-		for _, path := range s.cfg.AllowWrite {
-			// Skip if path is in DenyRead (DenyRead takes precedence)
-			if pathInDenyRead(path, s.cfg.DenyRead) {
+		// Allow writes to specific paths, plus their symlink spellings
+		// (e.g. /tmp for /private/tmp)
+		for _, path := range slices.Concat(s.cfg.AllowWrite, s.cfg.writeAliases) {
+			// Skip if path is in DenyRead or ReadOnly (they take precedence)
+			if pathInDenyRead(path, s.cfg.DenyRead) || pathWithin(path, s.cfg.ReadOnly) {
 				continue
 			}
 			sb.WriteString(fmt.Sprintf("(allow file-write* (subpath %q))\n", path))
 		}
 	}
 
+	// Deny writes to read-only paths (later rules take precedence)
+	for _, path := range slices.Concat(s.cfg.denyWrite, s.cfg.ReadOnly) {
+		sb.WriteString(fmt.Sprintf("(deny file-write* (subpath %q))\n", path))
+	}
+
 	// Handle read restrictions
-	if HasWildcard(s.cfg.DenyRead) {
-		// Wildcard: deny all reads (except essential system paths for execution)
+	if readAllowlisted(s.cfg) {
+		// AllowRead or wildcard: deny all reads (except essential system paths for execution)
 		sb.WriteString("(deny file-read*)\n")
 		// Must allow reads from essential paths for command execution
 		sb.WriteString("(allow file-read* (subpath \"/usr\"))\n")
@@ -85,16 +335,73 @@ func (s *darwinSandbox) generateProfile() string {
 		sb.WriteString("(allow file-read* (subpath \"/dev\"))\n")
 		sb.WriteString("(allow file-read* (subpath \"/System\"))\n")
 		sb.WriteString("(allow file-read* (subpath \"/Library\"))\n")
-	} else {
-		// Deny reads from specific sensitive paths
+
+		// AllowRead paths, and AllowWrite paths as on Linux
+		if len(s.cfg.AllowRead) > 0 {
+			for _, path := range slices.Concat(s.cfg.AllowRead, s.cfg.AllowWrite, s.cfg.writeAliases) {
+				if !IsWildcard(path) {
+					sb.WriteString(fmt.Sprintf("(allow file-read* (subpath %q))\n", path))
+				}
+			}
+		}
+		for _, path := range s.cfg.ReadOnly {
+			sb.WriteString(fmt.Sprintf("(allow file-read* (subpath %q))\n", path))
+		}
+	}
+	if !HasWildcard(s.cfg.DenyRead) {
+		// Deny reads from specific sensitive paths, after any allowed above
 		for _, path := range s.cfg.DenyRead {
 			sb.WriteString(fmt.Sprintf("(deny file-read* (subpath %q))\n", path))
+			if s.cfg.DenyReadImpliesNoWrite {
+				sb.WriteString(fmt.Sprintf("(deny file-write* (subpath %q))\n", path))
+			}
 		}
 	}
 
+	// Keep PATH entries in a home that DenyRead hid readable
+	for _, dir := range s.cfg.homeCarveOut {
+		sb.WriteString(fmt.Sprintf("(allow file-read* (subpath %q))\n", dir))
+	}
+
+	// Keep a workdir that DenyRead hid usable, with its read-only paths
+	if workdirDenied(s.cfg) {
+		sb.WriteString(fmt.Sprintf("(allow file-read* (subpath %q))\n", s.cfg.Workdir))
+		if HasWildcard(s.cfg.AllowWrite) || pathWithin(s.cfg.Workdir, s.cfg.AllowWrite) {
+			sb.WriteString(fmt.Sprintf("(allow file-write* (subpath %q))\n", s.cfg.Workdir))
+			for _, path := range slices.Concat(s.cfg.denyWrite, s.cfg.ReadOnly) {
+				if pathWithin(path, []string{s.cfg.Workdir}) {
+					sb.WriteString(fmt.Sprintf("(deny file-write* (subpath %q))\n", path))
+				}
+			}
+		}
+	}
+
+	// Share the SSH agent socket, even if DenyRead covers its directory
+	if s.cfg.sshAuthSock != "" {
+		sb.WriteString(fmt.Sprintf("(allow file-read* (literal %q))\n", s.cfg.sshAuthSock))
+	}
+
 	return sb.String()
 }
 
+// writeNetworkAllow limits outbound connections to NetworkAllow. Profiles
+// only match a remote host of "*" or "localhost", so other hosts are
+// allowed by port alone. DNS lookups go through mDNSResponder's socket.
+func (s *darwinSandbox) writeNetworkAllow(sb *strings.Builder) {
+	sb.WriteString("(deny network-outbound)\n")
+	sb.WriteString("(allow network-outbound (remote unix-socket (path-literal \"/private/var/run/mDNSResponder\")))\n")
+	for _, dest := range s.cfg.networkAllow {
+		host := "*"
+		if dest.isLocalhost() {
+			host = "localhost"
+		}
+		sb.WriteString(fmt.Sprintf("(allow network-outbound (remote ip \"%s:%s\"))\n", host, dest.port))
+	}
+	if s.cfg.sshAuthSock != "" {
+		sb.WriteString(fmt.Sprintf("(allow network-outbound (remote unix-socket (path-literal %q)))\n", s.cfg.sshAuthSock))
+	}
+}
+
 func (s *darwinSandbox) validateProfile() error {
 	// Run a no-op command to validate the profile syntax
 	c := exec.Command("sandbox-exec", "-p", s.profile, "/usr/bin/true")
@@ -105,5 +412,9 @@ func (s *darwinSandbox) validateProfile() error {
 }
 
 func (s *darwinSandbox) dryRunOutput(cmd string) string {
-	return fmt.Sprintf("sandbox-exec -p '%s' sh -c '%s'", s.profile, cmd)
+	return formatDryRun(s.cfg, "sandbox-exec", append([]string{"sandbox-exec", "-p", s.profile}, shellArgv(s.cfg, cmd)...))
+}
+
+func (s *darwinSandbox) dryRunArgsOutput(name string, argv []string) string {
+	return formatDryRun(s.cfg, "sandbox-exec", append([]string{"sandbox-exec", "-p", s.profile}, s.execArgv(name, argv)...))
 }
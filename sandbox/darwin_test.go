@@ -3,10 +3,50 @@
 package sandbox
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 )
 
+func TestNewDarwin_Unsupported(t *testing.T) {
+	for name, cfg := range map[string]Config{
+		"TmpfsSize": {TmpfsSize: "64m"},
+		"EnableGPU": {EnableGPU: true},
+		"DropRoot":  {DropRoot: true},
+	} {
+		cfg.Workdir = t.TempDir()
+		_, err := newDarwin(cfg)
+		if err == nil || !strings.Contains(err.Error(), name+" is only supported on Linux") {
+			t.Errorf("%s: expected unsupported error, got %v", name, err)
+		}
+	}
+}
+
+func TestGenerateProfile_SecretsFileHidden(t *testing.T) {
+	dir := t.TempDir()
+	secrets := filepath.Join(dir, "secrets.env")
+	if err := os.WriteFile(secrets, []byte("GITHUB_TOKEN=ghp_abc\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := resolveConfig(Config{Workdir: dir, AllowWrite: []string{dir}, SecretsFile: secrets, InjectSecrets: []string{"GITHUB_TOKEN"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	secrets, _ = expandPath(secrets)
+
+	profile := (&darwinSandbox{cfg: cfg}).generateProfile()
+	if !strings.Contains(profile, fmt.Sprintf("(deny file-read* (subpath %q))", secrets)) {
+		t.Errorf("profile should deny reading the secrets file:\n%s", profile)
+	}
+}
+
 func TestGenerateProfile(t *testing.T) {
 	cfg := Config{
 		Workdir:    "/home/user/project",
@@ -33,6 +73,121 @@ func TestGenerateProfile(t *testing.T) {
 	}
 }
 
+func TestGenerateProfile_NoNetwork(t *testing.T) {
+	s := &darwinSandbox{cfg: Config{Workdir: "/tmp", AllowWrite: []string{"/tmp"}, NoNetwork: true}}
+	profile := s.generateProfile()
+
+	if !strings.Contains(profile, "(deny network*)") || strings.Contains(profile, "(allow network*)") {
+		t.Errorf("offline profile should deny network\nGot:\n%s", profile)
+	}
+}
+
+func TestGenerateProfile_NetworkAllow(t *testing.T) {
+	cfg := Config{
+		Workdir:      "/tmp",
+		AllowWrite:   []string{"/tmp"},
+		networkAllow: []networkDest{{host: "registry.npmjs.org", port: "443"}, {host: "127.0.0.1", port: "*"}},
+	}
+	s := &darwinSandbox{cfg: cfg}
+	profile := s.generateProfile()
+
+	for _, check := range []string{
+		"(deny network-outbound)",
+		`(allow network-outbound (remote ip "*:443"))`,
+		`(allow network-outbound (remote ip "localhost:*"))`,
+	} {
+		if !strings.Contains(profile, check) {
+			t.Errorf("profile should contain %q\nGot:\n%s", check, profile)
+		}
+	}
+
+	// NoNetwork (as in RunNoNetwork) drops the allowlist
+	s.cfg.NoNetwork = true
+	if profile := s.generateProfile(); strings.Contains(profile, "network-outbound") {
+		t.Errorf("offline profile should not allow any destination\nGot:\n%s", profile)
+	}
+}
+
+func TestGenerateProfile_DenyReadImpliesNoWrite(t *testing.T) {
+	cfg := Config{
+		Workdir:                "/tmp",
+		AllowWrite:             []string{"*"},
+		DenyRead:               []string{"/Users/user/.aws"},
+		DenyReadImpliesNoWrite: true,
+	}
+	s := &darwinSandbox{cfg: cfg}
+	if profile := s.generateProfile(); !strings.Contains(profile, `(deny file-write* (subpath "/Users/user/.aws"))`) {
+		t.Errorf("DenyRead path should deny writes\nGot:\n%s", profile)
+	}
+
+	s.cfg.DenyReadImpliesNoWrite = false
+	if profile := s.generateProfile(); strings.Contains(profile, "(deny file-write*") {
+		t.Errorf("wildcard AllowWrite without the flag should deny no writes\nGot:\n%s", profile)
+	}
+}
+
+func TestGenerateProfile_AllowRead(t *testing.T) {
+	cfg := Config{
+		Workdir:    "/project",
+		AllowWrite: []string{"/project"},
+		AllowRead:  []string{"/data", "/Users/user/.ssh"},
+		DenyRead:   []string{"/Users/user/.ssh"},
+	}
+	s := &darwinSandbox{cfg: cfg}
+	profile := s.generateProfile()
+
+	for _, want := range []string{
+		"(deny file-read*)",
+		`(allow file-read* (subpath "/data"))`,
+		`(allow file-read* (subpath "/project"))`,
+	} {
+		if !strings.Contains(profile, want) {
+			t.Errorf("profile missing %s\nGot:\n%s", want, profile)
+		}
+	}
+	// DenyRead comes later and wins over AllowRead
+	allow := strings.Index(profile, `(allow file-read* (subpath "/Users/user/.ssh"))`)
+	deny := strings.Index(profile, `(deny file-read* (subpath "/Users/user/.ssh"))`)
+	if deny < 0 || deny < allow {
+		t.Errorf("DenyRead should follow AllowRead\nGot:\n%s", profile)
+	}
+}
+
+func TestGenerateProfile_ReadOnly(t *testing.T) {
+	cfg := Config{
+		Workdir:    "/project",
+		AllowWrite: []string{"/project", "/cache"},
+		ReadOnly:   []string{"/cache", "/project/vendor"},
+	}
+	s := &darwinSandbox{cfg: cfg}
+	profile := s.generateProfile()
+
+	if strings.Contains(profile, `(allow file-write* (subpath "/cache"))`) {
+		t.Errorf("ReadOnly paths should not be writable\nGot:\n%s", profile)
+	}
+	allow := strings.Index(profile, `(allow file-write* (subpath "/project"))`)
+	deny := strings.Index(profile, `(deny file-write* (subpath "/project/vendor"))`)
+	if allow < 0 || deny < allow {
+		t.Errorf("ReadOnly paths inside AllowWrite should be denied after it\nGot:\n%s", profile)
+	}
+}
+
+func TestGenerateProfile_HomeCarveOut(t *testing.T) {
+	cfg := Config{
+		Workdir:      "/tmp",
+		AllowWrite:   []string{"/tmp"},
+		DenyRead:     []string{"/Users/user"},
+		homeCarveOut: []string{"/Users/user/.local/bin"},
+	}
+	s := &darwinSandbox{cfg: cfg}
+	profile := s.generateProfile()
+	deny := strings.Index(profile, `(deny file-read* (subpath "/Users/user"))`)
+	allow := strings.Index(profile, `(allow file-read* (subpath "/Users/user/.local/bin"))`)
+	if deny < 0 || allow < deny {
+		t.Errorf("PATH entries should be allowed after the home is denied\nGot:\n%s", profile)
+	}
+}
+
 func TestGenerateProfile_DenyReadTakesPrecedence(t *testing.T) {
 	cfg := Config{
 		Workdir:    "/tmp",
@@ -53,6 +208,89 @@ func TestGenerateProfile_DenyReadTakesPrecedence(t *testing.T) {
 	}
 }
 
+func TestGenerateProfile_DenyWrite(t *testing.T) {
+	cfg := Config{
+		Workdir:    "/Users/user/project",
+		AllowWrite: []string{"/Users/user"},
+		denyWrite:  []string{"/Users/user/.agent/sandbox/config.json"},
+	}
+	s := &darwinSandbox{cfg: cfg}
+	profile := s.generateProfile()
+
+	allow := strings.Index(profile, `(allow file-write* (subpath "/Users/user"))`)
+	deny := strings.Index(profile, `(deny file-write* (subpath "/Users/user/.agent/sandbox/config.json"))`)
+	if deny < 0 {
+		t.Fatalf("profile should deny writes to protected path\nGot:\n%s", profile)
+	}
+	if allow < 0 || deny < allow {
+		t.Error("deny rule must come after the allow rule it overrides")
+	}
+}
+
+func TestGenerateProfile_WriteExclude(t *testing.T) {
+	cfg, err := resolveConfig(Config{
+		Workdir:      "/project",
+		AllowWrite:   []string{"/project"},
+		WriteExclude: []string{"/project/secrets"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &darwinSandbox{cfg: cfg}
+	profile := s.generateProfile()
+
+	allow := strings.Index(profile, `(allow file-write* (subpath "/project"))`)
+	deny := strings.Index(profile, `(deny file-write* (subpath "/project/secrets"))`)
+	if allow < 0 || deny < 0 {
+		t.Fatalf("profile should allow /project and deny /project/secrets\nGot:\n%s", profile)
+	}
+	if deny < allow {
+		t.Error("exclusion must come after the allow rule it overrides")
+	}
+}
+
+func TestGenerateProfile_WorkdirInDenyRead(t *testing.T) {
+	cfg := Config{
+		Workdir:    "/Users/user/project",
+		AllowWrite: []string{"/Users/user/project"},
+		DenyRead:   []string{"/Users/user"},
+		ReadOnly:   []string{"/Users/user/project/vendor"},
+	}
+	s := &darwinSandbox{cfg: cfg}
+	profile := s.generateProfile()
+
+	deny := strings.Index(profile, `(deny file-read* (subpath "/Users/user"))`)
+	allowRead := strings.Index(profile, `(allow file-read* (subpath "/Users/user/project"))`)
+	allowWrite := strings.LastIndex(profile, `(allow file-write* (subpath "/Users/user/project"))`)
+	if deny < 0 || allowRead < deny || allowWrite < deny {
+		t.Errorf("workdir should be allowed after the DenyRead rule\nGot:\n%s", profile)
+	}
+	// DenyRead > ReadOnly > AllowWrite holds inside the carve-out too
+	if readOnly := strings.LastIndex(profile, `(deny file-write* (subpath "/Users/user/project/vendor"))`); readOnly < allowWrite {
+		t.Errorf("ReadOnly paths in the workdir should be denied writes after the carve-out\nGot:\n%s", profile)
+	}
+}
+
+func TestGenerateProfile_ShareSSHAgent(t *testing.T) {
+	cfg := Config{
+		Workdir:     "/tmp",
+		AllowWrite:  []string{"/tmp"},
+		DenyRead:    []string{"/Users/user/.ssh"},
+		sshAuthSock: "/Users/user/.ssh/agent.sock",
+	}
+	s := &darwinSandbox{cfg: cfg}
+	profile := s.generateProfile()
+
+	deny := strings.Index(profile, `(deny file-read* (subpath "/Users/user/.ssh"))`)
+	allow := strings.Index(profile, `(allow file-read* (literal "/Users/user/.ssh/agent.sock"))`)
+	if deny < 0 {
+		t.Fatalf("~/.ssh should remain denied\nGot:\n%s", profile)
+	}
+	if allow < 0 || allow < deny {
+		t.Errorf("agent socket should be allowed after the deny rule\nGot:\n%s", profile)
+	}
+}
+
 func TestDryRunOutput_Darwin(t *testing.T) {
 	cfg := Config{
 		Workdir:    "/tmp",
@@ -71,3 +309,159 @@ func TestDryRunOutput_Darwin(t *testing.T) {
 		t.Error("dry run should show the command")
 	}
 }
+
+func TestDryRunOutput_DarwinJSON(t *testing.T) {
+	cfg := Config{Workdir: "/tmp", AllowWrite: []string{"/tmp"}, DryRun: true, DryRunFormat: DryRunJSON}
+	s := &darwinSandbox{cfg: cfg}
+	s.profile = s.generateProfile()
+
+	var plan DryRunPlan
+	if err := json.Unmarshal([]byte(s.dryRunOutput("echo hello")), &plan); err != nil {
+		t.Fatalf("dry run output is not JSON: %v", err)
+	}
+	if plan.Backend != "sandbox-exec" || len(plan.Argv) < 2 || plan.Argv[0] != "-p" || plan.Argv[1] != s.profile {
+		t.Errorf("plan = %+v, want sandbox-exec with the profile", plan)
+	}
+}
+
+func TestRun_EmptyCommand_Darwin(t *testing.T) {
+	cfg := Config{
+		Workdir:    "/tmp",
+		AllowWrite: []string{"/tmp"},
+	}
+	s := &darwinSandbox{cfg: cfg}
+
+	for _, cmd := range []string{"", " ", "   ", "\t", "\n", " \t\n "} {
+		if _, _, err := s.Run(context.Background(), cmd); !errors.Is(err, ErrEmptyCommand) {
+			t.Errorf("Run(%q) error = %v, want ErrEmptyCommand", cmd, err)
+		}
+		if _, _, err := s.RunWithStdin(context.Background(), cmd, strings.NewReader("input")); !errors.Is(err, ErrEmptyCommand) {
+			t.Errorf("RunWithStdin(%q) error = %v, want ErrEmptyCommand", cmd, err)
+		}
+	}
+}
+
+func TestExecArgv_Argv0(t *testing.T) {
+	s := &darwinSandbox{cfg: Config{Workdir: "/tmp"}}
+
+	argv := s.execArgv("ls", []string{"/bin/busybox", "-la"})
+	expected := []string{"/bin/bash", "-c", `exec -a "$0" "$@"`, "ls", "/bin/busybox", "-la"}
+	if strings.Join(argv, "\x00") != strings.Join(expected, "\x00") {
+		t.Errorf("execArgv() = %q, want %q", argv, expected)
+	}
+
+	argv = s.execArgv("", []string{"/bin/busybox"})
+	if len(argv) != 1 || argv[0] != "/bin/busybox" {
+		t.Errorf("empty name should pass argv through, got %q", argv)
+	}
+}
+
+func TestGenerateProfile_TmpSymlink(t *testing.T) {
+	// On macOS /tmp is a symlink to /private/tmp
+	cfg, err := resolveConfig(Config{
+		Workdir:    "/tmp",
+		AllowWrite: []string{"/tmp"},
+	})
+	if err != nil {
+		t.Fatalf("resolveConfig() error: %v", err)
+	}
+	s := &darwinSandbox{cfg: cfg}
+	profile := s.generateProfile()
+
+	for _, check := range []string{
+		`(allow file-write* (subpath "/private/tmp"))`,
+		`(allow file-write* (subpath "/tmp"))`,
+	} {
+		if !strings.Contains(profile, check) {
+			t.Errorf("profile should contain %q\nGot:\n%s", check, profile)
+		}
+	}
+}
+
+func TestRun_TrimTrailingNewline_Darwin(t *testing.T) {
+	cfg := Config{
+		Workdir:             t.TempDir(),
+		AllowWrite:          []string{"/tmp"},
+		TrimTrailingNewline: true,
+	}
+	s := &darwinSandbox{cfg: cfg}
+	s.profile = s.generateProfile()
+
+	output, _, err := s.Run(context.Background(), "printf 'hello\\n\\n'")
+	if err != nil {
+		t.Fatalf("Run() error: %v", err)
+	}
+	if string(output) != "hello\n" {
+		t.Errorf("expected one trailing newline trimmed, got %q", output)
+	}
+}
+
+func TestRunSeparate_Darwin(t *testing.T) {
+	s := &darwinSandbox{cfg: Config{Workdir: t.TempDir(), AllowWrite: []string{"/tmp"}}}
+	s.profile = s.generateProfile()
+
+	stdout, stderr, _, err := s.RunSeparate(context.Background(), `echo '{"ok":true}'; echo 'warning: slow' >&2`)
+	if err != nil {
+		t.Fatalf("RunSeparate() error: %v", err)
+	}
+	if string(stdout) != "{\"ok\":true}\n" {
+		t.Errorf("stdout = %q, stderr should not leak into it", stdout)
+	}
+	if string(stderr) != "warning: slow\n" {
+		t.Errorf("stderr = %q, want %q", stderr, "warning: slow\n")
+	}
+}
+
+func TestRunStream_Darwin(t *testing.T) {
+	s := &darwinSandbox{cfg: Config{Workdir: t.TempDir(), AllowWrite: []string{"/tmp"}}}
+	s.profile = s.generateProfile()
+
+	var stdout, stderr bytes.Buffer
+	exitCode, err := s.RunStream(context.Background(), "echo out; echo err >&2; exit 3", &stdout, &stderr)
+	if err == nil || exitCode != 3 {
+		t.Errorf("RunStream() = %d, %v; want exit code 3 with an error", exitCode, err)
+	}
+	if stdout.String() != "out\n" || stderr.String() != "err\n" {
+		t.Errorf("stdout = %q, stderr = %q; want them streamed apart", stdout.String(), stderr.String())
+	}
+}
+
+func TestRun_Timeout_Darwin(t *testing.T) {
+	s := &darwinSandbox{cfg: Config{Workdir: t.TempDir(), AllowWrite: []string{"/tmp"}, Timeout: 100 * time.Millisecond}}
+	s.profile = s.generateProfile()
+
+	// A background child holding stdout open must be killed too
+	start := time.Now()
+	_, _, err := s.Run(context.Background(), "sleep 10 & sleep 10")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("error = %v, want context.DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Run took %v, the process group should be killed at the deadline", elapsed)
+	}
+
+	res, _ := s.RunResult(context.Background(), "sleep 10")
+	if !res.Signaled || !res.TimedOut {
+		t.Errorf("Signaled = %v, TimedOut = %v; want a killed, timed out run", res.Signaled, res.TimedOut)
+	}
+}
+
+func TestRun_KillGrace_Darwin(t *testing.T) {
+	workdir := t.TempDir()
+	s := &darwinSandbox{cfg: Config{Workdir: workdir, AllowWrite: []string{workdir}, KillGrace: 5 * time.Second}}
+	s.profile = s.generateProfile()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, _, err := s.Run(ctx, `trap "echo cleaned > cleanup; exit 0" TERM; sleep 10 & wait`)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("error = %v, want context.DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > 4*time.Second {
+		t.Errorf("Run took %v, the command should exit on SIGTERM before the grace period ends", elapsed)
+	}
+	if data, err := os.ReadFile(filepath.Join(workdir, "cleanup")); err != nil || string(data) != "cleaned\n" {
+		t.Errorf("trap handler should have run, cleanup = %q, %v", data, err)
+	}
+}
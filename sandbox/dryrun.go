@@ -0,0 +1,67 @@
+package sandbox
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Dry-run output formats, for Config.DryRunFormat.
+const (
+	DryRunShell = "shell" // The command line, shell-quoted (default)
+	DryRunJSON  = "json"  // A DryRunPlan as indented JSON
+)
+
+// DryRunPlan describes what a run would do, for tooling that inspects or
+// diffs the planned invocation.
+type DryRunPlan struct {
+	Backend    string   `json:"backend"` // "bwrap" or "sandbox-exec"
+	Binary     string   `json:"binary"`
+	Argv       []string `json:"argv"` // Arguments after Binary
+	Env        []string `json:"env"`  // KEY=VALUE, with InjectSecrets values redacted
+	Workdir    string   `json:"workdir"`
+	AllowWrite []string `json:"allowWrite"`
+	DenyRead   []string `json:"denyRead"`
+}
+
+// redactedSecret replaces secret values in a DryRunPlan's env.
+const redactedSecret = "<redacted>"
+
+// checkDryRunFormat returns an error if format isn't a known format.
+func checkDryRunFormat(format string) error {
+	switch format {
+	case "", DryRunShell, DryRunJSON:
+		return nil
+	}
+	return fmt.Errorf("unknown format %q, want %s or %s", format, DryRunShell, DryRunJSON)
+}
+
+// formatDryRun renders argv, the backend's binary first, in cfg's
+// DryRunFormat.
+func formatDryRun(cfg Config, backend string, argv []string) string {
+	if cfg.DryRunFormat != DryRunJSON {
+		return shellJoin(argv)
+	}
+
+	env := buildEnv(cfg)
+	for i, kv := range env {
+		key, _, _ := strings.Cut(kv, "=")
+		if _, ok := cfg.secrets[key]; ok {
+			env[i] = key + "=" + redactedSecret
+		}
+	}
+	plan := DryRunPlan{
+		Backend:    backend,
+		Binary:     argv[0],
+		Argv:       argv[1:],
+		Env:        env,
+		Workdir:    cfg.Workdir,
+		AllowWrite: cfg.AllowWrite,
+		DenyRead:   cfg.DenyRead,
+	}
+	out, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		return err.Error()
+	}
+	return string(out) + "\n"
+}
@@ -0,0 +1,55 @@
+package sandbox
+
+import (
+	"encoding/json"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestFormatDryRun(t *testing.T) {
+	cfg := Config{
+		Workdir:    "/project",
+		AllowWrite: []string{"/project"},
+		DenyRead:   []string{"/home/user/.ssh"},
+		CleanEnv:   true,
+		SetEnv:     map[string]string{"CI": "true"},
+		secrets:    map[string]string{"API_TOKEN": "s3cret"},
+	}
+	argv := []string{"/usr/bin/bwrap", "--ro-bind", "/", "/", "sh", "-c", "echo 'hi there'"}
+
+	if got := formatDryRun(cfg, "bwrap", argv); got != shellJoin(argv) {
+		t.Errorf("default format = %q, want the shell-quoted command", got)
+	}
+
+	cfg.DryRunFormat = DryRunJSON
+	out := formatDryRun(cfg, "bwrap", argv)
+	var plan DryRunPlan
+	if err := json.Unmarshal([]byte(out), &plan); err != nil {
+		t.Fatalf("output is not JSON: %v\n%s", err, out)
+	}
+	if plan.Backend != "bwrap" || plan.Binary != "/usr/bin/bwrap" || !slices.Equal(plan.Argv, argv[1:]) {
+		t.Errorf("plan = %+v, want the backend, binary and arguments", plan)
+	}
+	if plan.Workdir != "/project" || !slices.Equal(plan.AllowWrite, cfg.AllowWrite) || !slices.Equal(plan.DenyRead, cfg.DenyRead) {
+		t.Errorf("plan = %+v, want the workdir and paths", plan)
+	}
+	if !slices.Contains(plan.Env, "CI=true") || !slices.Contains(plan.Env, "API_TOKEN="+redactedSecret) {
+		t.Errorf("env = %v, want CI and the redacted secret", plan.Env)
+	}
+	if strings.Contains(out, "s3cret") {
+		t.Error("secret values must not appear in dry-run output")
+	}
+}
+
+func TestResolveConfig_DryRunFormat(t *testing.T) {
+	for _, format := range []string{"", DryRunShell, DryRunJSON} {
+		if _, err := resolveConfig(Config{Workdir: t.TempDir(), DryRunFormat: format}); err != nil {
+			t.Errorf("DryRunFormat %q: unexpected error: %v", format, err)
+		}
+	}
+	_, err := resolveConfig(Config{Workdir: t.TempDir(), DryRunFormat: "yaml"})
+	if err == nil || !strings.Contains(err.Error(), "invalid DryRunFormat") {
+		t.Errorf("expected invalid DryRunFormat error, got %v", err)
+	}
+}
@@ -0,0 +1,31 @@
+package sandbox
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// goCacheDirs returns the Go build and module caches reported by go env,
+// creating them if missing so they can be bind mounted. A disabled build
+// cache (GOCACHE=off) is left out.
+func goCacheDirs() ([]string, error) {
+	out, err := exec.Command("go", "env", "GOCACHE", "GOMODCACHE").Output()
+	if err != nil {
+		return nil, fmt.Errorf("go env: %w", err)
+	}
+
+	var dirs []string
+	for _, dir := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		dir = strings.TrimSpace(dir)
+		if dir == "" || dir == "off" {
+			continue
+		}
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+		dirs = append(dirs, dir)
+	}
+	return dirs, nil
+}
@@ -0,0 +1,45 @@
+package sandbox
+
+import (
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestResolveConfig_ShareGoCache(t *testing.T) {
+	if _, err := exec.LookPath("go"); err != nil {
+		t.Skip("go not installed")
+	}
+
+	cacheDir := filepath.Join(t.TempDir(), "go-build")
+	modDir := filepath.Join(t.TempDir(), "mod")
+	t.Setenv("GOCACHE", cacheDir)
+	t.Setenv("GOMODCACHE", modDir)
+
+	cfg, err := resolveConfig(Config{Workdir: t.TempDir(), ShareGoCache: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for _, dir := range []string{cacheDir, modDir} {
+		want, _ := expandPath(dir)
+		if !slices.Contains(cfg.AllowWrite, want) {
+			t.Errorf("AllowWrite = %v, want it to contain %s", cfg.AllowWrite, want)
+		}
+	}
+
+	// DenyRead takes precedence over the shared caches
+	cfg, err = resolveConfig(Config{Workdir: t.TempDir(), ShareGoCache: true, DenyRead: []string{filepath.Dir(modDir)}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if want, _ := expandPath(modDir); slices.Contains(cfg.AllowWrite, want) {
+		t.Errorf("AllowWrite = %v, denied GOMODCACHE should be left out", cfg.AllowWrite)
+	}
+
+	// Disabled by default
+	cfg, _ = resolveConfig(Config{Workdir: t.TempDir()})
+	if len(cfg.AllowWrite) != 0 {
+		t.Errorf("AllowWrite = %v, want no Go caches unless ShareGoCache is set", cfg.AllowWrite)
+	}
+}
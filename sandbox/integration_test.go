@@ -3,10 +3,13 @@
 package sandbox
 
 import (
+	"cmp"
 	"context"
 	"errors"
 	"os"
 	"path/filepath"
+	"runtime"
+	"slices"
 	"strings"
 	"testing"
 	"time"
@@ -52,6 +55,26 @@ func TestWriteOutsideWorkdirDenied(t *testing.T) {
 	}
 }
 
+func TestWriteDeniedReportsPath(t *testing.T) {
+	sb, err := New(Config{
+		Workdir:    t.TempDir(),
+		AllowWrite: []string{t.TempDir()},
+	})
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+
+	_, _, err = sb.Run(context.Background(), "touch /etc/testfile_sandbox_test")
+
+	var denied *ErrWriteDenied
+	if !errors.As(err, &denied) {
+		t.Fatalf("expected ErrWriteDenied, got %v", err)
+	}
+	if denied.Path != "/etc/testfile_sandbox_test" {
+		t.Errorf("denied path = %q, want /etc/testfile_sandbox_test", denied.Path)
+	}
+}
+
 func TestReadProtectedDirDenied(t *testing.T) {
 	dir := t.TempDir()
 	sensitiveDir := filepath.Join(dir, "sensitive")
@@ -82,6 +105,48 @@ func TestReadProtectedDirDenied(t *testing.T) {
 	}
 }
 
+func TestWriteIntoDenyReadDenied(t *testing.T) {
+	dir := t.TempDir()
+	sensitiveDir := filepath.Join(dir, "sensitive")
+	if err := os.MkdirAll(sensitiveDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	sb, err := New(Config{
+		Workdir:                dir,
+		AllowWrite:             []string{"*"},
+		DenyRead:               []string{sensitiveDir},
+		DenyReadImpliesNoWrite: true,
+	})
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+
+	if _, code, _ := sb.Run(context.Background(), "echo x > "+filepath.Join(sensitiveDir, "planted")); code == 0 {
+		t.Error("write into DenyRead path should fail")
+	}
+}
+
+func TestCompareConfigs(t *testing.T) {
+	workdir := t.TempDir()
+	outside := t.TempDir()
+	target := filepath.Join(outside, "written")
+
+	loose := Config{Workdir: workdir, AllowWrite: []string{workdir, outside}}
+	strict := Config{Workdir: workdir, AllowWrite: []string{workdir}}
+
+	resLoose, resStrict, err := CompareConfigs(context.Background(), "echo x > "+target, loose, strict)
+	if err != nil {
+		t.Fatalf("CompareConfigs() error: %v", err)
+	}
+	if resLoose.ExitCode != 0 {
+		t.Errorf("write should succeed under the loose config, exit code %d: %s", resLoose.ExitCode, resLoose.Combined)
+	}
+	if resStrict.ExitCode == 0 {
+		t.Error("write should fail under the strict config")
+	}
+}
+
 func TestNetworkAllowed(t *testing.T) {
 	if testing.Short() {
 		t.Skip("skipping network test in short mode")
@@ -209,6 +274,46 @@ func TestContextCancellation(t *testing.T) {
 	if !errors.Is(err, context.DeadlineExceeded) && !strings.Contains(err.Error(), "killed") && !strings.Contains(err.Error(), "signal") {
 		t.Logf("error type: %T, value: %v", err, err)
 	}
+
+	// The kill is reported as such, not as an exit code of -1
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	res, _ := sb.RunResult(ctx, "sleep 10")
+	if !res.Signaled || res.ExitCode != 128+int(res.Signal) {
+		t.Errorf("Signaled = %v, Signal = %v, ExitCode = %d; want a signal kill as 128+n", res.Signaled, res.Signal, res.ExitCode)
+	}
+}
+
+func TestPIDNamespace_ReapsOrphans(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("PID namespaces are Linux only")
+	}
+	workdir := t.TempDir()
+	sb, err := New(Config{Workdir: workdir, AllowWrite: []string{workdir}, PIDNamespace: true, KillGrace: 2 * time.Second})
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+
+	// The orphaned sleep is reparented to the namespace's init, which reaps it
+	output, _, err := sb.Run(context.Background(),
+		`sh -c 'sleep 0.1 &'; sleep 0.5; grep -l "^State:.*zombie" /proc/[0-9]*/status; echo pid=$$`)
+	if err != nil {
+		t.Fatalf("Run() error: %v", err)
+	}
+	if strings.Contains(string(output), "/status") {
+		t.Errorf("orphan should have been reaped, zombies: %s", output)
+	}
+	if strings.Contains(string(output), "pid=1\n") || !strings.Contains(string(output), "pid=") {
+		t.Errorf("command should run under init, not as PID 1, got %s", output)
+	}
+
+	// Cancellation's SIGTERM reaches the command through the init
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	output, _, _ = sb.Run(ctx, "trap 'echo terminated; exit 0' TERM; sleep 10 & wait")
+	if !strings.Contains(string(output), "terminated") {
+		t.Errorf("command should get SIGTERM, got %q", output)
+	}
 }
 
 func TestStdinPiping(t *testing.T) {
@@ -259,3 +364,422 @@ func TestDryRun(t *testing.T) {
 		t.Error("dry run should show command, not output")
 	}
 }
+
+func TestRunArgsAs_Argv0(t *testing.T) {
+	sb, err := New(Config{
+		Workdir:    t.TempDir(),
+		AllowWrite: []string{t.TempDir()},
+	})
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+
+	// Without extra arguments, sh -c reports its own argv[0] as $0
+	output, code, err := sb.RunArgsAs(context.Background(), "custom-name", []string{"sh", "-c", "echo $0"})
+	if err != nil && code != 0 {
+		t.Fatalf("RunArgsAs() error: %v", err)
+	}
+
+	if strings.TrimSpace(string(output)) != "custom-name" {
+		t.Errorf("expected argv[0] 'custom-name', got %q", string(output))
+	}
+}
+
+func TestNeedsTTYDetected(t *testing.T) {
+	sb, err := New(Config{
+		Workdir:    t.TempDir(),
+		AllowWrite: []string{t.TempDir()},
+	})
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, _, err = sb.Run(ctx, "cat /dev/tty")
+	if ctx.Err() != nil {
+		t.Fatal("reading /dev/tty should fail fast, not hang")
+	}
+
+	if !errors.Is(err, ErrNeedsTTY) {
+		t.Errorf("expected ErrNeedsTTY, got %v", err)
+	}
+}
+
+func TestFrozenTime(t *testing.T) {
+	frozen := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	sb, err := New(Config{
+		Workdir:    t.TempDir(),
+		AllowWrite: []string{t.TempDir()},
+		FrozenTime: &frozen,
+	})
+	if err != nil {
+		t.Skipf("FrozenTime unavailable: %v", err)
+	}
+
+	output, code, err := sb.Run(context.Background(), "date -u +%Y-%m-%dT%H:%M:%SZ")
+	if err != nil && code != 0 {
+		t.Fatalf("Run() error: %v", err)
+	}
+
+	if got := strings.TrimSpace(string(output)); got != "2024-01-02T03:04:05Z" {
+		t.Errorf("expected frozen time 2024-01-02T03:04:05Z, got %q", got)
+	}
+}
+
+func TestWildcardDenyRead(t *testing.T) {
+	secretDir := t.TempDir()
+	secret := filepath.Join(secretDir, "secret.txt")
+	if err := os.WriteFile(secret, []byte("TOPSECRET"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	workdir := t.TempDir()
+	sb, err := New(Config{
+		Workdir:    workdir,
+		AllowWrite: []string{workdir},
+		DenyRead:   []string{"*"},
+	})
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+
+	output, code, _ := sb.Run(context.Background(), "cat "+secret)
+	if code == 0 || strings.Contains(string(output), "TOPSECRET") {
+		t.Errorf("reads outside AllowWrite should fail, got %q", output)
+	}
+
+	// Programs and the workdir still work
+	output, code, err = sb.Run(context.Background(), "echo ok > out.txt && cat out.txt")
+	if err != nil || code != 0 || strings.TrimSpace(string(output)) != "ok" {
+		t.Errorf("workdir should be usable, got %q, %d, %v", output, code, err)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	t.Setenv("VERIFY_TEST_SECRET", "hunter2")
+
+	sb, err := New(Config{
+		Workdir:     t.TempDir(),
+		AllowWrite:  []string{t.TempDir()},
+		EnvDenylist: []string{"VERIFY_TEST_SECRET"},
+	})
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+
+	report, err := sb.Verify(context.Background())
+	if err != nil {
+		t.Fatalf("Verify() error: %v", err)
+	}
+
+	if !report.OK() {
+		t.Errorf("protections not enforced: %+v", report)
+	}
+	if !report.EnvFiltered.Checked {
+		t.Errorf("env probe should run: %+v", report.EnvFiltered)
+	}
+}
+
+func TestRunResultDurations(t *testing.T) {
+	sb, err := New(Config{Workdir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+
+	res, err := sb.RunResult(context.Background(), "sleep 0.1")
+	if err != nil {
+		t.Fatalf("RunResult() error: %v", err)
+	}
+	if res.CommandDuration < 100*time.Millisecond {
+		t.Errorf("CommandDuration = %v, want >= 100ms", res.CommandDuration)
+	}
+	if runtime.GOOS == "linux" && res.SetupDuration <= 0 {
+		t.Errorf("SetupDuration = %v, want > 0 on Linux", res.SetupDuration)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	project := t.TempDir()
+	cache := filepath.Join(project, "cache")
+	if err := os.Mkdir(cache, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(cache, "entry"), []byte("cached\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	sb, err := New(Config{
+		Workdir:    project,
+		AllowWrite: []string{project},
+		ReadOnly:   []string{cache},
+	})
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+
+	out, code, err := sb.Run(context.Background(), "cat cache/entry")
+	if code != 0 || err != nil || string(out) != "cached\n" {
+		t.Errorf("read from ReadOnly path should succeed, got %q, exit %d: %v", out, code, err)
+	}
+	if _, code, _ := sb.Run(context.Background(), "echo evil > cache/entry"); code == 0 {
+		t.Error("write to ReadOnly path should fail")
+	}
+	if data, _ := os.ReadFile(filepath.Join(cache, "entry")); string(data) != "cached\n" {
+		t.Errorf("ReadOnly file was modified: %q", data)
+	}
+}
+
+func TestSampleUsageGrowingMemory(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("SampleUsage is Linux only")
+	}
+	dir := t.TempDir()
+	sb, err := New(Config{Workdir: dir, AllowWrite: []string{dir}, SampleUsage: 50 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+
+	// Each step appends a 4MB string to a shell variable, holding it in memory
+	grow := `c=x; for i in $(seq 22); do c="$c$c"; done; x=; for i in $(seq 10); do x="$x$c"; sleep 0.1; done`
+	res, err := sb.RunResult(context.Background(), grow)
+	if err != nil {
+		t.Fatalf("RunResult() error: %v", err)
+	}
+	samples := res.UsageSamples
+	if len(samples) < 9 {
+		t.Fatalf("expected samples every 50ms, got %+v", samples)
+	}
+	// Forks briefly count the shell's pages twice, so compare peaks
+	third := len(samples) / 3
+	early, late := peakRSS(samples[:third]), peakRSS(samples[len(samples)-third:])
+	if late < early+20_000_000 {
+		t.Errorf("RSS should grow by about 40MB, peaked at %d early and %d late", early, late)
+	}
+}
+
+func peakRSS(samples []UsageSample) int64 {
+	return slices.MaxFunc(samples, func(a, b UsageSample) int { return cmp.Compare(a.RSSBytes, b.RSSBytes) }).RSSBytes
+}
+
+func TestTimeoutKeepsPartialOutput(t *testing.T) {
+	dir := t.TempDir()
+	sb, err := New(Config{Workdir: dir, AllowWrite: []string{dir}, Timeout: 500 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+
+	res, err := sb.RunResult(context.Background(), "echo started; sleep 10")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("RunResult() error = %v, want DeadlineExceeded", err)
+	}
+	if !res.TimedOut || string(res.Stdout) != "started\n" {
+		t.Errorf("a timed-out run should keep its output, got TimedOut=%v stdout %q", res.TimedOut, res.Stdout)
+	}
+}
+
+func TestTmpfsWorkdir(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("TmpfsWorkdir is Linux only")
+	}
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "host.txt"), []byte("host\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sb, err := New(Config{Workdir: dir, AllowWrite: []string{dir}, TmpfsWorkdir: true, TmpfsWorkdirSize: "16m"})
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+
+	out, code, err := sb.Run(context.Background(), "echo built > out.txt && cat out.txt && ls && stat -f -c %T .")
+	if code != 0 || err != nil {
+		t.Fatalf("Run() exit %d: %v\n%s", code, err, out)
+	}
+	if string(out) != "built\nout.txt\ntmpfs\n" {
+		t.Errorf("workdir should be an empty tmpfs, got %q", out)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "out.txt")); !os.IsNotExist(err) {
+		t.Error("writes in the tmpfs workdir should not reach the host disk")
+	}
+}
+
+func TestCaptureViolationsDeniedRead(t *testing.T) {
+	if runtime.GOOS != "darwin" {
+		t.Skip("CaptureViolations is macOS only")
+	}
+	dir := t.TempDir()
+	secrets := filepath.Join(dir, "secrets")
+	if err := os.Mkdir(secrets, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(secrets, "token.txt"), []byte("hunter2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sb, err := New(Config{Workdir: dir, AllowWrite: []string{dir}, DenyRead: []string{secrets}, CaptureViolations: true})
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+
+	res, err := sb.RunResult(context.Background(), "cat secrets/token.txt")
+	if err != nil {
+		t.Fatalf("RunResult() error: %v", err)
+	}
+	if res.ExitCode == 0 {
+		t.Fatalf("reading a denyRead file should fail, got %q", res.Combined)
+	}
+	found := slices.ContainsFunc(res.Violations, func(v Violation) bool {
+		return strings.HasPrefix(v.Operation, "file-read") && strings.HasSuffix(v.Target, "token.txt")
+	})
+	if !found {
+		t.Errorf("the denied read should be a violation, got %+v", res.Violations)
+	}
+}
+
+func TestProtectHomeDotfiles(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	bashrc := filepath.Join(home, ".bashrc")
+	if err := os.WriteFile(bashrc, []byte("# rc\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	project := t.TempDir()
+
+	sb, err := New(Config{
+		Workdir:             project,
+		AllowWrite:          []string{home, project},
+		ProtectHomeDotfiles: true,
+	})
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+
+	if _, code, _ := sb.Run(context.Background(), "echo evil >> ~/.bashrc"); code == 0 {
+		t.Error("write to ~/.bashrc should fail")
+	}
+	if data, _ := os.ReadFile(bashrc); string(data) != "# rc\n" {
+		t.Errorf("~/.bashrc was modified: %q", data)
+	}
+
+	if _, code, err := sb.Run(context.Background(), "touch out.txt"); code != 0 || err != nil {
+		t.Errorf("write to project should succeed, got exit %d: %v", code, err)
+	}
+}
+
+func TestWorkdirInDenyReadCarvedOut(t *testing.T) {
+	denied := t.TempDir()
+	workdir := filepath.Join(denied, "project")
+	if err := os.MkdirAll(workdir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(workdir, "main.go"), []byte("package main\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(denied, "secret"), []byte("hunter2\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	sb, err := New(Config{
+		Workdir:    workdir,
+		AllowWrite: []string{workdir},
+		DenyRead:   []string{denied},
+	})
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+
+	output, code, err := sb.Run(context.Background(), "cat main.go && touch out.txt")
+	if code != 0 || err != nil || string(output) != "package main\n" {
+		t.Errorf("workdir should stay accessible, got %q, exit %d: %v", output, code, err)
+	}
+
+	output, _, _ = sb.Run(context.Background(), "cat ../secret 2>/dev/null")
+	if strings.Contains(string(output), "hunter2") {
+		t.Error("the rest of the DenyRead dir should stay hidden")
+	}
+}
+
+func TestPIDNamespace(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("PID namespaces are Linux only")
+	}
+	sb, err := New(Config{Workdir: t.TempDir(), PIDNamespace: true})
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+
+	stdout, _, err := sb.Run(context.Background(), "ps -e -o pid=,comm=")
+	if err != nil {
+		t.Fatalf("Run() error: %v", err)
+	}
+	// bwrap's init, the shell and ps itself
+	lines := strings.Split(strings.TrimSpace(string(stdout)), "\n")
+	if len(lines) > 3 {
+		t.Errorf("ps should show only the sandboxed tree, got:\n%s", stdout)
+	}
+	if !strings.HasPrefix(strings.TrimSpace(lines[0]), "1 ") {
+		t.Errorf("first process should be PID 1, got %q", lines[0])
+	}
+}
+
+func TestTrackReads(t *testing.T) {
+	workdir := t.TempDir()
+	input := filepath.Join(workdir, "input.txt")
+	if err := os.WriteFile(input, []byte("data\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	sb, err := New(Config{Workdir: workdir, AllowWrite: []string{workdir}, TrackReads: true})
+	if err != nil {
+		t.Skipf("TrackReads unavailable: %v", err)
+	}
+
+	res, err := sb.RunResult(context.Background(), "cat input.txt")
+	if err != nil {
+		t.Fatalf("RunResult() error: %v", err)
+	}
+
+	input, _ = expandPath(input)
+	found := false
+	for _, path := range res.ReadPaths {
+		if path == input {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("ReadPaths = %v, should contain %q", res.ReadPaths, input)
+	}
+}
+
+func TestRunNoNetwork(t *testing.T) {
+	sb, err := New(Config{Workdir: t.TempDir()})
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+
+	// Only loopback is left without network: no route to any other address
+	cmd := "cat /proc/net/route 2>/dev/null | tail -n +2 | wc -l"
+	if runtime.GOOS == "darwin" {
+		cmd = "curl -s -m 5 -o /dev/null http://1.1.1.1 && echo online || echo offline"
+	}
+	output, _, _ := sb.RunNoNetwork(context.Background(), cmd)
+	if got := strings.TrimSpace(string(output)); got != "0" && got != "offline" {
+		t.Errorf("command should have no network, got %q", got)
+	}
+}
+
+func TestNoNetwork(t *testing.T) {
+	sb, err := New(Config{Workdir: t.TempDir(), NoNetwork: true})
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+
+	cmd := "cat /proc/net/route 2>/dev/null | tail -n +2 | wc -l"
+	if runtime.GOOS == "darwin" {
+		cmd = "curl -s -m 5 -o /dev/null http://1.1.1.1 && echo online || echo offline"
+	}
+	output, _, _ := sb.Run(context.Background(), cmd)
+	if got := strings.TrimSpace(string(output)); got != "0" && got != "offline" {
+		t.Errorf("command should have no network, got %q", got)
+	}
+}
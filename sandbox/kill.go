@@ -0,0 +1,35 @@
+//go:build linux || darwin
+
+package sandbox
+
+import (
+	"context"
+	"syscall"
+	"time"
+)
+
+// watchCancel stops the process group led by pid once ctx is done, unless
+// done is closed first. term asks the group to exit, and SIGKILL follows
+// after grace if the run hasn't finished by then. With no grace the group
+// is killed at once.
+func watchCancel(ctx context.Context, pid int, grace time.Duration, term func(pgid int), done <-chan struct{}) {
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+			return
+		}
+
+		if grace > 0 {
+			term(pid)
+			t := time.NewTimer(grace)
+			defer t.Stop()
+			select {
+			case <-done:
+				return
+			case <-t.C:
+			}
+		}
+		syscall.Kill(-pid, syscall.SIGKILL)
+	}()
+}
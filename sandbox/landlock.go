@@ -0,0 +1,19 @@
+//go:build linux
+
+package sandbox
+
+import "syscall"
+
+const (
+	sysLandlockCreateRuleset     = 444 // Same number on all architectures
+	landlockCreateRulesetVersion = 1 << 0
+)
+
+// landlockABI returns the Landlock ABI version supported by the kernel, or 0.
+func landlockABI() int {
+	v, _, errno := syscall.Syscall(sysLandlockCreateRuleset, 0, 0, landlockCreateRulesetVersion)
+	if errno != 0 {
+		return 0
+	}
+	return int(v)
+}
@@ -7,23 +7,226 @@ import (
 	"context"
 	"fmt"
 	"io"
+	"os"
 	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 	"syscall"
+	"time"
 )
 
 type linuxSandbox struct {
-	cfg      Config
-	bwrapBin string
+	cfg          Config
+	bwrapBin     string
+	bwrapVersion string // From bwrap --version, "" if unknown
+	faketimeLib  string // libfaketime, preloaded when FrozenTime is set
+	straceBin    string // strace, wrapping the command when TrackReads is set
+	seccomp      []byte // Compiled SeccompProfile filter, nil if unset
+	prlimitBin   string // prlimit, applying resource limits to the command
+	tasksetBin   string // taskset, pinning the command when CPUAffinity is set
+	pastaBin     string // pasta, giving bwrap a network namespace when AllowedPorts is set
+	nftBin       string // nft, filtering that namespace's traffic
+	dropRoot     bool   // Run the command as nobody, set when DropRoot applies
+}
+
+// geteuid returns the effective uid, replaced in tests.
+var geteuid = os.Geteuid
+
+// nobodyID is the uid and gid DropRoot runs the command as.
+const nobodyID = "65534"
+
+// prlimitArgs returns the prlimit options for the configured limits.
+// The CPU hard limit is a second above the soft one, so the command gets
+// SIGXCPU, which identifies the cause, before the kernel's SIGKILL.
+func (s *linuxSandbox) prlimitArgs() []string {
+	var limits []string
+	if s.cfg.MemoryLimitBytes > 0 {
+		limits = append(limits, "--as="+strconv.FormatInt(s.cfg.MemoryLimitBytes, 10))
+	}
+	if s.cfg.CPUTimeLimit > 0 {
+		secs := int64((s.cfg.CPUTimeLimit + time.Second - 1) / time.Second)
+		limits = append(limits, fmt.Sprintf("--cpu=%d:%d", secs, secs+1))
+	}
+	if s.cfg.OpenFilesLimit > 0 {
+		limits = append(limits, "--nofile="+strconv.Itoa(s.cfg.OpenFilesLimit))
+	}
+	if s.cfg.FileSizeLimitBytes > 0 {
+		limits = append(limits, "--fsize="+strconv.FormatInt(s.cfg.FileSizeLimitBytes, 10))
+	}
+	if s.cfg.ProcessLimit > 0 {
+		limits = append(limits, "--nproc="+strconv.Itoa(s.cfg.ProcessLimit))
+	}
+	return limits
+}
+
+// checkRoot warns, or fails under StrictRoot, when run as root. bwrap then
+// runs privileged instead of in a user namespace, so the command runs as
+// uid 0: with its capabilities dropped it can still read any root-owned
+// file the sandbox exposes, and any kept Capabilities apply to the host.
+// It reports whether DropRoot should apply.
+func checkRoot(cfg *Config) (bool, error) {
+	if geteuid() != 0 {
+		return false, nil
+	}
+	if cfg.DropRoot {
+		return true, nil
+	}
+	if cfg.StrictRoot {
+		return false, fmt.Errorf("running as root: the command would run as uid 0 and could read root-owned files the sandbox exposes; run as a regular user or set DropRoot")
+	}
+	degradef(cfg, "running as root: the command runs as uid 0 and can read root-owned files the sandbox exposes; run as a regular user or set DropRoot")
+	return false, nil
+}
+
+// namespaceDir lists the namespace types the kernel supports, one file each.
+var namespaceDir = "/proc/self/ns"
+
+// checkNamespaces turns off UnshareIPC, UnshareUTS and Hostname if the
+// kernel lacks the namespace type they need, marking the sandbox degraded
+// rather than failing: bwrap would refuse to start.
+func checkNamespaces(cfg *Config) {
+	if cfg.UnshareIPC && !namespaceSupported("ipc") {
+		degradef(cfg, "the kernel has no IPC namespaces (CONFIG_IPC_NS): UnshareIPC is ignored and the command shares the host's System V IPC")
+		cfg.UnshareIPC = false
+	}
+	if (cfg.UnshareUTS || cfg.Hostname != "") && !namespaceSupported("uts") {
+		degradef(cfg, "the kernel has no UTS namespaces (CONFIG_UTS_NS): UnshareUTS and Hostname are ignored and the command sees the host's hostname")
+		cfg.UnshareUTS = false
+		cfg.Hostname = ""
+	}
+}
+
+// namespaceSupported reports whether the kernel supports namespaces of the
+// given type, e.g. "ipc".
+func namespaceSupported(kind string) bool {
+	_, err := os.Lstat(filepath.Join(namespaceDir, kind))
+	return err == nil
+}
+
+// straceOutputFD is the fd strace writes its trace to for TrackReads.
+// fd 3 is bwrap's --info-fd.
+const straceOutputFD = 4
+
+// seccompFD is the fd bwrap reads the SeccompProfile filter from, after
+// straceOutputFD if TrackReads uses it.
+func (s *linuxSandbox) seccompFD() int {
+	if s.cfg.TrackReads {
+		return straceOutputFD + 1
+	}
+	return straceOutputFD
+}
+
+// confinedBwrapDirs mark a bwrap packaged as a snap or flatpak, whose own
+// confinement limits what it can mount.
+var confinedBwrapDirs = []string{"/snap/", "/var/lib/snapd/", "/flatpak/"}
+
+// systemBwrapPaths are where distribution packages install bwrap.
+var systemBwrapPaths = []string{"/usr/bin/bwrap", "/usr/local/bin/bwrap", "/bin/bwrap"}
+
+// systemReadDirs are the only host dirs mounted when DenyRead is the
+// wildcard, enough to run programs, like the darwin profile's allowed paths.
+var systemReadDirs = []string{"/usr", "/bin", "/sbin", "/lib", "/lib32", "/lib64", "/libx32", "/etc", "/var", "/opt"}
+
+// gpuDevicePatterns are glob patterns for the NVIDIA device nodes.
+var gpuDevicePatterns = []string{"/dev/nvidia*", "/dev/nvidia-caps/*"}
+
+// faketimeLibPaths are glob patterns for libfaketime across distributions.
+var faketimeLibPaths = []string{
+	"/usr/lib/*/faketime/libfaketime.so.1",
+	"/usr/lib/faketime/libfaketime.so.1",
+	"/usr/lib64/faketime/libfaketime.so.1",
+	"/usr/local/lib/faketime/libfaketime.so.1",
 }
 
 func newLinux(cfg Config) (Sandbox, error) {
-	bin, err := exec.LookPath("bwrap")
+	if len(cfg.NetworkAllow) > 0 {
+		return nil, fmt.Errorf("NetworkAllow is not supported on Linux: bwrap can't filter network by host, use NoNetwork instead")
+	}
+	if cfg.CaptureViolations {
+		return nil, fmt.Errorf("CaptureViolations is only supported on macOS: bwrap denials aren't logged, see Result.ReadPaths and ErrWriteDenied instead")
+	}
+	if len(cfg.AllowedPorts) > 0 && cfg.TrackReads {
+		return nil, fmt.Errorf("AllowedPorts can't be combined with TrackReads: pasta closes the file descriptor strace writes to")
+	}
+	if len(cfg.AllowedPorts) > 0 && cfg.SeccompProfile != "" {
+		return nil, fmt.Errorf("AllowedPorts can't be combined with SeccompProfile: pasta closes the file descriptor bwrap reads the filter from")
+	}
+	if cfg.TrackReads && cfg.SeccompProfile == SeccompDefault {
+		return nil, fmt.Errorf("TrackReads can't be combined with the default SeccompProfile: it blocks the ptrace strace needs")
+	}
+
+	dropRoot, err := checkRoot(&cfg)
+	if err != nil {
+		return nil, err
+	}
+	checkNamespaces(&cfg)
+
+	found, err := exec.LookPath("bwrap")
 	if err != nil {
 		return nil, fmt.Errorf("bubblewrap not found: install with 'apt install bubblewrap' or 'dnf install bubblewrap'")
 	}
 
-	s := &linuxSandbox{cfg: cfg, bwrapBin: bin}
+	bin, confined := selectBwrap(found, systemBwrapPaths)
+	if confined {
+		warnf(&cfg, "bwrap at %q is a snap or flatpak wrapper and may not work; install the distribution's bubblewrap package", bin)
+	}
+
+	out, _ := exec.Command(bin, "--version").Output()
+	s := &linuxSandbox{cfg: cfg, bwrapBin: bin, bwrapVersion: parseBwrapVersion(string(out)), dropRoot: dropRoot}
+
+	if (cfg.TmpfsSize != "" || cfg.TmpfsWorkdirSize != "") && !bwrapAtLeast(s.bwrapVersion, tmpfsSizeVersion) {
+		warnf(&s.cfg, "bwrap %s has no --size option (added in %s): TmpfsSize and TmpfsWorkdirSize are ignored and tmpfs mounts use the kernel's default size", s.bwrapVersion, tmpfsSizeVersion)
+		s.cfg.TmpfsSize = ""
+		s.cfg.TmpfsWorkdirSize = ""
+	}
+
+	if cfg.FrozenTime != nil {
+		s.faketimeLib, err = findFaketimeLib()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if cfg.SeccompProfile != "" {
+		s.seccomp, err = loadSeccomp(cfg.SeccompProfile)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SeccompProfile: %w", err)
+		}
+	}
+
+	if cfg.TrackReads {
+		s.straceBin, err = exec.LookPath("strace")
+		if err != nil {
+			return nil, fmt.Errorf("TrackReads requires strace: install with 'apt install strace' or 'dnf install strace'")
+		}
+	}
+
+	if len(s.prlimitArgs()) > 0 {
+		s.prlimitBin, err = exec.LookPath("prlimit")
+		if err != nil {
+			return nil, fmt.Errorf("resource limits (MemoryLimitBytes, CPUTimeLimit, OpenFilesLimit, FileSizeLimitBytes, ProcessLimit) require prlimit: install with 'apt install util-linux' or 'dnf install util-linux'")
+		}
+	}
+
+	if len(cfg.CPUAffinity) > 0 {
+		s.tasksetBin, err = exec.LookPath("taskset")
+		if err != nil {
+			return nil, fmt.Errorf("CPUAffinity requires taskset: install with 'apt install util-linux' or 'dnf install util-linux'")
+		}
+	}
+
+	if len(cfg.AllowedPorts) > 0 {
+		s.pastaBin, err = exec.LookPath("pasta")
+		if err != nil {
+			return nil, fmt.Errorf("AllowedPorts requires pasta to give the sandbox a network namespace of its own: install with 'apt install passt' or 'dnf install passt'")
+		}
+		s.nftBin, err = exec.LookPath("nft")
+		if err != nil {
+			return nil, fmt.Errorf("AllowedPorts requires nft: install with 'apt install nftables' or 'dnf install nftables'")
+		}
+	}
 
 	if err := s.testUserNamespace(); err != nil {
 		return nil, fmt.Errorf("user namespaces disabled: run 'sudo sysctl kernel.unprivileged_userns_clone=1': %w", err)
@@ -37,70 +240,316 @@ func (s *linuxSandbox) Run(ctx context.Context, cmd string) ([]byte, int, error)
 }
 
 func (s *linuxSandbox) RunWithStdin(ctx context.Context, cmd string, stdin io.Reader) ([]byte, int, error) {
-	args := s.buildArgs(cmd)
+	if err := checkCommand(cmd); err != nil {
+		return nil, 0, err
+	}
+	if err := checkBinary(s.cfg, "sh"); err != nil {
+		return nil, 0, err
+	}
+
+	res, err := s.run(ctx, cmd, s.buildArgs(cmd), stdin, nil)
+	return res.Combined, res.ExitCode, err
+}
+
+func (s *linuxSandbox) RunNoNetwork(ctx context.Context, cmd string) ([]byte, int, error) {
+	offline := *s
+	offline.cfg.NoNetwork = true
+	return offline.Run(ctx, cmd)
+}
+
+func (s *linuxSandbox) RunWithEnv(ctx context.Context, cmd string, env map[string]string) ([]byte, int, error) {
+	if err := checkEnv(env); err != nil {
+		return nil, 0, err
+	}
+	withEnv := *s
+	withEnv.cfg.runEnv = env
+	return withEnv.Run(ctx, cmd)
+}
+
+func (s *linuxSandbox) RunResult(ctx context.Context, cmd string) (*Result, error) {
+	if err := checkCommand(cmd); err != nil {
+		return nil, err
+	}
+	if err := checkBinary(s.cfg, "sh"); err != nil {
+		return nil, err
+	}
+
+	res, err := s.run(ctx, cmd, s.buildArgs(cmd), nil, nil)
+	return &res, err
+}
+
+func (s *linuxSandbox) RunSeparate(ctx context.Context, cmd string) ([]byte, []byte, int, error) {
+	res, err := s.RunResult(ctx, cmd)
+	if res == nil {
+		return nil, nil, 0, err
+	}
+	return res.Stdout, res.Stderr, res.ExitCode, err
+}
+
+func (s *linuxSandbox) RunStream(ctx context.Context, cmd string, stdout, stderr io.Writer) (int, error) {
+	if err := checkCommand(cmd); err != nil {
+		return 0, err
+	}
+	if err := checkBinary(s.cfg, "sh"); err != nil {
+		return 0, err
+	}
 
 	if s.cfg.DryRun {
-		return []byte(s.dryRunOutput(args)), 0, nil
+		_, err := io.WriteString(orDiscard(stdout), s.dryRunOutput(s.buildArgs(cmd)))
+		return 0, err
 	}
 
-	c := exec.Command(s.bwrapBin, args...)
+	res, err := s.run(ctx, cmd, s.buildArgs(cmd), nil, &outputSink{stdout: stdout, stderr: stderr})
+	return res.ExitCode, err
+}
+
+func (s *linuxSandbox) RunArgs(ctx context.Context, argv []string) ([]byte, int, error) {
+	return s.RunArgsAs(ctx, "", argv)
+}
+
+func (s *linuxSandbox) RunArgsAs(ctx context.Context, name string, argv []string) ([]byte, int, error) {
+	if err := checkArgv(s.cfg, argv); err != nil {
+		return nil, 0, err
+	}
+
+	res, err := s.run(ctx, strings.Join(argv, " "), s.buildExecArgs(name, argv), nil, nil)
+	return res.Combined, res.ExitCode, err
+}
+
+// Bwrap returns the bubblewrap binary in use and its version.
+func (s *linuxSandbox) Bwrap() (path, version string) {
+	return s.bwrapBin, s.bwrapVersion
+}
+
+func (s *linuxSandbox) Verify(ctx context.Context) (VerifyReport, error) {
+	return verify(ctx, s, s.cfg)
+}
+
+// run executes bwrap with the given args; command describes it for tracing.
+// Output goes to sink if set, otherwise into the Result. A dry run's output
+// is always in the Result.
+func (s *linuxSandbox) run(ctx context.Context, command string, args []string, stdin io.Reader, sink *outputSink) (Result, error) {
+	if s.cfg.DryRun {
+		return dryRunResult(s.cfg, s.dryRunOutput(args)), nil
+	}
+
+	return transcribe(s.cfg, command, stdin, func(stdin io.Reader) (Result, error) {
+		return execute(ctx, s.cfg, command, func(ctx context.Context) (Result, error) {
+			return s.invoke(ctx, args, stdin, sink)
+		})
+	})
+}
+
+// invoke runs bwrap and returns its raw output.
+func (s *linuxSandbox) invoke(ctx context.Context, args []string, stdin io.Reader, sink *outputSink) (Result, error) {
+	// bwrap writes its info JSON to fd 3 once the namespaces are created and
+	// the command's process is started, which ends the setup phase
+	infoR, infoW, err := os.Pipe()
+	if err != nil {
+		return Result{}, err
+	}
+	defer infoR.Close()
+	defer infoW.Close()
+
+	argv := s.commandArgv(args)
+	c := exec.Command(argv[0], argv[1:]...)
+	c.ExtraFiles = []*os.File{infoW}
+
+	// strace writes its trace to straceOutputFD, inherited through bwrap
+	var traceR, traceW *os.File
+	if s.cfg.TrackReads {
+		traceR, traceW, err = os.Pipe()
+		if err != nil {
+			return Result{}, err
+		}
+		defer traceR.Close()
+		defer traceW.Close()
+		c.ExtraFiles = append(c.ExtraFiles, traceW)
+	}
+
+	// bwrap reads the seccomp filter from a pipe at seccompFD, which holds
+	// the whole filter: it's far smaller than the pipe buffer
+	if s.seccomp != nil {
+		filterR, filterW, err := os.Pipe()
+		if err != nil {
+			return Result{}, err
+		}
+		defer filterR.Close()
+		_, err = filterW.Write(s.seccomp)
+		filterW.Close()
+		if err != nil {
+			return Result{}, err
+		}
+		c.ExtraFiles = append(c.ExtraFiles, filterR)
+	}
 	c.Env = buildEnv(s.cfg)
-	c.Stdin = stdin
-	// Create new process group so we can kill all children
-	c.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	// New session: its own process group so we can kill all children, and
+	// no controlling terminal so TTY reads fail fast instead of hanging
+	c.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
 
-	// Use a buffer to capture combined output
-	var buf bytes.Buffer
-	c.Stdout = &buf
-	c.Stderr = &buf
+	// Capture or stream stdout and stderr separately, each within its own limit
+	capture := captureFor(s.cfg, sink)
+	c.Stdout = &capture.stdout
+	c.Stderr = &capture.stderr
 
+	release, err := feedStdin(c, stdin, s.cfg.StdinFile)
+	if err != nil {
+		return Result{}, err
+	}
+	defer release()
+
+	start := time.Now()
 	if err := c.Start(); err != nil {
-		return nil, 0, err
+		return Result{}, err
 	}
+	infoW.Close()
 
-	// Watch for context cancellation
-	done := make(chan struct{})
+	// The sandbox's processes stay in bwrap's session unless they start
+	// their own
+	var usage *usageSampler
+	if s.cfg.SampleUsage > 0 {
+		usage = sampleUsage("/proc", c.Process.Pid, s.cfg.SampleUsage)
+	}
+
+	var trace bytes.Buffer
+	traceDone := make(chan struct{})
+	if traceR != nil {
+		traceW.Close()
+		go func() {
+			trace.ReadFrom(traceR)
+			close(traceDone)
+		}()
+	} else {
+		close(traceDone)
+	}
+
+	setupDone := make(chan time.Time, 1)
 	go func() {
-		select {
-		case <-ctx.Done():
-			if c.Process != nil {
-				syscall.Kill(-c.Process.Pid, syscall.SIGKILL)
-			}
-		case <-done:
+		if n, _ := infoR.Read(make([]byte, 1)); n > 0 {
+			setupDone <- time.Now()
 		}
+		close(setupDone)
 	}()
 
+	// Watch for context cancellation
+	done := make(chan struct{})
+	watchCancel(ctx, c.Process.Pid, s.cfg.KillGrace, termBwrapGroup, done)
+
 	// Wait for process to finish
 	waitErr := c.Wait()
+	end := time.Now()
 	close(done)
+	samples := usage.finish()
 
-	output := buf.Bytes()
-	exitCode := 0
+	exitCode, signal := 0, syscall.Signal(0)
 	if c.ProcessState != nil {
-		exitCode = c.ProcessState.ExitCode()
+		exitCode, signal = exitStatus(c.ProcessState)
+		// bwrap exits 128+n when its child dies of signal n. After
+		// cancellation that's the SIGTERM or SIGKILL sent to the group.
+		if signal == 0 && ctx.Err() != nil && exitCode > 128 {
+			signal = syscall.Signal(exitCode - 128)
+		}
+		exitCode = remapExitCode(exitCode, s.cfg.ExitCodeMap)
+	}
+	res := capture.result(exitCode)
+	res.Signaled = signal != 0
+	res.Signal = signal
+	res.UsageSamples = samples
+
+	// Without bwrap's signal (e.g. setup failed), all time counts as command time
+	infoR.Close()
+	ready, ok := <-setupDone
+	if !ok {
+		ready = start
+	}
+	res.SetupDuration = ready.Sub(start)
+	res.CommandDuration = end.Sub(ready)
+
+	// A process that escaped the trace may hold the pipe open, so don't
+	// wait for the rest of the trace forever
+	if traceR != nil {
+		traceR.SetReadDeadline(time.Now().Add(time.Second))
+		<-traceDone
+		res.ReadPaths = parseStraceReads(trace.Bytes(), s.cfg.Workdir)
 	}
 
 	// If context was cancelled, return context error
 	if ctx.Err() != nil {
-		return output, exitCode, ctx.Err()
+		return res, ctx.Err()
 	}
-	return output, exitCode, waitErr
+	return res, waitErr
 }
 
 func (s *linuxSandbox) buildArgs(cmd string) []string {
-	args := []string{
-		"--share-net", // Allow network access
-		"--die-with-parent",
+	return s.buildExecArgs("", shellArgv(s.cfg, cmd))
+}
+
+// buildExecArgs builds bwrap args that execute argv directly.
+// A non-empty name is passed to the process as its argv[0].
+func (s *linuxSandbox) buildExecArgs(name string, argv []string) []string {
+	network := "--share-net" // Allow network access
+	if s.cfg.NoNetwork {
+		network = "--unshare-net"
+	}
+	args := []string{network, "--die-with-parent"}
+	if s.dropRoot {
+		// A user namespace mapping root to nobody
+		args = append(args, "--unshare-user", "--uid", nobodyID, "--gid", nobodyID)
+	}
+	// Only the listed capabilities are kept, which matters when running as
+	// root: bwrap otherwise leaves the command root's capabilities
+	args = append(args, "--cap-drop", "ALL")
+	for _, c := range s.cfg.Capabilities {
+		args = append(args, "--cap-add", c)
+	}
+	if s.seccomp != nil {
+		// Applied to the command, after bwrap has set up the mounts
+		args = append(args, "--seccomp", strconv.Itoa(s.seccompFD()))
+	}
+	if s.cfg.PIDNamespace {
+		// bwrap runs its own init as PID 1, reaping orphaned children until
+		// the command exits. /proc, mounted below, shows only this namespace,
+		// so the command can't see or signal host processes. When bwrap
+		// dies, --die-with-parent kills the init and with it the namespace.
+		args = append(args, "--unshare-pid")
+	}
+	if s.cfg.UnshareIPC {
+		args = append(args, "--unshare-ipc")
+	}
+	if s.cfg.UnshareUTS || s.cfg.Hostname != "" {
+		args = append(args, "--unshare-uts")
+		if s.cfg.Hostname != "" {
+			args = append(args, "--hostname", s.cfg.Hostname)
+		}
 	}
 
-	// Handle root filesystem mount based on wildcard
-	if HasWildcard(s.cfg.AllowWrite) {
+	// Handle root filesystem mount based on wildcards
+	if readAllowlisted(s.cfg) {
+		// AllowRead or wildcard denyRead: mount only system dirs and
+		// AllowRead paths, so nothing else on the host is readable except
+		// the AllowWrite paths bound below
+		bind := "--ro-bind-try"
+		if HasWildcard(s.cfg.AllowWrite) {
+			bind = "--bind-try"
+		}
+		for _, dir := range systemReadDirs {
+			args = append(args, bind, dir, dir)
+		}
+		for _, path := range s.cfg.AllowRead {
+			if !pathInDenyRead(path, s.cfg.DenyRead) {
+				args = append(args, "--ro-bind-try", path, path)
+			}
+		}
+		// ReadOnly paths are bound below
+	} else if HasWildcard(s.cfg.AllowWrite) {
 		// Wildcard: allow all writes - mount root as read-write
 		args = append(args, "--bind", "/", "/")
 	} else {
 		// Read-only bind mount of root filesystem
 		args = append(args, "--ro-bind", "/", "/")
+	}
 
+	if !HasWildcard(s.cfg.AllowWrite) {
 		// Writable bind mounts (skip paths in DenyRead)
 		for _, path := range s.cfg.AllowWrite {
 			if pathInDenyRead(path, s.cfg.DenyRead) {
@@ -110,19 +559,76 @@ func (s *linuxSandbox) buildArgs(cmd string) []string {
 		}
 	}
 
-	// Handle read restrictions
-	if HasWildcard(s.cfg.DenyRead) {
-		// Wildcard denyRead on Linux: hide home directory
-		// Can't hide everything, but hide user data
-		home, _ := expandPathNoResolve("~")
-		if home != "" {
-			args = append(args, "--tmpfs", home)
+	// Read-only binds over writable mounts (missing paths are skipped)
+	for _, path := range s.cfg.denyWrite {
+		// Don't expose paths that an allowlist leaves unmounted
+		if readAllowlisted(s.cfg) && !pathWithin(path, slices.Concat(s.cfg.AllowWrite, s.cfg.AllowRead, s.cfg.ReadOnly, systemReadDirs)) {
+			continue
 		}
-	} else {
-		// Hide specific sensitive directories with tmpfs overlay
-		// This must come after ro-bind to overlay the read-only mount
+		args = append(args, "--ro-bind-try", path, path)
+	}
+
+	// ReadOnly paths, over any writable mount (DenyRead takes precedence)
+	for _, path := range s.cfg.ReadOnly {
+		if !pathInDenyRead(path, s.cfg.DenyRead) {
+			args = append(args, "--ro-bind", path, path)
+		}
+	}
+
+	// Hide specific sensitive directories with tmpfs overlay
+	// This must come after ro-bind to overlay the read-only mount
+	if !HasWildcard(s.cfg.DenyRead) {
 		for _, path := range s.cfg.DenyRead {
-			args = append(args, "--tmpfs", path)
+			args = append(args, s.denyReadArgs(path)...)
+		}
+	}
+
+	// Keep PATH entries in a home that DenyRead hid readable
+	for _, dir := range s.cfg.homeCarveOut {
+		args = append(args, "--ro-bind-try", dir, dir)
+	}
+
+	// Re-bind a workdir that DenyRead hid, with its read-only paths
+	if workdirDenied(s.cfg) {
+		bind := "--ro-bind"
+		if HasWildcard(s.cfg.AllowWrite) || pathWithin(s.cfg.Workdir, s.cfg.AllowWrite) {
+			bind = "--bind"
+		}
+		args = append(args, bind, s.cfg.Workdir, s.cfg.Workdir)
+		for _, path := range slices.Concat(s.cfg.denyWrite, s.cfg.ReadOnly) {
+			if pathWithin(path, []string{s.cfg.Workdir}) {
+				args = append(args, "--ro-bind-try", path, path)
+			}
+		}
+	}
+
+	// Share the SSH agent socket, even if DenyRead hides its directory
+	if s.cfg.sshAuthSock != "" {
+		args = append(args, "--bind-try", s.cfg.sshAuthSock, s.cfg.sshAuthSock)
+	}
+
+	// An empty tmpfs over the workdir, hiding the host's files and anything
+	// mounted inside it above, so all the command's work stays in RAM
+	if s.cfg.TmpfsWorkdir {
+		if size, err := parseSize(s.cfg.TmpfsWorkdirSize); err == nil && size > 0 {
+			args = append(args, "--size", strconv.FormatInt(size, 10))
+		}
+		args = append(args, "--tmpfs", s.cfg.Workdir)
+	}
+
+	// Make the DenyRead tmpfs overlays read-only once everything mounted
+	// inside them is in place. The remount isn't recursive, so those mounts
+	// keep their mode; a workdir carved out at the same path is skipped.
+	if s.cfg.DenyReadImpliesNoWrite && !HasWildcard(s.cfg.DenyRead) {
+		for _, path := range s.cfg.DenyRead {
+			if workdirDenied(s.cfg) && path == s.cfg.Workdir {
+				continue
+			}
+			// /dev/null over a file is bound read-only already
+			if info, err := os.Stat(path); err == nil && !info.IsDir() {
+				continue
+			}
+			args = append(args, "--remount-ro", path)
 		}
 	}
 
@@ -130,20 +636,210 @@ func (s *linuxSandbox) buildArgs(cmd string) []string {
 	args = append(args, "--dev", "/dev")
 	args = append(args, "--proc", "/proc")
 
+	// GPU device nodes, after --dev which would hide them. The driver and
+	// CUDA libraries are already readable through the root bind.
+	if s.cfg.EnableGPU {
+		for _, dev := range gpuDevices() {
+			args = append(args, "--dev-bind-try", dev, dev)
+		}
+	}
+
+	// Freeze the clock for the command only, not bwrap itself
+	if s.cfg.FrozenTime != nil {
+		args = append(args,
+			"--setenv", "LD_PRELOAD", s.faketimeLib,
+			"--setenv", "FAKETIME_FMT", "%s",
+			"--setenv", "FAKETIME", strconv.FormatInt(s.cfg.FrozenTime.Unix(), 10),
+		)
+	}
+
+	// Override argv[0] (bwrap >= 0.9)
+	if name != "" {
+		args = append(args, "--argv0", name)
+	}
+
 	// Set working directory
 	args = append(args, "--chdir", s.cfg.Workdir)
 
+	// Resource limits, inherited by everything the command starts
+	if limits := s.prlimitArgs(); len(limits) > 0 {
+		args = append(args, s.prlimitBin)
+		args = append(args, limits...)
+		args = append(args, "--")
+	}
+	if len(s.cfg.CPUAffinity) > 0 {
+		cpus := make([]string, len(s.cfg.CPUAffinity))
+		for i, cpu := range s.cfg.CPUAffinity {
+			cpus[i] = strconv.Itoa(cpu)
+		}
+		// taskset stops parsing options at the list, so it takes no "--"
+		args = append(args, s.tasksetBin, "--cpu-list", strings.Join(cpus, ","))
+	}
+
+	// Trace the command's opens for TrackReads
+	if s.cfg.TrackReads {
+		args = append(args, s.straceBin, "-f", "-qq", "-e", straceReadSyscalls,
+			"-o", fmt.Sprintf("/proc/self/fd/%d", straceOutputFD), "--")
+	}
+
 	// Command to execute
-	args = append(args, "sh", "-c", cmd)
+	args = append(args, argv...)
 
 	return args
 }
 
+// tmpfsSizeVersion is the first bwrap release with --size.
+const tmpfsSizeVersion = "0.6.0"
+
+// denyReadArgs returns the args hiding a DenyRead path: an empty tmpfs over
+// a directory, or /dev/null over a file, which a tmpfs can't be mounted on.
+func (s *linuxSandbox) denyReadArgs(path string) []string {
+	if info, err := os.Stat(path); err == nil && !info.IsDir() {
+		return []string{"--ro-bind", "/dev/null", path}
+	}
+	return s.tmpfsArgs(path)
+}
+
+// tmpfsArgs returns the args for a tmpfs overlay, limited to TmpfsSize if set.
+func (s *linuxSandbox) tmpfsArgs(path string) []string {
+	if size, err := parseSize(s.cfg.TmpfsSize); err == nil && size > 0 {
+		return []string{"--size", strconv.FormatInt(size, 10), "--tmpfs", path}
+	}
+	return []string{"--tmpfs", path}
+}
+
+// termBwrapGroup sends SIGTERM to the processes in bwrap's process group,
+// but not to bwrap itself: it would exit and, with --die-with-parent, take
+// the command down with SIGKILL before it could clean up.
+func termBwrapGroup(pgid int) {
+	entries, _ := os.ReadDir("/proc")
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err == nil && pid != pgid && processGroup(pid) == pgid {
+			syscall.Kill(pid, syscall.SIGTERM)
+		}
+	}
+}
+
+// processGroup returns the process group of pid, or -1 if it's gone.
+func processGroup(pid int) int {
+	stat, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return -1
+	}
+	// The fields after the parenthesized command name start with state,
+	// ppid and pgrp; the name itself may contain spaces and parentheses
+	fields := strings.Fields(string(stat[bytes.LastIndexByte(stat, ')')+1:]))
+	if len(fields) < 3 {
+		return -1
+	}
+	pgrp, err := strconv.Atoi(fields[2])
+	if err != nil {
+		return -1
+	}
+	return pgrp
+}
+
 func (s *linuxSandbox) testUserNamespace() error {
 	c := exec.Command(s.bwrapBin, "--ro-bind", "/", "/", "/usr/bin/true")
 	return c.Run()
 }
 
+// selectBwrap returns found, or the first system bwrap if found is a snap
+// or flatpak wrapper. confined reports that only a wrapper is available.
+func selectBwrap(found string, system []string) (path string, confined bool) {
+	if !isConfinedBwrap(found) {
+		return found, false
+	}
+	for _, candidate := range system {
+		if info, err := os.Stat(candidate); err == nil && info.Mode()&0111 != 0 && !isConfinedBwrap(candidate) {
+			return candidate, false
+		}
+	}
+	return found, true
+}
+
+// isConfinedBwrap reports whether path, or the file it links to, belongs to
+// a snap or flatpak (e.g. /snap/bin/bwrap, which links to /usr/bin/snap).
+func isConfinedBwrap(path string) bool {
+	paths := []string{path}
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		paths = append(paths, resolved)
+	}
+
+	for _, p := range paths {
+		if filepath.Base(p) == "snap" {
+			return true
+		}
+		for _, dir := range confinedBwrapDirs {
+			if strings.Contains(p, dir) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// gpuDevices returns the NVIDIA device nodes present on the host.
+func gpuDevices() []string {
+	var devices []string
+	for _, pattern := range gpuDevicePatterns {
+		matches, _ := filepath.Glob(pattern)
+		devices = append(devices, matches...)
+	}
+	return devices
+}
+
+// findFaketimeLib returns the path of the installed libfaketime.
+func findFaketimeLib() (string, error) {
+	for _, pattern := range faketimeLibPaths {
+		if matches, _ := filepath.Glob(pattern); len(matches) > 0 {
+			return matches[0], nil
+		}
+	}
+	return "", fmt.Errorf("FrozenTime requires libfaketime: install with 'apt install faketime' or 'dnf install libfaketime'")
+}
+
+// dryRunOutput returns the dry-run output for bwrap with args. The shell
+// form can be pasted and run unless the plan reads or writes an fd only
+// Run opens (the seccomp filter, the TrackReads trace): it then starts with
+// a comment saying so.
 func (s *linuxSandbox) dryRunOutput(args []string) string {
-	return fmt.Sprintf("%s %s", s.bwrapBin, strings.Join(args, " "))
+	argv := append([]string{s.bwrapBin}, args...)
+	if len(s.cfg.AllowedPorts) > 0 {
+		argv = s.commandArgv(args)
+	}
+	out := formatDryRun(s.cfg, "bwrap", argv)
+	if s.cfg.DryRunFormat == DryRunJSON {
+		return out
+	}
+
+	var fds []string
+	if s.cfg.TrackReads {
+		fds = append(fds, fmt.Sprintf("strace writes the trace to fd %d", straceOutputFD))
+	}
+	if s.seccomp != nil {
+		fds = append(fds, fmt.Sprintf("bwrap reads the seccomp filter from fd %d", s.seccompFD()))
+	}
+	if len(fds) > 0 {
+		out = "# Not runnable as-is: " + strings.Join(fds, " and ") + ", which only the library opens\n" + out
+	}
+	return out
+}
+
+// nftLoadScript loads the ruleset in $1 with the nft at $2, then runs the
+// rest of its arguments.
+const nftLoadScript = `printf '%s' "$1" | "$2" -f - && shift 2 && exec "$@"`
+
+// commandArgv returns the argv running bwrap with args. With AllowedPorts,
+// pasta runs it in a network namespace of its own, connected to the host's
+// network, where nft first limits outbound traffic to those ports. pasta
+// closes inherited file descriptors, so bwrap gets no --info-fd and the
+// whole run counts as command time.
+func (s *linuxSandbox) commandArgv(args []string) []string {
+	if len(s.cfg.AllowedPorts) == 0 {
+		return append([]string{s.bwrapBin, "--info-fd", "3"}, args...)
+	}
+	argv := []string{s.pastaBin, "--config-net", "--quiet", "--", "/bin/sh", "-c", nftLoadScript, "sh", nftPortRules(s.cfg.AllowedPorts), s.nftBin, s.bwrapBin}
+	return append(argv, args...)
 }
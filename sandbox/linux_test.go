@@ -3,9 +3,23 @@
 package sandbox
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
 	"slices"
+	"strconv"
 	"strings"
+	"syscall"
 	"testing"
+	"time"
+	"unsafe"
 )
 
 func TestBuildArgs(t *testing.T) {
@@ -90,6 +104,556 @@ func TestBuildArgs_DenyReadTakesPrecedence(t *testing.T) {
 	}
 }
 
+func TestBuildArgs_WildcardAllowWrite(t *testing.T) {
+	cfg, err := resolveConfig(Config{
+		Workdir:    "/project",
+		AllowWrite: []string{"*", "/project"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &linuxSandbox{cfg: cfg, bwrapBin: "/usr/bin/bwrap"}
+	args := s.buildArgs("true")
+
+	if !containsSequence(args, "--bind", "/", "/") {
+		t.Errorf("wildcard AllowWrite should bind root writable, got %v", args)
+	}
+	if slices.Contains(args, "--ro-bind") {
+		t.Error("wildcard AllowWrite should not bind root read-only")
+	}
+	for _, arg := range args {
+		if strings.HasSuffix(arg, "*") {
+			t.Errorf("wildcard should not be bound as a literal path: %v", args)
+		}
+	}
+}
+
+func TestBuildArgs_WildcardDenyRead(t *testing.T) {
+	cfg, err := resolveConfig(Config{
+		Workdir:    "/project",
+		AllowWrite: []string{"/project"},
+		DenyRead:   []string{"*"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.denyWrite = []string{"/home/user/.agent/sandbox/config.json", "/project/.git/hooks"}
+	s := &linuxSandbox{cfg: cfg, bwrapBin: "/usr/bin/bwrap"}
+	args := s.buildArgs("true")
+
+	for _, arg := range args {
+		if strings.HasSuffix(arg, "*") {
+			t.Fatalf("wildcard should not become a literal path: %v", args)
+		}
+	}
+	if containsSequence(args, "--ro-bind", "/", "/") {
+		t.Error("wildcard DenyRead should not mount the host root")
+	}
+	if !containsSequence(args, "--ro-bind-try", "/usr", "/usr") || !containsSequence(args, "--ro-bind-try", "/etc", "/etc") {
+		t.Errorf("system dirs should be readable, got %v", args)
+	}
+	if !containsSequence(args, "--bind", "/project", "/project") {
+		t.Errorf("AllowWrite paths should stay accessible, got %v", args)
+	}
+
+	// Protected paths are only re-bound inside mounted trees
+	if slices.Contains(args, "/home/user/.agent/sandbox/config.json") {
+		t.Error("should not expose paths outside the mounted dirs")
+	}
+	if !containsSequence(args, "--ro-bind-try", "/project/.git/hooks", "/project/.git/hooks") {
+		t.Error("should still protect paths inside AllowWrite")
+	}
+}
+
+func TestBuildArgs_DenyWrite(t *testing.T) {
+	cfg := Config{
+		Workdir:    "/home/user/project",
+		AllowWrite: []string{"/home/user"},
+		denyWrite:  []string{"/home/user/.agent/sandbox/config.json"},
+	}
+	s := &linuxSandbox{cfg: cfg, bwrapBin: "/usr/bin/bwrap"}
+	args := s.buildArgs("true")
+
+	if !containsSequence(args, "--ro-bind-try", "/home/user/.agent/sandbox/config.json", "/home/user/.agent/sandbox/config.json") {
+		t.Error("should re-bind protected path read-only")
+	}
+
+	// Read-only bind must come after the writable bind it overlays
+	bind := slices.Index(args, "--bind")
+	roBind := slices.Index(args, "--ro-bind-try")
+	if bind < 0 || roBind < bind {
+		t.Error("--ro-bind-try must come after --bind")
+	}
+}
+
+func TestBuildArgs_WriteExclude(t *testing.T) {
+	cfg, err := resolveConfig(Config{
+		Workdir:      "/project",
+		AllowWrite:   []string{"/project"},
+		WriteExclude: []string{"/project/secrets"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &linuxSandbox{cfg: cfg, bwrapBin: "/usr/bin/bwrap"}
+	args := s.buildArgs("true")
+
+	bind := slices.Index(args, "/project")
+	roBind := slices.Index(args, "/project/secrets")
+	if !containsSequence(args, "--bind", "/project", "/project") || !containsSequence(args, "--ro-bind-try", "/project/secrets", "/project/secrets") {
+		t.Fatalf("should bind /project writable and /project/secrets read-only, got %v", args)
+	}
+	if roBind < bind {
+		t.Error("read-only exclusion must come after the writable bind")
+	}
+}
+
+func TestBuildArgs_WorkdirInDenyRead(t *testing.T) {
+	cfg := Config{
+		Workdir:    "/home/user/project",
+		AllowWrite: []string{"/home/user/project"},
+		DenyRead:   []string{"/home/user"},
+		ReadOnly:   []string{"/home/user/project/vendor"},
+		denyWrite:  []string{"/home/user/project/.git", "/etc/agent.json"},
+	}
+	s := &linuxSandbox{cfg: cfg, bwrapBin: "/usr/bin/bwrap"}
+	args := s.buildArgs("true")
+
+	tmpfs := slices.Index(args, "--tmpfs")
+	carve := slices.Index(args[tmpfs:], "/home/user/project")
+	if tmpfs < 0 || carve < 0 || args[tmpfs+carve-1] != "--bind" {
+		t.Fatalf("workdir should be re-bound writable after the tmpfs, got %v", args)
+	}
+	if !containsSequence(args[tmpfs:], "--ro-bind-try", "/home/user/project/.git", "/home/user/project/.git") {
+		t.Errorf("read-only paths in the workdir should be re-applied after the carve-out, got %v", args)
+	}
+	// DenyRead > ReadOnly > AllowWrite holds inside the carve-out too
+	if !containsSequence(args[tmpfs+carve:], "--ro-bind-try", "/home/user/project/vendor", "/home/user/project/vendor") {
+		t.Errorf("ReadOnly paths in the workdir should stay read-only after the carve-out, got %v", args)
+	}
+	if containsSequence(args[tmpfs:], "--ro-bind-try", "/etc/agent.json", "/etc/agent.json") {
+		t.Errorf("read-only paths outside the workdir need no re-bind, got %v", args)
+	}
+
+	// Not writable: carve out read-only
+	s.cfg.AllowWrite = []string{"/tmp"}
+	args = s.buildArgs("true")
+	if !containsSequence(args, "--ro-bind", "/home/user/project", "/home/user/project") {
+		t.Errorf("workdir outside AllowWrite should be re-bound read-only, got %v", args)
+	}
+
+	// Workdir not under DenyRead: no carve-out
+	s.cfg.Workdir = "/tmp"
+	if args := s.buildArgs("true"); slices.Contains(args, "/home/user/project") {
+		t.Errorf("unexpected carve-out: %v", args)
+	}
+}
+
+func TestBuildArgs_AllowRead(t *testing.T) {
+	cfg := Config{
+		Workdir:    "/project",
+		AllowWrite: []string{"/project"},
+		AllowRead:  []string{"/data", "/home/user/.ssh"},
+		DenyRead:   []string{"/home/user/.ssh"},
+		denyWrite:  []string{"/home/user/.agent/sandbox/config.json"},
+	}
+	s := &linuxSandbox{cfg: cfg, bwrapBin: "/usr/bin/bwrap"}
+	args := s.buildArgs("true")
+
+	if containsSequence(args, "--ro-bind", "/", "/") {
+		t.Error("AllowRead should not mount the host root")
+	}
+	if !containsSequence(args, "--ro-bind-try", "/usr", "/usr") {
+		t.Errorf("system dirs should be readable, got %v", args)
+	}
+	if !containsSequence(args, "--ro-bind-try", "/data", "/data") {
+		t.Errorf("AllowRead paths should be bound read-only, got %v", args)
+	}
+	if !containsSequence(args, "--bind", "/project", "/project") {
+		t.Errorf("AllowWrite paths should stay accessible, got %v", args)
+	}
+	// DenyRead wins over AllowRead
+	if containsSequence(args, "--ro-bind-try", "/home/user/.ssh", "/home/user/.ssh") {
+		t.Errorf("DenyRead paths should not be bound, got %v", args)
+	}
+	if slices.Contains(args, "/home/user/.agent/sandbox/config.json") {
+		t.Error("should not expose paths outside the mounted dirs")
+	}
+}
+
+func TestBuildArgs_ReadOnly(t *testing.T) {
+	cfg := Config{
+		Workdir:    "/project",
+		AllowWrite: []string{"/project"},
+		ReadOnly:   []string{"/project/cache", "/home/user/.ssh/keys"},
+		DenyRead:   []string{"/home/user/.ssh"},
+	}
+	s := &linuxSandbox{cfg: cfg, bwrapBin: "/usr/bin/bwrap"}
+	args := s.buildArgs("true")
+
+	bind := slices.Index(args, "/project")
+	ro := slices.Index(args, "/project/cache")
+	if bind < 0 || ro < bind || !containsSequence(args, "--ro-bind", "/project/cache", "/project/cache") {
+		t.Errorf("ReadOnly paths should be bound read-only over AllowWrite, got %v", args)
+	}
+	// DenyRead wins over ReadOnly
+	if slices.Contains(args, "/home/user/.ssh/keys") {
+		t.Errorf("ReadOnly paths inside DenyRead should stay hidden, got %v", args)
+	}
+}
+
+func TestBuildArgs_HomeCarveOut(t *testing.T) {
+	cfg := Config{
+		Workdir:      "/tmp",
+		AllowWrite:   []string{"/tmp"},
+		DenyRead:     []string{"/home/user"},
+		homeCarveOut: []string{"/home/user/.local/bin"},
+	}
+	s := &linuxSandbox{cfg: cfg, bwrapBin: "/usr/bin/bwrap"}
+	args := s.buildArgs("true")
+
+	tmpfs := slices.Index(args, "--tmpfs")
+	if tmpfs < 0 || !containsSequence(args[tmpfs:], "--ro-bind-try", "/home/user/.local/bin", "/home/user/.local/bin") {
+		t.Errorf("PATH entries should be re-bound read-only after the tmpfs, got %v", args)
+	}
+}
+
+func TestBuildArgs_DenyReadImpliesNoWrite(t *testing.T) {
+	cfg := Config{
+		Workdir:                "/home/user/project",
+		AllowWrite:             []string{"/home/user/project"},
+		DenyRead:               []string{"/home/user", "/home/user/.aws"},
+		DenyReadImpliesNoWrite: true,
+		sshAuthSock:            "/home/user/.ssh/agent.sock",
+	}
+	s := &linuxSandbox{cfg: cfg, bwrapBin: "/usr/bin/bwrap"}
+	args := s.buildArgs("true")
+
+	remount := slices.Index(args, "--remount-ro")
+	if remount < 0 || !containsSequence(args, "--remount-ro", "/home/user") || !containsSequence(args, "--remount-ro", "/home/user/.aws") {
+		t.Fatalf("DenyRead tmpfs overlays should be remounted read-only, got %v", args)
+	}
+	// Mounts inside the overlays come first, or bwrap couldn't create them
+	for _, mount := range [][]string{
+		{"--tmpfs", "/home/user/.aws"},
+		{"--bind", "/home/user/project", "/home/user/project"},
+		{"--bind-try", "/home/user/.ssh/agent.sock", "/home/user/.ssh/agent.sock"},
+	} {
+		if !containsSequence(args[:remount], mount...) {
+			t.Errorf("%v should come before the read-only remounts, got %v", mount, args)
+		}
+	}
+
+	// A workdir carved out at the DenyRead path itself stays writable
+	s.cfg.DenyRead = []string{"/home/user/project"}
+	if containsSequence(s.buildArgs("true"), "--remount-ro", "/home/user/project") {
+		t.Error("the carved-out workdir should not be remounted read-only")
+	}
+
+	s.cfg.DenyReadImpliesNoWrite = false
+	s.cfg.DenyRead = []string{"/home/user/.aws"}
+	if slices.Contains(s.buildArgs("true"), "--remount-ro") {
+		t.Error("should not remount read-only without DenyReadImpliesNoWrite")
+	}
+}
+
+func TestBuildArgs_TmpfsSize(t *testing.T) {
+	cfg := Config{
+		Workdir:    "/tmp",
+		AllowWrite: []string{"/tmp"},
+		DenyRead:   []string{"/home/user/.ssh", "/home/user/.aws"},
+		TmpfsSize:  "64m",
+	}
+	s := &linuxSandbox{cfg: cfg, bwrapBin: "/usr/bin/bwrap"}
+	args := s.buildArgs("true")
+
+	for _, path := range cfg.DenyRead {
+		if !containsSequence(args, "--size", "67108864", "--tmpfs", path) {
+			t.Errorf("should limit tmpfs size for %s, got %v", path, args)
+		}
+	}
+
+	// No size without TmpfsSize
+	s.cfg.TmpfsSize = ""
+	if slices.Contains(s.buildArgs("true"), "--size") {
+		t.Error("should not pass --size without TmpfsSize")
+	}
+}
+
+func TestNewLinux_TmpfsSizeOldBwrap(t *testing.T) {
+	dir := t.TempDir()
+	script := "#!/bin/sh\n[ \"$1\" = --version ] && echo 'bubblewrap 0.4.0'\nexit 0\n"
+	if err := os.WriteFile(filepath.Join(dir, "bwrap"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir)
+
+	var logged bytes.Buffer
+	sb, err := newLinux(Config{
+		Workdir:    "/tmp",
+		AllowWrite: []string{"/tmp"},
+		DenyRead:   []string{"/home/user/.ssh"},
+		TmpfsSize:  "64m",
+		Logger:     log.New(&logged, "", 0),
+	})
+	if err != nil {
+		t.Fatalf("newLinux() error: %v", err)
+	}
+	if !strings.Contains(logged.String(), "no --size option") {
+		t.Errorf("an old bwrap should be warned about, got %q", logged.String())
+	}
+	if args := sb.(*linuxSandbox).buildArgs("true"); slices.Contains(args, "--size") {
+		t.Errorf("should not pass --size to an old bwrap, got %v", args)
+	}
+}
+
+func TestNewLinux_CaptureViolations(t *testing.T) {
+	_, err := newLinux(Config{Workdir: t.TempDir(), CaptureViolations: true})
+	if err == nil || !strings.Contains(err.Error(), "only supported on macOS") {
+		t.Errorf("expected CaptureViolations error, got %v", err)
+	}
+}
+
+func TestNewLinux_AllowedPortsRequiresPasta(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "bwrap"), []byte("#!/bin/sh\nexit 0\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir)
+
+	_, err := newLinux(Config{Workdir: "/tmp", AllowWrite: []string{"/tmp"}, AllowedPorts: []int{443}})
+	if err == nil || !strings.Contains(err.Error(), "requires pasta") {
+		t.Errorf("expected pasta error, got %v", err)
+	}
+
+	_, err = newLinux(Config{Workdir: "/tmp", AllowWrite: []string{"/tmp"}, AllowedPorts: []int{443}, TrackReads: true})
+	if err == nil || !strings.Contains(err.Error(), "can't be combined") {
+		t.Errorf("expected TrackReads conflict error, got %v", err)
+	}
+}
+
+func TestDryRunOutput_AllowedPorts(t *testing.T) {
+	cfg := Config{Workdir: "/tmp", AllowWrite: []string{"/tmp"}, AllowedPorts: []int{443}}
+	s := &linuxSandbox{cfg: cfg, bwrapBin: "/usr/bin/bwrap", pastaBin: "/usr/bin/pasta", nftBin: "/usr/sbin/nft"}
+
+	argv := s.commandArgv(s.buildArgs("curl example.com"))
+	if argv[0] != "/usr/bin/pasta" || !containsSequence(argv, "--config-net", "--quiet", "--") {
+		t.Errorf("bwrap should run under pasta, got %v", argv)
+	}
+	if !containsSequence(argv, "/usr/sbin/nft", "/usr/bin/bwrap", "--share-net") {
+		t.Errorf("nft should load the rules before bwrap runs, got %v", argv)
+	}
+	if slices.Contains(argv, "--info-fd") {
+		t.Errorf("pasta closes fd 3, so bwrap should get no --info-fd, got %v", argv)
+	}
+	if !strings.Contains(s.dryRunOutput(s.buildArgs("true")), "tcp dport { 443 } accept") {
+		t.Error("dry run should show the ruleset")
+	}
+
+	plain := &linuxSandbox{cfg: Config{Workdir: "/tmp"}, bwrapBin: "/usr/bin/bwrap"}
+	if argv := plain.commandArgv([]string{"true"}); !containsSequence(argv, "/usr/bin/bwrap", "--info-fd", "3", "true") {
+		t.Errorf("without AllowedPorts bwrap runs directly, got %v", argv)
+	}
+}
+
+func TestBuildArgs_TmpfsWorkdir(t *testing.T) {
+	cfg := Config{
+		Workdir:          "/project",
+		AllowWrite:       []string{"/project"},
+		TmpfsWorkdir:     true,
+		TmpfsWorkdirSize: "512m",
+		denyWrite:        []string{"/project/.git/hooks"},
+	}
+	s := &linuxSandbox{cfg: cfg, bwrapBin: "/usr/bin/bwrap"}
+	args := s.buildArgs("true")
+
+	tmpfs := slices.Index(args, "--tmpfs")
+	if !containsSequence(args, "--size", "536870912", "--tmpfs", "/project") {
+		t.Fatalf("workdir should be a sized tmpfs, got %v", args)
+	}
+	// It covers the host workdir and mounts inside it
+	for _, path := range []string{"/project", "/project/.git/hooks"} {
+		if i := slices.Index(args, path); i > tmpfs {
+			t.Errorf("%s should be mounted before the tmpfs, got %v", path, args)
+		}
+	}
+	if !containsSequence(args[tmpfs:], "--chdir", "/project") {
+		t.Errorf("command should start in the tmpfs workdir, got %v", args)
+	}
+
+	s.cfg.TmpfsWorkdirSize = ""
+	if args := s.buildArgs("true"); !containsSequence(args, "--tmpfs", "/project") || slices.Contains(args, "--size") {
+		t.Errorf("without a size the kernel's default applies, got %v", args)
+	}
+}
+
+func TestBuildArgs_ShareSSHAgent(t *testing.T) {
+	cfg := Config{
+		Workdir:     "/tmp",
+		AllowWrite:  []string{"/tmp"},
+		DenyRead:    []string{"/home/user/.ssh"},
+		sshAuthSock: "/home/user/.ssh/agent.sock",
+	}
+	s := &linuxSandbox{cfg: cfg, bwrapBin: "/usr/bin/bwrap"}
+	args := s.buildArgs("true")
+
+	if !containsSequence(args, "--tmpfs", "/home/user/.ssh") {
+		t.Error("~/.ssh should remain hidden")
+	}
+	if !containsSequence(args, "--bind-try", "/home/user/.ssh/agent.sock", "/home/user/.ssh/agent.sock") {
+		t.Errorf("should bind the agent socket, got %v", args)
+	}
+
+	// Socket bind must come after the tmpfs that hides its directory
+	if slices.Index(args, "--bind-try") < slices.Index(args, "--tmpfs") {
+		t.Error("--bind-try must come after --tmpfs")
+	}
+}
+
+func TestBuildArgs_FrozenTime(t *testing.T) {
+	frozen := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	cfg := Config{
+		Workdir:    "/tmp",
+		AllowWrite: []string{"/tmp"},
+		FrozenTime: &frozen,
+	}
+	s := &linuxSandbox{cfg: cfg, bwrapBin: "/usr/bin/bwrap", faketimeLib: "/usr/lib/faketime/libfaketime.so.1"}
+	args := s.buildArgs("date")
+
+	if !containsSequence(args, "--setenv", "LD_PRELOAD", "/usr/lib/faketime/libfaketime.so.1") {
+		t.Errorf("should preload libfaketime, got %v", args)
+	}
+	if !containsSequence(args, "--setenv", "FAKETIME", "1704164645") {
+		t.Errorf("should set FAKETIME to the frozen unix time, got %v", args)
+	}
+
+	s.cfg.FrozenTime = nil
+	if slices.Contains(s.buildArgs("date"), "LD_PRELOAD") {
+		t.Error("should not preload libfaketime without FrozenTime")
+	}
+}
+
+func TestBuildArgs_EnableGPU(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"nvidia0", "nvidiactl", "nvidia-uvm", "null"} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	saved := gpuDevicePatterns
+	t.Cleanup(func() { gpuDevicePatterns = saved })
+	gpuDevicePatterns = []string{filepath.Join(dir, "nvidia*")}
+
+	cfg := Config{Workdir: "/tmp", AllowWrite: []string{"/tmp"}, EnableGPU: true}
+	s := &linuxSandbox{cfg: cfg, bwrapBin: "/usr/bin/bwrap"}
+	args := s.buildArgs("nvidia-smi")
+
+	for _, name := range []string{"nvidia0", "nvidiactl", "nvidia-uvm"} {
+		dev := filepath.Join(dir, name)
+		if !containsSequence(args, "--dev-bind-try", dev, dev) {
+			t.Errorf("should dev-bind %s, got %v", dev, args)
+		}
+	}
+	if slices.Contains(args, filepath.Join(dir, "null")) {
+		t.Error("should only bind GPU devices")
+	}
+
+	// Device binds must come after --dev, which mounts a fresh /dev
+	if slices.Index(args, "--dev-bind-try") < slices.Index(args, "--dev") {
+		t.Error("--dev-bind-try must come after --dev")
+	}
+
+	s.cfg.EnableGPU = false
+	if slices.Contains(s.buildArgs("true"), "--dev-bind-try") {
+		t.Error("should not bind GPU devices without EnableGPU")
+	}
+}
+
+func TestFindFaketimeLib(t *testing.T) {
+	dir := t.TempDir()
+	lib := filepath.Join(dir, "x86_64-linux-gnu", "faketime", "libfaketime.so.1")
+	if err := os.MkdirAll(filepath.Dir(lib), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(lib, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	saved := faketimeLibPaths
+	t.Cleanup(func() { faketimeLibPaths = saved })
+
+	faketimeLibPaths = []string{filepath.Join(dir, "*", "faketime", "libfaketime.so.1")}
+	if got, err := findFaketimeLib(); err != nil || got != lib {
+		t.Errorf("findFaketimeLib() = %q, %v, want %q", got, err, lib)
+	}
+
+	faketimeLibPaths = []string{filepath.Join(dir, "missing", "libfaketime.so.1")}
+	if _, err := findFaketimeLib(); err == nil || !strings.Contains(err.Error(), "libfaketime") {
+		t.Errorf("expected a clear error when libfaketime is missing, got %v", err)
+	}
+}
+
+func TestIsConfinedBwrap(t *testing.T) {
+	dir := t.TempDir()
+	snapBin := filepath.Join(dir, "snap")
+	if err := os.WriteFile(snapBin, nil, 0755); err != nil {
+		t.Fatal(err)
+	}
+	snapLink := filepath.Join(dir, "bwrap")
+	if err := os.Symlink(snapBin, snapLink); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{"/usr/bin/bwrap", false},
+		{"/usr/local/bin/bwrap", false},
+		{"/snap/bin/bwrap", true},
+		{"/snap/bubblewrap/current/usr/bin/bwrap", true},
+		{"/var/lib/flatpak/exports/bin/bwrap", true},
+		{snapLink, true}, // Links to the snap launcher
+	}
+
+	for _, tt := range tests {
+		if got := isConfinedBwrap(tt.path); got != tt.want {
+			t.Errorf("isConfinedBwrap(%q) = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestSelectBwrap(t *testing.T) {
+	dir := t.TempDir()
+	system := filepath.Join(dir, "bwrap")
+	if err := os.WriteFile(system, nil, 0755); err != nil {
+		t.Fatal(err)
+	}
+	missing := filepath.Join(dir, "missing", "bwrap")
+
+	if got, confined := selectBwrap("/usr/bin/bwrap", []string{system}); got != "/usr/bin/bwrap" || confined {
+		t.Errorf("selectBwrap() = %q, %v, want the bwrap on PATH", got, confined)
+	}
+	if got, confined := selectBwrap("/snap/bin/bwrap", []string{missing, system}); got != system || confined {
+		t.Errorf("selectBwrap() = %q, %v, want system bwrap %q", got, confined, system)
+	}
+	if got, confined := selectBwrap("/snap/bin/bwrap", []string{missing}); got != "/snap/bin/bwrap" || !confined {
+		t.Errorf("selectBwrap() = %q, %v, want the snap wrapper flagged as confined", got, confined)
+	}
+}
+
+func TestBwrapInfo(t *testing.T) {
+	var sb Sandbox = &linuxSandbox{bwrapBin: "/usr/bin/bwrap", bwrapVersion: "0.9.0"}
+	info, ok := sb.(BwrapInfo)
+	if !ok {
+		t.Fatal("linux sandbox should implement BwrapInfo")
+	}
+	if path, version := info.Bwrap(); path != "/usr/bin/bwrap" || version != "0.9.0" {
+		t.Errorf("Bwrap() = %q, %q", path, version)
+	}
+}
+
 func TestDryRunOutput_Linux(t *testing.T) {
 	cfg := Config{
 		Workdir:    "/tmp",
@@ -108,6 +672,1158 @@ func TestDryRunOutput_Linux(t *testing.T) {
 	}
 }
 
+func TestDryRunOutput_NoNetwork(t *testing.T) {
+	cfg := Config{Workdir: "/tmp", AllowWrite: []string{"/tmp"}, NoNetwork: true}
+	s := &linuxSandbox{cfg: cfg, bwrapBin: "/usr/bin/bwrap"}
+	output := s.dryRunOutput(s.buildArgs("curl example.com"))
+
+	if !strings.Contains(output, "--unshare-net") || strings.Contains(output, "--share-net") {
+		t.Errorf("dry run should show --unshare-net, got %s", output)
+	}
+}
+
+func TestDryRunOutput_JSON(t *testing.T) {
+	cfg := Config{Workdir: "/tmp", AllowWrite: []string{"/tmp"}, DryRun: true, DryRunFormat: DryRunJSON}
+	s := &linuxSandbox{cfg: cfg, bwrapBin: "/usr/bin/bwrap"}
+
+	var plan DryRunPlan
+	if err := json.Unmarshal([]byte(s.dryRunOutput(s.buildArgs("echo hello"))), &plan); err != nil {
+		t.Fatalf("dry run output is not JSON: %v", err)
+	}
+	if plan.Backend != "bwrap" || plan.Binary != "/usr/bin/bwrap" {
+		t.Errorf("plan = %+v, want bwrap", plan)
+	}
+	if !containsSequence(plan.Argv, "sh", "-c", "echo hello") || !slices.Contains(plan.Argv, "--share-net") {
+		t.Errorf("argv = %v, want bwrap's arguments", plan.Argv)
+	}
+}
+
+func TestRunNoNetwork_Linux(t *testing.T) {
+	cfg := Config{Workdir: "/tmp", AllowWrite: []string{"/tmp"}, DryRun: true}
+	s := &linuxSandbox{cfg: cfg, bwrapBin: "/usr/bin/bwrap"}
+
+	output, _, err := s.RunNoNetwork(context.Background(), "curl example.com")
+	if err != nil {
+		t.Fatalf("RunNoNetwork() error: %v", err)
+	}
+	if !strings.Contains(string(output), "--unshare-net") || strings.Contains(string(output), "--share-net") {
+		t.Errorf("per-call args should unshare the network, got %s", output)
+	}
+
+	// Other runs keep network access
+	output, _, _ = s.Run(context.Background(), "curl example.com")
+	if !strings.Contains(string(output), "--share-net") {
+		t.Errorf("Run after RunNoNetwork should share the network, got %s", output)
+	}
+}
+
+func TestDryRunOutput_ShellEscaped(t *testing.T) {
+	cfg := Config{
+		Workdir:    "/tmp/my project",
+		AllowWrite: []string{"/tmp/my project"},
+		DryRun:     true,
+	}
+	s := &linuxSandbox{cfg: cfg, bwrapBin: "/usr/bin/bwrap"}
+	args := s.buildArgs("echo 'it works' > out.txt")
+	output := s.dryRunOutput(args)
+
+	if !strings.Contains(output, "--bind '/tmp/my project' '/tmp/my project'") {
+		t.Errorf("paths with spaces should be quoted, got %s", output)
+	}
+
+	// The shell must split the line back into the original args
+	out, err := exec.Command("sh", "-c", `printf '%s\n' `+output).Output()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := append([]string{"/usr/bin/bwrap"}, args...)
+	if got := strings.Split(strings.TrimSuffix(string(out), "\n"), "\n"); !slices.Equal(got, want) {
+		t.Errorf("shell parsed args = %q, want %q", got, want)
+	}
+}
+
+func TestDryRunOutput_Seccomp(t *testing.T) {
+	cfg := Config{Workdir: "/tmp", AllowWrite: []string{"/tmp"}, SeccompProfile: SeccompDefault}
+	s := &linuxSandbox{cfg: cfg, bwrapBin: "/usr/bin/bwrap", seccomp: make([]byte, 8)}
+	output := s.dryRunOutput(s.buildArgs("make"))
+
+	// The filter's fd only exists when the library runs bwrap
+	first, rest, _ := strings.Cut(output, "\n")
+	if !strings.HasPrefix(first, "# Not runnable as-is") || !strings.Contains(first, "seccomp filter from fd 4") {
+		t.Errorf("first line = %q, want a note about the seccomp fd", first)
+	}
+	if !strings.Contains(rest, "--seccomp 4") {
+		t.Errorf("command = %q, want --seccomp 4", rest)
+	}
+
+	s.cfg.TrackReads = true
+	if output := s.dryRunOutput(s.buildArgs("make")); !strings.Contains(output, "trace to fd 4 and bwrap reads the seccomp filter from fd 5") {
+		t.Errorf("output = %q, want notes for both fds", output)
+	}
+
+	// Plans without such fds stay runnable, and JSON plans carry no note
+	s.seccomp, s.cfg.TrackReads = nil, false
+	if output := s.dryRunOutput(s.buildArgs("make")); strings.HasPrefix(output, "#") {
+		t.Errorf("output = %q, want no note", output)
+	}
+	s.seccomp, s.cfg.DryRunFormat = make([]byte, 8), DryRunJSON
+	if output := s.dryRunOutput(s.buildArgs("make")); strings.HasPrefix(output, "#") {
+		t.Errorf("JSON output = %q, want no note", output)
+	}
+}
+
+func TestRun_DryRunRedactsSecrets_Linux(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secrets.env")
+	if err := os.WriteFile(path, []byte("GITHUB_TOKEN=ghp_abc\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := resolveConfig(Config{
+		Workdir:       t.TempDir(),
+		DryRun:        true,
+		SecretsFile:   path,
+		InjectSecrets: []string{"GITHUB_TOKEN"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &linuxSandbox{cfg: cfg, bwrapBin: "/usr/bin/bwrap"}
+
+	output, _, err := s.Run(context.Background(), "gh auth status")
+	if err != nil {
+		t.Fatalf("Run() error: %v", err)
+	}
+	if strings.Contains(string(output), "ghp_abc") {
+		t.Errorf("dry run should not print secret values, got %s", output)
+	}
+}
+
+func TestRun_EmptyCommand_Linux(t *testing.T) {
+	cfg := Config{
+		Workdir:    "/tmp",
+		AllowWrite: []string{"/tmp"},
+	}
+	s := &linuxSandbox{cfg: cfg, bwrapBin: "/usr/bin/bwrap"}
+
+	for _, cmd := range []string{"", " ", "   ", "\t", "\n", " \t\n "} {
+		if _, _, err := s.Run(context.Background(), cmd); !errors.Is(err, ErrEmptyCommand) {
+			t.Errorf("Run(%q) error = %v, want ErrEmptyCommand", cmd, err)
+		}
+		if _, _, err := s.RunWithStdin(context.Background(), cmd, strings.NewReader("input")); !errors.Is(err, ErrEmptyCommand) {
+			t.Errorf("RunWithStdin(%q) error = %v, want ErrEmptyCommand", cmd, err)
+		}
+	}
+}
+
+func TestRun_MaxConcurrent_Linux(t *testing.T) {
+	SetMaxConcurrent(1)
+	defer SetMaxConcurrent(0)
+
+	cfg := Config{Workdir: t.TempDir()}
+	s := &linuxSandbox{cfg: cfg, bwrapBin: fakeBwrap(t)}
+
+	// Simulate a run already holding the only slot
+	release, err := acquireSlot(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	done := make(chan error)
+	go func() {
+		_, _, err := s.Run(context.Background(), "true")
+		done <- err
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("Run should block while the slot is held")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	release()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Run() error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run should proceed once the slot is released")
+	}
+}
+
+func TestRun_ExitCodeMap_Linux(t *testing.T) {
+	cfg := Config{
+		Workdir:     t.TempDir(),
+		ExitCodeMap: map[int]int{125: 1},
+	}
+	s := &linuxSandbox{cfg: cfg, bwrapBin: fakeBwrap(t)}
+
+	_, code, _ := s.Run(context.Background(), "exit 125")
+	if code != 1 {
+		t.Errorf("exit 125 should be remapped to 1, got %d", code)
+	}
+
+	_, code, _ = s.Run(context.Background(), "exit 3")
+	if code != 3 {
+		t.Errorf("unmapped exit code should pass through, got %d", code)
+	}
+}
+
+func TestBuildExecArgs_Argv0(t *testing.T) {
+	cfg := Config{
+		Workdir:    "/tmp",
+		AllowWrite: []string{"/tmp"},
+	}
+	s := &linuxSandbox{cfg: cfg, bwrapBin: "/usr/bin/bwrap"}
+
+	args := s.buildExecArgs("ls", []string{"/bin/busybox", "-la"})
+	if !containsSequence(args, "--argv0", "ls") {
+		t.Error("should contain --argv0 ls")
+	}
+	if !slices.Equal(args[len(args)-2:], []string{"/bin/busybox", "-la"}) {
+		t.Errorf("argv should be at end without a shell, got %v", args[len(args)-2:])
+	}
+	if slices.Contains(args, "sh") {
+		t.Error("should not wrap argv in a shell")
+	}
+
+	args = s.buildExecArgs("", []string{"/bin/busybox"})
+	if slices.Contains(args, "--argv0") {
+		t.Error("empty name should not set --argv0")
+	}
+}
+
+func TestRunArgsAs_NoShell_Linux(t *testing.T) {
+	cfg := Config{Workdir: t.TempDir()}
+	s := &linuxSandbox{cfg: cfg, bwrapBin: fakeBwrap(t)}
+
+	output, code, err := s.RunArgsAs(context.Background(), "", []string{"echo", "$HOME", "a;b"})
+	if err != nil {
+		t.Fatalf("RunArgsAs() error: %v", err)
+	}
+	if code != 0 {
+		t.Errorf("expected exit code 0, got %d", code)
+	}
+	if string(output) != "$HOME a;b\n" {
+		t.Errorf("arguments should be passed verbatim, got %q", output)
+	}
+
+	for _, argv := range [][]string{nil, {}, {""}, {"  "}} {
+		if _, _, err := s.RunArgsAs(context.Background(), "name", argv); !errors.Is(err, ErrEmptyCommand) {
+			t.Errorf("RunArgsAs(%q) error = %v, want ErrEmptyCommand", argv, err)
+		}
+	}
+}
+
+func TestRunArgs_Linux(t *testing.T) {
+	s := &linuxSandbox{cfg: Config{Workdir: t.TempDir()}, bwrapBin: fakeBwrap(t)}
+
+	output, _, err := s.RunArgs(context.Background(), []string{"printf", "%s|", "my file.txt", "$(id)", "*"})
+	if err != nil {
+		t.Fatalf("RunArgs() error: %v", err)
+	}
+	if string(output) != "my file.txt|$(id)|*|" {
+		t.Errorf("arguments should reach the program unexpanded, got %q", output)
+	}
+}
+
+func TestRunArgsAs_MaxArgs_Linux(t *testing.T) {
+	cfg := Config{Workdir: t.TempDir(), MaxArgs: 2}
+	s := &linuxSandbox{cfg: cfg, bwrapBin: fakeBwrap(t)}
+
+	if _, _, err := s.RunArgsAs(context.Background(), "", []string{"echo", "ok"}); err != nil {
+		t.Errorf("argv at the limit should run, got %v", err)
+	}
+	if _, _, err := s.RunArgsAs(context.Background(), "", []string{"echo", "too", "many"}); !errors.Is(err, ErrArgvTooLarge) {
+		t.Errorf("error = %v, want ErrArgvTooLarge", err)
+	}
+}
+
+func TestRun_ShellPrelude_Linux(t *testing.T) {
+	cfg := Config{Workdir: t.TempDir(), ShellPrelude: "set -e"}
+	s := &linuxSandbox{cfg: cfg, bwrapBin: fakeBwrap(t)}
+
+	tests := []struct {
+		cmd  string
+		want int
+	}{
+		{"(exit 3) && echo unreachable", 3},
+		{"false; echo unreachable", 1},
+		{"true && echo ok", 0},
+	}
+
+	for _, tt := range tests {
+		output, code, _ := s.Run(context.Background(), tt.cmd)
+		if code != tt.want {
+			t.Errorf("Run(%q) exit code = %d, want %d", tt.cmd, code, tt.want)
+		}
+		if strings.Contains(string(output), "unreachable") {
+			t.Errorf("Run(%q) should abort before the rest of the command, got %q", tt.cmd, output)
+		}
+	}
+
+	// Without the prelude, the shell keeps going after a failure
+	s.cfg.ShellPrelude = ""
+	if output, code, _ := s.Run(context.Background(), "false; echo reached"); code != 0 || !strings.Contains(string(output), "reached") {
+		t.Errorf("without prelude, got exit code %d and output %q", code, output)
+	}
+}
+
+func TestRunWithEnv_Linux(t *testing.T) {
+	t.Setenv("TEST_RUN_WITH_ENV", "inherited")
+	s := &linuxSandbox{cfg: Config{Workdir: t.TempDir()}, bwrapBin: fakeBwrap(t)}
+
+	output, _, err := s.RunWithEnv(context.Background(), `echo "$TEST_RUN_WITH_ENV $TEST_TASK_ID"`,
+		map[string]string{"TEST_RUN_WITH_ENV": "overridden", "TEST_TASK_ID": "42"})
+	if err != nil || string(output) != "overridden 42\n" {
+		t.Errorf("RunWithEnv() = %q, %v; want the run's vars", output, err)
+	}
+
+	// The vars don't stick to the sandbox
+	output, _, _ = s.Run(context.Background(), `echo "$TEST_RUN_WITH_ENV $TEST_TASK_ID"`)
+	if string(output) != "inherited \n" {
+		t.Errorf("Run() = %q, want the inherited env only", output)
+	}
+
+	if _, _, err := s.RunWithEnv(context.Background(), "true", map[string]string{"A=B": "x"}); err == nil {
+		t.Error("expected an error for an invalid var name")
+	}
+}
+
+func TestRun_StdinFile_Linux(t *testing.T) {
+	input := filepath.Join(t.TempDir(), "input.txt")
+	if err := os.WriteFile(input, []byte("from file\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	s := &linuxSandbox{cfg: Config{Workdir: t.TempDir(), StdinFile: input}, bwrapBin: fakeBwrap(t)}
+
+	output, _, err := s.Run(context.Background(), "cat")
+	if err != nil || string(output) != "from file\n" {
+		t.Errorf("Run() = %q, %v; want the file's contents", output, err)
+	}
+
+	// An explicit reader takes precedence
+	output, _, _ = s.RunWithStdin(context.Background(), "cat", strings.NewReader("from reader"))
+	if string(output) != "from reader" {
+		t.Errorf("RunWithStdin() = %q, want the reader's contents", output)
+	}
+
+	// Removed after New validated it
+	os.Remove(input)
+	if _, _, err := s.Run(context.Background(), "cat"); err == nil || !strings.Contains(err.Error(), "StdinFile") {
+		t.Errorf("expected StdinFile error, got %v", err)
+	}
+}
+
+func TestRunWithStdin_BlockingReader_Linux(t *testing.T) {
+	cfg := Config{Workdir: t.TempDir()}
+	s := &linuxSandbox{cfg: cfg, bwrapBin: fakeBwrap(t)}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	stdin := blockingReader(t)
+
+	start := time.Now()
+	_, _, err := s.RunWithStdin(ctx, "cat", stdin)
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("should return promptly after the deadline, took %v", elapsed)
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("error = %v, want context.DeadlineExceeded", err)
+	}
+
+	// A command that ignores stdin finishes without waiting for the reader
+	start = time.Now()
+	output, code, err := s.RunWithStdin(context.Background(), "echo done", blockingReader(t))
+	if err != nil || code != 0 || string(output) != "done\n" {
+		t.Errorf("RunWithStdin() = %q, %d, %v", output, code, err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("should not wait for the stdin reader, took %v", elapsed)
+	}
+
+	// Readers that do return are still piped through in full
+	output, _, err = s.RunWithStdin(context.Background(), "cat", strings.NewReader("hello from stdin"))
+	if err != nil || string(output) != "hello from stdin" {
+		t.Errorf("RunWithStdin() = %q, %v, want stdin echoed", output, err)
+	}
+}
+
+func TestRun_TrimTrailingNewline_Linux(t *testing.T) {
+	cfg := Config{Workdir: t.TempDir(), TrimTrailingNewline: true}
+	s := &linuxSandbox{cfg: cfg, bwrapBin: fakeBwrap(t)}
+
+	output, _, err := s.Run(context.Background(), "printf 'hello\\n\\n'")
+	if err != nil {
+		t.Fatalf("Run() error: %v", err)
+	}
+	if string(output) != "hello\n" {
+		t.Errorf("expected one trailing newline trimmed, got %q", output)
+	}
+}
+
+func TestRunResult_StreamLimits_Linux(t *testing.T) {
+	cfg := Config{Workdir: t.TempDir(), MaxStdoutBytes: 6, MaxStderrBytes: 3}
+	s := &linuxSandbox{cfg: cfg, bwrapBin: fakeBwrap(t)}
+
+	res, err := s.RunResult(context.Background(), "echo stdout; echo stderr >&2; exit 2")
+	if err == nil {
+		t.Error("expected an error for exit code 2")
+	}
+	if res.ExitCode != 2 {
+		t.Errorf("exit code = %d, want 2", res.ExitCode)
+	}
+	if string(res.Stdout) != "stdout" || !res.StdoutTruncated {
+		t.Errorf("stdout = %q (truncated %v), want %q truncated", res.Stdout, res.StdoutTruncated, "stdout")
+	}
+	if string(res.Stderr) != "std" || !res.StderrTruncated {
+		t.Errorf("stderr = %q (truncated %v), want %q truncated", res.Stderr, res.StderrTruncated, "std")
+	}
+
+	s.cfg.MaxStdoutBytes = 0
+	res, err = s.RunResult(context.Background(), "echo stdout; echo stderr >&2")
+	if err != nil {
+		t.Fatalf("RunResult() error: %v", err)
+	}
+	if string(res.Stdout) != "stdout\n" || res.StdoutTruncated {
+		t.Errorf("stdout = %q (truncated %v), want it kept in full", res.Stdout, res.StdoutTruncated)
+	}
+	if !res.StderrTruncated {
+		t.Error("stderr should still be truncated")
+	}
+}
+
+func TestRun_CPUAffinity_Linux(t *testing.T) {
+	taskset, err := exec.LookPath("taskset")
+	if err != nil {
+		t.Skip("taskset not installed")
+	}
+	cfg := Config{Workdir: t.TempDir(), CPUAffinity: []int{0}}
+	s := &linuxSandbox{cfg: cfg, bwrapBin: fakeBwrap(t), tasksetBin: taskset}
+
+	args := s.buildArgs("true")
+	if !containsSequence(args, "--chdir", cfg.Workdir, taskset, "--cpu-list", "0", "sh") {
+		t.Errorf("command should run under taskset, got %v", args)
+	}
+
+	output, _, err := s.Run(context.Background(), "grep Cpus_allowed_list /proc/self/status")
+	if err != nil {
+		t.Fatalf("Run() error: %v", err)
+	}
+	if got := strings.Fields(string(output)); len(got) != 2 || got[1] != "0" {
+		t.Errorf("affinity = %q, want CPU 0 only", output)
+	}
+}
+
+func TestRun_SampleUsage_Linux(t *testing.T) {
+	cfg := Config{Workdir: t.TempDir(), SampleUsage: 20 * time.Millisecond}
+	s := &linuxSandbox{cfg: cfg, bwrapBin: fakeBwrap(t)}
+
+	res, err := s.RunResult(context.Background(), "sleep 0.3")
+	if err != nil {
+		t.Fatalf("RunResult() error: %v", err)
+	}
+	if len(res.UsageSamples) < 3 {
+		t.Fatalf("expected samples every 20ms, got %+v", res.UsageSamples)
+	}
+	for i, sample := range res.UsageSamples {
+		if sample.Processes == 0 || sample.RSSBytes == 0 {
+			t.Errorf("sample %d should cover the running command, got %+v", i, sample)
+		}
+		if i > 0 && sample.Elapsed <= res.UsageSamples[i-1].Elapsed {
+			t.Errorf("samples should be in order, got %+v", res.UsageSamples)
+		}
+	}
+
+	s.cfg.SampleUsage = 0
+	if res, _ := s.RunResult(context.Background(), "true"); res.UsageSamples != nil {
+		t.Errorf("sampling should be off by default, got %+v", res.UsageSamples)
+	}
+}
+
+func TestRun_TranscriptFile_Linux(t *testing.T) {
+	cfg, err := resolveConfig(Config{Workdir: t.TempDir(), TranscriptFile: "transcript.jsonl"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Contains(cfg.denyWrite, cfg.TranscriptFile) {
+		t.Errorf("transcript should be read-only in the sandbox, denyWrite = %v", cfg.denyWrite)
+	}
+	s := &linuxSandbox{cfg: cfg, bwrapBin: fakeBwrap(t)}
+
+	s.RunWithStdin(context.Background(), "tr a-z A-Z", strings.NewReader("abc"))
+	s.Run(context.Background(), "echo oops >&2; exit 3")
+
+	entries, err := LoadTranscript(cfg.TranscriptFile)
+	if err != nil {
+		t.Fatalf("LoadTranscript() error: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("got %d entries, want 2", len(entries))
+	}
+	if e := entries[0]; e.Command != "tr a-z A-Z" || string(e.Stdin) != "abc" || string(e.Stdout) != "ABC" || e.ExitCode != 0 {
+		t.Errorf("entry 0 = %+v", e)
+	}
+	if e := entries[1]; string(e.Stderr) != "oops\n" || e.ExitCode != 3 || e.Duration <= 0 {
+		t.Errorf("entry 1 = %+v", e)
+	}
+}
+
+func TestRun_MaxOutputBytes_Linux(t *testing.T) {
+	cfg := Config{Workdir: t.TempDir(), MaxOutputBytes: 100}
+	s := &linuxSandbox{cfg: cfg, bwrapBin: fakeBwrap(t)}
+
+	// Far more than a pipe buffer: the rest must be drained, not left to block
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	res, err := s.RunResult(ctx, "head -c 10000000 /dev/zero | tr '\\0' x")
+	if err != nil {
+		t.Fatalf("RunResult() error: %v", err)
+	}
+	if !res.Truncated || len(res.Stdout) != 100 {
+		t.Errorf("kept %d bytes (truncated %v), want 100 truncated", len(res.Stdout), res.Truncated)
+	}
+	if !strings.HasSuffix(string(res.Combined), "\n[output truncated at 100 bytes]") {
+		t.Errorf("combined should end with the truncation marker, got %q", res.Combined)
+	}
+}
+
+func TestRunSeparate_Linux(t *testing.T) {
+	s := &linuxSandbox{cfg: Config{Workdir: t.TempDir()}, bwrapBin: fakeBwrap(t)}
+
+	stdout, stderr, exitCode, err := s.RunSeparate(context.Background(), `echo '{"ok":true}'; echo 'warning: slow' >&2`)
+	if err != nil {
+		t.Fatalf("RunSeparate() error: %v", err)
+	}
+	if exitCode != 0 {
+		t.Errorf("exit code = %d, want 0", exitCode)
+	}
+	if string(stdout) != "{\"ok\":true}\n" {
+		t.Errorf("stdout = %q, stderr should not leak into it", stdout)
+	}
+	if string(stderr) != "warning: slow\n" {
+		t.Errorf("stderr = %q, want %q", stderr, "warning: slow\n")
+	}
+
+	if _, _, _, err := s.RunSeparate(context.Background(), ""); err == nil {
+		t.Error("expected error for empty command")
+	}
+}
+
+func TestRunStream_Linux(t *testing.T) {
+	s := &linuxSandbox{cfg: Config{Workdir: t.TempDir()}, bwrapBin: fakeBwrap(t)}
+
+	// Cancel once the first line arrives: it must come through while the
+	// command still runs, and the cancellation must still kill it
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stdout := &notifyWriter{written: make(chan struct{})}
+	go func() {
+		<-stdout.written
+		cancel()
+	}()
+
+	var stderr bytes.Buffer
+	start := time.Now()
+	_, err := s.RunStream(ctx, "echo oops >&2; echo first; sleep 10; echo never", stdout, &stderr)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("expected context.Canceled, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("RunStream took %v, output should stream before the command exits", elapsed)
+	}
+	if stdout.buf.String() != "first\n" {
+		t.Errorf("stdout = %q, want %q", stdout.buf.String(), "first\n")
+	}
+	if stderr.String() != "oops\n" {
+		t.Errorf("stderr = %q, want %q", stderr.String(), "oops\n")
+	}
+}
+
+// notifyWriter buffers writes and closes written on the first one.
+type notifyWriter struct {
+	buf     bytes.Buffer
+	written chan struct{}
+}
+
+func (w *notifyWriter) Write(p []byte) (int, error) {
+	if w.buf.Len() == 0 {
+		close(w.written)
+	}
+	return w.buf.Write(p)
+}
+
+func TestRun_Timeout_Linux(t *testing.T) {
+	cfg := Config{Workdir: t.TempDir(), Timeout: 100 * time.Millisecond}
+	s := &linuxSandbox{cfg: cfg, bwrapBin: fakeBwrap(t)}
+
+	// A background child holding stdout open must be killed too, or Run
+	// would wait for it
+	start := time.Now()
+	_, _, err := s.Run(context.Background(), "sleep 10 & sleep 10")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("error = %v, want context.DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Run took %v, the process group should be killed at the deadline", elapsed)
+	}
+
+	res, _ := s.RunResult(context.Background(), "sleep 10")
+	if !res.Signaled || !res.TimedOut {
+		t.Errorf("Signaled = %v, TimedOut = %v; want a killed, timed out run", res.Signaled, res.TimedOut)
+	}
+
+	// The command's own exit status 137 is not a kill by the sandbox
+	s.cfg.Timeout = 0
+	res, _ = s.RunResult(context.Background(), "exit 137")
+	if res.ExitCode != 137 || res.Signaled || res.TimedOut {
+		t.Errorf("ExitCode = %d, Signaled = %v, TimedOut = %v; want a plain exit 137", res.ExitCode, res.Signaled, res.TimedOut)
+	}
+}
+
+func TestRun_KillGrace_Linux(t *testing.T) {
+	workdir := t.TempDir()
+	cfg := Config{Workdir: workdir, KillGrace: 5 * time.Second}
+	s := &linuxSandbox{cfg: cfg, bwrapBin: fakeBwrap(t)}
+
+	// The fake bwrap execs the outer shell, standing in for bwrap as the
+	// group leader; the inner shell is the command and traps SIGTERM
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, _, err := s.Run(ctx, `sh -c 'trap "echo cleaned > cleanup; exit 0" TERM; sleep 10 & wait'`)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("error = %v, want context.DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > 4*time.Second {
+		t.Errorf("Run took %v, the command should exit on SIGTERM before the grace period ends", elapsed)
+	}
+	if data, err := os.ReadFile(filepath.Join(workdir, "cleanup")); err != nil || string(data) != "cleaned\n" {
+		t.Errorf("trap handler should have run, cleanup = %q, %v", data, err)
+	}
+}
+
+func TestRunResult_Signaled_Linux(t *testing.T) {
+	s := &linuxSandbox{cfg: Config{Workdir: t.TempDir()}, bwrapBin: fakeBwrap(t)}
+
+	// The fake bwrap execs the shell, so it's the process that dies
+	res, _ := s.RunResult(context.Background(), "kill -SEGV $$")
+	if !res.Signaled || res.Signal != syscall.SIGSEGV || res.ExitCode != 139 {
+		t.Errorf("Signaled = %v, Signal = %v, ExitCode = %d; want SIGSEGV as 139", res.Signaled, res.Signal, res.ExitCode)
+	}
+	if res.Reason != "killed by signal SIGSEGV" {
+		t.Errorf("Reason = %q", res.Reason)
+	}
+
+	// Like bwrap, the leader survives SIGTERM and reports its child's
+	// death as 128+15
+	s.cfg.KillGrace = 5 * time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	res, _ = s.RunResult(ctx, "sleep 10 && true")
+	if !res.Signaled || res.Signal != syscall.SIGTERM || res.ExitCode != 143 {
+		t.Errorf("Signaled = %v, Signal = %v, ExitCode = %d; want SIGTERM as 143", res.Signaled, res.Signal, res.ExitCode)
+	}
+
+	res, _ = s.RunResult(context.Background(), "exit 143")
+	if res.Signaled || res.ExitCode != 143 {
+		t.Errorf("Signaled = %v, ExitCode = %d; the command's own exit 143 is no signal", res.Signaled, res.ExitCode)
+	}
+}
+
+func TestRun_KillGraceEscalates_Linux(t *testing.T) {
+	cfg := Config{Workdir: t.TempDir(), KillGrace: 200 * time.Millisecond}
+	s := &linuxSandbox{cfg: cfg, bwrapBin: fakeBwrap(t)}
+
+	// A command ignoring SIGTERM is killed once the grace period is over
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	s.Run(ctx, `sh -c 'trap "" TERM; sleep 10 & wait'`)
+	if elapsed := time.Since(start); elapsed > 4*time.Second {
+		t.Errorf("Run took %v, SIGKILL should follow the grace period", elapsed)
+	}
+}
+
+func TestProcessGroup(t *testing.T) {
+	if pgrp := processGroup(os.Getpid()); pgrp != syscall.Getpgrp() {
+		t.Errorf("processGroup(self) = %d, want %d", pgrp, syscall.Getpgrp())
+	}
+	if pgrp := processGroup(-5); pgrp != -1 {
+		t.Errorf("processGroup(-5) = %d, want -1", pgrp)
+	}
+}
+
+func TestRun_MemoryLimit_Linux(t *testing.T) {
+	prlimit, err := exec.LookPath("prlimit")
+	if err != nil {
+		t.Skip("prlimit not installed")
+	}
+	cfg := Config{Workdir: t.TempDir(), MemoryLimitBytes: 100 << 20}
+	s := &linuxSandbox{cfg: cfg, bwrapBin: fakeBwrap(t), prlimitBin: prlimit}
+
+	args := s.buildArgs("true")
+	if !containsSequence(args, "--chdir", cfg.Workdir, prlimit, "--as=104857600", "--") {
+		t.Errorf("command should run under prlimit, got %v", args)
+	}
+
+	if output, _, err := s.Run(context.Background(), "echo ok"); err != nil || string(output) != "ok\n" {
+		t.Errorf("small command should run within the limit, got %q, %v", output, err)
+	}
+
+	// sort fails to grow past the limit and says so
+	_, _, err = s.Run(context.Background(), "head -c 300000000 /dev/zero | sort >/dev/null")
+	if !errors.Is(err, ErrMemoryLimit) {
+		t.Errorf("error = %v, want ErrMemoryLimit", err)
+	}
+
+	// A segfault under the limit is just a crash
+	_, _, err = s.Run(context.Background(), `sh -c 'kill -SEGV $$'`)
+	if errors.Is(err, ErrMemoryLimit) {
+		t.Errorf("error = %v, a segfault should not be ErrMemoryLimit", err)
+	}
+}
+
+func TestRun_CPUTimeLimit_Linux(t *testing.T) {
+	prlimit, err := exec.LookPath("prlimit")
+	if err != nil {
+		t.Skip("prlimit not installed")
+	}
+	cfg := Config{Workdir: t.TempDir(), CPUTimeLimit: 500 * time.Millisecond}
+	s := &linuxSandbox{cfg: cfg, bwrapBin: fakeBwrap(t), prlimitBin: prlimit}
+
+	args := s.buildArgs("true")
+	if !containsSequence(args, "--chdir", cfg.Workdir, prlimit, "--cpu=1:2", "--") {
+		t.Errorf("command should run under prlimit, got %v", args)
+	}
+
+	// The inner shell spins until SIGXCPU; the outer one reports it
+	start := time.Now()
+	_, _, err = s.Run(context.Background(), `sh -c 'while :; do :; done'`)
+	if !errors.Is(err, ErrCPULimit) {
+		t.Errorf("error = %v, want ErrCPULimit", err)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("busy loop ran for %v, want about 1s of CPU", elapsed)
+	}
+}
+
+func TestRun_FileLimits_Linux(t *testing.T) {
+	prlimit, err := exec.LookPath("prlimit")
+	if err != nil {
+		t.Skip("prlimit not installed")
+	}
+	cfg := Config{Workdir: t.TempDir(), OpenFilesLimit: 64, FileSizeLimitBytes: 1 << 20, ProcessLimit: 4096}
+	s := &linuxSandbox{cfg: cfg, bwrapBin: fakeBwrap(t), prlimitBin: prlimit}
+
+	args := s.buildArgs("true")
+	if !containsSequence(args, prlimit, "--nofile=64", "--fsize=1048576", "--nproc=4096", "--") {
+		t.Errorf("command should run under prlimit, got %v", args)
+	}
+
+	stdout, _, err := s.Run(context.Background(), "ulimit -n")
+	if err != nil {
+		t.Fatalf("Run() error: %v", err)
+	}
+	if got := strings.TrimSpace(string(stdout)); got != "64" {
+		t.Errorf("ulimit -n = %q, want 64", got)
+	}
+
+	// Writing past the file size limit fails
+	_, _, err = s.Run(context.Background(), "head -c 2000000 /dev/zero > big")
+	if err == nil {
+		t.Error("writing 2MB should fail with a 1MB file size limit")
+	}
+}
+
+func TestRun_AllowedBinaryHashes_Linux(t *testing.T) {
+	cfg := Config{Workdir: t.TempDir(), AllowedBinaryHashes: map[string]string{"sh": strings.Repeat("0", 64)}}
+	s := &linuxSandbox{cfg: cfg, bwrapBin: fakeBwrap(t)}
+
+	marker := filepath.Join(cfg.Workdir, "ran")
+	if _, _, err := s.Run(context.Background(), "touch "+marker); !errors.Is(err, ErrBinaryHashMismatch) {
+		t.Errorf("Run() error = %v, want ErrBinaryHashMismatch for sh", err)
+	}
+	if _, _, err := s.RunArgs(context.Background(), []string{"touch", marker}); !errors.Is(err, ErrBinaryHashMismatch) {
+		t.Errorf("RunArgs() error = %v, want ErrBinaryHashMismatch for an unlisted binary", err)
+	}
+	if _, err := os.Stat(marker); err == nil {
+		t.Error("a rejected command should not run")
+	}
+}
+
+func TestRunResult_Durations_Linux(t *testing.T) {
+	cfg := Config{Workdir: t.TempDir()}
+	s := &linuxSandbox{cfg: cfg, bwrapBin: fakeBwrap(t)}
+
+	start := time.Now()
+	res, err := s.RunResult(context.Background(), "sleep 0.2")
+	total := time.Since(start)
+	if err != nil {
+		t.Fatalf("RunResult() error: %v", err)
+	}
+
+	if res.SetupDuration <= 0 {
+		t.Errorf("SetupDuration = %v, want > 0", res.SetupDuration)
+	}
+	if res.CommandDuration < 200*time.Millisecond {
+		t.Errorf("CommandDuration = %v, want >= 200ms", res.CommandDuration)
+	}
+	if sum := res.SetupDuration + res.CommandDuration; sum > total || sum < total-100*time.Millisecond {
+		t.Errorf("setup %v + command %v = %v, want roughly the total %v", res.SetupDuration, res.CommandDuration, sum, total)
+	}
+}
+
+func TestNewLinux_NetworkAllow(t *testing.T) {
+	// Host filtering can't be enforced, so it fails rather than allowing all
+	_, err := newLinux(Config{Workdir: t.TempDir(), NetworkAllow: []string{"example.com:443"}})
+	if err == nil || !strings.Contains(err.Error(), "NetworkAllow is not supported") {
+		t.Errorf("expected NetworkAllow error, got %v", err)
+	}
+}
+
+func TestCheckRoot(t *testing.T) {
+	saved := geteuid
+	t.Cleanup(func() { geteuid = saved })
+
+	var logged bytes.Buffer
+	cfg := Config{Logger: log.New(&logged, "", 0)}
+
+	geteuid = func() int { return 1000 }
+	if drop, err := checkRoot(&cfg); drop || err != nil || logged.Len() > 0 {
+		t.Errorf("non-root: checkRoot() = %v, %v, logged %q", drop, err, logged.String())
+	}
+
+	geteuid = func() int { return 0 }
+	if drop, err := checkRoot(&cfg); drop || err != nil {
+		t.Errorf("root: checkRoot() = %v, %v, want a warning only", drop, err)
+	}
+	if !strings.Contains(logged.String(), "warning: running as root") || !cfg.degraded {
+		t.Errorf("root should be warned about and degrade the sandbox, got %q", logged.String())
+	}
+
+	cfg.StrictRoot = true
+	if _, err := checkRoot(&cfg); err == nil || !strings.Contains(err.Error(), "running as root") {
+		t.Errorf("StrictRoot should fail as root, got %v", err)
+	}
+
+	// DropRoot takes precedence: there's nothing left to refuse
+	cfg.DropRoot = true
+	logged.Reset()
+	if drop, err := checkRoot(&cfg); !drop || err != nil || logged.Len() > 0 {
+		t.Errorf("DropRoot: checkRoot() = %v, %v, logged %q", drop, err, logged.String())
+	}
+}
+
+func TestBuildArgs_PIDNamespace(t *testing.T) {
+	cfg := Config{Workdir: "/tmp", AllowWrite: []string{"/tmp"}, PIDNamespace: true}
+	s := &linuxSandbox{cfg: cfg, bwrapBin: "/usr/bin/bwrap"}
+	args := s.buildArgs("make")
+	if !slices.Contains(args, "--unshare-pid") || !slices.Contains(args, "--die-with-parent") {
+		t.Errorf("PIDNamespace should unshare the PID namespace and die with the parent, got %v", args)
+	}
+	if slices.Index(args, "--unshare-pid") > slices.Index(args, "--proc") {
+		t.Error("--unshare-pid must come before --proc")
+	}
+
+	if !hardcodedDefaults().PIDNamespace {
+		t.Error("PIDNamespace should be on by default")
+	}
+}
+
+func TestBuildArgs_IPCAndUTS(t *testing.T) {
+	cfg := Config{Workdir: "/tmp", AllowWrite: []string{"/tmp"}, UnshareIPC: true, Hostname: "sandbox"}
+	s := &linuxSandbox{cfg: cfg, bwrapBin: "/usr/bin/bwrap"}
+	args := s.buildArgs("hostname")
+	if !slices.Contains(args, "--unshare-ipc") {
+		t.Errorf("UnshareIPC should unshare the IPC namespace, got %v", args)
+	}
+	if !containsSequence(args, "--unshare-uts", "--hostname", "sandbox") {
+		t.Errorf("Hostname should unshare the UTS namespace and set it, got %v", args)
+	}
+
+	s.cfg = Config{Workdir: "/tmp", AllowWrite: []string{"/tmp"}, UnshareUTS: true}
+	args = s.buildArgs("hostname")
+	if !slices.Contains(args, "--unshare-uts") || slices.Contains(args, "--hostname") || slices.Contains(args, "--unshare-ipc") {
+		t.Errorf("UnshareUTS alone should keep the hostname, got %v", args)
+	}
+}
+
+func TestCheckNamespaces(t *testing.T) {
+	saved := namespaceDir
+	t.Cleanup(func() { namespaceDir = saved })
+	namespaceDir = t.TempDir()
+	if err := os.WriteFile(filepath.Join(namespaceDir, "ipc"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var logged bytes.Buffer
+	cfg := Config{UnshareIPC: true, Hostname: "sandbox", Logger: log.New(&logged, "", 0)}
+	checkNamespaces(&cfg)
+	if !cfg.UnshareIPC {
+		t.Error("UnshareIPC should stay on with IPC namespaces supported")
+	}
+	if cfg.Hostname != "" || cfg.UnshareUTS {
+		t.Errorf("Hostname = %q, want it dropped without UTS namespaces", cfg.Hostname)
+	}
+	if !cfg.degraded || !strings.Contains(logged.String(), "CONFIG_UTS_NS") {
+		t.Errorf("dropping Hostname should degrade the sandbox, logged %q", logged.String())
+	}
+}
+
+func TestBuildArgs_Seccomp(t *testing.T) {
+	cfg := Config{Workdir: "/tmp", AllowWrite: []string{"/tmp"}}
+	s := &linuxSandbox{cfg: cfg, bwrapBin: "/usr/bin/bwrap", seccomp: make([]byte, 8)}
+	args := s.buildArgs("make")
+	if !containsSequence(args, "--seccomp", "4") {
+		t.Errorf("the filter should be read from fd 4, got %v", args)
+	}
+	if slices.Index(args, "--seccomp") > slices.Index(args, "--chdir") {
+		t.Error("--seccomp must come before the command")
+	}
+
+	s.cfg.TrackReads = true
+	if args := s.buildArgs("make"); !containsSequence(args, "--seccomp", "5") {
+		t.Errorf("with TrackReads on fd 4, the filter should be on fd 5, got %v", args)
+	}
+
+	s.seccomp = nil
+	if slices.Contains(s.buildArgs("make"), "--seccomp") {
+		t.Error("no --seccomp without a SeccompProfile")
+	}
+}
+
+func TestRun_SeccompFD_Linux(t *testing.T) {
+	filter, err := seccompFilter(runtime.GOARCH)
+	if err != nil {
+		t.Skip(err)
+	}
+	cfg := Config{Workdir: t.TempDir()}
+	s := &linuxSandbox{cfg: cfg, bwrapBin: fakeBwrap(t), seccomp: filter}
+
+	output, _, err := s.Run(context.Background(), "wc -c <&4")
+	if err != nil {
+		t.Fatalf("Run() error: %v", err)
+	}
+	if got := strings.TrimSpace(string(output)); got != strconv.Itoa(len(filter)) {
+		t.Errorf("fd 4 holds %s bytes, want the %d byte filter", got, len(filter))
+	}
+}
+
+// TestSeccompFilter_Enforced_Linux loads the default filter on a thread of
+// its own, which the runtime discards when the goroutine exits locked.
+func TestSeccompFilter_Enforced_Linux(t *testing.T) {
+	filter, err := seccompFilter(runtime.GOARCH)
+	if err != nil {
+		t.Skip(err)
+	}
+
+	mountpoint := t.TempDir()
+	type outcome struct{ setup, getpid, ptrace, mount error }
+	done := make(chan outcome)
+	go func() {
+		runtime.LockOSThread()
+		var o outcome
+		defer func() { done <- o }()
+
+		const prSetNoNewPrivs, prSetSeccomp, seccompModeFilter = 38, 22, 2
+		prog := struct {
+			len    uint16
+			filter *byte
+		}{uint16(len(filter) / 8), &filter[0]}
+		if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0); errno != 0 {
+			o.setup = errno
+			return
+		}
+		if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetSeccomp, seccompModeFilter, uintptr(unsafe.Pointer(&prog))); errno != 0 {
+			o.setup = errno
+			return
+		}
+		if _, _, errno := syscall.RawSyscall(syscall.SYS_GETPID, 0, 0, 0); errno != 0 {
+			o.getpid = errno
+		}
+		_, _, o.ptrace = syscall.RawSyscall(syscall.SYS_PTRACE, syscall.PTRACE_PEEKUSR, uintptr(os.Getpid()), 0)
+		o.mount = syscall.Mount("none", mountpoint, "tmpfs", 0, "")
+		runtime.KeepAlive(filter)
+	}()
+	o := <-done
+	if o.mount == nil {
+		syscall.Unmount(mountpoint, 0)
+	}
+
+	if o.setup != nil {
+		t.Skipf("can't load a seccomp filter here: %v", o.setup)
+	}
+	if o.getpid != nil {
+		t.Errorf("getpid should be allowed, got %v", o.getpid)
+	}
+	if o.ptrace != syscall.EPERM {
+		t.Errorf("ptrace error = %v, want EPERM", o.ptrace)
+	}
+	if o.mount != syscall.EPERM {
+		t.Errorf("mount error = %v, want EPERM", o.mount)
+	}
+}
+
+func TestBuildArgs_SecretsFileHidden(t *testing.T) {
+	dir := t.TempDir()
+	secrets := filepath.Join(dir, "secrets.env")
+	if err := os.WriteFile(secrets, []byte("GITHUB_TOKEN=ghp_abc\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := resolveConfig(Config{
+		Workdir:                dir,
+		AllowWrite:             []string{dir},
+		SecretsFile:            secrets,
+		InjectSecrets:          []string{"GITHUB_TOKEN"},
+		DenyReadImpliesNoWrite: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	secrets, _ = expandPath(secrets)
+
+	args := (&linuxSandbox{cfg: cfg, bwrapBin: "/usr/bin/bwrap"}).buildArgs("cat secrets.env")
+	if !containsSequence(args, "--ro-bind", "/dev/null", secrets) {
+		t.Errorf("the secrets file should be hidden behind /dev/null, got %v", args)
+	}
+	if containsSequence(args, "--tmpfs", secrets) || containsSequence(args, "--remount-ro", secrets) {
+		t.Errorf("a file can't take a tmpfs or be remounted, got %v", args)
+	}
+	// Over the writable workdir bind
+	if slices.Index(args, "/dev/null") < slices.Index(args, "--bind") {
+		t.Error("the secrets file must be hidden after the workdir is bound")
+	}
+}
+
+func TestBuildArgs_DropRoot(t *testing.T) {
+	cfg := Config{Workdir: "/tmp", AllowWrite: []string{"/tmp"}}
+	s := &linuxSandbox{cfg: cfg, bwrapBin: "/usr/bin/bwrap", dropRoot: true}
+	args := s.buildArgs("id")
+	if !containsSequence(args, "--unshare-user", "--uid", "65534", "--gid", "65534", "--cap-drop", "ALL") {
+		t.Errorf("should run as nobody without capabilities, got %v", args)
+	}
+
+	s.dropRoot = false
+	if slices.Contains(s.buildArgs("id"), "--unshare-user") {
+		t.Error("should not unshare the user namespace unless dropping root")
+	}
+}
+
+func TestBuildArgs_Capabilities(t *testing.T) {
+	cfg := Config{Workdir: "/tmp", AllowWrite: []string{"/tmp"}}
+	s := &linuxSandbox{cfg: cfg, bwrapBin: "/usr/bin/bwrap"}
+	args := s.buildArgs("id")
+	if !containsSequence(args, "--cap-drop", "ALL") || slices.Contains(args, "--cap-add") {
+		t.Errorf("should drop all capabilities by default, got %v", args)
+	}
+
+	s.cfg.Capabilities = []string{"CAP_NET_BIND_SERVICE", "CAP_CHOWN"}
+	args = s.buildArgs("id")
+	if !containsSequence(args, "--cap-drop", "ALL", "--cap-add", "CAP_NET_BIND_SERVICE", "--cap-add", "CAP_CHOWN") {
+		t.Errorf("should add back only the listed capabilities, got %v", args)
+	}
+	if dash := slices.Index(args, "--"); dash >= 0 && slices.Index(args, "--cap-add") > dash {
+		t.Errorf("capability args should come before the command, got %v", args)
+	}
+}
+
+func TestRunResult_TrackReads_Linux(t *testing.T) {
+	// Stand-in for strace that reports one read and runs the command
+	script := `#!/bin/sh
+while [ "$1" != "--" ]; do
+	if [ "$1" = "-o" ]; then out="$2"; fi
+	shift
+done
+shift
+echo 'openat(AT_FDCWD, "input.txt", O_RDONLY|O_CLOEXEC) = 3' > "$out"
+exec "$@"
+`
+	strace := filepath.Join(t.TempDir(), "strace")
+	if err := os.WriteFile(strace, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	workdir := t.TempDir()
+	cfg := Config{Workdir: workdir, TrackReads: true}
+	s := &linuxSandbox{cfg: cfg, bwrapBin: fakeBwrap(t), straceBin: strace}
+
+	args := s.buildArgs("true")
+	if !containsSequence(args, "--chdir", workdir, strace) || !slices.Contains(args, "/proc/self/fd/4") {
+		t.Errorf("command should run under strace writing to fd 4, got %v", args)
+	}
+
+	res, err := s.RunResult(context.Background(), "echo ok")
+	if err != nil {
+		t.Fatalf("RunResult() error: %v", err)
+	}
+	if string(res.Stdout) != "ok\n" {
+		t.Errorf("stdout = %q, want %q", res.Stdout, "ok\n")
+	}
+	if want := filepath.Join(workdir, "input.txt"); !slices.Equal(res.ReadPaths, []string{want}) {
+		t.Errorf("ReadPaths = %v, want [%s]", res.ReadPaths, want)
+	}
+}
+
+func TestRun_NeedsTTY_Linux(t *testing.T) {
+	cfg := Config{Workdir: t.TempDir()}
+	s := &linuxSandbox{cfg: cfg, bwrapBin: fakeBwrap(t)}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Without a controlling terminal, opening /dev/tty fails instead of blocking
+	_, code, err := s.Run(ctx, "cat /dev/tty")
+	if ctx.Err() != nil {
+		t.Fatal("reading /dev/tty should fail fast, not hang")
+	}
+	if code == 0 {
+		t.Fatal("expected non-zero exit code")
+	}
+	if !errors.Is(err, ErrNeedsTTY) {
+		t.Errorf("error = %v, want ErrNeedsTTY", err)
+	}
+}
+
+// blockingReader returns a reader whose Read blocks until the test ends,
+// like a pipe with no writer.
+func blockingReader(t *testing.T) io.Reader {
+	r, w := io.Pipe()
+	t.Cleanup(func() { w.Close() })
+	return r
+}
+
+// fakeBwrap writes a stand-in for bwrap that skips the sandbox options and
+// runs the command directly, so the run path can be tested without bwrap.
+func fakeBwrap(t *testing.T) string {
+	t.Helper()
+
+	script := `#!/bin/sh
+while [ "$#" -gt 0 ]; do
+	if [ "$1" = "--info-fd" ]; then
+		printf '{"child-pid": %d}' "$$" >&"$2"
+		eval "exec $2>&-"
+		shift 2
+		continue
+	fi
+	if [ "$1" = "--chdir" ]; then
+		cd "$2" || exit 125
+		shift 2
+		break
+	fi
+	shift
+done
+exec "$@"
+`
+	path := filepath.Join(t.TempDir(), "bwrap")
+	if err := os.WriteFile(path, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
 // containsSequence checks if slice contains consecutive elements.
 func containsSequence(slice []string, seq ...string) bool {
 	if len(seq) == 0 {
@@ -0,0 +1,36 @@
+package sandbox
+
+import (
+	"os"
+	"strconv"
+	"strings"
+)
+
+// depthEnv is the variable buildEnv sets to the sandbox nesting depth: 1
+// in a sandbox started outside any, 2 in one started inside that, etc.
+const depthEnv = "AGENTSANDBOX_DEPTH"
+
+// IsSandboxed reports whether the current process runs in a sandbox, so
+// callers can skip setting up a redundant one. It checks for the
+// AGENTSANDBOX_DEPTH marker this package sets, which commands can unset,
+// and for bwrap's init as PID 1, as under Config.PIDNamespace or other bwrap
+// sandboxes with their own PID namespace. Other sandboxes may go unnoticed.
+func IsSandboxed() bool {
+	return sandboxDepth() > 0 || bwrapInit()
+}
+
+// sandboxDepth returns the nesting depth from the marker, 0 if unset.
+func sandboxDepth() int {
+	n, err := strconv.Atoi(os.Getenv(depthEnv))
+	if err != nil || n < 0 {
+		return 0
+	}
+	return n
+}
+
+// bwrapInit reports whether PID 1 is bwrap. Outside Linux there's no /proc
+// to tell.
+func bwrapInit() bool {
+	comm, err := os.ReadFile("/proc/1/comm")
+	return err == nil && strings.TrimSpace(string(comm)) == "bwrap"
+}
@@ -0,0 +1,53 @@
+package sandbox
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestIsSandboxed_DepthMarker(t *testing.T) {
+	if bwrapInit() {
+		t.Skip("running under bwrap's init")
+	}
+	t.Setenv(depthEnv, "")
+	if IsSandboxed() {
+		t.Fatal("should not be sandboxed without the marker")
+	}
+
+	// The marker buildEnv passes to commands makes them see a sandbox
+	cfg := Config{CleanEnv: true, SetEnv: map[string]string{depthEnv: "0"}}
+	depth := lookupEnv(buildEnv(cfg), depthEnv)
+	if depth != "1" {
+		t.Fatalf("%s = %q, want 1 outside any sandbox", depthEnv, depth)
+	}
+	t.Setenv(depthEnv, depth)
+	if !IsSandboxed() {
+		t.Error("should be sandboxed with the marker set by buildEnv")
+	}
+
+	// Nested sandboxes count up
+	if got := lookupEnv(buildEnv(cfg), depthEnv); got != "2" {
+		t.Errorf("nested %s = %q, want 2", depthEnv, got)
+	}
+
+	for _, bad := range []string{"0", "-1", "yes"} {
+		t.Setenv(depthEnv, bad)
+		if IsSandboxed() {
+			t.Errorf("%s=%s should not count as sandboxed", depthEnv, bad)
+		}
+	}
+}
+
+func TestBuildEnv_DepthMarkerLast(t *testing.T) {
+	t.Setenv(depthEnv, "")
+	cfg := Config{runEnv: map[string]string{depthEnv: "7"}}
+	var markers []string
+	for _, kv := range buildEnv(cfg) {
+		if strings.HasPrefix(kv, depthEnv+"=") {
+			markers = append(markers, kv)
+		}
+	}
+	if len(markers) != 1 || markers[0] != depthEnv+"=1" {
+		t.Errorf("markers = %v, want only %s=1", markers, depthEnv)
+	}
+}
@@ -0,0 +1,90 @@
+package sandbox
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// networkDest is a parsed NetworkAllow entry.
+type networkDest struct {
+	host string // Hostname, IP, CIDR or "*"
+	port string // Port number or "*"
+}
+
+// parseNetworkAllow parses NetworkAllow entries of the form "host:port",
+// where host is a hostname, IP, CIDR or "*" and port a number or "*". An
+// entry without a port allows every port. IPv6 hosts with a port go in
+// brackets, e.g. "[::1]:8080".
+func parseNetworkAllow(entries []string) ([]networkDest, error) {
+	dests := make([]networkDest, 0, len(entries))
+	for _, entry := range entries {
+		host, port, err := net.SplitHostPort(entry)
+		if err != nil {
+			host, port = entry, "*"
+		}
+
+		if port != "*" {
+			if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+				return nil, fmt.Errorf("%q: invalid port %q", entry, port)
+			}
+		}
+		if !validNetworkHost(host) {
+			return nil, fmt.Errorf("%q: invalid host %q", entry, host)
+		}
+		dests = append(dests, networkDest{host: host, port: port})
+	}
+	return dests, nil
+}
+
+// validNetworkHost reports whether host is "*", an IP, a CIDR or a
+// plausible hostname.
+func validNetworkHost(host string) bool {
+	if host == "*" || net.ParseIP(host) != nil {
+		return true
+	}
+	if _, _, err := net.ParseCIDR(host); err == nil {
+		return true
+	}
+	return host != "" && !strings.ContainsAny(host, " /:*")
+}
+
+// isLocalhost reports whether host names the loopback interface.
+func (d networkDest) isLocalhost() bool {
+	if d.host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(d.host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// nftPortRules returns the nftables ruleset enforcing AllowedPorts in the
+// sandbox's network namespace. Outbound connections to other ports are
+// rejected rather than dropped, so they fail at once instead of timing out.
+// Loopback and replies on established connections stay allowed.
+func nftPortRules(ports []int) string {
+	ports = slices.Clone(ports)
+	slices.Sort(ports)
+	ports = slices.Compact(ports)
+	set := make([]string, len(ports))
+	for i, port := range ports {
+		set[i] = strconv.Itoa(port)
+	}
+	list := strings.Join(set, ", ")
+
+	var sb strings.Builder
+	sb.WriteString("table inet agentsandbox {\n")
+	sb.WriteString("\tchain output {\n")
+	sb.WriteString("\t\ttype filter hook output priority 0; policy accept;\n")
+	sb.WriteString("\t\toifname \"lo\" accept\n")
+	sb.WriteString("\t\tct state established,related accept\n")
+	fmt.Fprintf(&sb, "\t\ttcp dport { %s } accept\n", list)
+	fmt.Fprintf(&sb, "\t\tudp dport { %s } accept\n", list)
+	sb.WriteString("\t\tmeta l4proto tcp reject with tcp reset\n")
+	sb.WriteString("\t\treject with icmpx type admin-prohibited\n")
+	sb.WriteString("\t}\n")
+	sb.WriteString("}\n")
+	return sb.String()
+}
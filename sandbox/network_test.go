@@ -0,0 +1,107 @@
+package sandbox
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseNetworkAllow(t *testing.T) {
+	dests, err := parseNetworkAllow([]string{
+		"registry.npmjs.org:443",
+		"10.0.0.0/8",
+		"[::1]:8080",
+		"*:53",
+	})
+	if err != nil {
+		t.Fatalf("parseNetworkAllow() error: %v", err)
+	}
+
+	want := []networkDest{
+		{host: "registry.npmjs.org", port: "443"},
+		{host: "10.0.0.0/8", port: "*"},
+		{host: "::1", port: "8080"},
+		{host: "*", port: "53"},
+	}
+	if len(dests) != len(want) {
+		t.Fatalf("dests = %v, want %v", dests, want)
+	}
+	for i := range want {
+		if dests[i] != want[i] {
+			t.Errorf("dests[%d] = %v, want %v", i, dests[i], want[i])
+		}
+	}
+	if !dests[2].isLocalhost() || dests[0].isLocalhost() {
+		t.Error("only [::1] should be localhost")
+	}
+
+	for _, entry := range []string{"example.com:0", "example.com:https", "", "a b:443", "exa*mple.com:443"} {
+		if _, err := parseNetworkAllow([]string{entry}); err == nil {
+			t.Errorf("parseNetworkAllow(%q) should fail", entry)
+		}
+	}
+}
+
+func TestResolveConfig_NetworkAllow(t *testing.T) {
+	cfg, err := resolveConfig(Config{Workdir: t.TempDir(), NetworkAllow: []string{"example.com:443"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(cfg.networkAllow) != 1 || cfg.networkAllow[0].port != "443" {
+		t.Errorf("networkAllow = %v, want example.com:443 parsed", cfg.networkAllow)
+	}
+
+	_, err = resolveConfig(Config{Workdir: t.TempDir(), NetworkAllow: []string{"example.com:99999"}})
+	if err == nil || !strings.Contains(err.Error(), "invalid NetworkAllow") {
+		t.Errorf("expected invalid NetworkAllow error, got %v", err)
+	}
+
+	_, err = resolveConfig(Config{Workdir: t.TempDir(), NoNetwork: true, NetworkAllow: []string{"example.com:443"}})
+	if err == nil {
+		t.Error("expected error for NetworkAllow with NoNetwork")
+	}
+}
+
+func TestNftPortRules(t *testing.T) {
+	rules := nftPortRules([]int{8080, 443, 53, 443})
+
+	for _, want := range []string{
+		"table inet agentsandbox {",
+		"type filter hook output priority 0;",
+		`oifname "lo" accept`,
+		"ct state established,related accept",
+		"tcp dport { 53, 443, 8080 } accept",
+		"udp dport { 53, 443, 8080 } accept",
+		"meta l4proto tcp reject with tcp reset",
+		"reject with icmpx type admin-prohibited",
+	} {
+		if !strings.Contains(rules, want) {
+			t.Errorf("rules should contain %q, got:\n%s", want, rules)
+		}
+	}
+	// Accepts come before the rejects that end the chain
+	if strings.Index(rules, "dport") > strings.Index(rules, "reject") {
+		t.Errorf("ports should be accepted before the rest is rejected, got:\n%s", rules)
+	}
+
+	if rules := nftPortRules([]int{443}); !strings.Contains(rules, "tcp dport { 443 } accept") {
+		t.Errorf("single port rules, got:\n%s", rules)
+	}
+}
+
+func TestResolveConfig_AllowedPorts(t *testing.T) {
+	if _, err := resolveConfig(Config{Workdir: t.TempDir(), AllowedPorts: []int{53, 443}}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for _, port := range []int{0, -1, 65536} {
+		_, err := resolveConfig(Config{Workdir: t.TempDir(), AllowedPorts: []int{port}})
+		if err == nil || !strings.Contains(err.Error(), "invalid AllowedPorts") {
+			t.Errorf("port %d: expected invalid AllowedPorts error, got %v", port, err)
+		}
+	}
+
+	_, err := resolveConfig(Config{Workdir: t.TempDir(), NoNetwork: true, AllowedPorts: []int{443}})
+	if err == nil {
+		t.Error("expected error for AllowedPorts with NoNetwork")
+	}
+}
@@ -0,0 +1,58 @@
+package sandbox
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+)
+
+// Output encodings for Config.OutputEncoding.
+const (
+	EncodingRaw       = "raw"        // Bytes exactly as produced by the command
+	EncodingUTF8Lossy = "utf8-lossy" // Invalid UTF-8 sequences replaced with U+FFFD
+	EncodingBase64    = "base64"     // Standard base64 of the raw bytes
+)
+
+// EncodeOutput encodes command output with the given encoding.
+// An empty encoding is treated as raw.
+func EncodeOutput(output []byte, encoding string) ([]byte, error) {
+	switch encoding {
+	case "", EncodingRaw:
+		return output, nil
+	case EncodingUTF8Lossy:
+		return bytes.ToValidUTF8(output, []byte("\uFFFD")), nil
+	case EncodingBase64:
+		encoded := make([]byte, base64.StdEncoding.EncodedLen(len(output)))
+		base64.StdEncoding.Encode(encoded, output)
+		return encoded, nil
+	default:
+		return nil, fmt.Errorf("unknown output encoding %q", encoding)
+	}
+}
+
+// checkOutputEncoding validates an encoding name.
+func checkOutputEncoding(encoding string) error {
+	_, err := EncodeOutput(nil, encoding)
+	return err
+}
+
+// finishOutput applies the configured output post-processing.
+// Encoding was validated in New, so unknown encodings leave output unchanged.
+func finishOutput(cfg Config, output []byte) []byte {
+	if cfg.TrimTrailingNewline {
+		output = trimTrailingNewline(output)
+	}
+	if encoded, err := EncodeOutput(output, cfg.OutputEncoding); err == nil {
+		return encoded
+	}
+	return output
+}
+
+// trimTrailingNewline removes one trailing "\n" or "\r\n".
+func trimTrailingNewline(output []byte) []byte {
+	if trimmed, ok := bytes.CutSuffix(output, []byte("\n")); ok {
+		trimmed, _ = bytes.CutSuffix(trimmed, []byte("\r"))
+		return trimmed
+	}
+	return output
+}
@@ -0,0 +1,93 @@
+package sandbox
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestEncodeOutput_InvalidUTF8(t *testing.T) {
+	// "ok " followed by an invalid byte and a truncated multi-byte sequence
+	input := []byte("ok \xff\xe2\x82")
+
+	tests := []struct {
+		encoding string
+		expected string
+	}{
+		{"", "ok \xff\xe2\x82"},
+		{EncodingRaw, "ok \xff\xe2\x82"},
+		{EncodingUTF8Lossy, "ok \uFFFD"},
+		{EncodingBase64, "b2sg/+KC"},
+	}
+
+	for _, tt := range tests {
+		result, err := EncodeOutput(input, tt.encoding)
+		if err != nil {
+			t.Errorf("EncodeOutput(%q) unexpected error: %v", tt.encoding, err)
+			continue
+		}
+		if string(result) != tt.expected {
+			t.Errorf("EncodeOutput(%q) = %q, want %q", tt.encoding, result, tt.expected)
+		}
+	}
+}
+
+func TestEncodeOutput_ValidUTF8Unchanged(t *testing.T) {
+	input := []byte("héllo wörld\n")
+
+	result, err := EncodeOutput(input, EncodingUTF8Lossy)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !bytes.Equal(result, input) {
+		t.Errorf("got %q, want %q", result, input)
+	}
+}
+
+func TestEncodeOutput_Unknown(t *testing.T) {
+	if _, err := EncodeOutput([]byte("x"), "hex"); err == nil {
+		t.Error("expected error for unknown encoding")
+	}
+}
+
+func TestResolveConfig_InvalidOutputEncoding(t *testing.T) {
+	_, err := resolveConfig(Config{
+		Workdir:        t.TempDir(),
+		OutputEncoding: "latin1",
+	})
+	if err == nil {
+		t.Error("expected error for invalid OutputEncoding")
+	}
+}
+
+func TestTrimTrailingNewline(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"hello\n", "hello"},
+		{"hello\r\n", "hello"},
+		{"hello\n\n", "hello\n"},
+		{"hello", "hello"},
+		{"\n", ""},
+		{"", ""},
+	}
+
+	for _, tt := range tests {
+		if result := trimTrailingNewline([]byte(tt.input)); string(result) != tt.expected {
+			t.Errorf("trimTrailingNewline(%q) = %q, want %q", tt.input, result, tt.expected)
+		}
+	}
+}
+
+func TestFinishOutput_TrimBeforeEncoding(t *testing.T) {
+	cfg := Config{TrimTrailingNewline: true, OutputEncoding: EncodingBase64}
+
+	// base64("hi") — the newline is trimmed before encoding
+	if result := finishOutput(cfg, []byte("hi\n")); string(result) != "aGk=" {
+		t.Errorf("finishOutput() = %q, want %q", result, "aGk=")
+	}
+
+	if result := finishOutput(Config{}, []byte("hi\n")); string(result) != "hi\n" {
+		t.Errorf("trimming should be off by default, got %q", result)
+	}
+}
@@ -0,0 +1,151 @@
+package sandbox
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+)
+
+// Policy is the effective filesystem policy of a config: path list files
+// loaded and paths expanded as the sandbox enforces them. It's meant for
+// review by external tools and doesn't change enforcement. "*" in a list
+// matches every path. Nothing under DenyRead is writable, except
+// WriteCarveOut. The system dirs that stay readable under AllowRead or a
+// wildcard DenyRead, which vary by platform, and the Go caches ShareGoCache
+// adds, which only go env knows, aren't listed.
+type Policy struct {
+	AllowWrite    []string `json:"allowWrite"`              // Writable paths
+	DenyWrite     []string `json:"denyWrite"`               // Read-only paths within AllowWrite
+	DenyRead      []string `json:"denyRead"`                // Hidden paths, taking precedence over AllowWrite
+	AllowRead     []string `json:"allowRead,omitempty"`     // If set, the only readable paths besides AllowWrite
+	ReadCarveOut  []string `json:"readCarveOut,omitempty"`  // Readable paths within DenyRead: a hidden workdir, PATH dirs in a hidden home
+	WriteCarveOut []string `json:"writeCarveOut,omitempty"` // Writable paths within DenyRead: a hidden workdir in AllowWrite
+}
+
+// NewPolicy returns the effective Policy of cfg. It only resolves paths:
+// unlike New, it runs nothing and doesn't read StdinFile or SecretsFile.
+func NewPolicy(cfg Config) (Policy, error) {
+	cfg, err := resolvePaths(cfg)
+	if err != nil {
+		return Policy{}, err
+	}
+	// The workdir and PATH dirs the backends carve out of DenyRead
+	var readCarveOut, writeCarveOut []string
+	if workdirDenied(cfg) {
+		readCarveOut = append(readCarveOut, cfg.Workdir)
+		if HasWildcard(cfg.AllowWrite) || pathWithin(cfg.Workdir, cfg.AllowWrite) {
+			writeCarveOut = append(writeCarveOut, cfg.Workdir)
+		}
+	}
+	readCarveOut = append(readCarveOut, cfg.homeCarveOut...)
+
+	// ReadOnly paths are readable even when only listed paths are
+	allowRead := cfg.AllowRead
+	if readAllowlisted(cfg) {
+		allowRead = slices.Concat(cfg.AllowRead, cfg.ReadOnly)
+	}
+	return Policy{
+		AllowWrite:    nonNil(cfg.AllowWrite),
+		DenyWrite:     nonNil(slices.Concat(cfg.denyWrite, cfg.ReadOnly)),
+		DenyRead:      nonNil(cfg.DenyRead),
+		AllowRead:     allowRead,
+		ReadCarveOut:  readCarveOut,
+		WriteCarveOut: writeCarveOut,
+	}, nil
+}
+
+// ToRego renders the policy as a Rego module for OPA. Query
+// data.agentsandbox.allow_read and allow_write with input.path set to an
+// absolute path.
+func (p Policy) ToRego() string {
+	return fmt.Sprintf(regoTemplate, regoList(p.AllowWrite), regoList(p.DenyWrite), regoList(p.DenyRead), regoList(p.AllowRead),
+		regoList(p.ReadCarveOut), regoList(p.WriteCarveOut))
+}
+
+const regoTemplate = `# Effective agentsandbox filesystem policy, generated for review.
+package agentsandbox
+
+import rego.v1
+
+allow_write_paths := %s
+
+deny_write_paths := %s
+
+deny_read_paths := %s
+
+allow_read_paths := %s
+
+read_carve_out_paths := %s
+
+write_carve_out_paths := %s
+
+within(path, root) if root == "*"
+
+within(path, root) if path == root
+
+within(path, root) if startswith(path, concat("", [root, "/"]))
+
+in_any(path, roots) if {
+	some root in roots
+	within(path, root)
+}
+
+default allow_read := false
+
+allow_read if {
+	count(allow_read_paths) == 0
+	not in_any(input.path, deny_read_paths)
+}
+
+# With denyRead "*" or allowRead, only allowWrite paths (and system dirs)
+# stay readable, plus allowRead paths outside denyRead
+allow_read if {
+	listed_read
+	not "*" in allow_write_paths
+	in_any(input.path, allow_write_paths)
+	not in_any(input.path, specific_deny_read)
+}
+
+allow_read if {
+	in_any(input.path, allow_read_paths)
+	not in_any(input.path, specific_deny_read)
+}
+
+# A workdir or PATH dirs that denyRead hid are mounted back
+allow_read if in_any(input.path, read_carve_out_paths)
+
+specific_deny_read := [p | some p in deny_read_paths; p != "*"]
+
+listed_read if "*" in deny_read_paths
+
+listed_read if count(allow_read_paths) > 0
+
+default allow_write := false
+
+allow_write if {
+	allow_read
+	in_any(input.path, allow_write_paths)
+	not in_any(input.path, deny_write_paths)
+	not hidden_write
+}
+
+# Nothing under denyRead is writable, bar a carved-out workdir
+hidden_write if {
+	in_any(input.path, specific_deny_read)
+	not in_any(input.path, write_carve_out_paths)
+}
+`
+
+// regoList renders paths as a Rego array. JSON strings are valid Rego.
+func regoList(paths []string) string {
+	data, _ := json.Marshal(nonNil(paths))
+	return string(data)
+}
+
+// nonNil returns paths, or an empty slice if nil, so it encodes as [].
+func nonNil(paths []string) []string {
+	if paths == nil {
+		return []string{}
+	}
+	return paths
+}
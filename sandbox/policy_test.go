@@ -0,0 +1,143 @@
+package sandbox
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestNewPolicy(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	project := t.TempDir()
+
+	policy, err := NewPolicy(Config{
+		Workdir:      project,
+		AllowWrite:   []string{project},
+		WriteExclude: []string{"./.git"},
+		DenyRead:     []string{"~/.ssh"},
+	})
+	if err != nil {
+		t.Fatalf("NewPolicy() error: %v", err)
+	}
+
+	project, _ = expandPath(project)
+	home, _ = expandPath(home)
+	want := Policy{
+		AllowWrite: []string{project},
+		DenyWrite:  []string{filepath.Join(project, ".git")},
+		DenyRead:   []string{filepath.Join(home, ".ssh")},
+	}
+
+	got, _ := json.Marshal(policy)
+	wantJSON, _ := json.Marshal(want)
+	if string(got) != string(wantJSON) {
+		t.Errorf("policy = %s, want %s", got, wantJSON)
+	}
+}
+
+func TestNewPolicy_NoSideEffects(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("GOCACHE", filepath.Join(dir, "gocache"))
+	cfg := Config{
+		Workdir:       dir,
+		AllowWrite:    []string{dir},
+		ShareGoCache:  true,
+		StdinFile:     "missing.txt",
+		SecretsFile:   filepath.Join(dir, "missing.env"),
+		InjectSecrets: []string{"TOKEN"},
+	}
+	if _, err := resolveConfig(cfg); err == nil {
+		t.Fatal("resolveConfig() should fail on the missing StdinFile")
+	}
+
+	// Introspection needs neither file, and creates no Go cache
+	os.RemoveAll(filepath.Join(dir, "gocache"))
+	policy, err := NewPolicy(cfg)
+	if err != nil {
+		t.Fatalf("NewPolicy() error: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "gocache")); !os.IsNotExist(err) {
+		t.Errorf("NewPolicy() should not create the Go cache, stat error = %v", err)
+	}
+	if !slices.Contains(policy.DenyRead, cfg.SecretsFile) {
+		t.Errorf("DenyRead = %v, want the SecretsFile hidden", policy.DenyRead)
+	}
+}
+
+func TestNewPolicy_CarveOuts(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	home, _ = expandPath(home)
+	project := filepath.Join(home, "project")
+	bin := filepath.Join(home, "bin")
+	for _, dir := range []string{project, bin} {
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("PATH", bin+string(filepath.ListSeparator)+os.Getenv("PATH"))
+
+	policy, err := NewPolicy(Config{Workdir: project, AllowWrite: []string{project}, DenyRead: []string{home}})
+	if err != nil {
+		t.Fatalf("NewPolicy() error: %v", err)
+	}
+	if want := []string{project, bin}; !slices.Equal(policy.ReadCarveOut, want) {
+		t.Errorf("ReadCarveOut = %v, want %v", policy.ReadCarveOut, want)
+	}
+	if want := []string{project}; !slices.Equal(policy.WriteCarveOut, want) {
+		t.Errorf("WriteCarveOut = %v, want %v", policy.WriteCarveOut, want)
+	}
+
+	rego := policy.ToRego()
+	for _, want := range []string{
+		`read_carve_out_paths := ["` + project + `","` + bin + `"]` + "\n",
+		`write_carve_out_paths := ["` + project + `"]` + "\n",
+		"allow_read if in_any(input.path, read_carve_out_paths)\n",
+		"\tnot hidden_write\n",
+		"\tnot in_any(input.path, write_carve_out_paths)\n",
+	} {
+		if !strings.Contains(rego, want) {
+			t.Errorf("Rego missing %q:\n%s", want, rego)
+		}
+	}
+
+	// Without a hidden workdir or home there's nothing to carve out
+	policy, err = NewPolicy(Config{Workdir: project, AllowWrite: []string{project}, DenyRead: []string{filepath.Join(home, ".ssh")}})
+	if err != nil {
+		t.Fatalf("NewPolicy() error: %v", err)
+	}
+	if policy.ReadCarveOut != nil || policy.WriteCarveOut != nil {
+		t.Errorf("carve-outs = %v, %v, want none", policy.ReadCarveOut, policy.WriteCarveOut)
+	}
+}
+
+func TestPolicy_ToRego(t *testing.T) {
+	policy := Policy{
+		AllowWrite: []string{"/project", "/tmp"},
+		DenyRead:   []string{"/home/user/.ssh"},
+	}
+
+	rego := policy.ToRego()
+	for _, want := range []string{
+		"package agentsandbox\n",
+		`allow_write_paths := ["/project","/tmp"]` + "\n",
+		"deny_write_paths := []\n",
+		`deny_read_paths := ["/home/user/.ssh"]` + "\n",
+		"default allow_read := false\n",
+		"default allow_write := false\n",
+		"allow_read_paths := []\n",
+		"read_carve_out_paths := []\n",
+		"write_carve_out_paths := []\n",
+	} {
+		if !strings.Contains(rego, want) {
+			t.Errorf("Rego missing %q:\n%s", want, rego)
+		}
+	}
+	if strings.Contains(rego, "%!") {
+		t.Errorf("Rego has formatting errors:\n%s", rego)
+	}
+}
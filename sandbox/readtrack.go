@@ -0,0 +1,82 @@
+package sandbox
+
+import (
+	"bufio"
+	"bytes"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// straceReadSyscalls are the syscalls traced for TrackReads.
+const straceReadSyscalls = "trace=open,openat"
+
+// straceOpenRe matches an open or openat line from strace -f, complete or
+// cut off by another process's output. The groups are the pid, the quoted
+// path, the flags, and the return value of a complete call.
+var straceOpenRe = regexp.MustCompile(`^(?:(\d+)\s+)?open(?:at)?\((?:[^",]+, )?("(?:[^"\\]|\\.)*"), ([A-Z0-9_|]+)(?:, \d+)?(?:\) += (-?\d+)| <unfinished \.\.\.>)`)
+
+// straceResumedRe matches the end of a cut-off open or openat call.
+var straceResumedRe = regexp.MustCompile(`^(?:(\d+)\s+)?<\.\.\. open(?:at)? resumed>.*\) += (-?\d+)`)
+
+// untrackedReadDirs are pseudo filesystems left out of ReadPaths.
+var untrackedReadDirs = []string{"/proc", "/dev", "/sys"}
+
+// parseStraceReads returns the files a traced command opened for reading,
+// sorted and deduplicated. Relative paths are resolved against workdir.
+func parseStraceReads(output []byte, workdir string) []string {
+	var paths []string
+	pending := make(map[string]string) // pid -> path of a cut-off read
+
+	add := func(path string) {
+		if !filepath.IsAbs(path) {
+			path = filepath.Join(workdir, path)
+		}
+		path = filepath.Clean(path)
+		if !pathWithin(path, untrackedReadDirs) {
+			paths = append(paths, path)
+		}
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if m := straceResumedRe.FindStringSubmatch(line); m != nil {
+			if path, ok := pending[m[1]]; ok && !strings.HasPrefix(m[2], "-") {
+				add(path)
+			}
+			delete(pending, m[1])
+			continue
+		}
+
+		m := straceOpenRe.FindStringSubmatch(line)
+		if m == nil || !isReadOpen(m[3]) {
+			continue
+		}
+		path, err := strconv.Unquote(m[2])
+		if err != nil {
+			continue
+		}
+		switch {
+		case strings.HasSuffix(line, "<unfinished ...>"):
+			pending[m[1]] = path
+		case !strings.HasPrefix(m[4], "-"):
+			add(path)
+		}
+	}
+
+	slices.Sort(paths)
+	return slices.Compact(paths)
+}
+
+// isReadOpen reports whether open flags read a file's contents.
+func isReadOpen(flags string) bool {
+	set := strings.Split(flags, "|")
+	if slices.Contains(set, "O_DIRECTORY") {
+		return false
+	}
+	return slices.Contains(set, "O_RDONLY") || slices.Contains(set, "O_RDWR")
+}
@@ -0,0 +1,33 @@
+package sandbox
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseStraceReads(t *testing.T) {
+	output := `openat(AT_FDCWD, "/etc/ld.so.cache", O_RDONLY|O_CLOEXEC) = 3
+openat(AT_FDCWD, "/proc/self/maps", O_RDONLY) = 3
+openat(AT_FDCWD, "missing.txt", O_RDONLY) = -1 ENOENT (No such file or directory)
+openat(AT_FDCWD, "out.txt", O_WRONLY|O_CREAT|O_TRUNC, 0666) = 4
+openat(AT_FDCWD, ".", O_RDONLY|O_NONBLOCK|O_CLOEXEC|O_DIRECTORY) = 3
+1201  openat(AT_FDCWD, "input.txt", O_RDONLY <unfinished ...>
+1202  open("/etc/passwd", O_RDONLY|O_CLOEXEC) = 5
+1201  <... openat resumed>) = 3
+1203  openat(AT_FDCWD, "/etc/shadow", O_RDONLY <unfinished ...>
+1203  <... openat resumed>) = -1 EACCES (Permission denied)
+openat(AT_FDCWD, "/etc/ld.so.cache", O_RDONLY|O_CLOEXEC) = 3
+openat(AT_FDCWD, "/tmp/with \"quote\"", O_RDWR) = 3
+`
+
+	got := parseStraceReads([]byte(output), "/project")
+	want := []string{
+		"/etc/ld.so.cache",
+		"/etc/passwd",
+		"/project/input.txt",
+		`/tmp/with "quote"`,
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("parseStraceReads() = %q, want %q", got, want)
+	}
+}
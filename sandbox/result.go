@@ -0,0 +1,208 @@
+package sandbox
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Result is the outcome of a sandboxed command, with stdout and stderr
+// kept apart.
+type Result struct {
+	Stdout   []byte // Standard output, up to MaxStdoutBytes
+	Stderr   []byte // Standard error, up to MaxStderrBytes
+	Combined []byte // The kept stdout and stderr bytes, in arrival order
+	ExitCode int
+	Labels   map[string]string // Config.Labels of the sandbox that ran it
+	Attempts int               // Times the command ran, more than 1 if retried
+
+	// Warnings are the problems logged while setting up the sandbox.
+	// Degraded is set if any of them leaves part of the policy unenforced,
+	// e.g. New ran as root or fell back to a later BackendOrder entry, so
+	// callers can decide not to trust the isolation.
+	Warnings []string
+	Degraded bool
+
+	// ReadPaths are the files the command opened for reading, when
+	// TrackReads is set. Best-effort: relative paths are resolved against
+	// the workdir, and /proc, /dev and /sys are left out.
+	ReadPaths []string
+
+	// UsageSamples are the sandbox's memory and CPU usage every
+	// SampleUsage while the command ran, e.g. to spot a memory spike in a
+	// long build. Processes are found by session; on Linux only.
+	UsageSamples []UsageSample
+
+	// Violations are the operations the sandbox denied during the run,
+	// when CaptureViolations is set. The log doesn't say which sandbox
+	// denied them, so denials of other sandboxed processes on the host in
+	// the same time window are included too; see Violation.PID.
+	Violations []Violation
+
+	// SetupDuration is the time the backend took to set up the sandbox
+	// before starting the command, CommandDuration the rest of the run.
+	// On macOS sandbox-exec isn't timed separately, so setup is zero.
+	SetupDuration   time.Duration
+	CommandDuration time.Duration
+	Duration        time.Duration // Wall time of all attempts, including retry backoff
+
+	// Signaled is set when the sandbox process was killed by Signal, e.g.
+	// on cancellation, rather than exiting; ExitCode is then 128+Signal, as
+	// in shells. A command that exits 137 itself isn't Signaled. TimedOut
+	// is set when it was stopped because ctx's deadline or Timeout passed.
+	Signaled bool
+	Signal   syscall.Signal
+	TimedOut bool
+
+	// Reason describes how the run ended for showing to users, e.g.
+	// "exited with code 1", "killed by timeout" or "command not found".
+	Reason string
+
+	StdoutTruncated bool // Stdout exceeded MaxStdoutBytes
+	StderrTruncated bool // Stderr exceeded MaxStderrBytes
+
+	// Truncated is set when the output exceeded MaxOutputBytes. Combined
+	// then ends with a truncationMarker; the rest of the output was read
+	// and discarded, so the command wasn't blocked writing it.
+	Truncated bool
+}
+
+// truncationMarker is appended to Combined output cut at MaxOutputBytes.
+const truncationMarker = "\n[output truncated at %d bytes]"
+
+// dryRunResult returns the Result of a dry run printing output.
+func dryRunResult(cfg Config, output string) Result {
+	res := Result{Stdout: []byte(output), Combined: []byte(output), Reason: "dry run"}
+	describeSandbox(&res, cfg)
+	return res
+}
+
+// describeSandbox sets the fields of res that describe the sandbox rather
+// than the run.
+func describeSandbox(res *Result, cfg Config) {
+	res.Labels = cfg.Labels
+	res.Warnings = slices.Clone(cfg.warnings)
+	res.Degraded = cfg.degraded
+}
+
+// outputCapture collects a command's stdout and stderr, each capped
+// separately and both together, plus the bytes kept from both in arrival
+// order.
+type outputCapture struct {
+	mu        sync.Mutex
+	combined  bytes.Buffer
+	stdout    cappedWriter
+	stderr    cappedWriter
+	kept      int
+	limit     int
+	truncated bool
+}
+
+// newOutputCapture returns a capture with the stream limits from cfg. The
+// OutputBufferHint is preallocated for stdout, which holds most output, and
+// for the combined buffer.
+func newOutputCapture(cfg Config) *outputCapture {
+	c := &outputCapture{limit: cfg.MaxOutputBytes}
+	c.stdout = cappedWriter{capture: c, limit: cfg.MaxStdoutBytes}
+	c.stderr = cappedWriter{capture: c, limit: cfg.MaxStderrBytes}
+	if hint := cfg.OutputBufferHint; hint > 0 {
+		if cfg.MaxOutputBytes > 0 {
+			hint = min(hint, cfg.MaxOutputBytes)
+		}
+		c.combined.Grow(hint)
+		if cfg.MaxStdoutBytes > 0 {
+			hint = min(hint, cfg.MaxStdoutBytes)
+		}
+		c.stdout.buf.Grow(hint)
+	}
+	return c
+}
+
+// outputSink receives a streamed command's stdout and stderr as they
+// arrive. A nil sink keeps the output in the Result instead.
+type outputSink struct {
+	stdout io.Writer
+	stderr io.Writer
+}
+
+// captureFor returns a capture that forwards output to sink, still applying
+// the stream limits from cfg, or one that buffers it if sink is nil.
+func captureFor(cfg Config, sink *outputSink) *outputCapture {
+	if sink == nil {
+		return newOutputCapture(cfg)
+	}
+	c := &outputCapture{limit: cfg.MaxOutputBytes}
+	c.stdout = cappedWriter{capture: c, limit: cfg.MaxStdoutBytes, sink: orDiscard(sink.stdout)}
+	c.stderr = cappedWriter{capture: c, limit: cfg.MaxStderrBytes, sink: orDiscard(sink.stderr)}
+	return c
+}
+
+// orDiscard returns w, or io.Discard if w is nil.
+func orDiscard(w io.Writer) io.Writer {
+	if w == nil {
+		return io.Discard
+	}
+	return w
+}
+
+// result returns the captured output as a Result.
+func (c *outputCapture) result(exitCode int) Result {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	combined := c.combined.Bytes()
+	if c.truncated {
+		combined = fmt.Appendf(combined, truncationMarker, c.limit)
+	}
+	return Result{
+		Stdout:          c.stdout.buf.Bytes(),
+		Stderr:          c.stderr.buf.Bytes(),
+		Combined:        combined,
+		ExitCode:        exitCode,
+		StdoutTruncated: c.stdout.truncated,
+		StderrTruncated: c.stderr.truncated,
+		Truncated:       c.truncated,
+	}
+}
+
+// cappedWriter keeps up to limit bytes (0: no limit) and discards the rest,
+// so a chatty command isn't stopped by a failing write. With a sink, kept
+// bytes are written to it instead, and its errors are returned.
+type cappedWriter struct {
+	capture   *outputCapture
+	buf       bytes.Buffer
+	sink      io.Writer
+	kept      int
+	limit     int
+	truncated bool
+}
+
+func (w *cappedWriter) Write(p []byte) (int, error) {
+	w.capture.mu.Lock()
+	defer w.capture.mu.Unlock()
+
+	keep := p
+	if w.limit > 0 && w.kept+len(keep) > w.limit {
+		keep = keep[:w.limit-w.kept]
+		w.truncated = true
+	}
+	if c := w.capture; c.limit > 0 && c.kept+len(keep) > c.limit {
+		keep = keep[:c.limit-c.kept]
+		c.truncated = true
+	}
+	w.kept += len(keep)
+	w.capture.kept += len(keep)
+
+	if w.sink != nil {
+		if _, err := w.sink.Write(keep); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+	w.buf.Write(keep)
+	w.capture.combined.Write(keep)
+	return len(p), nil
+}
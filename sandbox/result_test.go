@@ -0,0 +1,112 @@
+package sandbox
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestOutputCapture_SeparateLimits(t *testing.T) {
+	c := newOutputCapture(Config{MaxStderrBytes: 4})
+
+	c.stdout.Write([]byte("out1\n"))
+	c.stderr.Write([]byte("warning\n"))
+	c.stdout.Write([]byte("out2\n"))
+	c.stderr.Write([]byte("more\n"))
+
+	res := c.result(0)
+	if string(res.Stdout) != "out1\nout2\n" || res.StdoutTruncated {
+		t.Errorf("stdout = %q (truncated %v), want it kept in full", res.Stdout, res.StdoutTruncated)
+	}
+	if string(res.Stderr) != "warn" || !res.StderrTruncated {
+		t.Errorf("stderr = %q (truncated %v), want %q truncated", res.Stderr, res.StderrTruncated, "warn")
+	}
+	if string(res.Combined) != "out1\nwarnout2\n" {
+		t.Errorf("combined = %q, want only the kept bytes in order", res.Combined)
+	}
+
+	c = newOutputCapture(Config{MaxStdoutBytes: 3})
+	if n, err := c.stdout.Write([]byte("hello")); n != 5 || err != nil {
+		t.Errorf("Write() = %d, %v; dropped bytes should still count as written", n, err)
+	}
+	c.stderr.Write([]byte("error\n"))
+
+	res = c.result(0)
+	if string(res.Stdout) != "hel" || !res.StdoutTruncated {
+		t.Errorf("stdout = %q (truncated %v), want %q truncated", res.Stdout, res.StdoutTruncated, "hel")
+	}
+	if string(res.Stderr) != "error\n" || res.StderrTruncated {
+		t.Errorf("stderr = %q (truncated %v), want it kept in full", res.Stderr, res.StderrTruncated)
+	}
+}
+
+func TestOutputCapture_MaxOutputBytes(t *testing.T) {
+	c := newOutputCapture(Config{MaxOutputBytes: 8, MaxStderrBytes: 2})
+	c.stdout.Write([]byte("out1\n"))
+	c.stderr.Write([]byte("err\n"))
+	if n, err := c.stdout.Write([]byte("out2\n")); n != 5 || err != nil {
+		t.Errorf("Write() = %d, %v; dropped bytes should still count as written", n, err)
+	}
+	c.stderr.Write([]byte("more\n"))
+
+	res := c.result(1)
+	if string(res.Stdout) != "out1\no" || string(res.Stderr) != "er" {
+		t.Errorf("stdout = %q, stderr = %q, want 8 bytes kept between them", res.Stdout, res.Stderr)
+	}
+	if want := "out1\nero\n[output truncated at 8 bytes]"; string(res.Combined) != want {
+		t.Errorf("combined = %q, want %q", res.Combined, want)
+	}
+	if !res.Truncated {
+		t.Error("Truncated should be set")
+	}
+
+	c = newOutputCapture(Config{MaxOutputBytes: 8})
+	c.stdout.Write([]byte("12345678"))
+	if res := c.result(0); res.Truncated || string(res.Combined) != "12345678" {
+		t.Errorf("output at the limit: combined = %q (truncated %v), want it kept in full", res.Combined, res.Truncated)
+	}
+}
+
+func TestOutputCapture_BufferHint(t *testing.T) {
+	chunk := bytes.Repeat([]byte("x"), 1000)
+
+	for _, hint := range []int{0, 10, 64 << 10} {
+		c := newOutputCapture(Config{OutputBufferHint: hint, MaxStdoutBytes: 2500})
+		for range 3 {
+			c.stdout.Write(chunk)
+			c.stderr.Write([]byte("e"))
+		}
+
+		res := c.result(0)
+		if len(res.Stdout) != 2500 || !res.StdoutTruncated {
+			t.Errorf("hint %d: stdout has %d bytes (truncated %v), want 2500 truncated", hint, len(res.Stdout), res.StdoutTruncated)
+		}
+		if string(res.Stderr) != "eee" {
+			t.Errorf("hint %d: stderr = %q, want %q", hint, res.Stderr, "eee")
+		}
+		if len(res.Combined) != 2503 {
+			t.Errorf("hint %d: combined has %d bytes, want 2503", hint, len(res.Combined))
+		}
+	}
+}
+
+func BenchmarkOutputCapture(b *testing.B) {
+	chunk := bytes.Repeat([]byte("x"), 4096)
+
+	for _, bench := range []struct {
+		name string
+		hint int
+	}{
+		{"NoHint", 0},
+		{"Hint", 4 << 20},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for b.Loop() {
+				c := newOutputCapture(Config{OutputBufferHint: bench.hint})
+				for range 1024 {
+					c.stdout.Write(chunk)
+				}
+			}
+		})
+	}
+}
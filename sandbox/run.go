@@ -0,0 +1,275 @@
+package sandbox
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"regexp"
+	"slices"
+	"time"
+)
+
+// execFunc runs a prepared sandbox invocation and returns its raw result.
+type execFunc func(ctx context.Context) (Result, error)
+
+// execute wraps a backend invocation with the behavior shared by all
+// backends: concurrency limits, retries, tracing and output post-processing.
+func execute(ctx context.Context, cfg Config, command string, fn execFunc) (Result, error) {
+	if err := confirmCommand(cfg, command); err != nil {
+		return Result{}, err
+	}
+
+	release, err := acquireSlot(ctx)
+	if err != nil {
+		return Result{}, err
+	}
+	defer release()
+
+	// The deadline covers all attempts, but not waiting for a slot
+	if cfg.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, cfg.Timeout)
+		defer cancel()
+	}
+
+	var res Result
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		res, err = traceRun(ctx, cfg.Tracer, command, fn)
+		res.Attempts = attempt
+		if attempt > cfg.MaxRetries || !slices.Contains(cfg.RetryExitCodes, res.ExitCode) || !sleepCtx(ctx, cfg.RetryBackoff) {
+			break
+		}
+	}
+	res.Duration = time.Since(start)
+	res.TimedOut = errors.Is(err, context.DeadlineExceeded)
+
+	// The TTY check is last: its messages are the least specific
+	if res.ExitCode != 0 {
+		if cfg.CPUTimeLimit > 0 && ctx.Err() == nil && res.ExitCode == exitSIGXCPU {
+			err = fmt.Errorf("%w: %w", ErrCPULimit, errOrExit(err, res.ExitCode))
+		} else if cfg.MemoryLimitBytes > 0 && ctx.Err() == nil && memoryExhausted(res) {
+			err = fmt.Errorf("%w: %w", ErrMemoryLimit, errOrExit(err, res.ExitCode))
+		} else if denied := writeDenied(res.Combined, cfg.Workdir); denied != nil {
+			err = fmt.Errorf("%w: %w", denied, errOrExit(err, res.ExitCode))
+		} else if needsTTY(res.Combined) {
+			err = fmt.Errorf("%w: %w", ErrNeedsTTY, errOrExit(err, res.ExitCode))
+		}
+	}
+
+	res.Reason = exitReason(res, err)
+	res.Stdout = finishOutput(cfg, res.Stdout)
+	res.Stderr = finishOutput(cfg, res.Stderr)
+	res.Combined = finishOutput(cfg, res.Combined)
+	describeSandbox(&res, cfg)
+	return res, err
+}
+
+// sleepCtx waits for d, returning false if ctx is done first.
+func sleepCtx(ctx context.Context, d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-t.C:
+		return true
+	}
+}
+
+// ErrCommandRejected is returned when ConfirmFunc declined to run a command
+// matching ConfirmPatterns.
+var ErrCommandRejected = errors.New("command rejected")
+
+// confirmCommand asks ConfirmFunc about a command matching ConfirmPatterns,
+// returning ErrCommandRejected if it mustn't run. Other commands run
+// without asking.
+func confirmCommand(cfg Config, command string) error {
+	i := slices.IndexFunc(cfg.confirm, func(re *regexp.Regexp) bool { return re.MatchString(command) })
+	if i < 0 {
+		return nil
+	}
+	ok, err := cfg.ConfirmFunc(command)
+	if err != nil {
+		return fmt.Errorf("confirming command: %w", err)
+	}
+	if !ok {
+		return fmt.Errorf("%w: matches %q", ErrCommandRejected, cfg.ConfirmPatterns[i])
+	}
+	return nil
+}
+
+// ErrNeedsTTY is returned when a command failed because it needs a
+// terminal (e.g. sudo or ssh prompting for a password). Sandboxed commands
+// run in a new session without a controlling terminal, so they fail fast
+// instead of hanging; pass input via stdin or use non-interactive flags.
+var ErrNeedsTTY = errors.New("command requires a terminal, but the sandbox has none")
+
+// ttyErrorPatterns are lowercase messages printed by tools that need a TTY.
+// They're whole messages, so output that merely mentions /dev/tty (ls -l,
+// a grep hit) doesn't match.
+var ttyErrorPatterns = []string{
+	"/dev/tty: no such device",
+	"could not open /dev/tty",
+	"can't open /dev/tty",
+	"cannot open /dev/tty",
+	"unable to open /dev/tty",
+	"no tty present",
+	"a terminal is required",
+	"is not a tty",
+	"'standard input': inappropriate ioctl for device",
+	"signing failed: inappropriate ioctl for device",
+	"must be run from a terminal",
+	"pseudo-terminal will not be allocated",
+}
+
+// needsTTY reports whether output looks like a failure due to a missing TTY.
+func needsTTY(output []byte) bool {
+	lower := bytes.ToLower(output)
+	for _, pattern := range ttyErrorPatterns {
+		if bytes.Contains(lower, []byte(pattern)) {
+			return true
+		}
+	}
+	return false
+}
+
+// ErrMemoryLimit is returned when a command failed after running out of
+// the address space allowed by MemoryLimitBytes. Detection is best-effort.
+var ErrMemoryLimit = errors.New("command exceeded the memory limit")
+
+// memoryErrorPatterns are lowercase messages printed when allocation fails.
+var memoryErrorPatterns = []string{
+	"cannot allocate memory",
+	"out of memory",
+	"memory exhausted",
+	"memoryerror",
+	"bad_alloc",
+	"xmalloc",
+}
+
+// memoryExhausted reports whether a failed run printed an allocation
+// error. Programs whose allocations fail often crash silently instead, but
+// a crash alone (SIGSEGV, SIGABRT) is no evidence of the limit.
+func memoryExhausted(res Result) bool {
+	lower := bytes.ToLower(res.Combined)
+	for _, pattern := range memoryErrorPatterns {
+		if bytes.Contains(lower, []byte(pattern)) {
+			return true
+		}
+	}
+	return false
+}
+
+// ErrCPULimit is returned when a command was stopped for using more CPU
+// time than CPUTimeLimit allows. Unlike a Timeout, which returns
+// context.DeadlineExceeded, it counts time spent computing, not waiting.
+var ErrCPULimit = errors.New("command exceeded the CPU time limit")
+
+// exitSIGXCPU is the exit code of a process killed by SIGXCPU, as reported
+// by bwrap and shells.
+const exitSIGXCPU = 128 + 24
+
+// exitReason describes how a run with result res and error err ended.
+// Exit codes above 128 are read as death by signal 128+n, as shells and
+// bwrap report it; 126 and 127 as the shell's can't-execute and not-found.
+func exitReason(res Result, err error) string {
+	switch {
+	case res.TimedOut:
+		return "killed by timeout"
+	case errors.Is(err, context.Canceled):
+		return "killed by cancellation"
+	case errors.Is(err, ErrCPULimit):
+		return "killed for exceeding the CPU time limit"
+	case errors.Is(err, ErrMemoryLimit):
+		return "failed after exceeding the memory limit"
+	case errors.Is(err, ErrNeedsTTY):
+		return "failed because it needs a terminal"
+	case res.Signaled:
+		return "killed by signal " + signalName(int(res.Signal))
+	case res.ExitCode == 0 && err != nil:
+		return "failed to run: " + err.Error()
+	case res.ExitCode == 0:
+		return "exited successfully"
+	case res.ExitCode == 126:
+		return "command not executable"
+	case res.ExitCode == 127:
+		return "command not found"
+	case res.ExitCode > 128 && res.ExitCode <= 128+64:
+		return "killed by signal " + signalName(res.ExitCode-128)
+	default:
+		return fmt.Sprintf("exited with code %d", res.ExitCode)
+	}
+}
+
+// errOrExit returns err, or an error describing the exit code if err is nil.
+func errOrExit(err error, exitCode int) error {
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("exit status %d", exitCode)
+}
+
+// feedStdin sets c.Stdin from stdin, or from the file at stdinFile if stdin
+// is nil and stdinFile isn't empty. Readers that aren't files are copied
+// through a pipe owned by the caller rather than by exec, whose Wait would
+// block until the reader returns, even after the process was killed.
+// The returned func closes the pipe, abandoning a reader still blocked in
+// Read (e.g. a pipe with no writer); call it once Wait returns.
+func feedStdin(c *exec.Cmd, stdin io.Reader, stdinFile string) (release func(), err error) {
+	if stdin == nil && stdinFile != "" {
+		f, err := os.Open(stdinFile)
+		if err != nil {
+			return nil, fmt.Errorf("opening StdinFile: %w", err)
+		}
+		c.Stdin = f
+		return func() { f.Close() }, nil
+	}
+
+	if _, ok := stdin.(*os.File); ok || stdin == nil {
+		c.Stdin = stdin
+		return func() {}, nil
+	}
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	c.Stdin = r
+
+	go func() {
+		io.Copy(w, stdin)
+		w.Close()
+	}()
+
+	return func() {
+		r.Close()
+		w.Close()
+	}, nil
+}
+
+// traceRun runs fn inside a span when a tracer is configured.
+func traceRun(ctx context.Context, tracer Tracer, command string, fn execFunc) (Result, error) {
+	if tracer == nil {
+		return fn(ctx)
+	}
+
+	ctx, end := tracer.StartSpan(ctx, SpanName)
+	start := time.Now()
+	res, err := fn(ctx)
+
+	if setter, ok := tracer.(SpanAttributeSetter); ok {
+		setter.SetSpanAttributes(ctx, map[string]any{
+			AttrCommand:  command,
+			AttrExitCode: res.ExitCode,
+			AttrDuration: time.Since(start),
+		})
+	}
+	end(err)
+
+	return res, err
+}
@@ -0,0 +1,401 @@
+package sandbox
+
+import (
+	"context"
+	"errors"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// fakeTracer records spans started and ended.
+type fakeTracer struct {
+	started []string
+	ended   []error
+	attrs   []map[string]any
+}
+
+type spanKey struct{}
+
+func (f *fakeTracer) StartSpan(ctx context.Context, name string) (context.Context, func(err error)) {
+	f.started = append(f.started, name)
+	return context.WithValue(ctx, spanKey{}, len(f.started)), func(err error) {
+		f.ended = append(f.ended, err)
+	}
+}
+
+func (f *fakeTracer) SetSpanAttributes(ctx context.Context, attrs map[string]any) {
+	if ctx.Value(spanKey{}) == nil {
+		panic("attributes set without span context")
+	}
+	f.attrs = append(f.attrs, attrs)
+}
+
+func TestExecute_Tracer(t *testing.T) {
+	tracer := &fakeTracer{}
+	cfg := Config{Tracer: tracer}
+
+	fn := func(ctx context.Context) (Result, error) {
+		if ctx.Value(spanKey{}) == nil {
+			t.Error("run should receive the span context")
+		}
+		return Result{Combined: []byte("out")}, nil
+	}
+	if _, err := execute(context.Background(), cfg, "echo ok", fn); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	runErr := errors.New("boom")
+	failing := func(ctx context.Context) (Result, error) {
+		return Result{ExitCode: 2}, runErr
+	}
+	execute(context.Background(), cfg, "false", failing)
+
+	if len(tracer.started) != 2 || tracer.started[0] != SpanName {
+		t.Fatalf("started = %v, want two %q spans", tracer.started, SpanName)
+	}
+	if len(tracer.ended) != 2 {
+		t.Fatalf("ended %d spans, want 2", len(tracer.ended))
+	}
+	if tracer.ended[0] != nil || tracer.ended[1] != runErr {
+		t.Errorf("ended errors = %v, want [nil boom]", tracer.ended)
+	}
+
+	attrs := tracer.attrs[1]
+	if attrs[AttrCommand] != "false" {
+		t.Errorf("command attribute = %v, want %q", attrs[AttrCommand], "false")
+	}
+	if attrs[AttrExitCode] != 2 {
+		t.Errorf("exit code attribute = %v, want 2", attrs[AttrExitCode])
+	}
+	if _, ok := attrs[AttrDuration].(time.Duration); !ok {
+		t.Errorf("duration attribute = %T, want time.Duration", attrs[AttrDuration])
+	}
+}
+
+func TestExecute_NoTracer(t *testing.T) {
+	fn := func(ctx context.Context) (Result, error) {
+		return Result{Stdout: []byte("out\n"), Combined: []byte("out\n")}, nil
+	}
+
+	res, err := execute(context.Background(), Config{TrimTrailingNewline: true}, "echo out", fn)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if string(res.Combined) != "out" || string(res.Stdout) != "out" {
+		t.Errorf("output should be post-processed, got %q and %q", res.Combined, res.Stdout)
+	}
+}
+
+func TestExecute_Labels(t *testing.T) {
+	fn := func(ctx context.Context) (Result, error) {
+		return Result{}, nil
+	}
+
+	cfg := Config{Labels: map[string]string{"tenant": "acme"}}
+	res, err := execute(context.Background(), cfg, "true", fn)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if res.Labels["tenant"] != "acme" {
+		t.Errorf("labels = %v, want tenant=acme", res.Labels)
+	}
+}
+
+func TestExecute_Retry(t *testing.T) {
+	cfg := Config{RetryExitCodes: []int{75}, MaxRetries: 2}
+
+	var calls int
+	flaky := func(ctx context.Context) (Result, error) {
+		calls++
+		if calls < 2 {
+			return Result{ExitCode: 75}, nil
+		}
+		return Result{Combined: []byte("ok")}, nil
+	}
+	res, err := execute(context.Background(), cfg, "fetch", flaky)
+	if err != nil || res.ExitCode != 0 || string(res.Combined) != "ok" {
+		t.Errorf("execute() = %+v, %v, want the successful retry", res, err)
+	}
+	if calls != 2 || res.Attempts != 2 {
+		t.Errorf("calls = %d, attempts = %d, want 2", calls, res.Attempts)
+	}
+
+	calls = 0
+	failing := func(ctx context.Context) (Result, error) {
+		calls++
+		return Result{ExitCode: 75}, nil
+	}
+	res, _ = execute(context.Background(), cfg, "fetch", failing)
+	if calls != 3 || res.Attempts != 3 || res.ExitCode != 75 {
+		t.Errorf("calls = %d, attempts = %d, exit code %d; want 3 attempts ending in 75", calls, res.Attempts, res.ExitCode)
+	}
+
+	calls = 0
+	broken := func(ctx context.Context) (Result, error) {
+		calls++
+		return Result{ExitCode: 1}, nil
+	}
+	res, _ = execute(context.Background(), cfg, "fetch", broken)
+	if calls != 1 || res.Attempts != 1 {
+		t.Errorf("non-retryable exit code ran %d times, want 1", calls)
+	}
+}
+
+func TestExecute_RetryStopsOnCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cfg := Config{RetryExitCodes: []int{75}, MaxRetries: 5, RetryBackoff: time.Hour}
+
+	var calls int
+	fn := func(ctx context.Context) (Result, error) {
+		calls++
+		cancel()
+		return Result{ExitCode: 75}, nil
+	}
+	execute(ctx, cfg, "fetch", fn)
+	if calls != 1 {
+		t.Errorf("ran %d times after cancel, want 1", calls)
+	}
+}
+
+func TestExecute_Timeout(t *testing.T) {
+	cfg := Config{Timeout: 50 * time.Millisecond}
+
+	fn := func(ctx context.Context) (Result, error) {
+		if _, ok := ctx.Deadline(); !ok {
+			t.Error("run context should have a deadline")
+		}
+		<-ctx.Done()
+		return Result{ExitCode: -1}, ctx.Err()
+	}
+	res, err := execute(context.Background(), cfg, "sleep", fn)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("error = %v, want context.DeadlineExceeded", err)
+	}
+	if !res.TimedOut || res.Duration < cfg.Timeout {
+		t.Errorf("TimedOut = %v, Duration = %v; want timed out after %v", res.TimedOut, res.Duration, cfg.Timeout)
+	}
+
+	fn = func(ctx context.Context) (Result, error) {
+		if _, ok := ctx.Deadline(); ok {
+			t.Error("run context should have no deadline without Timeout")
+		}
+		return Result{}, nil
+	}
+	if res, _ := execute(context.Background(), Config{}, "true", fn); res.TimedOut {
+		t.Error("TimedOut should not be set for a run that finished")
+	}
+}
+
+func TestExecute_MemoryLimit(t *testing.T) {
+	cfg := Config{MemoryLimitBytes: 64 << 20}
+
+	for _, res := range []Result{
+		{ExitCode: 1, Combined: []byte("fatal error: runtime: out of memory")},
+		{ExitCode: 1, Combined: []byte("MemoryError")},
+		{ExitCode: 134, Combined: []byte("terminate called after throwing an instance of 'std::bad_alloc'")},
+	} {
+		fn := func(ctx context.Context) (Result, error) { return res, nil }
+		if _, err := execute(context.Background(), cfg, "build", fn); !errors.Is(err, ErrMemoryLimit) {
+			t.Errorf("%+v: error = %v, want ErrMemoryLimit", res, err)
+		}
+	}
+
+	// Only with a limit set, and not for ordinary failures
+	oom := func(ctx context.Context) (Result, error) { return Result{ExitCode: 139}, nil }
+	if _, err := execute(context.Background(), Config{}, "build", oom); errors.Is(err, ErrMemoryLimit) {
+		t.Error("should not report ErrMemoryLimit without MemoryLimitBytes")
+	}
+	failed := func(ctx context.Context) (Result, error) {
+		return Result{ExitCode: 2, Combined: []byte("no such file")}, nil
+	}
+	if _, err := execute(context.Background(), cfg, "build", failed); errors.Is(err, ErrMemoryLimit) {
+		t.Error("should not report ErrMemoryLimit for an unrelated failure")
+	}
+
+	// A crash without an allocation error isn't evidence of the limit
+	for _, code := range []int{134, 137, 139} {
+		crashed := func(ctx context.Context) (Result, error) {
+			return Result{ExitCode: code, Combined: []byte("Segmentation fault")}, nil
+		}
+		if _, err := execute(context.Background(), cfg, "build", crashed); errors.Is(err, ErrMemoryLimit) {
+			t.Errorf("exit %d: should not report ErrMemoryLimit for a crash", code)
+		}
+	}
+}
+
+func TestExecute_CPULimit(t *testing.T) {
+	cfg := Config{CPUTimeLimit: time.Second}
+	killed := func(ctx context.Context) (Result, error) { return Result{ExitCode: 152}, nil }
+	if _, err := execute(context.Background(), cfg, "loop", killed); !errors.Is(err, ErrCPULimit) {
+		t.Errorf("error = %v, want ErrCPULimit", err)
+	}
+	if _, err := execute(context.Background(), Config{}, "loop", killed); errors.Is(err, ErrCPULimit) {
+		t.Error("should not report ErrCPULimit without CPUTimeLimit")
+	}
+
+	failed := func(ctx context.Context) (Result, error) { return Result{ExitCode: 1}, nil }
+	if _, err := execute(context.Background(), cfg, "loop", failed); errors.Is(err, ErrCPULimit) {
+		t.Error("should not report ErrCPULimit for an unrelated failure")
+	}
+}
+
+func TestExecute_Confirm(t *testing.T) {
+	var asked []string
+	answer := false
+	cfg, err := resolveConfig(Config{
+		Workdir:         t.TempDir(),
+		ConfirmPatterns: []string{`rm -rf`, `git push (-f|--force)`},
+		ConfirmFunc: func(command string) (bool, error) {
+			asked = append(asked, command)
+			return answer, nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	runs := 0
+	fn := func(ctx context.Context) (Result, error) { runs++; return Result{}, nil }
+
+	if _, err := execute(context.Background(), cfg, "rm -rf build", fn); !errors.Is(err, ErrCommandRejected) {
+		t.Errorf("error = %v, want ErrCommandRejected", err)
+	}
+	if runs != 0 || len(asked) != 1 || asked[0] != "rm -rf build" {
+		t.Errorf("rejected command should be asked about and not run, got %d runs, asked %q", runs, asked)
+	}
+
+	answer = true
+	if _, err := execute(context.Background(), cfg, "git push --force origin", fn); err != nil || runs != 1 {
+		t.Errorf("confirmed command should run, got %d runs: %v", runs, err)
+	}
+
+	// Other commands run without asking
+	asked = nil
+	if _, err := execute(context.Background(), cfg, "make test", fn); err != nil || runs != 2 || asked != nil {
+		t.Errorf("unmatched command should run without asking, got %d runs, asked %q: %v", runs, asked, err)
+	}
+
+	cfg.ConfirmFunc = func(string) (bool, error) { return false, errors.New("no answer") }
+	if _, err := execute(context.Background(), cfg, "rm -rf /tmp/x", fn); err == nil || errors.Is(err, ErrCommandRejected) || runs != 2 {
+		t.Errorf("ConfirmFunc errors should be returned without running, got %d runs: %v", runs, err)
+	}
+}
+
+func TestExitReason(t *testing.T) {
+	tests := []struct {
+		res  Result
+		err  error
+		want string
+	}{
+		{Result{}, nil, "exited successfully"},
+		{Result{ExitCode: 1}, nil, "exited with code 1"},
+		{Result{ExitCode: 127}, nil, "command not found"},
+		{Result{ExitCode: 126}, nil, "command not executable"},
+		{Result{ExitCode: 128 + int(syscall.SIGSEGV)}, nil, "killed by signal SIGSEGV"},
+		{Result{ExitCode: 128 + int(syscall.SIGKILL)}, nil, "killed by signal SIGKILL"},
+		{Result{ExitCode: 137, Signaled: true, Signal: syscall.SIGKILL, TimedOut: true}, context.DeadlineExceeded, "killed by timeout"},
+		{Result{ExitCode: 143, Signaled: true, Signal: syscall.SIGTERM}, context.Canceled, "killed by cancellation"},
+		{Result{ExitCode: 143, Signaled: true, Signal: syscall.SIGTERM}, nil, "killed by signal SIGTERM"},
+		{Result{ExitCode: 152}, ErrCPULimit, "killed for exceeding the CPU time limit"},
+		{Result{ExitCode: 1}, ErrMemoryLimit, "failed after exceeding the memory limit"},
+		{Result{ExitCode: 1}, ErrNeedsTTY, "failed because it needs a terminal"},
+		{Result{}, errors.New("fork/exec bwrap: permission denied"), "failed to run: fork/exec bwrap: permission denied"},
+	}
+	for _, tt := range tests {
+		if got := exitReason(tt.res, tt.err); got != tt.want {
+			t.Errorf("exitReason(%+v, %v) = %q, want %q", tt.res, tt.err, got, tt.want)
+		}
+	}
+
+	// execute sets it from the classified error
+	fn := func(ctx context.Context) (Result, error) {
+		return Result{ExitCode: 1, Combined: []byte("sudo: a terminal is required")}, nil
+	}
+	if res, _ := execute(context.Background(), Config{}, "sudo true", fn); res.Reason != "failed because it needs a terminal" {
+		t.Errorf("Reason = %q, want the TTY failure", res.Reason)
+	}
+}
+
+func TestNeedsTTY(t *testing.T) {
+	tests := []struct {
+		output string
+		want   bool
+	}{
+		{"sudo: a terminal is required to read the password", true},
+		{"cat: /dev/tty: No such device or address", true},
+		{"Pseudo-terminal will not be allocated because stdin is not a terminal.", true},
+		{"stty: 'standard input': Inappropriate ioctl for device", true},
+		{"ls: cannot access 'x': No such file or directory", false},
+		{"crw-rw-rw- 1 root tty 5, 0 Oct 16 10:00 /dev/tty", false},
+		{"src/term.c:12: #include </dev/tty> not found", false},
+		{"ioctl: Inappropriate ioctl for device", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		if got := needsTTY([]byte(tt.output)); got != tt.want {
+			t.Errorf("needsTTY(%q) = %v, want %v", tt.output, got, tt.want)
+		}
+	}
+}
+
+func TestExecute_NeedsTTYAfterLimits(t *testing.T) {
+	// A limit hit by a command whose output mentions a TTY is still the limit
+	fn := func(ctx context.Context) (Result, error) {
+		return Result{ExitCode: 2, Combined: []byte("opening /dev/tty\nsort: memory exhausted\n")}, nil
+	}
+	_, err := execute(context.Background(), Config{MemoryLimitBytes: 64 << 20}, "sort", fn)
+	if !errors.Is(err, ErrMemoryLimit) || errors.Is(err, ErrNeedsTTY) {
+		t.Errorf("error = %v, want ErrMemoryLimit only", err)
+	}
+
+	// Failing output that merely mentions /dev/tty
+	fn = func(ctx context.Context) (Result, error) {
+		return Result{ExitCode: 1, Combined: []byte("crw-rw-rw- 1 root tty 5, 0 Oct 16 10:00 /dev/tty\n")}, nil
+	}
+	if _, err := execute(context.Background(), Config{}, "ls -l /dev/tty; false", fn); errors.Is(err, ErrNeedsTTY) {
+		t.Errorf("error = %v, should not be ErrNeedsTTY", err)
+	}
+}
+
+func TestExecute_NeedsTTY(t *testing.T) {
+	runErr := errors.New("exit status 1")
+	fn := func(ctx context.Context) (Result, error) {
+		return Result{Combined: []byte("sudo: a terminal is required to read the password\n"), ExitCode: 1}, runErr
+	}
+
+	res, err := execute(context.Background(), Config{}, "sudo true", fn)
+	if !errors.Is(err, ErrNeedsTTY) {
+		t.Errorf("error = %v, want ErrNeedsTTY", err)
+	}
+	if !errors.Is(err, runErr) {
+		t.Errorf("error = %v, should wrap the original error", err)
+	}
+	if res.ExitCode != 1 {
+		t.Errorf("exit code = %d, want 1", res.ExitCode)
+	}
+
+	// A successful command mentioning a TTY is not an error
+	ok := func(ctx context.Context) (Result, error) {
+		return Result{Combined: []byte("stdin is not a tty\n")}, nil
+	}
+	if _, err := execute(context.Background(), Config{}, "tty", ok); err != nil {
+		t.Errorf("unexpected error for exit code 0: %v", err)
+	}
+}
+
+func TestExecute_WriteDenied(t *testing.T) {
+	fn := func(ctx context.Context) (Result, error) {
+		return Result{Combined: []byte("touch: cannot touch 'out.txt': Read-only file system\n"), ExitCode: 1}, nil
+	}
+
+	_, err := execute(context.Background(), Config{Workdir: "/project"}, "touch out.txt", fn)
+
+	var denied *ErrWriteDenied
+	if !errors.As(err, &denied) {
+		t.Fatalf("error = %v, want ErrWriteDenied", err)
+	}
+	if denied.Path != "/project/out.txt" {
+		t.Errorf("denied path = %q, want /project/out.txt", denied.Path)
+	}
+}
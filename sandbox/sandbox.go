@@ -2,55 +2,296 @@ package sandbox
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"maps"
+	"math"
 	"os"
 	"path/filepath"
+	"regexp"
 	"runtime"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 )
 
 // Config defines sandbox configuration.
 type Config struct {
 	// Filesystem
-	Workdir    string   // Working directory (default: cwd)
-	AllowWrite []string // Writable paths (default: workdir, /tmp)
-	DenyRead   []string // Protected paths (default: ~/.ssh, ~/.aws, etc.)
+	Workdir      string   // Working directory (default: cwd)
+	AllowWrite   []string // Writable paths (default: workdir, /tmp)
+	WriteExclude []string // Read-only subpaths of AllowWrite trees, e.g. /project/secrets
+	ReadOnly     []string // Existing paths that stay readable but never writable, e.g. a shared cache
+	DenyRead     []string // Protected paths (default: ~/.ssh, ~/.aws, etc.)
+	AllowRead    []string // If set, the only readable paths besides AllowWrite and system dirs
+
+	AllowWriteFile         string // File with extra AllowWrite paths, one per line (# comments)
+	DenyReadFile           string // File with extra DenyRead paths, one per line (# comments)
+	ProtectSelf            bool   // Make the config file and running executable read-only (default: true)
+	ProtectHomeDotfiles    bool   // Make shell, git and package manager dotfiles in home read-only (default: true)
+	DenyReadImpliesNoWrite bool   // Also deny writes into DenyRead paths, whose Linux tmpfs is otherwise writable (default: true)
+	BaseDir                string // Anchor for relative AllowWrite paths like "./build" (default: workdir)
+
+	PreflightWritable bool   // Warn in New if an AllowWrite path isn't writable on the host
+	StrictWorkdir     bool   // Fail in New if Workdir is within DenyRead, instead of keeping it visible
+	AllowHomeDenyRead bool   // Let a DenyRead of the home directory hide it all, PATH entries in it too
+	TmpfsSize         string // Size limit for DenyRead tmpfs overlays, e.g. "64m" (Linux only)
+	TmpfsWorkdir      bool   // Run in an empty, writable tmpfs at Workdir that vanishes after the run (Linux only)
+	TmpfsWorkdirSize  string // Size limit for TmpfsWorkdir, e.g. "512m" (default: the kernel's, half of RAM)
+	EnableGPU         bool   // Expose /dev/nvidia* devices; host drivers required (Linux only)
+	PIDNamespace      bool   // Run the command in a new PID namespace, hiding host processes (default: true; Linux only)
+	UnshareIPC        bool   // Give the command its own System V IPC and POSIX message queues (Linux only)
+	UnshareUTS        bool   // Give the command its own hostname, so changing it doesn't affect the host (Linux only)
+	Hostname          string // Hostname in the sandbox, e.g. "sandbox"; implies UnshareUTS (Linux only)
+	SeccompProfile    string // SeccompDefault or a compiled seccomp BPF filter file, applied with bwrap --seccomp (Linux only)
+	ShareGoCache      bool   // Make `go env` GOCACHE and GOMODCACHE writable, unless in DenyRead
+	StrictRoot        bool   // Fail in New when run as root, instead of warning (Linux only)
+	DropRoot          bool   // When run as root, run the command as nobody without capabilities (Linux only)
 
 	// Environment
-	CleanEnv     bool     // If true, start with empty env (default: false)
-	EnvAllowlist []string // When CleanEnv=true, only pass these vars
-	EnvDenylist  []string // When CleanEnv=false, remove these vars
+	CleanEnv      bool              // If true, start with empty env (default: false)
+	EnvAllowlist  []string          // When CleanEnv=true, only pass these vars
+	EnvDenylist   []string          // When CleanEnv=false, remove these vars
+	SetEnv        map[string]string // Vars set in the sandbox, overriding inherited values; $VAR expands
+	PathPrepend   []string          // Directories prepended to PATH (must be readable in the sandbox)
+	PathOverride  string            // Replaces PATH entirely, e.g. "/opt/toolchain/bin:/usr/bin:/bin"
+	ShareSSHAgent bool              // Share the $SSH_AUTH_SOCK agent socket (not ~/.ssh) with the sandbox
+	ForceCLocale  bool              // Set LC_ALL=C and LANG=C over inherited and allowlisted locale vars
+	SecretsFile   string            // KEY=VALUE file of secrets, mode 0600, e.g. ~/.agent/secrets.env
+	InjectSecrets []string          // Names of secrets from SecretsFile set in the sandbox env
 
 	// Execution
-	DryRun bool // If true, return command string instead of executing
+	DryRun       bool          // If true, return command string instead of executing
+	DryRunFormat string        // Dry-run output: DryRunShell (default) or DryRunJSON, a DryRunPlan
+	NoNetwork    bool          // Run commands without network access (default: network allowed)
+	NetworkAllow []string      // Only reach these "host:port" destinations (macOS, by port only; see README)
+	AllowedPorts []int         // Only connect out to these TCP and UDP ports (Linux, needs pasta and nft; see README)
+	BackendOrder []string      // Backends New tries in turn, e.g. {"bwrap", "sandbox-exec"} (default: the platform's)
+	ShellPrelude string        // Script run before each shell command, e.g. "set -eu"
+	StdinFile    string        // File fed to commands run without a stdin reader; must not be within DenyRead
+	ExitCodeMap  map[int]int   // Remaps command exit codes, e.g. {125: 1} to keep 125 for sandbox errors
+	Timeout      time.Duration // Kill a run after this long, returning context.DeadlineExceeded (0: none)
+	KillGrace    time.Duration // Time between SIGTERM and SIGKILL on cancellation (default: 5s; 0: SIGKILL at once)
+	Tracer       Tracer        // Optional span hook around each run
+	Logger       *log.Logger   // Destination for warnings (default: the standard logger)
+	FrozenTime   *time.Time    // Fixed time seen by the command, via libfaketime (Linux only)
+	MaxArgs      int           // Max argv count for RunArgsAs (0: no limit)
+	MaxArgBytes  int           // Max total argv length in bytes for RunArgsAs (0: no limit)
+	TrackReads   bool          // Record files the command reads in Result.ReadPaths, via strace (Linux only)
+	SampleUsage  time.Duration // Record resource usage this often in Result.UsageSamples (Linux only; 0: off)
+
+	// CaptureViolations queries the system log after each run for the
+	// operations the sandbox denied while it ran, and records them in
+	// Result.Violations (macOS only). It adds the time log show takes.
+	CaptureViolations bool
+
+	// MemoryLimitBytes caps the address space of the command and each
+	// process it starts (RLIMIT_AS, via prlimit; Linux only). Exceeding it
+	// fails allocations, reported as ErrMemoryLimit. 0: no limit.
+	MemoryLimitBytes int64
+
+	// CPUTimeLimit caps the CPU time of the command and of each process it
+	// starts (RLIMIT_CPU, via prlimit; Linux only), rounded up to whole
+	// seconds. A process over it gets SIGXCPU, reported as ErrCPULimit,
+	// and SIGKILL a second later if it survives. 0: no limit.
+	CPUTimeLimit time.Duration
+
+	// OpenFilesLimit caps the file descriptors each process of the command
+	// can have open (RLIMIT_NOFILE, via prlimit; Linux only). 0: no limit.
+	OpenFilesLimit int
+
+	// FileSizeLimitBytes caps the size of the files the command writes
+	// (RLIMIT_FSIZE, via prlimit; Linux only). A write past it fails with
+	// EFBIG and the process gets SIGXFSZ. 0: no limit.
+	FileSizeLimitBytes int64
+
+	// ProcessLimit caps the processes the command's user can have
+	// (RLIMIT_NPROC, via prlimit; Linux only). The kernel counts all of the
+	// user's processes, also those outside the sandbox, and doesn't apply
+	// it to root, so it's most useful with DropRoot. 0: no limit.
+	ProcessLimit int
+
+	// CPUAffinity pins the command and each process it starts to these
+	// CPUs, numbered from 0 (via taskset; Linux only), e.g. for
+	// reproducible benchmarks. Empty: any CPU.
+	CPUAffinity []int
+
+	// Capabilities lists the Linux capabilities the command keeps, e.g.
+	// "CAP_NET_BIND_SERVICE" (the "CAP_" prefix is optional). All others
+	// are dropped (Linux only). Empty: none, even when running as root.
+	Capabilities []string
+
+	// Retries: a command exiting with one of RetryExitCodes runs again, up
+	// to MaxRetries more times, waiting RetryBackoff before each retry.
+	// Stdin is not replayed, so retries of RunWithStdin see it drained.
+	RetryExitCodes []int
+	MaxRetries     int
+	RetryBackoff   time.Duration
+
+	// TranscriptFile, if set, has each run appended as a line of JSON:
+	// the command, its input and output, exit code and timing, for replay
+	// and debugging. Read it back with LoadTranscript. The file is created
+	// mode 0600 and is read-only in the sandbox.
+	TranscriptFile string
+
+	// ConfirmFunc is asked before running a command that matches one of
+	// ConfirmPatterns (regular expressions, e.g. `rm -rf`, `git push
+	// (-f|--force)`), for a human in the loop. If it returns false the
+	// command doesn't run and ErrCommandRejected is returned. RunArgs
+	// commands are matched with their argv joined by spaces. It may be
+	// called from concurrent runs.
+	ConfirmFunc     func(command string) (bool, error)
+	ConfirmPatterns []string
+
+	// AllowedBinaryHashes, if set, pins the binaries commands may execute:
+	// keys are paths or names (e.g. "/usr/bin/git" or "git"), values the
+	// hex SHA-256 of the file. Before each run the binary is resolved on the
+	// sandbox's PATH and hashed; one that isn't listed or doesn't match
+	// fails with ErrBinaryHashMismatch. Shell commands execute sh (cmd.exe
+	// on Windows), so that's the binary checked, not the programs the shell
+	// starts; use RunArgs to pin those. A binary in an AllowWrite path can
+	// be swapped between the check and its execution.
+	AllowedBinaryHashes map[string]string
+
+	// Labels (e.g. tenant, task-id) are added to every warning logged for
+	// this sandbox and to each Result, for correlating runs.
+	Labels map[string]string
+
+	// Output
+	OutputEncoding      string // raw (default), utf8-lossy or base64
+	TrimTrailingNewline bool   // Remove a single trailing newline from output
+	MaxStdoutBytes      int    // Keep at most this much stdout, dropping the rest (0: no limit)
+	MaxStderrBytes      int    // Keep at most this much stderr, dropping the rest (0: no limit)
+	MaxOutputBytes      int    // Keep at most this much stdout and stderr together, marking the cut (0: no limit)
+	OutputBufferHint    int    // Expected output size in bytes, preallocated to save regrowing
+
+	configPaths  []string          // Config files this config was loaded from, in order
+	denyWrite    []string          // Effective read-only paths, set by resolveConfig
+	networkAllow []networkDest     // Parsed NetworkAllow, set by resolveConfig
+	confirm      []*regexp.Regexp  // Compiled ConfirmPatterns, set by resolveConfig
+	writeAliases []string          // Symlink spellings of AllowWrite paths, set by resolveConfig
+	homeCarveOut []string          // PATH entries kept readable in a denied home, set by resolveConfig
+	sshAuthSock  string            // SSH agent socket to share, set by resolveConfig
+	secrets      map[string]string // InjectSecrets values, set by resolveConfig
+	warnings     []string          // Warnings logged while setting up, reported in each Result
+	runEnv       map[string]string // Vars for a single run, from RunWithEnv
+	degraded     bool              // Some of the policy isn't enforced, see warnings
+}
+
+// ErrEmptyCommand is returned when the command is empty or whitespace-only.
+var ErrEmptyCommand = errors.New("empty command")
+
+// ErrNoBackend is returned by New when no backend in BackendOrder is
+// available. It wraps each backend's reason.
+var ErrNoBackend = errors.New("no sandbox backend available")
+
+// backends maps BackendOrder names to constructors. A constructor fails if
+// its backend isn't available on this host.
+var backends = map[string]func(Config) (Sandbox, error){
+	"bwrap":        newLinux,
+	"sandbox-exec": newDarwin,
+	"job-object":   newWindows,
 }
 
+// ErrArgvTooLarge is returned when argv exceeds MaxArgs or MaxArgBytes.
+var ErrArgvTooLarge = errors.New("argv too large")
+
 // Sandbox executes commands in a restricted environment.
 type Sandbox interface {
 	Run(ctx context.Context, command string) (output []byte, exitCode int, err error)
 	RunWithStdin(ctx context.Context, command string, stdin io.Reader) (output []byte, exitCode int, err error)
+
+	// RunNoNetwork is like Run, but this command alone gets no network
+	// access. Each run starts its own sandbox, so other runs keep network.
+	RunNoNetwork(ctx context.Context, command string) (output []byte, exitCode int, err error)
+
+	// RunWithEnv is like Run, but env is set for this command alone, e.g. a
+	// per-task TASK_ID. The vars are set last, over inherited, SetEnv and
+	// PATH values; EnvAllowlist and EnvDenylist don't filter them.
+	RunWithEnv(ctx context.Context, command string, env map[string]string) (output []byte, exitCode int, err error)
+
+	// RunResult is like Run but keeps stdout and stderr apart, each capped
+	// by MaxStdoutBytes and MaxStderrBytes, and together by MaxOutputBytes.
+	RunResult(ctx context.Context, command string) (*Result, error)
+
+	// RunSeparate is RunResult returning just stdout, stderr and the exit
+	// code, for callers parsing stdout that stderr diagnostics would corrupt.
+	RunSeparate(ctx context.Context, command string) (stdout, stderr []byte, exitCode int, err error)
+
+	// RunStream is like Run but writes stdout and stderr to the given
+	// writers as the command produces them, instead of buffering them.
+	// The output limits still apply, without a truncation marker;
+	// OutputEncoding and TrimTrailingNewline don't. Cancelling ctx kills the command.
+	RunStream(ctx context.Context, command string, stdout, stderr io.Writer) (exitCode int, err error)
+
+	// RunArgs executes argv[0] with the arguments argv[1:] directly, without
+	// a shell: no expansion, quoting, globbing or word splitting happens,
+	// so file names with spaces or $(...) are passed through verbatim.
+	RunArgs(ctx context.Context, argv []string) (output []byte, exitCode int, err error)
+
+	// RunArgsAs executes argv directly, without a shell, so no expansion or
+	// word splitting happens. The process sees name as its argv[0] while
+	// argv[0] selects the binary; an empty name keeps argv[0].
+	RunArgsAs(ctx context.Context, name string, argv []string) (output []byte, exitCode int, err error)
+
+	// Verify runs probes inside the sandbox (a write outside AllowWrite, a
+	// read of a DenyRead path, a filtered env var) and reports which
+	// protections are actually enforced on this host.
+	Verify(ctx context.Context) (VerifyReport, error)
 }
 
+// BwrapInfo is implemented by the Linux sandbox to report the bubblewrap
+// binary it runs, which may differ from the bwrap on PATH when that is a
+// snap or flatpak wrapper.
+type BwrapInfo interface {
+	Bwrap() (path, version string)
+}
+
+// defaultKillGrace is how long a cancelled command gets to exit after
+// SIGTERM before it's killed, in the default config.
+const defaultKillGrace = 5 * time.Second
+
 // hardcodedDefaults returns the built-in default configuration.
 func hardcodedDefaults() Config {
 	cwd, _ := os.Getwd()
 	return Config{
-		Workdir:    cwd,
-		AllowWrite: []string{cwd, "/tmp"},
-		DenyRead:   []string{"~/.ssh", "~/.aws", "~/.gnupg", "~/.kube", "~/.docker", "~/.config/gh"},
-		CleanEnv:   false,
+		Workdir:     cwd,
+		AllowWrite:  []string{cwd, "/tmp"},
+		DenyRead:    []string{"~/.ssh", "~/.aws", "~/.gnupg", "~/.kube", "~/.docker", "~/.config/gh"},
+		CleanEnv:    false,
+		ProtectSelf: true,
+
+		ProtectHomeDotfiles:    true,
+		DenyReadImpliesNoWrite: true,
+		PIDNamespace:           true,
+		KillGrace:              defaultKillGrace,
 	}
 }
 
 // DefaultConfig returns config merged from hardcoded defaults and config file.
-// Config file at ~/.agent/sandbox/config.json is loaded if it exists.
+// The config file DefaultConfigPath finds is loaded if it exists.
 // Use DefaultConfigWithPath to specify a custom config file path.
 func DefaultConfig() Config {
 	return DefaultConfigWithPath(DefaultConfigPath())
 }
 
+// SourceDefaults is the source reported by DefaultConfigWithSource when no
+// config file was loaded.
+const SourceDefaults = "(defaults)"
+
+// DefaultConfigWithSource is like DefaultConfig, but also returns the config
+// file that was loaded, or SourceDefaults if none was.
+func DefaultConfigWithSource() (Config, string) {
+	cfg := DefaultConfig()
+	if len(cfg.configPaths) == 0 {
+		return cfg, SourceDefaults
+	}
+	return cfg, cfg.configPaths[len(cfg.configPaths)-1]
+}
+
 // DefaultConfigWithPath returns config merged from hardcoded defaults and specified config file.
 // If configPath is empty or file doesn't exist, returns hardcoded defaults only.
 func DefaultConfigWithPath(configPath string) Config {
@@ -67,47 +308,485 @@ func DefaultConfigWithPath(configPath string) Config {
 		return base
 	}
 
-	return MergeConfig(base, fileCfg)
+	cfg := MergeConfig(base, fileCfg)
+	if fileCfg != nil {
+		cfg.configPaths = []string{configPath}
+	}
+	return cfg
+}
+
+// LoadConfigCascade returns config merged from hardcoded defaults and each
+// of paths in turn, so later files take precedence, e.g. SystemConfigPath,
+// DefaultConfigPath() and a project's FindProjectConfig. Missing files and
+// empty paths are skipped. As with a single file, each file's non-empty
+// lists replace those of the layers below.
+func LoadConfigCascade(paths []string) (Config, error) {
+	cfg := hardcodedDefaults()
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		fileCfg, err := LoadConfigFile(path)
+		if err != nil {
+			return Config{}, fmt.Errorf("loading config file %q: %w", path, err)
+		}
+		if fileCfg != nil {
+			cfg = MergeConfig(cfg, fileCfg)
+			cfg.configPaths = append(cfg.configPaths, path)
+		}
+	}
+	return cfg, nil
 }
 
 // New creates a platform-specific sandbox.
 // Returns error if backend unavailable or invalid paths.
 // Logs warning if workdir doesn't exist.
 func New(cfg Config) (Sandbox, error) {
+	cfg, err := resolveConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	validatePaths(&cfg)
+
+	if len(cfg.BackendOrder) > 0 {
+		return newFromOrder(cfg)
+	}
+
+	switch runtime.GOOS {
+	case "darwin":
+		return newDarwin(cfg)
+	case "linux":
+		return newLinux(cfg)
+	case "windows":
+		return newWindows(cfg)
+	default:
+		return nil, fmt.Errorf("unsupported platform: %s", runtime.GOOS)
+	}
+}
+
+// newFromOrder returns the first backend in cfg.BackendOrder that is
+// available, or ErrNoBackend listing why each one failed.
+func newFromOrder(cfg Config) (Sandbox, error) {
+	var errs []error
+	for _, name := range cfg.BackendOrder {
+		newBackend, ok := backends[name]
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s: unknown backend", name))
+			continue
+		}
+
+		if len(errs) > 0 {
+			degradef(&cfg, "falling back to backend %s: %v", name, errors.Join(errs...))
+		}
+		sb, err := newBackend(cfg)
+		if err == nil {
+			return sb, nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", name, err))
+	}
+	return nil, fmt.Errorf("%w: %w", ErrNoBackend, errors.Join(errs...))
+}
+
+// resolveConfig returns the effective config: paths resolved by
+// resolvePaths, the Go caches ShareGoCache adds, StdinFile and the secrets
+// checked and loaded. The caller's slices are not modified.
+func resolveConfig(cfg Config) (Config, error) {
+	if _, err := parseSize(cfg.TmpfsWorkdirSize); err != nil {
+		return cfg, fmt.Errorf("invalid TmpfsWorkdirSize: %w", err)
+	}
+	if _, err := parseSize(cfg.TmpfsSize); err != nil {
+		return cfg, fmt.Errorf("invalid TmpfsSize: %w", err)
+	}
+
+	if err := checkOutputEncoding(cfg.OutputEncoding); err != nil {
+		return cfg, fmt.Errorf("invalid OutputEncoding: %w", err)
+	}
+	if err := checkDryRunFormat(cfg.DryRunFormat); err != nil {
+		return cfg, fmt.Errorf("invalid DryRunFormat: %w", err)
+	}
+
+	cfg, err := resolvePaths(cfg)
+	if err != nil {
+		return cfg, err
+	}
+
+	// Go caches are added after DenyRead is expanded, which takes precedence
+	if cfg.ShareGoCache && !HasWildcard(cfg.AllowWrite) {
+		dirs, err := goCacheDirs()
+		if err != nil {
+			warnf(&cfg, "ShareGoCache: %v", err)
+		}
+		for _, dir := range dirs {
+			if dir, err = expandPath(dir); err == nil && !pathInDenyRead(dir, cfg.DenyRead) {
+				cfg.AllowWrite = append(cfg.AllowWrite, dir)
+			}
+		}
+	}
+
+	if cfg.StdinFile != "" {
+		cfg.StdinFile, err = expandPath(anchorPath(cfg.StdinFile, cfg.Workdir))
+		if err != nil {
+			return cfg, fmt.Errorf("invalid StdinFile: %w", err)
+		}
+		if pathInDenyRead(cfg.StdinFile, cfg.DenyRead) {
+			return cfg, fmt.Errorf("StdinFile %q is within DenyRead", cfg.StdinFile)
+		}
+		f, err := os.Open(cfg.StdinFile)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid StdinFile: %w", err)
+		}
+		f.Close()
+	}
+
+	cfg.secrets = nil
+	if len(cfg.InjectSecrets) > 0 {
+		if cfg.SecretsFile == "" {
+			return cfg, fmt.Errorf("InjectSecrets requires SecretsFile")
+		}
+		path, err := expandPathNoResolve(cfg.SecretsFile)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid SecretsFile: %w", err)
+		}
+		all, err := LoadSecrets(path)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid SecretsFile: %w", err)
+		}
+		cfg.secrets = make(map[string]string, len(cfg.InjectSecrets))
+		for _, name := range cfg.InjectSecrets {
+			value, ok := all[name]
+			if !ok {
+				return cfg, fmt.Errorf("secret %q not found in SecretsFile", name)
+			}
+			cfg.secrets[name] = value
+		}
+	}
+
+	cfg.networkAllow, err = parseNetworkAllow(cfg.NetworkAllow)
+	if err != nil {
+		return cfg, fmt.Errorf("invalid NetworkAllow: %w", err)
+	}
+	if cfg.NoNetwork && len(cfg.networkAllow) > 0 {
+		return cfg, fmt.Errorf("NetworkAllow conflicts with NoNetwork")
+	}
+	for _, port := range cfg.AllowedPorts {
+		if port < 1 || port > 65535 {
+			return cfg, fmt.Errorf("invalid AllowedPorts: port %d out of range 1-65535", port)
+		}
+	}
+	if cfg.NoNetwork && len(cfg.AllowedPorts) > 0 {
+		return cfg, fmt.Errorf("AllowedPorts conflicts with NoNetwork")
+	}
+
+	for _, cpu := range cfg.CPUAffinity {
+		if cpu < 0 || cpu >= runtime.NumCPU() {
+			return cfg, fmt.Errorf("invalid CPUAffinity: CPU %d out of range 0-%d", cpu, runtime.NumCPU()-1)
+		}
+	}
+
+	if len(cfg.ConfirmPatterns) > 0 && cfg.ConfirmFunc == nil {
+		return cfg, fmt.Errorf("ConfirmPatterns needs a ConfirmFunc")
+	}
+	cfg.confirm = nil
+	for _, pattern := range cfg.ConfirmPatterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid ConfirmPatterns entry %q: %w", pattern, err)
+		}
+		cfg.confirm = append(cfg.confirm, re)
+	}
+
+	cfg.AllowedBinaryHashes, err = checkBinaryHashes(cfg.AllowedBinaryHashes)
+	if err != nil {
+		return cfg, err
+	}
+
+	caps := make([]string, len(cfg.Capabilities))
+	for i, c := range cfg.Capabilities {
+		caps[i] = strings.ToUpper(c)
+		if !strings.HasPrefix(caps[i], "CAP_") {
+			caps[i] = "CAP_" + caps[i]
+		}
+		if !validCapability(caps[i]) {
+			return cfg, fmt.Errorf("invalid Capabilities entry %q", c)
+		}
+	}
+	cfg.Capabilities = caps
+
+	if _, err := expandSetEnv(cfg.SetEnv, nil); err != nil {
+		return cfg, fmt.Errorf("invalid SetEnv: %w", err)
+	}
+
+	cfg.sshAuthSock = ""
+	if sock := os.Getenv("SSH_AUTH_SOCK"); cfg.ShareSSHAgent && sock != "" {
+		cfg.sshAuthSock, err = filepath.Abs(sock)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid SSH_AUTH_SOCK: %w", err)
+		}
+	}
+
+	pathPrepend := make([]string, len(cfg.PathPrepend))
+	for i, p := range cfg.PathPrepend {
+		pathPrepend[i], err = checkPathDir(p, cfg.DenyRead)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid PathPrepend dir: %w", err)
+		}
+	}
+	cfg.PathPrepend = pathPrepend
+
+	if cfg.PathOverride != "" {
+		for _, p := range filepath.SplitList(cfg.PathOverride) {
+			if _, err := checkPathDir(p, cfg.DenyRead); err != nil {
+				return cfg, fmt.Errorf("invalid PathOverride dir: %w", err)
+			}
+		}
+	}
+
+	return cfg, nil
+}
+
+// resolvePaths loads the path list files and expands every path to an
+// absolute one, resolving symlinks, and derives the paths kept read-only or
+// carved out of DenyRead. It runs no commands, creates nothing and reads no
+// file but the path lists, so NewPolicy can use it for introspection.
+func resolvePaths(cfg Config) (Config, error) {
+	allowWrite := slices.Clone(cfg.AllowWrite)
+	if cfg.AllowWriteFile != "" {
+		paths, err := loadPathListFile(cfg.AllowWriteFile)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid AllowWriteFile: %w", err)
+		}
+		allowWrite = append(allowWrite, paths...)
+	}
+
+	denyRead := slices.Clone(cfg.DenyRead)
+	if cfg.DenyReadFile != "" {
+		paths, err := loadPathListFile(cfg.DenyReadFile)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid DenyReadFile: %w", err)
+		}
+		denyRead = append(denyRead, paths...)
+	}
+
 	// Expand and validate paths
 	var err error
 	cfg.Workdir, err = expandPath(cfg.Workdir)
 	if err != nil {
-		return nil, fmt.Errorf("invalid workdir: %w", err)
+		return cfg, fmt.Errorf("invalid workdir: %w", err)
+	}
+
+	baseDir := cfg.Workdir
+	if cfg.BaseDir != "" {
+		baseDir, err = expandPath(cfg.BaseDir)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid BaseDir: %w", err)
+		}
+	}
+	cfg.BaseDir = baseDir
+
+	var writeAliases []string
+	for i, p := range allowWrite {
+		// Keep the wildcard as is, backends check for it with HasWildcard
+		if IsWildcard(p) {
+			continue
+		}
+
+		p = anchorPath(p, baseDir)
+		allowWrite[i], err = expandPath(p)
+		if err != nil {
+			return cfg, fmt.Errorf("invalid AllowWrite path %q: %w", p, err)
+		}
+
+		// Keep the symlink spelling (e.g. /tmp -> /private/tmp on macOS) so
+		// policies that match on the path as written also allow it
+		if unresolved, err := expandPathNoResolve(p); err == nil && unresolved != allowWrite[i] {
+			writeAliases = append(writeAliases, unresolved)
+		}
 	}
 
-	for i, p := range cfg.AllowWrite {
-		cfg.AllowWrite[i], err = expandPath(p)
+	allowRead := slices.Clone(cfg.AllowRead)
+	for i, p := range allowRead {
+		if IsWildcard(p) {
+			return cfg, fmt.Errorf("AllowRead can't be a wildcard: leave it empty to allow all reads")
+		}
+		allowRead[i], err = expandPath(anchorPath(p, baseDir))
 		if err != nil {
-			return nil, fmt.Errorf("invalid AllowWrite path %q: %w", p, err)
+			return cfg, fmt.Errorf("invalid AllowRead path %q: %w", p, err)
 		}
 	}
+	cfg.AllowRead = allowRead
 
-	for i, p := range cfg.DenyRead {
-		cfg.DenyRead[i], err = expandPath(p)
+	for i, p := range denyRead {
+		if IsWildcard(p) {
+			continue
+		}
+
+		denyRead[i], err = expandPath(p)
 		if err != nil {
 			// DenyRead paths might not exist (e.g., ~/.aws on systems without AWS CLI)
 			// Just skip expansion errors for non-existent paths
-			expanded, _ := expandPathNoResolve(p)
-			cfg.DenyRead[i] = expanded
+			expanded, err := expandPathNoResolve(p)
+			if err != nil {
+				return cfg, fmt.Errorf("invalid DenyRead path %q: %w", p, err)
+			}
+			denyRead[i] = expanded
 		}
 	}
 
-	validatePaths(&cfg)
+	// The secrets file is only read on the host, so commands can't read
+	// the secrets that weren't injected
+	if cfg.SecretsFile != "" {
+		path, err := expandPath(cfg.SecretsFile)
+		if err != nil {
+			path, err = expandPathNoResolve(cfg.SecretsFile)
+		}
+		if err != nil {
+			return cfg, fmt.Errorf("invalid SecretsFile: %w", err)
+		}
+		if !pathInDenyRead(path, denyRead) {
+			denyRead = append(denyRead, path)
+		}
+	}
 
-	switch runtime.GOOS {
-	case "darwin":
-		return newDarwin(cfg)
-	case "linux":
-		return newLinux(cfg)
-	default:
-		return nil, fmt.Errorf("unsupported platform: %s", runtime.GOOS)
+	cfg.AllowWrite = allowWrite
+	cfg.writeAliases = writeAliases
+	cfg.DenyRead = denyRead
+	if cfg.StrictWorkdir && workdirDenied(cfg) {
+		return cfg, fmt.Errorf("workdir %q is within DenyRead", cfg.Workdir)
+	}
+	cfg.homeCarveOut = homeCarveOut(cfg)
+
+	cfg.denyWrite = nil
+	if cfg.ProtectSelf {
+		cfg.denyWrite = selfPaths(cfg.configPaths)
+	}
+	if home, err := os.UserHomeDir(); err == nil && cfg.ProtectHomeDotfiles {
+		cfg.denyWrite = append(cfg.denyWrite, homeDotfilePaths(home, allowWrite, denyRead)...)
+	}
+
+	writeExclude := make([]string, len(cfg.WriteExclude))
+	for i, p := range cfg.WriteExclude {
+		writeExclude[i], err = expandPath(anchorPath(p, baseDir))
+		if err != nil {
+			return cfg, fmt.Errorf("invalid WriteExclude path %q: %w", p, err)
+		}
+	}
+	cfg.WriteExclude = writeExclude
+	cfg.denyWrite = append(cfg.denyWrite, writeExclude...)
+
+	// The transcript is read-only in the sandbox, so commands can't rewrite it
+	if cfg.TranscriptFile != "" {
+		cfg.TranscriptFile, err = expandPath(anchorPath(cfg.TranscriptFile, baseDir))
+		if err != nil {
+			return cfg, fmt.Errorf("invalid TranscriptFile: %w", err)
+		}
+		cfg.denyWrite = append(cfg.denyWrite, cfg.TranscriptFile)
+	}
+
+	readOnly := make([]string, len(cfg.ReadOnly))
+	for i, p := range cfg.ReadOnly {
+		if IsWildcard(p) {
+			return cfg, fmt.Errorf("ReadOnly can't be a wildcard: leave AllowWrite empty instead")
+		}
+		readOnly[i], err = expandPath(anchorPath(p, baseDir))
+		if err != nil {
+			return cfg, fmt.Errorf("invalid ReadOnly path %q: %w", p, err)
+		}
+		// Bound with --ro-bind, which fails on a missing path
+		if _, err := os.Stat(readOnly[i]); err != nil {
+			return cfg, fmt.Errorf("invalid ReadOnly path %q: %w", p, err)
+		}
+	}
+	cfg.ReadOnly = readOnly
+
+	return cfg, nil
+}
+
+// selfPaths returns the paths a sandboxed command could modify to weaken
+// future runs: the loaded and default config files and the running executable.
+func selfPaths(configPaths []string) []string {
+	var paths []string
+	add := func(p string) {
+		if p == "" {
+			return
+		}
+		if expanded, err := expandPath(p); err == nil && !slices.Contains(paths, expanded) {
+			paths = append(paths, expanded)
+		}
+	}
+
+	for _, p := range configPaths {
+		add(p)
+	}
+	if home, err := os.UserHomeDir(); err == nil {
+		for _, name := range defaultConfigFiles {
+			add(filepath.Join(home, ".agent", "sandbox", name))
+		}
+	}
+	if exe, err := os.Executable(); err == nil {
+		add(exe)
+	}
+	return paths
+}
+
+// homeDotfiles are files and dirs in home that shells, git and package
+// managers read on startup, so a write there outlives the sandboxed command.
+var homeDotfiles = []string{
+	".bashrc", ".bash_profile", ".bash_login", ".bash_logout", ".profile",
+	".zshrc", ".zshenv", ".zprofile", ".zlogin",
+	".gitconfig", ".config/git", ".config/fish",
+	".npmrc", ".yarnrc", ".pypirc", ".netrc",
+	".local/bin",
+}
+
+// homeDotfilePaths returns the homeDotfiles that allowWrite would make
+// writable. Paths in denyRead are left out, since hiding them takes precedence.
+func homeDotfilePaths(home string, allowWrite, denyRead []string) []string {
+	home, err := expandPath(home)
+	if err != nil {
+		return nil
+	}
+
+	var paths []string
+	for _, name := range homeDotfiles {
+		path := filepath.Join(home, name)
+		if !HasWildcard(allowWrite) && !pathWithin(path, allowWrite) {
+			continue
+		}
+		if pathWithin(path, denyRead) {
+			continue
+		}
+		paths = append(paths, path)
+	}
+	return paths
+}
+
+// checkPathDir expands a PATH directory and checks it is usable inside the sandbox.
+func checkPathDir(p string, denyRead []string) (string, error) {
+	expanded, err := expandPath(p)
+	if err != nil {
+		return "", fmt.Errorf("%q: %w", p, err)
+	}
+	info, err := os.Stat(expanded)
+	if err != nil {
+		return "", fmt.Errorf("%q: %w", p, err)
+	}
+	if !info.IsDir() {
+		return "", fmt.Errorf("%q is not a directory", p)
+	}
+	if pathInDenyRead(expanded, denyRead) {
+		return "", fmt.Errorf("%q is not readable in the sandbox (DenyRead)", p)
+	}
+	return expanded, nil
+}
+
+// loadPathListFile loads a path list file, expanding ~ in its location.
+func loadPathListFile(p string) ([]string, error) {
+	p, err := expandPathNoResolve(p)
+	if err != nil {
+		return nil, err
 	}
+	return LoadPathList(p)
 }
 
 // expandPath resolves ~ and relative paths to absolute paths with symlink resolution.
@@ -128,28 +807,378 @@ func expandPath(p string) (string, error) {
 	return resolved, nil
 }
 
-// expandPathNoResolve expands ~ and relative paths without resolving symlinks.
+// anchorPath joins a relative path onto base, leaving absolute, ~,
+// variable and wildcard paths unchanged.
+func anchorPath(p, base string) string {
+	if IsWildcard(p) || p == "~" || strings.HasPrefix(p, "~/") || strings.HasPrefix(p, "$") || filepath.IsAbs(p) {
+		return p
+	}
+	return filepath.Join(base, p)
+}
+
+// expandPathNoResolve expands environment variables, ~ and relative paths
+// without resolving symlinks.
 func expandPathNoResolve(p string) (string, error) {
-	if strings.HasPrefix(p, "~/") {
+	p, err := expandEnv(p)
+	if err != nil {
+		return "", err
+	}
+
+	if p == "~" || strings.HasPrefix(p, "~/") {
 		home, err := os.UserHomeDir()
 		if err != nil {
 			return "", fmt.Errorf("cannot expand ~: %w", err)
 		}
-		p = filepath.Join(home, p[2:])
+		p = filepath.Join(home, strings.TrimPrefix(p[1:], "/"))
 	}
 
 	return filepath.Abs(p)
 }
 
+// expandEnv expands $VAR and ${VAR} in p. A variable that's unset or empty
+// is an error: "$PROJECT_ROOT/" silently becoming "/" would expose the
+// whole filesystem.
+func expandEnv(p string) (string, error) {
+	if !strings.Contains(p, "$") {
+		return p, nil
+	}
+	var missing []string
+	expanded := os.Expand(p, func(name string) string {
+		value := os.Getenv(name)
+		if value == "" {
+			missing = append(missing, name)
+		}
+		return value
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("cannot expand %q: $%s is not set", p, strings.Join(missing, ", $"))
+	}
+	return expanded, nil
+}
+
 // validatePaths checks paths and logs warnings.
 func validatePaths(cfg *Config) {
 	if _, err := os.Stat(cfg.Workdir); err != nil {
-		log.Printf("warning: workdir %q does not exist", cfg.Workdir)
+		warnf(cfg, "workdir %q does not exist", cfg.Workdir)
+	}
+
+	if workdirDenied(*cfg) {
+		degradef(cfg, "workdir %q is within DenyRead; keeping it visible", cfg.Workdir)
+	}
+
+	if home, ok := deniedHome(*cfg); ok && !cfg.AllowHomeDenyRead {
+		if len(cfg.homeCarveOut) > 0 {
+			degradef(cfg, "DenyRead hides the home directory %q; keeping PATH entries %q readable, set AllowHomeDenyRead to hide them too", home, cfg.homeCarveOut)
+		} else {
+			warnf(cfg, "DenyRead hides the home directory %q; tools that keep config or binaries there will fail", home)
+		}
+	}
+
+	if cfg.ShareSSHAgent && cfg.sshAuthSock == "" {
+		warnf(cfg, "ShareSSHAgent is set but SSH_AUTH_SOCK is not")
+	}
+
+	if cfg.PreflightWritable && !HasWildcard(cfg.AllowWrite) {
+		for _, path := range cfg.AllowWrite {
+			if err := probeWritable(path); err != nil {
+				warnf(cfg, "AllowWrite path %q is not writable on the host: %v", path, err)
+			}
+		}
+	}
+}
+
+// warnf logs a warning followed by cfg.Labels, if any, and records it for
+// Result.Warnings.
+func warnf(cfg *Config, format string, args ...any) {
+	msg := fmt.Sprintf(format, args...)
+	cfg.warnings = append(cfg.warnings, msg)
+
+	logger := cfg.Logger
+	if logger == nil {
+		logger = log.Default()
+	}
+	logger.Print("warning: " + msg + formatLabels(cfg.Labels))
+}
+
+// degradef is warnf for a setup problem that leaves part of the policy
+// unenforced, which sets Result.Degraded.
+func degradef(cfg *Config, format string, args ...any) {
+	cfg.degraded = true
+	warnf(cfg, format, args...)
+}
+
+// formatLabels returns labels as " [key=value ...]" sorted by key, or "".
+func formatLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	var parts []string
+	for _, key := range slices.Sorted(maps.Keys(labels)) {
+		parts = append(parts, key+"="+labels[key])
+	}
+	return " [" + strings.Join(parts, " ") + "]"
+}
+
+// probeWritable checks that path is writable on the host, e.g. not on a
+// read-only mount. Directories get a temporary probe file; missing paths pass.
+func probeWritable(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil
+	}
+
+	if !info.IsDir() {
+		f, err := os.OpenFile(path, os.O_WRONLY, 0)
+		if err != nil {
+			return err
+		}
+		return f.Close()
+	}
+
+	f, err := os.CreateTemp(path, ".agentsandbox-probe-*")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	return os.Remove(f.Name())
+}
+
+// parseSize parses a size like "512", "64k", "64m" or "1g" (binary units)
+// into bytes. An empty string is 0.
+func parseSize(size string) (int64, error) {
+	if size == "" {
+		return 0, nil
+	}
+
+	s := strings.ToLower(strings.TrimSpace(size))
+	s = strings.TrimSuffix(s, "b")
+	multiplier := int64(1)
+	if n := len(s); n > 0 {
+		switch s[n-1] {
+		case 'k':
+			multiplier = 1 << 10
+		case 'm':
+			multiplier = 1 << 20
+		case 'g':
+			multiplier = 1 << 30
+		}
+		if multiplier > 1 {
+			s = s[:n-1]
+		}
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 || n > math.MaxInt64/multiplier {
+		return 0, fmt.Errorf("invalid size %q", size)
+	}
+	return n * multiplier, nil
+}
+
+// checkCommand rejects empty and whitespace-only commands, which sh -c
+// would otherwise run as a successful no-op.
+func checkCommand(cmd string) error {
+	if strings.TrimSpace(cmd) == "" {
+		return ErrEmptyCommand
 	}
+	return nil
+}
+
+// checkEnv rejects env var names the OS can't represent.
+func checkEnv(env map[string]string) error {
+	for key := range env {
+		if key == "" || strings.ContainsAny(key, "=\x00") {
+			return fmt.Errorf("invalid env var name %q", key)
+		}
+	}
+	return nil
+}
+
+// checkArgv rejects an empty argv or an empty program name, argv over the
+// configured limits, before the OS fails opaquely with E2BIG, and a program
+// AllowedBinaryHashes doesn't allow.
+func checkArgv(cfg Config, argv []string) error {
+	if len(argv) == 0 || strings.TrimSpace(argv[0]) == "" {
+		return ErrEmptyCommand
+	}
+
+	if cfg.MaxArgs > 0 && len(argv) > cfg.MaxArgs {
+		return fmt.Errorf("%w: %d arguments, max %d", ErrArgvTooLarge, len(argv), cfg.MaxArgs)
+	}
+
+	if cfg.MaxArgBytes > 0 {
+		// Count the NUL terminators, as the kernel does
+		size := 0
+		for _, arg := range argv {
+			size += len(arg) + 1
+		}
+		if size > cfg.MaxArgBytes {
+			return fmt.Errorf("%w: %d bytes, max %d", ErrArgvTooLarge, size, cfg.MaxArgBytes)
+		}
+	}
+
+	return checkBinary(cfg, argv[0])
+}
+
+// shellArgv returns the argv that runs cmd with sh -c, after ShellPrelude.
+func shellArgv(cfg Config, cmd string) []string {
+	if cfg.ShellPrelude != "" {
+		// A newline, not "; ", so a prelude ending in a comment still works
+		cmd = cfg.ShellPrelude + "\n" + cmd
+	}
+	return []string{"sh", "-c", cmd}
+}
+
+// shellJoin quotes each arg with shellQuote and joins them with spaces.
+func shellJoin(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = shellQuote(arg)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// shellQuote quotes s for POSIX shells, leaving plain words unquoted.
+func shellQuote(s string) string {
+	if s != "" && strings.Trim(s, "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789_@%+=:,./-") == "" {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// remapExitCode applies ExitCodeMap to a command's exit code.
+func remapExitCode(code int, m map[int]int) int {
+	if mapped, ok := m[code]; ok {
+		return mapped
+	}
+	return code
 }
 
 // buildEnv constructs environment variables based on config.
 func buildEnv(cfg Config) []string {
+	env := inheritEnv(cfg)
+
+	// LC_ALL takes precedence over LANG and every other LC_* var. SetEnv
+	// and RunWithEnv can still set them, as they're explicit.
+	if cfg.ForceCLocale {
+		env = setEnv(env, "LC_ALL", "C")
+		env = setEnv(env, "LANG", "C")
+	}
+
+	if cfg.sshAuthSock != "" {
+		env = setEnv(env, "SSH_AUTH_SOCK", cfg.sshAuthSock)
+	}
+
+	for _, key := range slices.Sorted(maps.Keys(cfg.secrets)) {
+		env = setEnv(env, key, cfg.secrets[key])
+	}
+
+	// Explicitly set vars always win over inherited ones. Cycles were
+	// rejected in New; if one slips through, values are set unexpanded.
+	values, err := expandSetEnv(cfg.SetEnv, env)
+	if err != nil {
+		values = cfg.SetEnv
+	}
+	for _, key := range slices.Sorted(maps.Keys(values)) {
+		env = setEnv(env, key, values[key])
+	}
+
+	if cfg.PathOverride != "" || len(cfg.PathPrepend) > 0 {
+		path := cfg.PathOverride
+		if path == "" {
+			path = lookupEnv(env, "PATH")
+		}
+		if len(cfg.PathPrepend) > 0 {
+			prepend := strings.Join(cfg.PathPrepend, string(filepath.ListSeparator))
+			if path == "" {
+				path = prepend
+			} else {
+				path = prepend + string(filepath.ListSeparator) + path
+			}
+		}
+		env = setEnv(env, "PATH", path)
+	}
+
+	for _, key := range slices.Sorted(maps.Keys(cfg.runEnv)) {
+		env = setEnv(env, key, cfg.runEnv[key])
+	}
+
+	// Set last, so nothing overrides it, for IsSandboxed
+	env = setEnv(env, depthEnv, strconv.Itoa(sandboxDepth()+1))
+
+	return env
+}
+
+// expandSetEnv expands $VAR and ${VAR} in setEnv values, with $$ for a
+// literal $. A reference to another setEnv key uses that key's expanded
+// value; other references, and a key's reference to itself as in
+// "PATH": "/opt/bin:$PATH", use base. Cycles like A=$B, B=$A fail.
+func expandSetEnv(setEnv map[string]string, base []string) (map[string]string, error) {
+	expanded := make(map[string]string, len(setEnv))
+	visiting := make(map[string]bool)
+
+	var expand func(key string, chain []string) (string, error)
+	expand = func(key string, chain []string) (string, error) {
+		if value, ok := expanded[key]; ok {
+			return value, nil
+		}
+		chain = append(chain, key)
+		if visiting[key] {
+			return "", fmt.Errorf("cyclic reference %s", strings.Join(chain, " -> "))
+		}
+		visiting[key] = true
+
+		var err error
+		value := os.Expand(setEnv[key], func(ref string) string {
+			if ref == "$" {
+				return "$"
+			}
+			if _, ok := setEnv[ref]; !ok || ref == key {
+				return lookupEnv(base, ref)
+			}
+			value, refErr := expand(ref, chain)
+			if err == nil {
+				err = refErr
+			}
+			return value
+		})
+		if err != nil {
+			return "", err
+		}
+		expanded[key] = value
+		return value, nil
+	}
+
+	for _, key := range slices.Sorted(maps.Keys(setEnv)) {
+		if _, err := expand(key, nil); err != nil {
+			return nil, err
+		}
+	}
+	return expanded, nil
+}
+
+// lookupEnv returns the value of key in env, or "" if unset.
+func lookupEnv(env []string, key string) string {
+	for _, e := range env {
+		if k, v, _ := strings.Cut(e, "="); k == key {
+			return v
+		}
+	}
+	return ""
+}
+
+// setEnv sets key to value in env, replacing an existing entry.
+func setEnv(env []string, key, value string) []string {
+	for i, e := range env {
+		if k, _, _ := strings.Cut(e, "="); k == key {
+			env[i] = key + "=" + value
+			return env
+		}
+	}
+	return append(env, key+"="+value)
+}
+
+// inheritEnv selects the variables passed through from the current process.
+func inheritEnv(cfg Config) []string {
 	if cfg.CleanEnv {
 		env := []string{}
 
@@ -198,8 +1227,81 @@ func buildEnv(cfg Config) []string {
 // pathInDenyRead checks if a path should be denied based on DenyRead config.
 // DenyRead always takes precedence over AllowWrite.
 func pathInDenyRead(path string, denyRead []string) bool {
-	for _, denied := range denyRead {
-		if path == denied || strings.HasPrefix(path, denied+string(filepath.Separator)) {
+	return pathWithin(path, denyRead)
+}
+
+// validCapability reports whether name looks like a capability name, e.g.
+// CAP_SYS_ADMIN. bwrap rejects names it doesn't know.
+func validCapability(name string) bool {
+	rest := strings.TrimPrefix(name, "CAP_")
+	if rest == "" || rest == "ALL" {
+		return false
+	}
+	for _, r := range rest {
+		if (r < 'A' || r > 'Z') && (r < '0' || r > '9') && r != '_' {
+			return false
+		}
+	}
+	return true
+}
+
+// readAllowlisted reports whether only listed paths are readable: with
+// AllowRead set, or a wildcard DenyRead, which allows no extra paths.
+func readAllowlisted(cfg Config) bool {
+	return HasWildcard(cfg.DenyRead) || len(cfg.AllowRead) > 0
+}
+
+// deniedHome returns the home directory if a DenyRead entry is exactly it.
+// A wildcard DenyRead is meant to hide everything and doesn't count.
+func deniedHome(cfg Config) (string, bool) {
+	home, err := os.UserHomeDir()
+	if err != nil || HasWildcard(cfg.DenyRead) {
+		return "", false
+	}
+	if resolved, err := expandPath(home); err == nil {
+		home = resolved
+	}
+	return home, slices.Contains(cfg.DenyRead, home)
+}
+
+// homeCarveOut returns the existing PATH entries within a home directory
+// that DenyRead hides whole, so tools installed there (~/.local/bin,
+// ~/go/bin, ~/.cargo/bin) keep working. Entries also within another
+// DenyRead path stay hidden.
+func homeCarveOut(cfg Config) []string {
+	home, ok := deniedHome(cfg)
+	if !ok || cfg.AllowHomeDenyRead {
+		return nil
+	}
+	others := slices.DeleteFunc(slices.Clone(cfg.DenyRead), func(p string) bool { return p == home })
+
+	var dirs []string
+	for _, dir := range filepath.SplitList(lookupEnv(buildEnv(cfg), "PATH")) {
+		if !filepath.IsAbs(dir) {
+			continue
+		}
+		dir, err := expandPath(dir)
+		if err != nil || !pathWithin(dir, []string{home}) || dir == home || pathInDenyRead(dir, others) {
+			continue
+		}
+		if info, err := os.Stat(dir); err == nil && info.IsDir() && !slices.Contains(dirs, dir) {
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
+
+// workdirDenied reports whether a DenyRead entry would hide the workdir,
+// leaving commands in an empty dir. Backends carve the workdir back out.
+// A wildcard DenyRead is meant to hide everything and doesn't count.
+func workdirDenied(cfg Config) bool {
+	return !HasWildcard(cfg.DenyRead) && pathInDenyRead(cfg.Workdir, cfg.DenyRead)
+}
+
+// pathWithin checks if path is one of roots or inside one of them.
+func pathWithin(path string, roots []string) bool {
+	for _, root := range roots {
+		if path == root || strings.HasPrefix(path, root+string(filepath.Separator)) {
 			return true
 		}
 	}
@@ -2,9 +2,13 @@ package sandbox
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"log"
 	"os"
 	"path/filepath"
+	"runtime"
+	"slices"
 	"strings"
 	"testing"
 )
@@ -24,6 +28,11 @@ func TestExpandPath_Tilde(t *testing.T) {
 	if result != expected {
 		t.Errorf("got %q, want %q", result, expected)
 	}
+
+	// A bare ~ is the home itself
+	if result, _ := expandPathNoResolve("~"); result != home {
+		t.Errorf("got %q, want %q", result, home)
+	}
 }
 
 func TestExpandPath_Relative(t *testing.T) {
@@ -51,6 +60,44 @@ func TestExpandPath_Absolute(t *testing.T) {
 	}
 }
 
+func TestExpandPath_EnvVars(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	t.Setenv("PROJECT_ROOT", "/srv/project")
+
+	for in, want := range map[string]string{
+		"$HOME/.cache":           filepath.Join(home, ".cache"),
+		"${PROJECT_ROOT}/build":  "/srv/project/build",
+		"$PROJECT_ROOT/../other": "/srv/other",
+	} {
+		result, err := expandPathNoResolve(in)
+		if err != nil {
+			t.Errorf("expandPathNoResolve(%q) error: %v", in, err)
+		} else if result != want {
+			t.Errorf("expandPathNoResolve(%q) = %q, want %q", in, result, want)
+		}
+	}
+
+	// An unset or empty variable would turn "$UNDEFINED/" into "/"
+	t.Setenv("AGENTSANDBOX_EMPTY", "")
+	for _, in := range []string{"$AGENTSANDBOX_UNDEFINED/", "${AGENTSANDBOX_EMPTY}/data"} {
+		_, err := expandPath(in)
+		if err == nil || !strings.Contains(err.Error(), "is not set") {
+			t.Errorf("expandPath(%q): expected unset variable error, got %v", in, err)
+		}
+	}
+
+	_, err := resolveConfig(Config{Workdir: t.TempDir(), DenyRead: []string{"$AGENTSANDBOX_UNDEFINED/secrets"}})
+	if err == nil || !strings.Contains(err.Error(), "invalid DenyRead") {
+		t.Errorf("expected invalid DenyRead error, got %v", err)
+	}
+
+	// Variable paths aren't anchored to a base directory
+	if got := anchorPath("$HOME/.cache", "/base"); got != "$HOME/.cache" {
+		t.Errorf("anchorPath() = %q, want it unchanged", got)
+	}
+}
+
 func TestBuildEnv_CleanEnv(t *testing.T) {
 	// Set test env vars
 	os.Setenv("TEST_CUSTOM_VAR", "custom_value")
@@ -140,6 +187,38 @@ func TestValidatePaths_WorkdirMissing_LogsWarning(t *testing.T) {
 	}
 }
 
+func TestValidatePaths_LogsLabels(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	cfg := Config{
+		Workdir: "/nonexistent/test/path/12345",
+		Labels:  map[string]string{"tenant": "acme", "task-id": "42"},
+	}
+	validatePaths(&cfg)
+
+	if !strings.Contains(buf.String(), "[task-id=42 tenant=acme]") {
+		t.Errorf("warning should carry sorted labels, got: %s", buf.String())
+	}
+}
+
+func TestValidatePaths_Logger(t *testing.T) {
+	var std, diag bytes.Buffer
+	log.SetOutput(&std)
+	defer log.SetOutput(os.Stderr)
+
+	cfg := Config{Workdir: "/nonexistent/test/path/12345", Logger: log.New(&diag, "", 0)}
+	validatePaths(&cfg)
+
+	if !strings.Contains(diag.String(), "warning: ") || !strings.Contains(diag.String(), "/nonexistent/test/path/12345") {
+		t.Errorf("warning should go to Config.Logger, got: %q", diag.String())
+	}
+	if std.Len() > 0 {
+		t.Errorf("standard logger should get nothing, got: %q", std.String())
+	}
+}
+
 func TestValidatePaths_WorkdirExists_NoWarning(t *testing.T) {
 	var buf bytes.Buffer
 	log.SetOutput(&buf)
@@ -153,6 +232,70 @@ func TestValidatePaths_WorkdirExists_NoWarning(t *testing.T) {
 	}
 }
 
+func TestValidatePaths_PreflightWritable_ReadOnly(t *testing.T) {
+	dir := readOnlyDir(t)
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	cfg := Config{
+		Workdir:           os.TempDir(),
+		AllowWrite:        []string{dir},
+		PreflightWritable: true,
+	}
+	validatePaths(&cfg)
+
+	logOutput := buf.String()
+	if !strings.Contains(logOutput, "not writable") || !strings.Contains(logOutput, dir) {
+		t.Errorf("should warn about read-only AllowWrite path, got: %s", logOutput)
+	}
+}
+
+func TestValidatePaths_PreflightWritable_Writable(t *testing.T) {
+	dir := t.TempDir()
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	cfg := Config{
+		Workdir:           dir,
+		AllowWrite:        []string{dir, filepath.Join(dir, "missing")},
+		PreflightWritable: true,
+	}
+	validatePaths(&cfg)
+
+	if buf.Len() > 0 {
+		t.Errorf("should not log anything, got: %s", buf.String())
+	}
+
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 0 {
+		t.Errorf("probe file should be removed, found %d entries", len(entries))
+	}
+}
+
+// readOnlyDir returns a directory that can't be written to. Root bypasses
+// permission bits, so it gets a pseudo filesystem instead.
+func readOnlyDir(t *testing.T) string {
+	t.Helper()
+
+	if os.Geteuid() == 0 {
+		if _, err := os.Stat("/proc/self"); err == nil {
+			return "/proc"
+		}
+		t.Skip("running as root without /proc")
+	}
+
+	dir := t.TempDir()
+	if err := os.Chmod(dir, 0555); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chmod(dir, 0755) })
+	return dir
+}
+
 func TestPathInDenyRead(t *testing.T) {
 	denyRead := []string{"/home/user/.ssh", "/home/user/.aws"}
 
@@ -200,3 +343,881 @@ func TestDefaultConfig(t *testing.T) {
 		t.Error("EnvDenylist should be empty by default")
 	}
 }
+
+func TestDefaultConfigWithSource(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+
+	_, source := DefaultConfigWithSource()
+	if source != SourceDefaults {
+		t.Errorf("source = %q, want %q without a config file", source, SourceDefaults)
+	}
+
+	configPath := DefaultConfigPath()
+	if err := os.MkdirAll(filepath.Dir(configPath), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(configPath, []byte(`{"cleanEnv": true}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, source := DefaultConfigWithSource()
+	if source != configPath {
+		t.Errorf("source = %q, want %q", source, configPath)
+	}
+	if !cfg.CleanEnv {
+		t.Error("config file should be applied")
+	}
+}
+
+func TestResolveConfig_PathListFiles(t *testing.T) {
+	tmpDir := t.TempDir()
+	allowFile := filepath.Join(tmpDir, "allow-write")
+	denyFile := filepath.Join(tmpDir, "deny-read")
+
+	if err := os.WriteFile(allowFile, []byte("# writable\n/from/allow/file\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(denyFile, []byte("/from/deny/file\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	allowWrite := []string{"/from/config"}
+	cfg, err := resolveConfig(Config{
+		Workdir:        tmpDir,
+		AllowWrite:     allowWrite,
+		DenyRead:       []string{"/denied/config"},
+		AllowWriteFile: allowFile,
+		DenyReadFile:   denyFile,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// File entries are appended after config entries
+	if len(cfg.AllowWrite) != 2 || cfg.AllowWrite[0] != "/from/config" || cfg.AllowWrite[1] != "/from/allow/file" {
+		t.Errorf("AllowWrite = %v, want [/from/config /from/allow/file]", cfg.AllowWrite)
+	}
+	if len(cfg.DenyRead) != 2 || cfg.DenyRead[1] != "/from/deny/file" {
+		t.Errorf("DenyRead = %v, want [/denied/config /from/deny/file]", cfg.DenyRead)
+	}
+
+	// Caller's slice must not be modified
+	if len(allowWrite) != 1 || allowWrite[0] != "/from/config" {
+		t.Errorf("caller AllowWrite modified: %v", allowWrite)
+	}
+}
+
+func TestResolveConfig_BaseDir(t *testing.T) {
+	workdir, _ := expandPath(t.TempDir())
+	baseDir, _ := expandPath(t.TempDir())
+
+	tests := []struct {
+		name    string
+		baseDir string
+		want    string
+	}{
+		{"anchored at BaseDir", baseDir, filepath.Join(baseDir, "build")},
+		{"anchored at workdir", "", filepath.Join(workdir, "build")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := resolveConfig(Config{
+				Workdir:    workdir,
+				BaseDir:    tt.baseDir,
+				AllowWrite: []string{"./build", "/abs/path"},
+			})
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if cfg.AllowWrite[0] != tt.want {
+				t.Errorf("AllowWrite[0] = %q, want %q", cfg.AllowWrite[0], tt.want)
+			}
+			if cfg.AllowWrite[1] != "/abs/path" {
+				t.Errorf("absolute path should be unchanged, got %q", cfg.AllowWrite[1])
+			}
+		})
+	}
+}
+
+func TestResolveConfig_MissingPathListFile(t *testing.T) {
+	_, err := resolveConfig(Config{
+		Workdir:      t.TempDir(),
+		DenyReadFile: "/nonexistent/deny-read",
+	})
+	if err == nil {
+		t.Error("expected error for missing DenyReadFile")
+	}
+}
+
+func TestCheckArgv_Limits(t *testing.T) {
+	cfg := Config{MaxArgs: 3, MaxArgBytes: 13}
+
+	tests := []struct {
+		name string
+		argv []string
+		want error
+	}{
+		{"at count limit", []string{"ls", "-l", "a"}, nil},
+		{"beyond count limit", []string{"ls", "-l", "a", "b"}, ErrArgvTooLarge},
+		{"at length limit", []string{"echo", "abcdefg"}, nil}, // 5 + 8 bytes with NULs
+		{"beyond length limit", []string{"echo", "abcdefgh"}, ErrArgvTooLarge},
+		{"empty", nil, ErrEmptyCommand},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := checkArgv(cfg, tt.argv); !errors.Is(err, tt.want) {
+				t.Errorf("checkArgv(%q) = %v, want %v", tt.argv, err, tt.want)
+			}
+		})
+	}
+
+	// No limits by default
+	long := make([]string, 10000)
+	for i := range long {
+		long[i] = "arg"
+	}
+	if err := checkArgv(Config{}, long); err != nil {
+		t.Errorf("unexpected error without limits: %v", err)
+	}
+}
+
+func TestShellQuote(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"--ro-bind", "--ro-bind"},
+		{"/usr/bin/bwrap", "/usr/bin/bwrap"},
+		{"/tmp/my project", "'/tmp/my project'"},
+		{"echo 'hi'", `'echo '\''hi'\'''`},
+		{"$HOME", "'$HOME'"},
+		{"", "''"},
+	}
+
+	for _, tt := range tests {
+		if got := shellQuote(tt.in); got != tt.want {
+			t.Errorf("shellQuote(%q) = %s, want %s", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestRemapExitCode(t *testing.T) {
+	m := map[int]int{125: 1, 126: 2}
+
+	tests := []struct {
+		code     int
+		expected int
+	}{
+		{0, 0},
+		{1, 1},
+		{125, 1},
+		{126, 2},
+		{127, 127},
+	}
+
+	for _, tt := range tests {
+		if result := remapExitCode(tt.code, m); result != tt.expected {
+			t.Errorf("remapExitCode(%d) = %d, want %d", tt.code, result, tt.expected)
+		}
+	}
+
+	if result := remapExitCode(125, nil); result != 125 {
+		t.Errorf("remapExitCode with nil map = %d, want 125", result)
+	}
+}
+
+func TestBuildEnv_SetEnv(t *testing.T) {
+	t.Setenv("TEST_SET_ENV_EXISTING", "inherited")
+
+	env := buildEnv(Config{SetEnv: map[string]string{
+		"TEST_SET_ENV_EXISTING": "overridden",
+		"TEST_SET_ENV_NEW":      "added",
+	}})
+
+	if v := lookupEnv(env, "TEST_SET_ENV_EXISTING"); v != "overridden" {
+		t.Errorf("TEST_SET_ENV_EXISTING = %q, want %q", v, "overridden")
+	}
+	if v := lookupEnv(env, "TEST_SET_ENV_NEW"); v != "added" {
+		t.Errorf("TEST_SET_ENV_NEW = %q, want %q", v, "added")
+	}
+
+	// SetEnv applies with CleanEnv too
+	env = buildEnv(Config{CleanEnv: true, SetEnv: map[string]string{"TEST_SET_ENV_NEW": "added"}})
+	if v := lookupEnv(env, "TEST_SET_ENV_NEW"); v != "added" {
+		t.Errorf("with CleanEnv, TEST_SET_ENV_NEW = %q, want %q", v, "added")
+	}
+}
+
+func TestBuildEnv_ForceCLocale(t *testing.T) {
+	t.Setenv("LANG", "tr_TR.UTF-8")
+	t.Setenv("LC_ALL", "tr_TR.UTF-8")
+	t.Setenv("LC_NUMERIC", "de_DE.UTF-8")
+
+	for _, cfg := range []Config{
+		{ForceCLocale: true},
+		{ForceCLocale: true, CleanEnv: true, EnvAllowlist: []string{"LANG", "LC_ALL", "LC_NUMERIC"}},
+	} {
+		env := buildEnv(cfg)
+		if v := lookupEnv(env, "LC_ALL"); v != "C" {
+			t.Errorf("CleanEnv=%v: LC_ALL = %q, want C", cfg.CleanEnv, v)
+		}
+		if v := lookupEnv(env, "LANG"); v != "C" {
+			t.Errorf("CleanEnv=%v: LANG = %q, want C", cfg.CleanEnv, v)
+		}
+		if n := strings.Count(strings.Join(env, "\n"), "LC_ALL="); n != 1 {
+			t.Errorf("CleanEnv=%v: LC_ALL set %d times, want once", cfg.CleanEnv, n)
+		}
+	}
+
+	if v := lookupEnv(buildEnv(Config{}), "LANG"); v != "tr_TR.UTF-8" {
+		t.Errorf("without ForceCLocale, LANG = %q, want the inherited value", v)
+	}
+}
+
+func TestBuildEnv_RunEnv(t *testing.T) {
+	t.Setenv("TEST_RUN_ENV_EXISTING", "inherited")
+	t.Setenv("TEST_RUN_ENV_DENIED", "secret")
+
+	env := buildEnv(Config{
+		EnvDenylist: []string{"TEST_RUN_ENV_DENIED"},
+		SetEnv:      map[string]string{"TEST_RUN_ENV_SET": "from config"},
+		runEnv: map[string]string{
+			"TEST_RUN_ENV_EXISTING": "overridden",
+			"TEST_RUN_ENV_SET":      "from run",
+			"TASK_ID":               "42",
+		},
+	})
+
+	for key, want := range map[string]string{
+		"TEST_RUN_ENV_EXISTING": "overridden",
+		"TEST_RUN_ENV_SET":      "from run",
+		"TASK_ID":               "42",
+		"TEST_RUN_ENV_DENIED":   "",
+	} {
+		if v := lookupEnv(env, key); v != want {
+			t.Errorf("%s = %q, want %q", key, v, want)
+		}
+	}
+
+	// Explicitly provided vars win over the denylist
+	env = buildEnv(Config{EnvDenylist: []string{"TEST_RUN_ENV_DENIED"}, runEnv: map[string]string{"TEST_RUN_ENV_DENIED": "given"}})
+	if v := lookupEnv(env, "TEST_RUN_ENV_DENIED"); v != "given" {
+		t.Errorf("TEST_RUN_ENV_DENIED = %q, want %q", v, "given")
+	}
+}
+
+func TestBuildEnv_SetEnvExpansion(t *testing.T) {
+	t.Setenv("PATH", "/usr/bin:/bin")
+
+	env := buildEnv(Config{SetEnv: map[string]string{
+		"PATH":      "/opt/tool/bin:$PATH",
+		"TOOL_HOME": "${TOOL_ROOT}/tool",
+		"TOOL_ROOT": "/opt",
+		"PRICE":     "$$5",
+	}})
+
+	for key, want := range map[string]string{
+		"PATH":      "/opt/tool/bin:/usr/bin:/bin",
+		"TOOL_HOME": "/opt/tool",
+		"PRICE":     "$5",
+	} {
+		if v := lookupEnv(env, key); v != want {
+			t.Errorf("%s = %q, want %q", key, v, want)
+		}
+	}
+}
+
+func TestResolveConfig_SetEnvCycle(t *testing.T) {
+	_, err := resolveConfig(Config{Workdir: t.TempDir(), SetEnv: map[string]string{
+		"A": "$B",
+		"B": "x:${A}",
+	}})
+	if err == nil || !strings.Contains(err.Error(), "cyclic reference A -> B -> A") {
+		t.Errorf("expected cyclic reference error, got %v", err)
+	}
+
+	// A key referencing itself uses the inherited value, not a cycle
+	_, err = resolveConfig(Config{Workdir: t.TempDir(), SetEnv: map[string]string{"PATH": "/opt/bin:$PATH"}})
+	if err != nil {
+		t.Errorf("self-reference should not be an error, got %v", err)
+	}
+}
+
+func TestResolveConfig_CPUAffinity(t *testing.T) {
+	if _, err := resolveConfig(Config{Workdir: t.TempDir(), CPUAffinity: []int{0}}); err != nil {
+		t.Errorf("CPU 0 should be valid, got %v", err)
+	}
+	for _, cpu := range []int{-1, runtime.NumCPU()} {
+		_, err := resolveConfig(Config{Workdir: t.TempDir(), CPUAffinity: []int{0, cpu}})
+		if err == nil || !strings.Contains(err.Error(), "out of range") {
+			t.Errorf("CPU %d: expected out of range error, got %v", cpu, err)
+		}
+	}
+}
+
+func TestResolveConfig_StdinFile(t *testing.T) {
+	workdir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(workdir, "input.txt"), []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := resolveConfig(Config{Workdir: workdir, StdinFile: "input.txt"})
+	if err != nil {
+		t.Fatalf("resolveConfig() error: %v", err)
+	}
+	if want, _ := expandPath(filepath.Join(workdir, "input.txt")); cfg.StdinFile != want {
+		t.Errorf("StdinFile = %q, want %q resolved against the workdir", cfg.StdinFile, want)
+	}
+
+	_, err = resolveConfig(Config{Workdir: t.TempDir(), StdinFile: filepath.Join(workdir, "input.txt"), DenyRead: []string{workdir}})
+	if err == nil || !strings.Contains(err.Error(), "within DenyRead") {
+		t.Errorf("expected DenyRead error, got %v", err)
+	}
+	_, err = resolveConfig(Config{Workdir: workdir, StdinFile: "missing.txt"})
+	if err == nil || !strings.Contains(err.Error(), "invalid StdinFile") {
+		t.Errorf("expected error for a missing file, got %v", err)
+	}
+}
+
+func TestResolveConfig_Capabilities(t *testing.T) {
+	cfg, err := resolveConfig(Config{Workdir: t.TempDir(), Capabilities: []string{"net_bind_service", "CAP_CHOWN"}})
+	if err != nil {
+		t.Fatalf("resolveConfig() error: %v", err)
+	}
+	if got := strings.Join(cfg.Capabilities, ","); got != "CAP_NET_BIND_SERVICE,CAP_CHOWN" {
+		t.Errorf("Capabilities = %s, want normalized names", got)
+	}
+
+	for _, bad := range []string{"", "ALL", "CAP_ALL", "cap net"} {
+		if _, err := resolveConfig(Config{Workdir: t.TempDir(), Capabilities: []string{bad}}); err == nil {
+			t.Errorf("Capabilities %q should be rejected", bad)
+		}
+	}
+}
+
+func TestResolveConfig_ConfirmPatterns(t *testing.T) {
+	confirm := func(string) (bool, error) { return true, nil }
+	if _, err := resolveConfig(Config{Workdir: t.TempDir(), ConfirmPatterns: []string{"rm -rf"}}); err == nil {
+		t.Error("ConfirmPatterns without ConfirmFunc should be rejected")
+	}
+	if _, err := resolveConfig(Config{Workdir: t.TempDir(), ConfirmPatterns: []string{"rm ("}, ConfirmFunc: confirm}); err == nil {
+		t.Error("an invalid pattern should be rejected")
+	}
+}
+
+func TestResolveConfig_AllowRead(t *testing.T) {
+	workdir := t.TempDir()
+	cfg, err := resolveConfig(Config{Workdir: workdir, AllowRead: []string{"./docs"}})
+	if err != nil {
+		t.Fatalf("resolveConfig() error: %v", err)
+	}
+	workdir, _ = expandPath(workdir)
+	if want := filepath.Join(workdir, "docs"); len(cfg.AllowRead) != 1 || cfg.AllowRead[0] != want {
+		t.Errorf("AllowRead = %v, want [%s]", cfg.AllowRead, want)
+	}
+
+	if _, err := resolveConfig(Config{Workdir: workdir, AllowRead: []string{"*"}}); err == nil {
+		t.Error("wildcard AllowRead should be rejected")
+	}
+}
+
+func TestResolveConfig_ReadOnly(t *testing.T) {
+	workdir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(workdir, "cache"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := resolveConfig(Config{Workdir: workdir, ReadOnly: []string{"./cache"}})
+	if err != nil {
+		t.Fatalf("resolveConfig() error: %v", err)
+	}
+	workdir, _ = expandPath(workdir)
+	if want := filepath.Join(workdir, "cache"); len(cfg.ReadOnly) != 1 || cfg.ReadOnly[0] != want {
+		t.Errorf("ReadOnly = %v, want [%s]", cfg.ReadOnly, want)
+	}
+
+	for _, bad := range []string{"*", "./missing"} {
+		if _, err := resolveConfig(Config{Workdir: workdir, ReadOnly: []string{bad}}); err == nil {
+			t.Errorf("ReadOnly %q should be rejected", bad)
+		}
+	}
+}
+
+func TestResolveConfig_HomeDenyRead(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	home, _ = expandPath(home)
+	for _, dir := range []string{".local/bin", ".ssh/bin"} {
+		if err := os.MkdirAll(filepath.Join(home, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	localBin := filepath.Join(home, ".local/bin")
+	t.Setenv("PATH", strings.Join([]string{localBin, filepath.Join(home, ".ssh/bin"), filepath.Join(home, "missing"), "/usr/bin"}, string(filepath.ListSeparator)))
+
+	cfg, err := resolveConfig(Config{Workdir: t.TempDir(), DenyRead: []string{"~", "~/.ssh"}})
+	if err != nil {
+		t.Fatalf("resolveConfig() error: %v", err)
+	}
+	if strings.Join(cfg.homeCarveOut, ",") != localBin {
+		t.Errorf("homeCarveOut = %v, want only %s", cfg.homeCarveOut, localBin)
+	}
+
+	var logged bytes.Buffer
+	cfg.Logger = log.New(&logged, "", 0)
+	validatePaths(&cfg)
+	if !strings.Contains(logged.String(), "DenyRead hides the home directory") || !cfg.degraded {
+		t.Errorf("denying the home should be warned about, got %q", logged.String())
+	}
+
+	// Opted in: the whole home stays hidden, quietly
+	cfg, _ = resolveConfig(Config{Workdir: t.TempDir(), DenyRead: []string{"~"}, AllowHomeDenyRead: true})
+	if len(cfg.homeCarveOut) > 0 {
+		t.Errorf("AllowHomeDenyRead should keep no carve-out, got %v", cfg.homeCarveOut)
+	}
+	logged.Reset()
+	cfg.Logger = log.New(&logged, "", 0)
+	validatePaths(&cfg)
+	if logged.Len() > 0 {
+		t.Errorf("AllowHomeDenyRead should not warn, got %q", logged.String())
+	}
+
+	// Paths within the home aren't the home
+	cfg, _ = resolveConfig(Config{Workdir: t.TempDir(), DenyRead: []string{"~/.ssh"}})
+	if len(cfg.homeCarveOut) > 0 {
+		t.Errorf("DenyRead of ~/.ssh should keep no carve-out, got %v", cfg.homeCarveOut)
+	}
+}
+
+func TestResolveConfig_ShareSSHAgent(t *testing.T) {
+	t.Setenv("SSH_AUTH_SOCK", "/tmp/ssh-agent/agent.sock")
+
+	cfg, err := resolveConfig(Config{
+		Workdir:       t.TempDir(),
+		DenyRead:      []string{"~/.ssh"},
+		CleanEnv:      true,
+		ShareSSHAgent: true,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if cfg.sshAuthSock != "/tmp/ssh-agent/agent.sock" {
+		t.Errorf("sshAuthSock = %q, want /tmp/ssh-agent/agent.sock", cfg.sshAuthSock)
+	}
+	if v := lookupEnv(buildEnv(cfg), "SSH_AUTH_SOCK"); v != "/tmp/ssh-agent/agent.sock" {
+		t.Errorf("SSH_AUTH_SOCK = %q, should pass through even with CleanEnv", v)
+	}
+
+	sshDir, _ := expandPathNoResolve("~/.ssh")
+	if !slices.Contains(cfg.DenyRead, sshDir) {
+		t.Errorf("~/.ssh should remain denied, DenyRead = %v", cfg.DenyRead)
+	}
+
+	// Disabled: no socket, and SSH_AUTH_SOCK is not forced into a clean env
+	cfg, err = resolveConfig(Config{Workdir: t.TempDir(), CleanEnv: true})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if cfg.sshAuthSock != "" || lookupEnv(buildEnv(cfg), "SSH_AUTH_SOCK") != "" {
+		t.Error("SSH agent should not be shared unless ShareSSHAgent is set")
+	}
+}
+
+func TestResolveConfig_InjectSecrets(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secrets.env")
+	if err := os.WriteFile(path, []byte("GITHUB_TOKEN=ghp_abc\nAWS_SECRET=aws_xyz\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := resolveConfig(Config{
+		Workdir:       t.TempDir(),
+		CleanEnv:      true,
+		SecretsFile:   path,
+		InjectSecrets: []string{"GITHUB_TOKEN"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	env := buildEnv(cfg)
+	if v := lookupEnv(env, "GITHUB_TOKEN"); v != "ghp_abc" {
+		t.Errorf("GITHUB_TOKEN = %q, want ghp_abc", v)
+	}
+	if v := lookupEnv(env, "AWS_SECRET"); v != "" {
+		t.Errorf("AWS_SECRET = %q, only requested secrets should be injected", v)
+	}
+
+	// Unknown names are an error rather than silently missing
+	_, err = resolveConfig(Config{Workdir: t.TempDir(), SecretsFile: path, InjectSecrets: []string{"MISSING"}})
+	if err == nil || !strings.Contains(err.Error(), "MISSING") {
+		t.Errorf("expected error for unknown secret, got %v", err)
+	}
+
+	_, err = resolveConfig(Config{Workdir: t.TempDir(), InjectSecrets: []string{"GITHUB_TOKEN"}})
+	if err == nil {
+		t.Error("expected error for InjectSecrets without SecretsFile")
+	}
+}
+
+func TestResolveConfig_SecretsFileDenied(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secrets.env")
+	if err := os.WriteFile(path, []byte("GITHUB_TOKEN=ghp_abc\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := resolveConfig(Config{Workdir: t.TempDir(), SecretsFile: path, InjectSecrets: []string{"GITHUB_TOKEN"}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	path, _ = expandPath(path)
+	if !slices.Contains(cfg.DenyRead, path) {
+		t.Errorf("DenyRead = %v, should hide the secrets file %q", cfg.DenyRead, path)
+	}
+
+	// Not added twice when a DenyRead entry covers it already
+	cfg, err = resolveConfig(Config{Workdir: t.TempDir(), DenyRead: []string{filepath.Dir(path)}, SecretsFile: path})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(cfg.DenyRead) != 1 {
+		t.Errorf("DenyRead = %v, want only the covering directory", cfg.DenyRead)
+	}
+}
+
+func TestBuildEnv_PathPrepend(t *testing.T) {
+	t.Setenv("PATH", "/usr/bin:/bin")
+
+	env := buildEnv(Config{PathPrepend: []string{"/opt/tool/bin", "/opt/other/bin"}})
+
+	if path := lookupEnv(env, "PATH"); path != "/opt/tool/bin:/opt/other/bin:/usr/bin:/bin" {
+		t.Errorf("PATH = %q, want prepended dirs before inherited PATH", path)
+	}
+}
+
+func TestBuildEnv_PathOverride(t *testing.T) {
+	t.Setenv("PATH", "/usr/bin:/bin")
+
+	env := buildEnv(Config{
+		CleanEnv:     true,
+		PathOverride: "/opt/toolchain/bin",
+		PathPrepend:  []string{"/opt/tool/bin"},
+	})
+
+	if path := lookupEnv(env, "PATH"); path != "/opt/tool/bin:/opt/toolchain/bin" {
+		t.Errorf("PATH = %q, want prepend applied to override", path)
+	}
+
+	count := 0
+	for _, e := range env {
+		if strings.HasPrefix(e, "PATH=") {
+			count++
+		}
+	}
+	if count != 1 {
+		t.Errorf("PATH should appear once, got %d", count)
+	}
+}
+
+func TestResolveConfig_PathPrependValidation(t *testing.T) {
+	dir := t.TempDir()
+	denied := filepath.Join(dir, "denied")
+	if err := os.MkdirAll(denied, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := resolveConfig(Config{Workdir: dir, PathPrepend: []string{dir}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(cfg.PathPrepend) != 1 || !filepath.IsAbs(cfg.PathPrepend[0]) {
+		t.Errorf("PathPrepend = %v, want one absolute path", cfg.PathPrepend)
+	}
+
+	tests := []struct {
+		name string
+		cfg  Config
+	}{
+		{"missing dir", Config{Workdir: dir, PathPrepend: []string{filepath.Join(dir, "missing")}}},
+		{"denied dir", Config{Workdir: dir, DenyRead: []string{denied}, PathPrepend: []string{denied}}},
+		{"denied override", Config{Workdir: dir, DenyRead: []string{denied}, PathOverride: dir + ":" + denied}},
+	}
+
+	for _, tt := range tests {
+		if _, err := resolveConfig(tt.cfg); err == nil {
+			t.Errorf("%s: expected error", tt.name)
+		}
+	}
+}
+
+func TestResolveConfig_ProtectSelf(t *testing.T) {
+	tmpDir := t.TempDir()
+	configPath := filepath.Join(tmpDir, "config.json")
+	if err := os.WriteFile(configPath, []byte(`{"allowWrite": ["*"]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := DefaultConfigWithPath(configPath)
+	if !cfg.ProtectSelf {
+		t.Fatal("ProtectSelf should default to true")
+	}
+
+	resolved, err := resolveConfig(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	expectedConfig, _ := expandPath(configPath)
+	if !slices.Contains(resolved.denyWrite, expectedConfig) {
+		t.Errorf("denyWrite = %v, should contain config path %q", resolved.denyWrite, expectedConfig)
+	}
+
+	exe, err := os.Executable()
+	if err == nil {
+		expectedExe, _ := expandPath(exe)
+		if !slices.Contains(resolved.denyWrite, expectedExe) {
+			t.Errorf("denyWrite = %v, should contain executable %q", resolved.denyWrite, expectedExe)
+		}
+	}
+
+	cfg.ProtectSelf = false
+	cfg.ProtectHomeDotfiles = false
+	resolved, err = resolveConfig(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(resolved.denyWrite) != 0 {
+		t.Errorf("denyWrite = %v, want empty with ProtectSelf=false", resolved.denyWrite)
+	}
+}
+
+func TestResolveConfig_ProtectHomeDotfiles(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	project := t.TempDir()
+
+	cfg := Config{
+		Workdir:             project,
+		AllowWrite:          []string{home, project},
+		DenyRead:            []string{"~/.netrc"},
+		ProtectHomeDotfiles: true,
+	}
+	resolved, err := resolveConfig(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	home, _ = expandPath(home)
+	for _, name := range []string{".bashrc", ".npmrc", ".local/bin"} {
+		if path := filepath.Join(home, name); !slices.Contains(resolved.denyWrite, path) {
+			t.Errorf("denyWrite = %v, should contain %q", resolved.denyWrite, path)
+		}
+	}
+	if path := filepath.Join(home, ".netrc"); slices.Contains(resolved.denyWrite, path) {
+		t.Errorf("DenyRead path %q should be left to DenyRead", path)
+	}
+	if pathWithin(project, resolved.denyWrite) {
+		t.Errorf("denyWrite = %v, project should stay writable", resolved.denyWrite)
+	}
+
+	// Home outside AllowWrite is already read-only
+	cfg.AllowWrite = []string{project}
+	resolved, err = resolveConfig(cfg)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(resolved.denyWrite) != 0 {
+		t.Errorf("denyWrite = %v, want empty when home isn't writable", resolved.denyWrite)
+	}
+}
+
+func TestResolveConfig_StrictWorkdir(t *testing.T) {
+	denied := t.TempDir()
+	workdir := filepath.Join(denied, "project")
+	cfg := Config{Workdir: workdir, DenyRead: []string{denied}, StrictWorkdir: true}
+
+	if _, err := resolveConfig(cfg); err == nil || !strings.Contains(err.Error(), "within DenyRead") {
+		t.Errorf("expected an error for a workdir within DenyRead, got %v", err)
+	}
+
+	cfg.StrictWorkdir = false
+	if _, err := resolveConfig(cfg); err != nil {
+		t.Errorf("without StrictWorkdir the workdir should be carved out, got %v", err)
+	}
+
+	cfg.StrictWorkdir = true
+	cfg.DenyRead = []string{"*"}
+	if _, err := resolveConfig(cfg); err != nil {
+		t.Errorf("wildcard DenyRead should not count, got %v", err)
+	}
+}
+
+func TestResolveConfig_WriteExclude(t *testing.T) {
+	workdir, _ := expandPath(t.TempDir())
+
+	cfg, err := resolveConfig(Config{
+		Workdir:      workdir,
+		AllowWrite:   []string{workdir},
+		WriteExclude: []string{"secrets", "/project/keys"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := []string{filepath.Join(workdir, "secrets"), "/project/keys"}
+	if !slices.Equal(cfg.denyWrite, want) {
+		t.Errorf("denyWrite = %v, want %v", cfg.denyWrite, want)
+	}
+}
+
+func TestResolveConfig_SymlinkAllowWrite(t *testing.T) {
+	dir := t.TempDir()
+	target := filepath.Join(dir, "target")
+	link := filepath.Join(dir, "link")
+	if err := os.MkdirAll(target, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(target, link); err != nil {
+		t.Skipf("cannot create symlink: %v", err)
+	}
+
+	cfg, err := resolveConfig(Config{Workdir: dir, AllowWrite: []string{link}})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	resolvedTarget, _ := filepath.EvalSymlinks(target)
+	if len(cfg.AllowWrite) != 1 || cfg.AllowWrite[0] != resolvedTarget {
+		t.Errorf("AllowWrite = %v, want resolved target %q", cfg.AllowWrite, resolvedTarget)
+	}
+	if !slices.Contains(cfg.writeAliases, link) {
+		t.Errorf("writeAliases = %v, should contain symlink %q", cfg.writeAliases, link)
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		size     string
+		expected int64
+	}{
+		{"", 0},
+		{"512", 512},
+		{"64k", 64 << 10},
+		{"64m", 64 << 20},
+		{"64M", 64 << 20},
+		{"64MB", 64 << 20},
+		{"1g", 1 << 30},
+	}
+
+	for _, tt := range tests {
+		result, err := parseSize(tt.size)
+		if err != nil {
+			t.Errorf("parseSize(%q) unexpected error: %v", tt.size, err)
+			continue
+		}
+		if result != tt.expected {
+			t.Errorf("parseSize(%q) = %d, want %d", tt.size, result, tt.expected)
+		}
+	}
+
+	for _, size := range []string{"abc", "-1m", "m", "1t", "99999999999g"} {
+		if _, err := parseSize(size); err == nil {
+			t.Errorf("parseSize(%q) should fail", size)
+		}
+	}
+}
+
+func TestNew_BackendOrder(t *testing.T) {
+	saved := backends
+	t.Cleanup(func() { backends = saved })
+
+	var tried []string
+	available := &probeSandbox{}
+	backends = map[string]func(Config) (Sandbox, error){
+		"missing": func(Config) (Sandbox, error) {
+			tried = append(tried, "missing")
+			return nil, errors.New("not installed")
+		},
+		"ok": func(Config) (Sandbox, error) {
+			tried = append(tried, "ok")
+			return available, nil
+		},
+		"later": func(Config) (Sandbox, error) {
+			tried = append(tried, "later")
+			return &probeSandbox{}, nil
+		},
+	}
+
+	sb, err := New(Config{Workdir: t.TempDir(), BackendOrder: []string{"missing", "ok", "later"}})
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+	if sb != available {
+		t.Error("New should return the first available backend")
+	}
+	if strings.Join(tried, ",") != "missing,ok" {
+		t.Errorf("tried %v, want [missing ok]", tried)
+	}
+}
+
+func TestNew_BackendOrderFallbackDegraded(t *testing.T) {
+	saved := backends
+	t.Cleanup(func() { backends = saved })
+
+	var got Config
+	backends = map[string]func(Config) (Sandbox, error){
+		"preferred": func(Config) (Sandbox, error) { return nil, errors.New("not installed") },
+		"fallback": func(cfg Config) (Sandbox, error) {
+			got = cfg
+			return &probeSandbox{}, nil
+		},
+	}
+
+	var logged bytes.Buffer
+	_, err := New(Config{Workdir: t.TempDir(), BackendOrder: []string{"preferred", "fallback"}, Logger: log.New(&logged, "", 0)})
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+
+	res, _ := execute(context.Background(), got, "true", func(ctx context.Context) (Result, error) { return Result{}, nil })
+	if !res.Degraded {
+		t.Error("falling back should mark results Degraded")
+	}
+	if len(res.Warnings) != 1 || !strings.Contains(res.Warnings[0], "falling back to backend fallback: preferred: not installed") {
+		t.Errorf("Warnings = %q, want the reason for the fallback", res.Warnings)
+	}
+	if !strings.Contains(logged.String(), res.Warnings[0]) {
+		t.Errorf("warning should also be logged, got %q", logged.String())
+	}
+
+	// Warnings alone don't degrade the sandbox
+	got = Config{Logger: log.New(&logged, "", 0)}
+	warnf(&got, "ShareSSHAgent is set but SSH_AUTH_SOCK is not")
+	res = dryRunResult(got, "")
+	if res.Degraded || len(res.Warnings) != 1 {
+		t.Errorf("Degraded = %v, Warnings = %q; want one warning, not degraded", res.Degraded, res.Warnings)
+	}
+}
+
+func TestNew_BackendOrderNoneAvailable(t *testing.T) {
+	saved := backends
+	t.Cleanup(func() { backends = saved })
+
+	backends = map[string]func(Config) (Sandbox, error){
+		"first":  func(Config) (Sandbox, error) { return nil, errors.New("not installed") },
+		"second": func(Config) (Sandbox, error) { return nil, errors.New("kernel too old") },
+	}
+
+	_, err := New(Config{Workdir: t.TempDir(), BackendOrder: []string{"first", "second", "docker"}})
+	if !errors.Is(err, ErrNoBackend) {
+		t.Fatalf("error = %v, want ErrNoBackend", err)
+	}
+	for _, want := range []string{"first: not installed", "second: kernel too old", "docker: unknown backend"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error should contain %q, got:\n%v", want, err)
+		}
+	}
+}
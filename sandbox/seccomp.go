@@ -0,0 +1,118 @@
+package sandbox
+
+import (
+	"encoding/binary"
+	"fmt"
+	"maps"
+	"os"
+	"runtime"
+	"slices"
+)
+
+// SeccompDefault is the built-in SeccompProfile. It fails with EPERM the
+// syscalls a build or test command has no use for but an exploit might:
+// ptrace, mounting and pivoting filesystems, loading kernel modules and
+// kexec. Syscalls of another architecture than the host's (e.g. 32-bit
+// binaries on amd64) fail too, so they can't bypass it.
+const SeccompDefault = "default"
+
+// seccompSyscalls are the syscalls SeccompDefault blocks, by GOARCH.
+var seccompSyscalls = map[string]map[string]uint32{
+	"amd64": {
+		"ptrace": 101, "mount": 165, "umount2": 166, "pivot_root": 155,
+		"open_tree": 428, "move_mount": 429, "fsopen": 430, "fsconfig": 431, "fsmount": 432, "fspick": 433,
+		"kexec_load": 246, "kexec_file_load": 320,
+		"init_module": 175, "finit_module": 313, "delete_module": 176,
+	},
+	"arm64": {
+		"ptrace": 117, "mount": 40, "umount2": 39, "pivot_root": 41,
+		"open_tree": 428, "move_mount": 429, "fsopen": 430, "fsconfig": 431, "fsmount": 432, "fspick": 433,
+		"kexec_load": 104, "kexec_file_load": 294,
+		"init_module": 105, "finit_module": 273, "delete_module": 106,
+	},
+}
+
+// seccompAudit are the AUDIT_ARCH values seccomp reports, by GOARCH.
+var seccompAudit = map[string]uint32{
+	"amd64": 0xc000003e,
+	"arm64": 0xc00000b7,
+}
+
+// Classic BPF opcodes and seccomp return values for the filter.
+const (
+	bpfLoadAbs    = 0x20 // BPF_LD | BPF_W | BPF_ABS
+	bpfJumpEq     = 0x15 // BPF_JMP | BPF_JEQ | BPF_K
+	bpfJumpGE     = 0x35 // BPF_JMP | BPF_JGE | BPF_K
+	bpfReturn     = 0x06 // BPF_RET | BPF_K
+	seccompAllow  = 0x7fff0000
+	seccompEPERM  = 0x00050000 | 1 // SECCOMP_RET_ERRNO | EPERM
+	x32SyscallBit = 0x40000000
+)
+
+// seccompFilter returns SeccompDefault compiled for arch as the array of
+// struct sock_filter that bwrap's --seccomp reads.
+func seccompFilter(arch string) ([]byte, error) {
+	syscalls, ok := seccompSyscalls[arch]
+	if !ok {
+		return nil, fmt.Errorf("the built-in seccomp profile supports amd64 and arm64, not %s: pass a compiled filter instead", arch)
+	}
+
+	type insn struct {
+		code   uint16
+		jt, jf uint8
+		k      uint32
+	}
+	// struct seccomp_data starts with the syscall number, then the arch
+	prog := []insn{
+		{bpfLoadAbs, 0, 0, 4},
+		{bpfJumpEq, 1, 0, seccompAudit[arch]},
+		{bpfReturn, 0, 0, seccompEPERM},
+		{bpfLoadAbs, 0, 0, 0},
+	}
+	var numbers []uint32
+	if arch == "amd64" {
+		// x32 syscalls share the arch but set this bit
+		numbers = append(numbers, x32SyscallBit)
+	}
+	for _, name := range slices.Sorted(maps.Keys(syscalls)) {
+		numbers = append(numbers, syscalls[name])
+	}
+	// Every match jumps to the final EPERM, past the allow
+	for i, nr := range numbers {
+		code := uint16(bpfJumpEq)
+		if i == 0 && arch == "amd64" {
+			code = bpfJumpGE
+		}
+		prog = append(prog, insn{code, uint8(len(numbers) - i), 0, nr})
+	}
+	prog = append(prog, insn{bpfReturn, 0, 0, seccompAllow}, insn{bpfReturn, 0, 0, seccompEPERM})
+
+	buf := make([]byte, 0, 8*len(prog))
+	for _, in := range prog {
+		buf = binary.NativeEndian.AppendUint16(buf, in.code)
+		buf = append(buf, in.jt, in.jf)
+		buf = binary.NativeEndian.AppendUint32(buf, in.k)
+	}
+	return buf, nil
+}
+
+// loadSeccomp returns the filter for profile: SeccompDefault compiled for
+// this host, or the contents of the compiled filter file at profile.
+func loadSeccomp(profile string) ([]byte, error) {
+	if profile == SeccompDefault {
+		return seccompFilter(runtime.GOARCH)
+	}
+	path, err := expandPath(profile)
+	if err != nil {
+		return nil, err
+	}
+	filter, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	// A sock_filter is 8 bytes; the kernel takes at most 4096
+	if len(filter) == 0 || len(filter)%8 != 0 || len(filter) > 4096*8 {
+		return nil, fmt.Errorf("%s is not a compiled seccomp BPF filter: %d bytes", path, len(filter))
+	}
+	return filter, nil
+}
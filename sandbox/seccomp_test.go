@@ -0,0 +1,65 @@
+package sandbox
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSeccompFilter(t *testing.T) {
+	for arch, syscalls := range seccompSyscalls {
+		filter, err := seccompFilter(arch)
+		if err != nil {
+			t.Fatalf("%s: seccompFilter() error: %v", arch, err)
+		}
+		// Arch check (3), syscall load, one jump per syscall, allow, deny
+		n := 4 + len(syscalls) + 2
+		if arch == "amd64" {
+			n++ // x32 check
+		}
+		if len(filter) != 8*n {
+			t.Errorf("%s: filter is %d bytes, want %d instructions", arch, len(filter), n)
+			continue
+		}
+		if k := binary.NativeEndian.Uint32(filter[12:]); k != seccompAudit[arch] {
+			t.Errorf("%s: arch check compares with %#x, want %#x", arch, k, seccompAudit[arch])
+		}
+		if k := binary.NativeEndian.Uint32(filter[len(filter)-12:]); k != seccompAllow {
+			t.Errorf("%s: second to last instruction returns %#x, want allow", arch, k)
+		}
+		// Every jump lands on the final EPERM
+		for i := 4; i < n-2; i++ {
+			if jt := int(filter[8*i+2]); i+1+jt != n-1 {
+				t.Errorf("%s: instruction %d jumps to %d, want %d", arch, i, i+1+jt, n-1)
+			}
+		}
+	}
+
+	if _, err := seccompFilter("riscv64"); err == nil {
+		t.Error("an architecture without syscall numbers should fail")
+	}
+}
+
+func TestLoadSeccomp(t *testing.T) {
+	dir := t.TempDir()
+	compiled := filepath.Join(dir, "filter.bpf")
+	if err := os.WriteFile(compiled, make([]byte, 16), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if filter, err := loadSeccomp(compiled); err != nil || len(filter) != 16 {
+		t.Errorf("loadSeccomp() = %d bytes, %v; want the file's 16", len(filter), err)
+	}
+
+	truncated := filepath.Join(dir, "truncated.bpf")
+	if err := os.WriteFile(truncated, make([]byte, 12), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadSeccomp(truncated); err == nil || !strings.Contains(err.Error(), "not a compiled seccomp BPF filter") {
+		t.Errorf("error = %v, want a malformed filter", err)
+	}
+	if _, err := loadSeccomp(filepath.Join(dir, "missing.bpf")); err == nil {
+		t.Error("a missing filter file should fail")
+	}
+}
@@ -0,0 +1,49 @@
+//go:build linux || darwin
+
+package sandbox
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// signalNames maps the signals a command commonly dies from to their names.
+var signalNames = map[syscall.Signal]string{
+	syscall.SIGHUP:  "SIGHUP",
+	syscall.SIGINT:  "SIGINT",
+	syscall.SIGQUIT: "SIGQUIT",
+	syscall.SIGILL:  "SIGILL",
+	syscall.SIGTRAP: "SIGTRAP",
+	syscall.SIGABRT: "SIGABRT",
+	syscall.SIGBUS:  "SIGBUS",
+	syscall.SIGFPE:  "SIGFPE",
+	syscall.SIGKILL: "SIGKILL",
+	syscall.SIGUSR1: "SIGUSR1",
+	syscall.SIGSEGV: "SIGSEGV",
+	syscall.SIGUSR2: "SIGUSR2",
+	syscall.SIGPIPE: "SIGPIPE",
+	syscall.SIGALRM: "SIGALRM",
+	syscall.SIGTERM: "SIGTERM",
+	syscall.SIGXCPU: "SIGXCPU",
+	syscall.SIGXFSZ: "SIGXFSZ",
+	syscall.SIGSYS:  "SIGSYS",
+}
+
+// exitStatus returns the exit code of a finished process and, if a signal
+// killed it, the signal, with the code following the shell's 128+n
+// convention instead of ProcessState.ExitCode's -1.
+func exitStatus(state *os.ProcessState) (int, syscall.Signal) {
+	if ws, ok := state.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		return 128 + int(ws.Signal()), ws.Signal()
+	}
+	return state.ExitCode(), 0
+}
+
+// signalName returns the name of signal number sig, e.g. "SIGSEGV".
+func signalName(sig int) string {
+	if name, ok := signalNames[syscall.Signal(sig)]; ok {
+		return name
+	}
+	return fmt.Sprintf("signal %d", sig)
+}
@@ -0,0 +1,9 @@
+//go:build !linux && !darwin
+
+package sandbox
+
+import "fmt"
+
+func signalName(sig int) string {
+	return fmt.Sprintf("signal %d", sig)
+}
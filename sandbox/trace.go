@@ -0,0 +1,28 @@
+package sandbox
+
+import "context"
+
+// Tracer starts a span around each sandboxed run. It keeps the package free
+// of tracing dependencies; adapt it to OpenTelemetry or similar in the caller.
+type Tracer interface {
+	// StartSpan starts a span and returns a context carrying it, plus a func
+	// that ends the span, recording err if non-nil.
+	StartSpan(ctx context.Context, name string) (context.Context, func(err error))
+}
+
+// SpanAttributeSetter is optionally implemented by a Tracer to record run
+// attributes (AttrCommand, AttrExitCode, AttrDuration) on the span in ctx.
+// Attributes are set just before the span ends.
+type SpanAttributeSetter interface {
+	SetSpanAttributes(ctx context.Context, attrs map[string]any)
+}
+
+// SpanName is the name of the span started for each run.
+const SpanName = "sandbox.run"
+
+// Span attribute keys.
+const (
+	AttrCommand  = "sandbox.command"   // string
+	AttrExitCode = "sandbox.exit_code" // int
+	AttrDuration = "sandbox.duration"  // time.Duration
+)
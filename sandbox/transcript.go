@@ -0,0 +1,108 @@
+package sandbox
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// TranscriptEntry is one run recorded in a TranscriptFile. Output streamed
+// with RunStream went to the caller's writers and isn't recorded, nor is
+// input read from StdinFile.
+type TranscriptEntry struct {
+	Time     time.Time     `json:"time"` // When the run started
+	Command  string        `json:"command"`
+	Stdin    []byte        `json:"stdin,omitempty"` // Input the command read
+	Stdout   []byte        `json:"stdout"`
+	Stderr   []byte        `json:"stderr"`
+	ExitCode int           `json:"exitCode"`
+	Reason   string        `json:"reason"`
+	Error    string        `json:"error,omitempty"`
+	Duration time.Duration `json:"duration"`
+	Attempts int           `json:"attempts"`
+}
+
+// transcriptMu serializes appends, so entries of concurrent runs don't
+// interleave.
+var transcriptMu sync.Mutex
+
+// transcribe calls run with stdin and appends the run to cfg's
+// TranscriptFile, if set. The input the command reads is copied for it.
+// Failing to write the transcript is logged and doesn't fail the run.
+func transcribe(cfg Config, command string, stdin io.Reader, run func(stdin io.Reader) (Result, error)) (Result, error) {
+	if cfg.TranscriptFile == "" {
+		return run(stdin)
+	}
+
+	var input bytes.Buffer
+	if stdin != nil {
+		stdin = io.TeeReader(stdin, &input)
+	}
+	start := time.Now()
+	res, err := run(stdin)
+
+	entry := TranscriptEntry{
+		Time:     start,
+		Command:  command,
+		Stdin:    input.Bytes(),
+		Stdout:   res.Stdout,
+		Stderr:   res.Stderr,
+		ExitCode: res.ExitCode,
+		Reason:   res.Reason,
+		Duration: res.Duration,
+		Attempts: res.Attempts,
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	if werr := appendTranscript(cfg.TranscriptFile, entry); werr != nil {
+		warnf(&cfg, "writing transcript: %v", werr)
+	}
+	return res, err
+}
+
+// appendTranscript writes entry to path as one line of JSON. The file is
+// created private, since output can include secrets.
+func appendTranscript(path string, entry TranscriptEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	transcriptMu.Lock()
+	defer transcriptMu.Unlock()
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// LoadTranscript reads the entries of a TranscriptFile, in the order the
+// runs finished.
+func LoadTranscript(path string) ([]TranscriptEntry, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []TranscriptEntry
+	dec := json.NewDecoder(f)
+	for {
+		var entry TranscriptEntry
+		if err := dec.Decode(&entry); errors.Is(err, io.EOF) {
+			return entries, nil
+		} else if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+}
@@ -0,0 +1,76 @@
+package sandbox
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTranscribe_RoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "transcript.jsonl")
+	cfg := Config{TranscriptFile: path}
+
+	// Each fake run reads its stdin, as a command would
+	echo := func(stdin io.Reader) (Result, error) {
+		in, _ := io.ReadAll(stdin)
+		return Result{Stdout: in, ExitCode: 0, Reason: "exited successfully", Duration: time.Millisecond, Attempts: 1}, nil
+	}
+	fail := func(stdin io.Reader) (Result, error) {
+		return Result{Stderr: []byte("boom\n"), ExitCode: 2, Reason: "exited with code 2", Attempts: 1}, errors.New("exit status 2")
+	}
+
+	if _, err := transcribe(cfg, "cat", strings.NewReader("hello\n"), echo); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := transcribe(cfg, "make", nil, fail); err == nil {
+		t.Fatal("the run's error should be returned")
+	}
+	if _, err := transcribe(cfg, "printf '\\000\\377'", strings.NewReader("\x00\xff"), echo); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := LoadTranscript(path)
+	if err != nil {
+		t.Fatalf("LoadTranscript() error: %v", err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("got %d entries, want 3: %+v", len(entries), entries)
+	}
+	if e := entries[0]; e.Command != "cat" || string(e.Stdin) != "hello\n" || string(e.Stdout) != "hello\n" || e.Duration != time.Millisecond || e.Time.IsZero() {
+		t.Errorf("entry 0 = %+v", e)
+	}
+	if e := entries[1]; e.Command != "make" || e.ExitCode != 2 || string(e.Stderr) != "boom\n" || e.Error != "exit status 2" || e.Reason != "exited with code 2" {
+		t.Errorf("entry 1 = %+v", e)
+	}
+	if e := entries[2]; string(e.Stdout) != "\x00\xff" {
+		t.Errorf("binary output should round-trip, got %q", e.Stdout)
+	}
+
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("transcript should be private, got %v: %v", info.Mode(), err)
+	}
+}
+
+func TestTranscribe_Off(t *testing.T) {
+	ran := false
+	if _, err := transcribe(Config{}, "true", nil, func(io.Reader) (Result, error) { ran = true; return Result{}, nil }); err != nil || !ran {
+		t.Errorf("run should be called without a transcript, ran %v: %v", ran, err)
+	}
+}
+
+func TestLoadTranscript_Invalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "transcript.jsonl")
+	if err := os.WriteFile(path, []byte(`{"command":"ls"}`+"\n{not json\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadTranscript(path); err == nil {
+		t.Error("a corrupt transcript should fail to load")
+	}
+	if _, err := LoadTranscript(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("a missing transcript should fail to load")
+	}
+}
@@ -0,0 +1,118 @@
+package sandbox
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// UsageSample is the resource usage of a running command at one point,
+// summed over the processes of its sandbox.
+type UsageSample struct {
+	Elapsed   time.Duration // Time since the sandbox started
+	RSSBytes  int64         // Resident memory
+	CPUTime   time.Duration // User and system CPU time used so far
+	Processes int           // Processes running
+}
+
+// clockTicks is USER_HZ, the unit of CPU times in /proc/<pid>/stat. It's
+// 100 on every Linux architecture Go supports.
+const clockTicks = 100
+
+// usageSampler collects UsageSamples of a session until finished.
+type usageSampler struct {
+	stop    chan struct{}
+	done    chan struct{}
+	samples []UsageSample
+}
+
+// sampleUsage reads the usage of the processes in session sid from procDir
+// every interval, starting now, until finish is called.
+func sampleUsage(procDir string, sid int, interval time.Duration) *usageSampler {
+	u := &usageSampler{stop: make(chan struct{}), done: make(chan struct{})}
+	start := time.Now()
+	go func() {
+		defer close(u.done)
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-u.stop:
+				return
+			case now := <-t.C:
+				if sample, ok := readUsage(procDir, sid); ok {
+					sample.Elapsed = now.Sub(start)
+					u.samples = append(u.samples, sample)
+				}
+			}
+		}
+	}()
+	return u
+}
+
+// finish stops sampling and returns the samples taken. A nil sampler,
+// when sampling is off, has none.
+func (u *usageSampler) finish() []UsageSample {
+	if u == nil {
+		return nil
+	}
+	close(u.stop)
+	<-u.done
+	return u.samples
+}
+
+// readUsage sums the usage of the processes in session sid. It reports
+// false if none is running.
+func readUsage(procDir string, sid int) (UsageSample, bool) {
+	entries, err := os.ReadDir(procDir)
+	if err != nil {
+		return UsageSample{}, false
+	}
+	var sample UsageSample
+	pageSize := int64(os.Getpagesize())
+	for _, entry := range entries {
+		if _, err := strconv.Atoi(entry.Name()); err != nil {
+			continue
+		}
+		// The process may have exited since the directory was read
+		stat, err := os.ReadFile(filepath.Join(procDir, entry.Name(), "stat"))
+		if err != nil {
+			continue
+		}
+		session, ticks, rssPages, ok := parseProcStat(stat)
+		// Without resident pages it's exiting or a zombie
+		if !ok || session != sid || rssPages == 0 {
+			continue
+		}
+		sample.Processes++
+		sample.RSSBytes += rssPages * pageSize
+		sample.CPUTime += time.Duration(ticks) * time.Second / clockTicks
+	}
+	return sample, sample.Processes > 0
+}
+
+// parseProcStat returns the session, user plus system CPU ticks and
+// resident pages from a /proc/<pid>/stat line. The command name in
+// parentheses may contain spaces, so fields are counted after its end.
+func parseProcStat(stat []byte) (session int, ticks, rssPages int64, ok bool) {
+	end := bytes.LastIndexByte(stat, ')')
+	if end < 0 {
+		return 0, 0, 0, false
+	}
+	// Fields from the state (field 3) on: session is field 6, utime and
+	// stime 14 and 15, rss 24
+	fields := bytes.Fields(stat[end+1:])
+	if len(fields) < 22 {
+		return 0, 0, 0, false
+	}
+	session, err1 := strconv.Atoi(string(fields[3]))
+	utime, err2 := strconv.ParseInt(string(fields[11]), 10, 64)
+	stime, err3 := strconv.ParseInt(string(fields[12]), 10, 64)
+	rssPages, err4 := strconv.ParseInt(string(fields[21]), 10, 64)
+	if err1 != nil || err2 != nil || err3 != nil || err4 != nil {
+		return 0, 0, 0, false
+	}
+	return session, utime + stime, rssPages, true
+}
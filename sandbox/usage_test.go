@@ -0,0 +1,58 @@
+package sandbox
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseProcStat(t *testing.T) {
+	stat := "4242 (my (odd) cmd) S 1 4200 4200 0 -1 4194560 100 0 0 0 150 50 0 0 20 0 1 0 123 10485760 512 18446744073709551615\n"
+	session, ticks, rss, ok := parseProcStat([]byte(stat))
+	if !ok || session != 4200 || ticks != 200 || rss != 512 {
+		t.Errorf("parseProcStat() = %d, %d, %d, %v, want 4200, 200, 512, true", session, ticks, rss, ok)
+	}
+
+	if _, _, _, ok := parseProcStat([]byte("4242 (cut")); ok {
+		t.Error("a truncated line should not parse")
+	}
+}
+
+func TestReadUsage(t *testing.T) {
+	proc := t.TempDir()
+	for pid, stat := range map[string]string{
+		"10":   "10 (bwrap) S 1 10 10 0 -1 0 0 0 0 0 1 1 0 0 20 0 1 0 1 0 100 0\n",
+		"11":   "11 (sh) S 10 10 10 0 -1 0 0 0 0 0 100 0 0 0 20 0 1 0 1 0 300 0\n",
+		"12":   "12 (other) S 1 12 12 0 -1 0 0 0 0 0 500 500 0 0 20 0 1 0 1 0 9000 0\n",
+		"13":   "13 (exited) Z 11 10 10 0 -1 0 0 0 0 0 7 0 0 0 20 0 1 0 1 0 0 0\n",
+		"self": "ignored",
+	} {
+		if err := os.MkdirAll(filepath.Join(proc, pid), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(proc, pid, "stat"), []byte(stat), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	sample, ok := readUsage(proc, 10)
+	if !ok {
+		t.Fatal("readUsage() found no processes")
+	}
+	want := UsageSample{RSSBytes: 400 * int64(os.Getpagesize()), CPUTime: 1020 * time.Millisecond, Processes: 2}
+	if sample != want {
+		t.Errorf("readUsage() = %+v, want %+v", sample, want)
+	}
+
+	if _, ok := readUsage(proc, 99); ok {
+		t.Error("a session without processes should have no sample")
+	}
+}
+
+func TestUsageSampler_Nil(t *testing.T) {
+	var u *usageSampler
+	if samples := u.finish(); samples != nil {
+		t.Errorf("finish() = %v, want nil", samples)
+	}
+}
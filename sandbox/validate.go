@@ -0,0 +1,171 @@
+package sandbox
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+)
+
+// ConfigCheck is the result of CheckConfig.
+type ConfigCheck struct {
+	Problems []string // What's wrong, empty if the config is usable
+	Missing  []string // DenyRead paths that don't exist, which is harmless
+	Backend  string   // Backend New would use, e.g. "bwrap 0.8.0 (/usr/bin/bwrap)"; "" if none is available
+
+	Backends []BackendChoice // How New picks from BackendOrder, if set
+}
+
+// BackendChoice is one BackendOrder entry as New would consider it.
+type BackendChoice struct {
+	Name     string // BackendOrder name, e.g. "bwrap"
+	Selected bool   // New would use this backend
+	Skipped  string // Why New would move on to the next backend, e.g. "bubblewrap not found"; "" if selected or not reached
+}
+
+// ExplainBackends reports, for each backend in cfg.BackendOrder (or the
+// platform's backend if it's empty), whether New would select it and why
+// the ones before it were skipped. It creates but runs nothing. Entries
+// after the selected one aren't tried and have neither Selected nor
+// Skipped set.
+func ExplainBackends(cfg Config) ([]BackendChoice, error) {
+	cfg, err := resolveConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return explainBackends(cfg), nil
+}
+
+// explainBackends is ExplainBackends for a resolved cfg.
+func explainBackends(cfg Config) []BackendChoice {
+	order := cfg.BackendOrder
+	if len(order) == 0 {
+		order = []string{platformBackend()}
+	}
+	choices := make([]BackendChoice, len(order))
+	selected := false
+	for i, name := range order {
+		choices[i].Name = name
+		if selected {
+			continue
+		}
+		newBackend, ok := backends[name]
+		if !ok {
+			choices[i].Skipped = "unknown backend"
+			continue
+		}
+		if _, err := newBackend(cfg); err != nil {
+			choices[i].Skipped = err.Error()
+			continue
+		}
+		choices[i].Selected = true
+		selected = true
+	}
+	return choices
+}
+
+// platformBackend is the BackendOrder name of the backend New uses on this
+// platform without BackendOrder, or the platform's name if it has none.
+func platformBackend() string {
+	switch runtime.GOOS {
+	case "darwin":
+		return "sandbox-exec"
+	case "windows":
+		return "job-object"
+	case "linux":
+		return "bwrap"
+	default:
+		return runtime.GOOS
+	}
+}
+
+// CheckConfig checks cfg without running a command: every path must expand,
+// AllowWrite, AllowRead and ReadOnly paths must exist, no AllowWrite path
+// may be hidden by DenyRead, and a backend must be available.
+func CheckConfig(cfg Config) ConfigCheck {
+	var check ConfigCheck
+	lists := []struct {
+		name  string
+		paths []string
+	}{
+		{"allowWrite", cfg.AllowWrite},
+		{"denyRead", cfg.DenyRead},
+		{"allowRead", cfg.AllowRead},
+		{"readOnly", cfg.ReadOnly},
+		{"writeExclude", cfg.WriteExclude},
+	}
+	expandFailed := false
+	for _, list := range lists {
+		for _, p := range list.paths {
+			if IsWildcard(p) {
+				continue
+			}
+			if _, err := expandPath(p); err != nil {
+				check.Problems = append(check.Problems, fmt.Sprintf("%s: %v", list.name, err))
+				expandFailed = true
+			}
+		}
+	}
+	if expandFailed {
+		return check
+	}
+
+	// Expands paths relative to the workdir and checks the other options
+	resolved, err := resolveConfig(cfg)
+	if err != nil {
+		check.Problems = append(check.Problems, err.Error())
+		return check
+	}
+
+	for _, list := range []struct {
+		name  string
+		paths []string
+	}{
+		{"allowWrite", resolved.AllowWrite},
+		{"allowRead", resolved.AllowRead},
+		{"readOnly", resolved.ReadOnly},
+	} {
+		for _, p := range list.paths {
+			if _, err := os.Stat(p); !IsWildcard(p) && err != nil {
+				check.Problems = append(check.Problems, fmt.Sprintf("%s: %q does not exist", list.name, p))
+			}
+		}
+	}
+	for _, p := range resolved.DenyRead {
+		if _, err := os.Stat(p); !IsWildcard(p) && err != nil {
+			check.Missing = append(check.Missing, p)
+		}
+	}
+
+	// DenyRead takes precedence, so these paths aren't writable at all
+	for _, p := range resolved.AllowWrite {
+		if !IsWildcard(p) && pathInDenyRead(p, resolved.DenyRead) {
+			check.Problems = append(check.Problems, fmt.Sprintf("allowWrite: %q is within denyRead and stays hidden", p))
+		}
+	}
+
+	if len(cfg.BackendOrder) > 0 {
+		check.Backends = explainBackends(resolved)
+	}
+	sb, err := New(cfg)
+	if err != nil {
+		check.Problems = append(check.Problems, fmt.Sprintf("backend: %v", err))
+		return check
+	}
+	check.Backend = backendName(sb)
+	return check
+}
+
+// backendName describes the backend of sb.
+func backendName(sb Sandbox) string {
+	info, ok := sb.(BwrapInfo)
+	if !ok && runtime.GOOS == "windows" {
+		return "job-object"
+	} else if !ok {
+		return "sandbox-exec"
+	}
+	path, version := info.Bwrap()
+	if version == "" {
+		return fmt.Sprintf("bwrap (%s)", path)
+	}
+	return fmt.Sprintf("bwrap %s (%s)", version, path)
+}
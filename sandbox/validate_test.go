@@ -0,0 +1,97 @@
+package sandbox
+
+import (
+	"errors"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestCheckConfig(t *testing.T) {
+	saved := backends
+	t.Cleanup(func() { backends = saved })
+	backends = map[string]func(Config) (Sandbox, error){
+		"ok":      func(Config) (Sandbox, error) { return &probeSandbox{}, nil },
+		"missing": func(Config) (Sandbox, error) { return nil, errors.New("not installed") },
+	}
+
+	dir := t.TempDir()
+	check := CheckConfig(Config{
+		Workdir:      dir,
+		AllowWrite:   []string{dir},
+		DenyRead:     []string{filepath.Join(dir, "absent")},
+		BackendOrder: []string{"ok"},
+	})
+	if len(check.Problems) > 0 {
+		t.Errorf("Problems = %v, want none", check.Problems)
+	}
+	if len(check.Missing) != 1 || check.Missing[0] != filepath.Join(dir, "absent") {
+		t.Errorf("Missing = %v, want the absent denyRead path", check.Missing)
+	}
+	if check.Backend == "" {
+		t.Error("Backend should be set when one is available")
+	}
+
+	check = CheckConfig(Config{
+		Workdir:      dir,
+		AllowWrite:   []string{filepath.Join(dir, "secret", "out"), filepath.Join(dir, "gone")},
+		DenyRead:     []string{filepath.Join(dir, "secret")},
+		BackendOrder: []string{"missing"},
+	})
+	for _, want := range []string{"gone\" does not exist", "is within denyRead", "backend: "} {
+		if !strings.Contains(strings.Join(check.Problems, "\n"), want) {
+			t.Errorf("Problems should report %q, got %v", want, check.Problems)
+		}
+	}
+	if check.Backend != "" {
+		t.Errorf("Backend = %q, want none", check.Backend)
+	}
+
+	check = CheckConfig(Config{Workdir: dir, AllowWrite: []string{"$AGENTSANDBOX_UNDEFINED/cache"}})
+	if len(check.Problems) != 1 || !strings.Contains(check.Problems[0], "allowWrite: ") {
+		t.Errorf("Problems = %v, want the unset variable in allowWrite", check.Problems)
+	}
+}
+
+func TestExplainBackends(t *testing.T) {
+	saved := backends
+	t.Cleanup(func() { backends = saved })
+	var tried []string
+	backends = map[string]func(Config) (Sandbox, error){
+		"primary": func(Config) (Sandbox, error) {
+			tried = append(tried, "primary")
+			return nil, errors.New("not installed")
+		},
+		"fallback": func(Config) (Sandbox, error) {
+			tried = append(tried, "fallback")
+			return &probeSandbox{}, nil
+		},
+		"later": func(Config) (Sandbox, error) {
+			tried = append(tried, "later")
+			return &probeSandbox{}, nil
+		},
+	}
+
+	choices, err := ExplainBackends(Config{Workdir: t.TempDir(), BackendOrder: []string{"docker", "primary", "fallback", "later"}})
+	if err != nil {
+		t.Fatalf("ExplainBackends() error: %v", err)
+	}
+	want := []BackendChoice{
+		{Name: "docker", Skipped: "unknown backend"},
+		{Name: "primary", Skipped: "not installed"},
+		{Name: "fallback", Selected: true},
+		{Name: "later"},
+	}
+	if !slices.Equal(choices, want) {
+		t.Errorf("choices = %+v, want %+v", choices, want)
+	}
+	if strings.Join(tried, ",") != "primary,fallback" {
+		t.Errorf("tried %v, want [primary fallback]", tried)
+	}
+
+	check := CheckConfig(Config{Workdir: t.TempDir(), BackendOrder: []string{"primary", "fallback"}})
+	if len(check.Backends) != 2 || !check.Backends[1].Selected {
+		t.Errorf("CheckConfig Backends = %+v, want fallback selected", check.Backends)
+	}
+}
@@ -0,0 +1,167 @@
+package sandbox
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// VerifyReport lists which protections a sandbox actually enforces on this
+// host, as observed by probes run inside it.
+type VerifyReport struct {
+	WriteDenied ProbeResult // A write outside AllowWrite doesn't reach the host
+	ReadDenied  ProbeResult // A DenyRead path's contents can't be read
+	EnvFiltered ProbeResult // A filtered env var isn't visible
+}
+
+// ProbeResult is the outcome of one Verify probe.
+type ProbeResult struct {
+	Checked  bool   // False if the probe couldn't run, e.g. nothing to test
+	Enforced bool   // The protection held
+	Detail   string // What was probed, or why it was skipped
+}
+
+// OK reports whether every probe that ran found its protection enforced.
+func (r VerifyReport) OK() bool {
+	for _, p := range []ProbeResult{r.WriteDenied, r.ReadDenied, r.EnvFiltered} {
+		if p.Checked && !p.Enforced {
+			return false
+		}
+	}
+	return true
+}
+
+// verify runs the Verify probes through sb, which must be configured by cfg.
+func verify(ctx context.Context, sb Sandbox, cfg Config) (VerifyReport, error) {
+	var report VerifyReport
+	var err error
+
+	if report.WriteDenied, err = probeWrite(ctx, sb, cfg); err != nil {
+		return report, fmt.Errorf("write probe: %w", err)
+	}
+	if report.ReadDenied, err = probeRead(ctx, sb, cfg); err != nil {
+		return report, fmt.Errorf("read probe: %w", err)
+	}
+	if report.EnvFiltered, err = probeEnv(ctx, sb, cfg); err != nil {
+		return report, fmt.Errorf("env probe: %w", err)
+	}
+	return report, nil
+}
+
+// probeWrite writes to a host dir outside AllowWrite from inside the sandbox
+// and checks on the host whether the file appeared.
+func probeWrite(ctx context.Context, sb Sandbox, cfg Config) (ProbeResult, error) {
+	if HasWildcard(cfg.AllowWrite) {
+		return ProbeResult{Detail: "AllowWrite is the wildcard"}, nil
+	}
+
+	dir := writeProbeDir(cfg)
+	if dir == "" {
+		return ProbeResult{Detail: "no host dir outside AllowWrite to probe"}, nil
+	}
+
+	probeDir, err := os.MkdirTemp(dir, ".agentsandbox-verify-")
+	if err != nil {
+		return ProbeResult{Detail: fmt.Sprintf("cannot create probe dir in %s: %v", dir, err)}, nil
+	}
+	defer os.RemoveAll(probeDir)
+
+	target := filepath.Join(probeDir, "probe")
+	if _, err := runProbe(ctx, sb, "touch -- "+shellQuote(target)); err != nil {
+		return ProbeResult{}, err
+	}
+
+	_, statErr := os.Stat(target)
+	return ProbeResult{Checked: true, Enforced: os.IsNotExist(statErr), Detail: target}, nil
+}
+
+// writeProbeDir returns a writable host dir outside AllowWrite and DenyRead.
+func writeProbeDir(cfg Config) string {
+	var candidates []string
+	if home, err := os.UserHomeDir(); err == nil {
+		candidates = append(candidates, home)
+	}
+	if cache, err := os.UserCacheDir(); err == nil {
+		candidates = append(candidates, cache)
+	}
+	candidates = append(candidates, os.TempDir())
+
+	for _, dir := range candidates {
+		dir, err := expandPath(dir)
+		if err != nil || pathWithin(dir, cfg.AllowWrite) || pathWithin(dir, cfg.DenyRead) {
+			continue
+		}
+		if probeWritable(dir) == nil {
+			return dir
+		}
+	}
+	return ""
+}
+
+// probeRead reads a non-empty DenyRead path from inside the sandbox.
+func probeRead(ctx context.Context, sb Sandbox, cfg Config) (ProbeResult, error) {
+	for _, path := range cfg.DenyRead {
+		if IsWildcard(path) {
+			continue
+		}
+
+		var cmd string
+		if entries, err := os.ReadDir(path); err == nil && len(entries) > 0 {
+			cmd = "ls -A -- " + shellQuote(path)
+		} else if info, err := os.Stat(path); err == nil && info.Mode().IsRegular() && info.Size() > 0 {
+			cmd = "head -c 1 -- " + shellQuote(path)
+		} else {
+			continue
+		}
+
+		output, err := runProbe(ctx, sb, cmd+" 2>/dev/null")
+		if err != nil {
+			return ProbeResult{}, err
+		}
+		return ProbeResult{Checked: true, Enforced: len(output) == 0, Detail: path}, nil
+	}
+	return ProbeResult{Detail: "no non-empty DenyRead path on the host"}, nil
+}
+
+// probeEnv checks that a host env var the config filters out isn't visible.
+func probeEnv(ctx context.Context, sb Sandbox, cfg Config) (ProbeResult, error) {
+	key := filteredEnvVar(cfg)
+	if key == "" {
+		return ProbeResult{Detail: "no filtered env var set on the host"}, nil
+	}
+
+	output, err := runProbe(ctx, sb, "printenv "+shellQuote(key))
+	if err != nil {
+		return ProbeResult{}, err
+	}
+	return ProbeResult{Checked: true, Enforced: len(output) == 0, Detail: key}, nil
+}
+
+// filteredEnvVar returns a host env var that buildEnv leaves out, or "".
+func filteredEnvVar(cfg Config) string {
+	kept := make(map[string]bool)
+	for _, e := range buildEnv(cfg) {
+		key, _, _ := strings.Cut(e, "=")
+		kept[key] = true
+	}
+
+	for _, e := range os.Environ() {
+		key, value, _ := strings.Cut(e, "=")
+		if !kept[key] && value != "" {
+			return key
+		}
+	}
+	return ""
+}
+
+// runProbe runs a probe command, treating only sandbox failures as errors:
+// a probe command failing is an expected outcome.
+func runProbe(ctx context.Context, sb Sandbox, cmd string) ([]byte, error) {
+	output, exitCode, err := sb.Run(ctx, cmd)
+	if err != nil && exitCode == 0 {
+		return nil, err
+	}
+	return output, nil
+}
@@ -0,0 +1,159 @@
+package sandbox
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// probeSandbox runs probes through a canned run func.
+type probeSandbox struct {
+	run func(command string) ([]byte, int, error)
+}
+
+func (p *probeSandbox) Run(ctx context.Context, command string) ([]byte, int, error) {
+	return p.run(command)
+}
+
+func (p *probeSandbox) RunWithStdin(ctx context.Context, command string, stdin io.Reader) ([]byte, int, error) {
+	return p.run(command)
+}
+
+func (p *probeSandbox) RunNoNetwork(ctx context.Context, command string) ([]byte, int, error) {
+	return p.run(command)
+}
+
+func (p *probeSandbox) RunWithEnv(ctx context.Context, command string, env map[string]string) ([]byte, int, error) {
+	return p.run(command)
+}
+
+func (p *probeSandbox) RunResult(ctx context.Context, command string) (*Result, error) {
+	output, exitCode, err := p.run(command)
+	return &Result{Stdout: output, Combined: output, ExitCode: exitCode}, err
+}
+
+func (p *probeSandbox) RunSeparate(ctx context.Context, command string) ([]byte, []byte, int, error) {
+	output, exitCode, err := p.run(command)
+	return output, nil, exitCode, err
+}
+
+func (p *probeSandbox) RunStream(ctx context.Context, command string, stdout, stderr io.Writer) (int, error) {
+	output, exitCode, err := p.run(command)
+	stdout.Write(output)
+	return exitCode, err
+}
+
+func (p *probeSandbox) RunArgs(ctx context.Context, argv []string) ([]byte, int, error) {
+	return p.run(strings.Join(argv, " "))
+}
+
+func (p *probeSandbox) RunArgsAs(ctx context.Context, name string, argv []string) ([]byte, int, error) {
+	return p.run(strings.Join(argv, " "))
+}
+
+func (p *probeSandbox) Verify(ctx context.Context) (VerifyReport, error) {
+	return VerifyReport{}, nil
+}
+
+// verifyConfig returns a config with something for every probe to test.
+func verifyConfig(t *testing.T) Config {
+	t.Helper()
+
+	t.Setenv("HOME", t.TempDir())
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	t.Setenv("VERIFY_TEST_SECRET", "hunter2")
+
+	denied := t.TempDir()
+	if err := os.WriteFile(filepath.Join(denied, "id_rsa"), []byte("key"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	workdir, _ := expandPath(t.TempDir())
+	return Config{
+		Workdir:     workdir,
+		AllowWrite:  []string{workdir},
+		DenyRead:    []string{denied},
+		EnvDenylist: []string{"VERIFY_TEST_SECRET"},
+	}
+}
+
+func TestVerify_Enforced(t *testing.T) {
+	cfg := verifyConfig(t)
+
+	// Every probe fails inside the sandbox
+	sb := &probeSandbox{run: func(command string) ([]byte, int, error) {
+		return nil, 1, errors.New("exit status 1")
+	}}
+
+	report, err := verify(context.Background(), sb, cfg)
+	if err != nil {
+		t.Fatalf("verify() error: %v", err)
+	}
+
+	for name, p := range map[string]ProbeResult{"write": report.WriteDenied, "read": report.ReadDenied, "env": report.EnvFiltered} {
+		if !p.Checked || !p.Enforced {
+			t.Errorf("%s probe = %+v, want checked and enforced", name, p)
+		}
+	}
+	if !report.OK() {
+		t.Error("report should be OK")
+	}
+}
+
+func TestVerify_NotEnforced(t *testing.T) {
+	cfg := verifyConfig(t)
+
+	// Probes run unsandboxed on the host, with the full host env
+	sb := &probeSandbox{run: func(command string) ([]byte, int, error) {
+		out, err := exec.Command("sh", "-c", command).Output()
+		return out, 0, err
+	}}
+
+	report, err := verify(context.Background(), sb, cfg)
+	if err != nil {
+		t.Fatalf("verify() error: %v", err)
+	}
+
+	for name, p := range map[string]ProbeResult{"write": report.WriteDenied, "read": report.ReadDenied, "env": report.EnvFiltered} {
+		if !p.Checked || p.Enforced {
+			t.Errorf("%s probe = %+v, want checked and not enforced", name, p)
+		}
+	}
+	if report.OK() {
+		t.Error("report should not be OK")
+	}
+}
+
+func TestVerify_Skipped(t *testing.T) {
+	sb := &probeSandbox{run: func(command string) ([]byte, int, error) {
+		t.Errorf("no probe should run, got %q", command)
+		return nil, 0, nil
+	}}
+
+	report, err := verify(context.Background(), sb, Config{AllowWrite: []string{"*"}})
+	if err != nil {
+		t.Fatalf("verify() error: %v", err)
+	}
+	if report.WriteDenied.Checked || report.ReadDenied.Checked {
+		t.Errorf("probes should be skipped, got %+v", report)
+	}
+	if report.WriteDenied.Detail == "" {
+		t.Error("skipped probes should say why")
+	}
+}
+
+func TestVerify_SandboxError(t *testing.T) {
+	cfg := verifyConfig(t)
+	sb := &probeSandbox{run: func(command string) ([]byte, int, error) {
+		return nil, 0, errors.New("bwrap: setting up uid map: Permission denied")
+	}}
+
+	if _, err := verify(context.Background(), sb, cfg); err == nil {
+		t.Error("expected error when the sandbox itself fails")
+	}
+}
@@ -0,0 +1,121 @@
+package sandbox
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrWriteDenied is returned when a command failed writing to a path outside
+// AllowWrite. Detection is best-effort, from the error messages in the output.
+type ErrWriteDenied struct {
+	Path string // Path the command tried to write, as reported in its output
+}
+
+func (e *ErrWriteDenied) Error() string {
+	return fmt.Sprintf("write denied: %s", e.Path)
+}
+
+var (
+	// quotedPathRe matches a quoted path, e.g. 'foo' or "/etc/foo" or `foo'.
+	quotedPathRe = regexp.MustCompile("['\"`‘]([^'\"`’\\s]+)['\"’]")
+	// reportedPathRe matches the "PATH: <error>" form used by shells and Go.
+	reportedPathRe = regexp.MustCompile(`(?i)([^\s:'"]+): (?:read-only file system|operation not permitted)`)
+	// absPathRe matches any absolute path, e.g. after the error in zsh.
+	absPathRe = regexp.MustCompile(`(?:^|\s)(/[^\s:'",]+)`)
+)
+
+// writeDeniedPath returns the path from the first write-denied message in
+// output: "Read-only file system" (Linux) or "Operation not permitted" (macOS).
+func writeDeniedPath(output []byte) (string, bool) {
+	for line := range strings.Lines(string(output)) {
+		lower := strings.ToLower(line)
+		readOnly := strings.Contains(lower, "read-only file system")
+		if !readOnly && !strings.Contains(lower, "operation not permitted") {
+			continue
+		}
+
+		var candidates []string
+		if m := quotedPathRe.FindStringSubmatch(line); m != nil {
+			candidates = append(candidates, m[1])
+		}
+		if m := reportedPathRe.FindStringSubmatch(line); m != nil {
+			candidates = append(candidates, m[1])
+		}
+		if m := absPathRe.FindStringSubmatch(line); m != nil {
+			candidates = append(candidates, m[1])
+		}
+
+		for _, path := range candidates {
+			// "Operation not permitted" is also printed for non-file errors,
+			// so only trust it for things that look like paths
+			if readOnly || strings.Contains(path, "/") {
+				return path, true
+			}
+		}
+	}
+	return "", false
+}
+
+// writeDenied returns an ErrWriteDenied for output, resolving relative paths
+// against workdir, or nil if no write was denied.
+func writeDenied(output []byte, workdir string) *ErrWriteDenied {
+	path, ok := writeDeniedPath(output)
+	if !ok {
+		return nil
+	}
+	if !filepath.IsAbs(path) && workdir != "" {
+		path = filepath.Join(workdir, path)
+	}
+	return &ErrWriteDenied{Path: path}
+}
+
+// Violation is an operation the macOS sandbox denied, from the system log.
+type Violation struct {
+	Time      time.Time
+	Process   string // Name of the process, e.g. "cat"
+	PID       int
+	Operation string // e.g. "file-read-data" or "network-outbound"
+	Target    string // Path or address operated on, "" if not logged
+}
+
+// sandboxDenyRe matches the kernel's denial message, e.g.
+// "Sandbox: cat(1234) deny(1) file-read-data /Users/me/.ssh/id_rsa".
+var sandboxDenyRe = regexp.MustCompile(`Sandbox: (.+)\((\d+)\) deny\(\d+\) (\S+)(?: (.+))?`)
+
+// logTimeLayout is the timestamp format of log show's ndjson output.
+const logTimeLayout = "2006-01-02 15:04:05.000000-0700"
+
+// parseSandboxLog returns the violations in the output of log show
+// --style ndjson. Lines that aren't denials are skipped.
+func parseSandboxLog(out []byte) []Violation {
+	var violations []Violation
+	for line := range bytes.Lines(out) {
+		var entry struct {
+			Timestamp    string `json:"timestamp"`
+			EventMessage string `json:"eventMessage"`
+		}
+		if err := json.Unmarshal(line, &entry); err != nil {
+			continue
+		}
+		m := sandboxDenyRe.FindStringSubmatch(entry.EventMessage)
+		if m == nil {
+			continue
+		}
+		pid, _ := strconv.Atoi(m[2])
+		t, _ := time.Parse(logTimeLayout, entry.Timestamp)
+		violations = append(violations, Violation{
+			Time:      t,
+			Process:   m[1],
+			PID:       pid,
+			Operation: m[3],
+			Target:    strings.TrimSpace(m[4]),
+		})
+	}
+	return violations
+}
@@ -0,0 +1,81 @@
+package sandbox
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWriteDeniedPath(t *testing.T) {
+	tests := []struct {
+		name   string
+		output string
+		want   string
+	}{
+		{"touch", "touch: cannot touch '/etc/foo': Read-only file system\n", "/etc/foo"},
+		{"touch utf8 quotes", "touch: cannot touch ‘/etc/foo’: Read-only file system\n", "/etc/foo"},
+		{"mkdir", "mkdir: cannot create directory '/usr/local/x': Read-only file system\n", "/usr/local/x"},
+		{"bash redirect", "bash: line 1: /etc/foo: Read-only file system\n", "/etc/foo"},
+		{"sh redirect", "sh: 1: cannot create /etc/foo: Read-only file system\n", "/etc/foo"},
+		{"relative", "sh: 1: cannot create out.txt: Read-only file system\n", "out.txt"},
+		{"go", "open /etc/foo: read-only file system\n", "/etc/foo"},
+		{"python", "OSError: [Errno 30] Read-only file system: '/etc/foo'\n", "/etc/foo"},
+		{"node", "Error: EROFS: read-only file system, open '/etc/foo'\n", "/etc/foo"},
+		{"macos touch", "touch: /Users/user/foo: Operation not permitted\n", "/Users/user/foo"},
+		{"macos redirect", "zsh:1: operation not permitted: /Users/user/foo\n", "/Users/user/foo"},
+		{"after other output", "building...\ncp: cannot create regular file '/opt/app': Operation not permitted\n", "/opt/app"},
+		{"not a path", "ptrace: Operation not permitted\n", ""},
+		{"unrelated", "ls: cannot access 'x': No such file or directory\n", ""},
+		{"empty", "", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := writeDeniedPath([]byte(tt.output))
+			if got != tt.want || ok != (tt.want != "") {
+				t.Errorf("writeDeniedPath(%q) = %q, %v, want %q", tt.output, got, ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestWriteDenied_RelativePath(t *testing.T) {
+	denied := writeDenied([]byte("touch: cannot touch 'out.txt': Read-only file system\n"), "/project")
+	if denied == nil || denied.Path != "/project/out.txt" {
+		t.Errorf("writeDenied() = %v, want path /project/out.txt", denied)
+	}
+
+	if denied := writeDenied([]byte("ok\n"), "/project"); denied != nil {
+		t.Errorf("writeDenied() = %v, want nil", denied)
+	}
+}
+
+func TestParseSandboxLog(t *testing.T) {
+	out := []byte(`Filtering the log data using "eventMessage CONTAINS \"Sandbox: \""
+{"timestamp":"2026-03-01 10:15:02.123456-0800","eventMessage":"Sandbox: cat(4242) deny(1) file-read-data /Users/me/.ssh/id_rsa","processID":0}
+{"timestamp":"2026-03-01 10:15:02.200000-0800","eventMessage":"Sandbox: Google Chrome He(77) deny(1) mach-lookup com.apple.foo","processID":0}
+{"timestamp":"2026-03-01 10:15:03.000000-0800","eventMessage":"Sandbox: sh(4243) deny(1) network-outbound","processID":0}
+{"timestamp":"2026-03-01 10:15:03.000000-0800","eventMessage":"unrelated message","processID":0}
+`)
+	violations := parseSandboxLog(out)
+	if len(violations) != 3 {
+		t.Fatalf("got %d violations, want 3: %+v", len(violations), violations)
+	}
+
+	want := Violation{
+		Time:      time.Date(2026, 3, 1, 18, 15, 2, 123456000, time.UTC),
+		Process:   "cat",
+		PID:       4242,
+		Operation: "file-read-data",
+		Target:    "/Users/me/.ssh/id_rsa",
+	}
+	got := violations[0]
+	if !got.Time.Equal(want.Time) || got.Process != want.Process || got.PID != want.PID || got.Operation != want.Operation || got.Target != want.Target {
+		t.Errorf("violations[0] = %+v, want %+v", got, want)
+	}
+	if violations[1].Process != "Google Chrome He" || violations[1].PID != 77 {
+		t.Errorf("process names may contain spaces, got %+v", violations[1])
+	}
+	if violations[2].Operation != "network-outbound" || violations[2].Target != "" {
+		t.Errorf("a denial without a target, got %+v", violations[2])
+	}
+}
@@ -0,0 +1,425 @@
+//go:build windows
+
+package sandbox
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+var (
+	kernel32                     = syscall.NewLazyDLL("kernel32.dll")
+	advapi32                     = syscall.NewLazyDLL("advapi32.dll")
+	procCreateJobObjectW         = kernel32.NewProc("CreateJobObjectW")
+	procSetInformationJobObject  = kernel32.NewProc("SetInformationJobObject")
+	procAssignProcessToJobObject = kernel32.NewProc("AssignProcessToJobObject")
+	procTerminateJobObject       = kernel32.NewProc("TerminateJobObject")
+	procCreateRestrictedToken    = advapi32.NewProc("CreateRestrictedToken")
+)
+
+const (
+	jobObjectBasicUIRestrictions    = 4
+	jobObjectExtendedLimitInfo      = 9
+	jobLimitDieOnUnhandledException = 0x400
+	jobLimitKillOnJobClose          = 0x2000
+	jobUILimitAll                   = 0xff // Clipboard, desktop, display settings, global atoms, handles, logoff, system parameters
+	disableMaxPrivilege             = 0x1
+	luaToken                        = 0x4
+	processSetQuota                 = 0x100
+	processTerminate                = 0x1
+	createNewProcessGroup           = 0x200
+	restrictedTokenAccess           = syscall.TOKEN_DUPLICATE | syscall.TOKEN_ASSIGN_PRIMARY | syscall.TOKEN_QUERY | syscall.TOKEN_ADJUST_DEFAULT | syscall.TOKEN_ADJUST_SESSIONID
+)
+
+// windowsKilledExitCode is the exit code of a command whose job was
+// terminated on cancellation.
+const windowsKilledExitCode = 1
+
+// jobBasicLimits is JOBOBJECT_BASIC_LIMIT_INFORMATION.
+type jobBasicLimits struct {
+	PerProcessUserTimeLimit int64
+	PerJobUserTimeLimit     int64
+	LimitFlags              uint32
+	MinimumWorkingSetSize   uintptr
+	MaximumWorkingSetSize   uintptr
+	ActiveProcessLimit      uint32
+	Affinity                uintptr
+	PriorityClass           uint32
+	SchedulingClass         uint32
+}
+
+// jobExtendedLimits is JOBOBJECT_EXTENDED_LIMIT_INFORMATION.
+type jobExtendedLimits struct {
+	Basic                 jobBasicLimits
+	IoInfo                [6]uint64 // IO_COUNTERS
+	ProcessMemoryLimit    uintptr
+	JobMemoryLimit        uintptr
+	PeakProcessMemoryUsed uintptr
+	PeakJobMemoryUsed     uintptr
+}
+
+// windowsSandbox runs commands in a job object with a restricted token. It
+// doesn't enforce filesystem or network rules; see newWindows.
+type windowsSandbox struct {
+	cfg   Config
+	shell string // cmd.exe, from %ComSpec%
+}
+
+func newWindows(cfg Config) (Sandbox, error) {
+	// PIDNamespace is on by default and has no equivalent here: it's ignored.
+	// ShellPrelude is POSIX shell, but commands run with cmd.exe
+	for _, opt := range []struct {
+		name string
+		set  bool
+	}{
+		{"NoNetwork", cfg.NoNetwork},
+		{"NetworkAllow", len(cfg.NetworkAllow) > 0},
+		{"AllowedPorts", len(cfg.AllowedPorts) > 0},
+		{"FrozenTime", cfg.FrozenTime != nil},
+		{"TrackReads", cfg.TrackReads},
+		{"SampleUsage", cfg.SampleUsage > 0},
+		{"TmpfsWorkdir", cfg.TmpfsWorkdir},
+		{"TmpfsSize", cfg.TmpfsSize != ""},
+		{"EnableGPU", cfg.EnableGPU},
+		{"DropRoot", cfg.DropRoot},
+		{"UnshareIPC", cfg.UnshareIPC},
+		{"UnshareUTS", cfg.UnshareUTS},
+		{"Hostname", cfg.Hostname != ""},
+		{"SeccompProfile", cfg.SeccompProfile != ""},
+		{"MemoryLimitBytes", cfg.MemoryLimitBytes > 0},
+		{"CPUTimeLimit", cfg.CPUTimeLimit > 0},
+		{"OpenFilesLimit", cfg.OpenFilesLimit > 0},
+		{"FileSizeLimitBytes", cfg.FileSizeLimitBytes > 0},
+		{"ProcessLimit", cfg.ProcessLimit > 0},
+		{"Capabilities", len(cfg.Capabilities) > 0},
+		{"CPUAffinity", len(cfg.CPUAffinity) > 0},
+		{"CaptureViolations", cfg.CaptureViolations},
+		{"ShellPrelude", cfg.ShellPrelude != ""},
+	} {
+		if opt.set {
+			return nil, fmt.Errorf("%s is not supported on Windows", opt.name)
+		}
+	}
+
+	if !HasWildcard(cfg.AllowWrite) || len(cfg.DenyRead) > 0 || len(cfg.AllowRead) > 0 || len(cfg.ReadOnly) > 0 {
+		degradef(&cfg, "filesystem rules aren't enforced on Windows: the command can read and write what the user can, with admin rights and privileges dropped")
+	}
+
+	shell := os.Getenv("ComSpec")
+	if shell == "" {
+		shell = `C:\Windows\System32\cmd.exe`
+	}
+	s := &windowsSandbox{cfg: cfg, shell: shell}
+
+	// Fail early if the host doesn't allow either primitive
+	token, err := restrictedToken()
+	if err != nil {
+		return nil, fmt.Errorf("creating restricted token: %w", err)
+	}
+	token.Close()
+	job, err := newJob()
+	if err != nil {
+		return nil, fmt.Errorf("creating job object: %w", err)
+	}
+	syscall.CloseHandle(job)
+
+	return s, nil
+}
+
+func (s *windowsSandbox) Run(ctx context.Context, cmd string) ([]byte, int, error) {
+	return s.RunWithStdin(ctx, cmd, nil)
+}
+
+func (s *windowsSandbox) RunWithStdin(ctx context.Context, cmd string, stdin io.Reader) ([]byte, int, error) {
+	if err := checkCommand(cmd); err != nil {
+		return nil, 0, err
+	}
+	if err := checkBinary(s.cfg, s.shell); err != nil {
+		return nil, 0, err
+	}
+
+	if s.cfg.DryRun {
+		return []byte(s.dryRunOutput(s.shellArgv(cmd), s.shellLine(cmd))), 0, nil
+	}
+
+	res, err := s.run(ctx, cmd, s.shellCmd(cmd), stdin, nil)
+	return res.Combined, res.ExitCode, err
+}
+
+// RunNoNetwork fails: there's no way to cut off a job's network access.
+func (s *windowsSandbox) RunNoNetwork(ctx context.Context, cmd string) ([]byte, int, error) {
+	return nil, 0, fmt.Errorf("NoNetwork is not supported on Windows")
+}
+
+func (s *windowsSandbox) RunWithEnv(ctx context.Context, cmd string, env map[string]string) ([]byte, int, error) {
+	if err := checkEnv(env); err != nil {
+		return nil, 0, err
+	}
+	withEnv := *s
+	withEnv.cfg.runEnv = env
+	return withEnv.Run(ctx, cmd)
+}
+
+func (s *windowsSandbox) RunResult(ctx context.Context, cmd string) (*Result, error) {
+	if err := checkCommand(cmd); err != nil {
+		return nil, err
+	}
+	if err := checkBinary(s.cfg, s.shell); err != nil {
+		return nil, err
+	}
+
+	if s.cfg.DryRun {
+		res := dryRunResult(s.cfg, s.dryRunOutput(s.shellArgv(cmd), s.shellLine(cmd)))
+		return &res, nil
+	}
+
+	res, err := s.run(ctx, cmd, s.shellCmd(cmd), nil, nil)
+	return &res, err
+}
+
+func (s *windowsSandbox) RunSeparate(ctx context.Context, cmd string) ([]byte, []byte, int, error) {
+	res, err := s.RunResult(ctx, cmd)
+	if res == nil {
+		return nil, nil, 0, err
+	}
+	return res.Stdout, res.Stderr, res.ExitCode, err
+}
+
+func (s *windowsSandbox) RunStream(ctx context.Context, cmd string, stdout, stderr io.Writer) (int, error) {
+	if err := checkCommand(cmd); err != nil {
+		return 0, err
+	}
+	if err := checkBinary(s.cfg, s.shell); err != nil {
+		return 0, err
+	}
+
+	if s.cfg.DryRun {
+		_, err := io.WriteString(orDiscard(stdout), s.dryRunOutput(s.shellArgv(cmd), s.shellLine(cmd)))
+		return 0, err
+	}
+
+	res, err := s.run(ctx, cmd, s.shellCmd(cmd), nil, &outputSink{stdout: stdout, stderr: stderr})
+	return res.ExitCode, err
+}
+
+func (s *windowsSandbox) RunArgs(ctx context.Context, argv []string) ([]byte, int, error) {
+	return s.RunArgsAs(ctx, "", argv)
+}
+
+// RunArgsAs runs argv directly. Windows passes argv as one command line,
+// so name simply replaces its first word.
+func (s *windowsSandbox) RunArgsAs(ctx context.Context, name string, argv []string) ([]byte, int, error) {
+	if err := checkArgv(s.cfg, argv); err != nil {
+		return nil, 0, err
+	}
+
+	newCmd := func() *exec.Cmd {
+		c := exec.Command(argv[0], argv[1:]...)
+		if name != "" {
+			c.Args[0] = name
+		}
+		c.SysProcAttr = &syscall.SysProcAttr{}
+		return c
+	}
+
+	if s.cfg.DryRun {
+		c := newCmd()
+		return []byte(s.dryRunOutput(argv, joinCmdLine(c.Args))), 0, nil
+	}
+
+	res, err := s.run(ctx, strings.Join(argv, " "), newCmd, nil, nil)
+	return res.Combined, res.ExitCode, err
+}
+
+// Verify reports the filesystem probes as not enforced, since they
+// aren't, and skips the env probe, which needs a POSIX shell.
+func (s *windowsSandbox) Verify(ctx context.Context) (VerifyReport, error) {
+	notEnforced := ProbeResult{Checked: true, Detail: "filesystem rules aren't enforced on Windows"}
+	return VerifyReport{
+		WriteDenied: notEnforced,
+		ReadDenied:  notEnforced,
+		EnvFiltered: ProbeResult{Detail: "the env probe needs a POSIX shell"},
+	}, nil
+}
+
+// shellArgv returns the argv running cmd with cmd.exe, for dry runs.
+func (s *windowsSandbox) shellArgv(cmd string) []string {
+	return []string{s.shell, "/d", "/s", "/c", cmd}
+}
+
+// shellLine returns the command line running cmd with cmd.exe. With /s,
+// cmd.exe strips the outer quotes and runs the rest verbatim, so cmd isn't
+// escaped the way Go escapes arguments for C programs.
+func (s *windowsSandbox) shellLine(cmd string) string {
+	return syscall.EscapeArg(s.shell) + ` /d /s /c "` + cmd + `"`
+}
+
+// shellCmd returns a constructor for the process running cmd with cmd.exe.
+func (s *windowsSandbox) shellCmd(cmd string) func() *exec.Cmd {
+	return func() *exec.Cmd {
+		c := exec.Command(s.shell)
+		c.SysProcAttr = &syscall.SysProcAttr{CmdLine: s.shellLine(cmd)}
+		return c
+	}
+}
+
+// run executes the process newCmd returns; command describes it for
+// tracing. Output goes to sink if set, otherwise into the Result.
+func (s *windowsSandbox) run(ctx context.Context, command string, newCmd func() *exec.Cmd, stdin io.Reader, sink *outputSink) (Result, error) {
+	return transcribe(s.cfg, command, stdin, func(stdin io.Reader) (Result, error) {
+		return execute(ctx, s.cfg, command, func(ctx context.Context) (Result, error) {
+			return s.invoke(ctx, newCmd(), stdin, sink)
+		})
+	})
+}
+
+// invoke runs c with a restricted token in a new job object and returns its
+// raw output. The process is assigned to the job right after it starts, so
+// a child it starts in that moment could escape the job.
+func (s *windowsSandbox) invoke(ctx context.Context, c *exec.Cmd, stdin io.Reader, sink *outputSink) (Result, error) {
+	token, err := restrictedToken()
+	if err != nil {
+		return Result{}, fmt.Errorf("creating restricted token: %w", err)
+	}
+	defer token.Close()
+	job, err := newJob()
+	if err != nil {
+		return Result{}, fmt.Errorf("creating job object: %w", err)
+	}
+	// Closing the last handle kills whatever is left in the job
+	defer syscall.CloseHandle(job)
+
+	c.Dir = s.cfg.Workdir
+	c.Env = buildEnv(s.cfg)
+	c.SysProcAttr.Token = token
+	c.SysProcAttr.HideWindow = true
+	c.SysProcAttr.CreationFlags |= createNewProcessGroup
+
+	capture := captureFor(s.cfg, sink)
+	c.Stdout = &capture.stdout
+	c.Stderr = &capture.stderr
+
+	release, err := feedStdin(c, stdin, s.cfg.StdinFile)
+	if err != nil {
+		return Result{}, err
+	}
+	defer release()
+
+	start := time.Now()
+	if err := c.Start(); err != nil {
+		return Result{}, err
+	}
+	if err := assignToJob(job, c.Process.Pid); err != nil {
+		c.Process.Kill()
+		c.Wait()
+		return Result{}, fmt.Errorf("assigning process to job object: %w", err)
+	}
+
+	// Windows has no SIGTERM to give the command a grace period with, so
+	// cancellation terminates the whole job at once
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			procTerminateJobObject.Call(uintptr(job), uintptr(windowsKilledExitCode))
+		case <-done:
+		}
+	}()
+	err = c.Wait()
+	close(done)
+	commandDuration := time.Since(start)
+
+	exitCode := 0
+	if c.ProcessState != nil {
+		exitCode = remapExitCode(c.ProcessState.ExitCode(), s.cfg.ExitCodeMap)
+	}
+
+	res := capture.result(exitCode)
+	res.CommandDuration = commandDuration
+	if ctx.Err() != nil {
+		return res, ctx.Err()
+	}
+	return res, err
+}
+
+// restrictedToken returns a primary token like the process's own, with
+// every privilege but SeChangeNotify removed and, for an administrator,
+// the admin group disabled as under UAC.
+func restrictedToken() (syscall.Token, error) {
+	process, err := syscall.GetCurrentProcess()
+	if err != nil {
+		return 0, err
+	}
+	var token syscall.Token
+	if err := syscall.OpenProcessToken(process, restrictedTokenAccess, &token); err != nil {
+		return 0, err
+	}
+	defer token.Close()
+
+	var restricted syscall.Token
+	r, _, err := procCreateRestrictedToken.Call(uintptr(token), disableMaxPrivilege|luaToken, 0, 0, 0, 0, 0, 0, uintptr(unsafe.Pointer(&restricted)))
+	if r == 0 {
+		return 0, err
+	}
+	return restricted, nil
+}
+
+// newJob creates a job object whose processes are killed when it's closed
+// and can't touch the clipboard, desktop, global atoms, other processes'
+// UI handles or system settings.
+func newJob() (syscall.Handle, error) {
+	r, _, err := procCreateJobObjectW.Call(0, 0)
+	if r == 0 {
+		return 0, err
+	}
+	job := syscall.Handle(r)
+
+	limits := jobExtendedLimits{Basic: jobBasicLimits{LimitFlags: jobLimitKillOnJobClose | jobLimitDieOnUnhandledException}}
+	if r, _, err := procSetInformationJobObject.Call(uintptr(job), jobObjectExtendedLimitInfo, uintptr(unsafe.Pointer(&limits)), unsafe.Sizeof(limits)); r == 0 {
+		syscall.CloseHandle(job)
+		return 0, err
+	}
+	ui := uint32(jobUILimitAll)
+	if r, _, err := procSetInformationJobObject.Call(uintptr(job), jobObjectBasicUIRestrictions, uintptr(unsafe.Pointer(&ui)), unsafe.Sizeof(ui)); r == 0 {
+		syscall.CloseHandle(job)
+		return 0, err
+	}
+	return job, nil
+}
+
+// assignToJob puts the process pid into job.
+func assignToJob(job syscall.Handle, pid int) error {
+	process, err := syscall.OpenProcess(processSetQuota|processTerminate, false, uint32(pid))
+	if err != nil {
+		return err
+	}
+	defer syscall.CloseHandle(process)
+	if r, _, err := procAssignProcessToJobObject.Call(uintptr(job), uintptr(process)); r == 0 {
+		return err
+	}
+	return nil
+}
+
+// joinCmdLine returns the command line Go passes to CreateProcess for args.
+func joinCmdLine(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = syscall.EscapeArg(arg)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// dryRunOutput is the command line, or with DryRunJSON the plan for argv.
+func (s *windowsSandbox) dryRunOutput(argv []string, cmdLine string) string {
+	if s.cfg.DryRunFormat == DryRunJSON {
+		return formatDryRun(s.cfg, "job-object", argv)
+	}
+	return cmdLine
+}
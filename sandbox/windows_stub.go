@@ -0,0 +1,9 @@
+//go:build !windows
+
+package sandbox
+
+import "fmt"
+
+func newWindows(cfg Config) (Sandbox, error) {
+	return nil, fmt.Errorf("windows sandbox not available on this platform")
+}
@@ -0,0 +1,105 @@
+//go:build windows
+
+package sandbox
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewWindows_Unsupported(t *testing.T) {
+	for name, cfg := range map[string]Config{
+		"NoNetwork":    {NoNetwork: true},
+		"TrackReads":   {TrackReads: true},
+		"ShellPrelude": {ShellPrelude: "set -eu"},
+	} {
+		cfg.Workdir = t.TempDir()
+		_, err := newWindows(cfg)
+		if err == nil || !strings.Contains(err.Error(), name+" is not supported on Windows") {
+			t.Errorf("%s: expected unsupported error, got %v", name, err)
+		}
+	}
+}
+
+func TestNewWindows_Degraded(t *testing.T) {
+	dir := t.TempDir()
+	sb, err := New(Config{Workdir: dir, AllowWrite: []string{dir}})
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+	res, err := sb.RunResult(context.Background(), "echo hello")
+	if err != nil {
+		t.Fatalf("RunResult() error: %v", err)
+	}
+	if !res.Degraded {
+		t.Error("a sandbox that can't enforce AllowWrite should be degraded")
+	}
+	if strings.TrimSpace(string(res.Stdout)) != "hello" {
+		t.Errorf("stdout = %q, want hello", res.Stdout)
+	}
+}
+
+func TestRun_Windows(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("AGENTSANDBOX_SECRET", "s3cret")
+	sb, err := New(Config{Workdir: dir, AllowWrite: []string{"*"}, EnvDenylist: []string{"AGENTSANDBOX_SECRET"}})
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+
+	out, code, err := sb.Run(context.Background(), "echo [%AGENTSANDBOX_SECRET%] & exit /b 3")
+	if code != 3 {
+		t.Errorf("exit code = %d (%v), want 3", code, err)
+	}
+	if strings.Contains(string(out), "s3cret") {
+		t.Errorf("EnvDenylist should hide the var, got %q", out)
+	}
+
+	out, code, err = sb.RunArgs(context.Background(), []string{"cmd.exe", "/c", "cd"})
+	if code != 0 || err != nil || !strings.EqualFold(strings.TrimSpace(string(out)), dir) {
+		t.Errorf("RunArgs() = %q, %d, %v, want the workdir", out, code, err)
+	}
+}
+
+func TestRun_WindowsTimeout(t *testing.T) {
+	dir := t.TempDir()
+	sb, err := New(Config{Workdir: dir, AllowWrite: []string{"*"}, Timeout: 500 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+
+	start := time.Now()
+	res, err := sb.RunResult(context.Background(), "echo started & ping -n 30 127.0.0.1 > nul")
+	if !errors.Is(err, context.DeadlineExceeded) || !res.TimedOut {
+		t.Fatalf("RunResult() error = %v, TimedOut %v, want a timeout", err, res.TimedOut)
+	}
+	if time.Since(start) > 10*time.Second {
+		t.Error("terminating the job should stop the command's children too")
+	}
+	if !strings.Contains(string(res.Stdout), "started") {
+		t.Errorf("stdout = %q, want the partial output", res.Stdout)
+	}
+}
+
+func TestDryRunOutput_Windows(t *testing.T) {
+	s := &windowsSandbox{cfg: Config{Workdir: `C:\work`}, shell: `C:\Windows\System32\cmd.exe`}
+	if got, want := s.shellLine(`echo "a b" & dir`), `C:\Windows\System32\cmd.exe /d /s /c "echo "a b" & dir"`; got != want {
+		t.Errorf("shellLine() = %q, want %q", got, want)
+	}
+	if got := joinCmdLine([]string{"go", "test", "a b"}); got != `go test "a b"` {
+		t.Errorf("joinCmdLine() = %q", got)
+	}
+
+	s.cfg.DryRunFormat = DryRunJSON
+	var plan DryRunPlan
+	if err := json.Unmarshal([]byte(s.dryRunOutput(s.shellArgv("dir"), s.shellLine("dir"))), &plan); err != nil {
+		t.Fatalf("dry run output is not JSON: %v", err)
+	}
+	if plan.Backend != "job-object" || plan.Binary != s.shell || plan.Argv[len(plan.Argv)-1] != "dir" {
+		t.Errorf("plan = %+v", plan)
+	}
+}